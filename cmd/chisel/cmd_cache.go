@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/canonical/chisel/internal/archive"
+	"github.com/canonical/chisel/internal/cache"
+	"github.com/canonical/chisel/internal/netconf"
+	"github.com/canonical/chisel/internal/setup"
+	"github.com/canonical/chisel/internal/slicer"
+	"github.com/canonical/chisel/internal/snapshot"
+)
+
+type cmdCache struct{}
+
+var shortCacheHelp = "Manage the cache of downloaded files"
+var longCacheHelp = `
+The cache command contains sub-commands for managing the cache of
+releases, archive indexes, and packages downloaded.
+`
+
+var shortCacheExportHelp = "Export the cached files needed by slices"
+var longCacheExportHelp = `
+The export command writes into a tar bundle the cached files needed for
+cutting the provided selection of package slices, fetching the ones not
+cached yet. The bundle may be imported into the cache of another system,
+so that the same slices may be cut there with --offline.
+`
+
+var cacheExportDescs = map[string]string{
+	"release":  "Chisel release directory",
+	"arch":     "Package architecture",
+	"snapshot": "Use the archives as they were at the UTC time, such as 20240101T000000Z",
+	"jobs":     "Number of files downloaded concurrently",
+	"retries":  "Number of times failed downloads are retried",
+	"timeout":  "Time limit for each download, such as 30s or 5m",
+}
+
+type cmdCacheExport struct {
+	Release  string        `long:"release" value-name:"<dir>"`
+	Arch     string        `long:"arch" value-name:"<arch>"`
+	Snapshot string        `long:"snapshot" value-name:"<timestamp>"`
+	Jobs     int           `long:"jobs" value-name:"<n>" default:"4"`
+	Retries  int           `long:"retries" value-name:"<n>" default:"3"`
+	Timeout  time.Duration `long:"timeout" value-name:"<duration>"`
+
+	Positional struct {
+		Bundle    string   `positional-arg-name:"<bundle>" required:"yes"`
+		SliceRefs []string `positional-arg-name:"<slice names>" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+var shortCacheImportHelp = "Import cached files from a bundle"
+var longCacheImportHelp = `
+The import command reads the files in a tar bundle written by the export
+command into the cache, verifying their content.
+`
+
+type cmdCacheImport struct {
+	Positional struct {
+		Bundle string `positional-arg-name:"<bundle>" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+var shortCacheInfoHelp = "Show details about the cache"
+var longCacheInfoHelp = `
+The info command shows the location of the cache, and the number and
+total size of the files kept in it.
+`
+
+type cmdCacheInfo struct{}
+
+var shortCacheVerifyHelp = "Verify the content of the cache"
+var longCacheVerifyHelp = `
+The verify command checks the content of every file in the cache against
+its digest, and removes the files which are corrupted.
+`
+
+type cmdCacheVerify struct{}
+
+var shortCachePruneHelp = "Remove files from the cache"
+var longCachePruneHelp = `
+The prune command removes the files in the cache which were not used
+within --max-age, and then the least recently used files until the total
+size of the cache is within --max-size.
+`
+
+var cachePruneDescs = map[string]string{
+	"max-age":  "Remove files not used within the duration, such as 720h",
+	"max-size": "Limit the total size of the cache, such as 500M or 10G",
+}
+
+type cmdCachePrune struct {
+	MaxAge  time.Duration `long:"max-age" value-name:"<duration>"`
+	MaxSize string        `long:"max-size" value-name:"<size>"`
+}
+
+func init() {
+	addCacheCommand("export", shortCacheExportHelp, longCacheExportHelp, func() flags.Commander { return &cmdCacheExport{} }, cacheExportDescs, nil)
+	addCacheCommand("import", shortCacheImportHelp, longCacheImportHelp, func() flags.Commander { return &cmdCacheImport{} }, nil, nil)
+	addCacheCommand("info", shortCacheInfoHelp, longCacheInfoHelp, func() flags.Commander { return &cmdCacheInfo{} }, nil, nil)
+	addCacheCommand("verify", shortCacheVerifyHelp, longCacheVerifyHelp, func() flags.Commander { return &cmdCacheVerify{} }, nil, nil)
+	addCacheCommand("prune", shortCachePruneHelp, longCachePruneHelp, func() flags.Commander { return &cmdCachePrune{} }, cachePruneDescs, nil)
+}
+
+func (cmd *cmdCacheExport) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+
+	if cmd.Jobs < 1 {
+		return fmt.Errorf("invalid --jobs value: %d", cmd.Jobs)
+	}
+	if cmd.Retries < 0 {
+		return fmt.Errorf("invalid --retries value: %d", cmd.Retries)
+	}
+	if cmd.Timeout < 0 {
+		return fmt.Errorf("invalid --timeout value: %v", cmd.Timeout)
+	}
+	if cmd.Snapshot != "" {
+		if _, err := snapshot.Parse(cmd.Snapshot); err != nil {
+			return fmt.Errorf("invalid --snapshot value: %q", cmd.Snapshot)
+		}
+	}
+
+	var sliceKeys []setup.SliceKey
+	for _, sliceRef := range cmd.Positional.SliceRefs {
+		sliceKey, err := setup.ParseSliceKey(sliceRef)
+		if err != nil {
+			return err
+		}
+		sliceKeys = append(sliceKeys, sliceKey)
+	}
+
+	netConfig, err := netconf.Load(netconf.DefaultPath())
+	if err != nil {
+		return err
+	}
+	client, err := netConfig.Client()
+	if err != nil {
+		return err
+	}
+
+	// The files used from the cache are tracked while cutting is
+	// prepared, and these are the ones exported.
+	cacheDir := cache.DefaultDir("chisel")
+	var mu sync.Mutex
+	used := make(map[string]bool)
+	exportCache := &cache.Cache{
+		Dir: cacheDir,
+		Used: func(name string) {
+			mu.Lock()
+			used[name] = true
+			mu.Unlock()
+		},
+	}
+	exportCache.Backend, err = remoteCache(netConfig, client, cmd.Timeout)
+	if err != nil {
+		return err
+	}
+	defer exportCache.Wait()
+
+	release, err := obtainRelease(cmd.Release, &setup.FetchOptions{
+		CacheDir: cacheDir,
+		Timeout:  cmd.Timeout,
+		Client:   client,
+	})
+	if err != nil {
+		return err
+	}
+	// Fetched releases are kept within the cache directory as well.
+	if relPath, err := filepath.Rel(cacheDir, release.Path); err == nil && !strings.HasPrefix(relPath, "..") {
+		err = filepath.Walk(release.Path, func(path string, finfo os.FileInfo, err error) error {
+			if err != nil || !finfo.Mode().IsRegular() {
+				return err
+			}
+			name, err := filepath.Rel(cacheDir, path)
+			if err != nil {
+				return err
+			}
+			used[filepath.ToSlash(name)] = true
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("cannot list release files: %w", err)
+		}
+	}
+
+	selection, err := setup.Select(release, sliceKeys)
+	if err != nil {
+		return err
+	}
+
+	archives, err := openArchives(release, &archive.Options{
+		Arch:     cmd.Arch,
+		CacheDir: cacheDir,
+		Cache:    exportCache,
+		Snapshot: cmd.Snapshot,
+		Jobs:     cmd.Jobs,
+		Timeout:  cmd.Timeout,
+		Retries:  cmd.Retries,
+		Client:   client,
+	})
+	if err != nil {
+		return err
+	}
+	packages, err := slicer.SelectPackages(&slicer.SelectOptions{
+		Selection: selection,
+		Archives:  archives,
+	})
+	if err != nil {
+		return err
+	}
+	for _, selected := range packages {
+		pkgArchive := archives[selected.Archive]
+		if pkgArchive.Options().PackagesDir != "" {
+			// Local packages are not cached.
+			continue
+		}
+		reader, err := pkgArchive.FetchPackage(selected.Info)
+		if err != nil {
+			return err
+		}
+		reader.Close()
+	}
+
+	names := make([]string, 0, len(used))
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	file, err := os.Create(cmd.Positional.Bundle)
+	if err != nil {
+		return fmt.Errorf("cannot write cache bundle: %w", err)
+	}
+	err = exportCache.Export(file, names)
+	closeErr := file.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("cannot write cache bundle: %w", closeErr)
+	}
+	if err != nil {
+		os.Remove(cmd.Positional.Bundle)
+	}
+	return err
+}
+
+func (cmd *cmdCacheImport) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+
+	file, err := os.Open(cmd.Positional.Bundle)
+	if err != nil {
+		return fmt.Errorf("cannot read cache bundle: %w", err)
+	}
+	defer file.Close()
+
+	importCache := &cache.Cache{Dir: cache.DefaultDir("chisel")}
+	return importCache.Import(file)
+}
+
+func (cmd *cmdCacheInfo) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+
+	infoCache := &cache.Cache{Dir: cache.DefaultDir("chisel")}
+	entries, err := infoCache.Entries()
+	if err != nil {
+		return err
+	}
+	// Partially fetched content is reported apart from the files, which
+	// the oldest use refers to as well.
+	var files, partial int
+	var size, partialSize int64
+	var oldest *cache.Entry
+	for _, entry := range entries {
+		if entry.Partial {
+			partial++
+			partialSize += entry.Size
+		} else {
+			files++
+			size += entry.Size
+			if oldest == nil {
+				oldest = entry
+			}
+		}
+	}
+
+	w := tabwriter.NewWriter(Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Directory:\t%s\n", infoCache.Dir)
+	fmt.Fprintf(w, "Files:\t%d\n", files)
+	fmt.Fprintf(w, "Size:\t%s\n", formatBytes(size))
+	fmt.Fprintf(w, "Partial:\t%d (%s)\n", partial, formatBytes(partialSize))
+	if oldest != nil {
+		fmt.Fprintf(w, "Oldest use:\t%s\n", oldest.LastUse.UTC().Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func (cmd *cmdCacheVerify) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+
+	verifyCache := &cache.Cache{Dir: cache.DefaultDir("chisel")}
+	entries, err := verifyCache.Entries()
+	if err != nil {
+		return err
+	}
+	files := 0
+	for _, entry := range entries {
+		if !entry.Partial {
+			files++
+		}
+	}
+	corrupted, err := verifyCache.Verify()
+	for _, entry := range corrupted {
+		fmt.Fprintf(Stdout, "Removed corrupted %s\n", entry.Digest)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(Stdout, "Verified %d files, removed %d corrupted.\n", files, len(corrupted))
+	return nil
+}
+
+func (cmd *cmdCachePrune) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+
+	options, err := pruneOptions(cmd.MaxAge, cmd.MaxSize, "--max-age", "--max-size")
+	if err != nil {
+		return err
+	}
+	if options == nil {
+		return fmt.Errorf("cannot prune without --max-age or --max-size")
+	}
+	pruneCache := &cache.Cache{Dir: cache.DefaultDir("chisel")}
+	return pruneWith(pruneCache, options)
+}
+
+// pruneOptions returns the options for pruning the cache as given with
+// the named flags, or nil if none were given.
+func pruneOptions(maxAge time.Duration, maxSize string, ageFlag, sizeFlag string) (*cache.PruneOptions, error) {
+	if maxAge < 0 {
+		return nil, fmt.Errorf("invalid %s value: %v", ageFlag, maxAge)
+	}
+	options := &cache.PruneOptions{MaxAge: maxAge}
+	if maxSize != "" {
+		size, err := parseSize(maxSize)
+		if err != nil || size == 0 {
+			return nil, fmt.Errorf("invalid %s value: %q", sizeFlag, maxSize)
+		}
+		options.MaxSize = size
+	}
+	if options.MaxAge == 0 && options.MaxSize == 0 {
+		return nil, nil
+	}
+	return options, nil
+}
+
+func pruneWith(pruneCache *cache.Cache, options *cache.PruneOptions) error {
+	removed, err := pruneCache.Prune(options)
+	var size int64
+	for _, entry := range removed {
+		size += entry.Size
+	}
+	if len(removed) > 0 {
+		logf("Removed %d files from cache, freeing %s.", len(removed), formatBytes(size))
+	}
+	return err
+}
+
+// parseSize parses a size in bytes, optionally followed by one of the
+// decimal units also used by formatBytes, such as 500M or 10GB.
+func parseSize(value string) (int64, error) {
+	digits := strings.TrimSuffix(value, "B")
+	multiplier := int64(1)
+	if n := len(digits); n > 0 {
+		if i := strings.IndexByte("kMGT", digits[n-1]); i >= 0 {
+			digits = digits[:n-1]
+			for ; i >= 0; i-- {
+				multiplier *= 1000
+			}
+		}
+	}
+	size, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size: %q", value)
+	}
+	return size * multiplier, nil
+}
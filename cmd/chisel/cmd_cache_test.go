@@ -0,0 +1,94 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	chisel "github.com/canonical/chisel/cmd/chisel"
+	"github.com/canonical/chisel/internal/cache"
+)
+
+type parseSizeTest struct {
+	value string
+	size  int64
+	error string
+}
+
+var parseSizeTests = []parseSizeTest{
+	{value: "0", size: 0},
+	{value: "123", size: 123},
+	{value: "123B", size: 123},
+	{value: "5k", size: 5000},
+	{value: "500M", size: 500000000},
+	{value: "10G", size: 10000000000},
+	{value: "10GB", size: 10000000000},
+	{value: "2T", size: 2000000000000},
+	{value: "", error: `invalid size: ""`},
+	{value: "G", error: `invalid size: "G"`},
+	{value: "1.5G", error: `invalid size: "1.5G"`},
+	{value: "-1", error: `invalid size: "-1"`},
+	{value: "10X", error: `invalid size: "10X"`},
+}
+
+func (s *ChiselSuite) TestParseSize(c *C) {
+	for _, test := range parseSizeTests {
+		size, err := chisel.ParseSize(test.value)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(size, Equals, test.size)
+	}
+}
+
+const (
+	data1Digest = "5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9"
+	data2Digest = "d98cf53e0c8b77c14a96358d5b69584225b4bb9026423cbc2f7b0161894c402c"
+)
+
+func (s *ChiselSuite) TestCacheCommands(c *C) {
+	oldCacheHome := os.Getenv("XDG_CACHE_HOME")
+	s.AddCleanup(func() { os.Setenv("XDG_CACHE_HOME", oldCacheHome) })
+	os.Setenv("XDG_CACHE_HOME", c.MkDir())
+
+	cc := &cache.Cache{Dir: cache.DefaultDir("chisel")}
+	c.Assert(cc.Write(data1Digest, []byte("data1")), IsNil)
+	c.Assert(cc.Write(data2Digest, []byte("data2")), IsNil)
+	partialPath := filepath.Join(cc.Dir, "sha256", data2Digest+".partial")
+	c.Assert(ioutil.WriteFile(partialPath, []byte("dat"), 0644), IsNil)
+	for i, path := range []string{partialPath, filepath.Join(cc.Dir, "sha256", data1Digest)} {
+		mtime := time.Date(2024, 1, 1+i, 0, 0, 0, 0, time.UTC)
+		c.Assert(os.Chtimes(path, mtime, mtime), IsNil)
+	}
+
+	// Partially fetched content is reported on its own.
+	_, err := chisel.Parser().ParseArgs([]string{"cache", "info"})
+	c.Assert(err, IsNil)
+	c.Assert(s.Stdout(), Equals, "Directory:   "+cc.Dir+"\nFiles:       2\nSize:        10B\nPartial:     1 (3B)\nOldest use:  2024-01-02T00:00:00Z\n")
+	s.ResetStdStreams()
+
+	err = ioutil.WriteFile(filepath.Join(cc.Dir, "sha256", data2Digest), []byte("data3"), 0644)
+	c.Assert(err, IsNil)
+	_, err = chisel.Parser().ParseArgs([]string{"cache", "verify"})
+	c.Assert(err, IsNil)
+	c.Assert(s.Stdout(), Equals, "Removed corrupted "+data2Digest+"\nVerified 2 files, removed 1 corrupted.\n")
+	s.ResetStdStreams()
+
+	_, err = chisel.Parser().ParseArgs([]string{"cache", "prune"})
+	c.Assert(err, ErrorMatches, "cannot prune without --max-age or --max-size")
+	_, err = chisel.Parser().ParseArgs([]string{"cache", "prune", "--max-size", "lots"})
+	c.Assert(err, ErrorMatches, `invalid --max-size value: "lots"`)
+
+	_, err = chisel.Parser().ParseArgs([]string{"cache", "prune", "--max-size", "1"})
+	c.Assert(err, IsNil)
+	c.Assert(cc.Has(data1Digest), Equals, false)
+
+	_, err = chisel.Parser().ParseArgs([]string{"cache", "info"})
+	c.Assert(err, IsNil)
+	c.Assert(s.Stdout(), Equals, "Directory:  "+cc.Dir+"\nFiles:      0\nSize:       0B\nPartial:    0 (0B)\n")
+}
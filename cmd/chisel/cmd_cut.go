@@ -3,33 +3,102 @@ package main
 import (
 	"github.com/jessevdk/go-flags"
 
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
+	chiselcmd "github.com/canonical/chisel/cmd"
 	"github.com/canonical/chisel/internal/archive"
 	"github.com/canonical/chisel/internal/cache"
+	"github.com/canonical/chisel/internal/fsutil"
+	"github.com/canonical/chisel/internal/netconf"
+	"github.com/canonical/chisel/internal/output"
+	"github.com/canonical/chisel/internal/sbom"
 	"github.com/canonical/chisel/internal/setup"
 	"github.com/canonical/chisel/internal/slicer"
+	"github.com/canonical/chisel/internal/snapshot"
 )
 
 var shortCutHelp = "Cut a tree with selected slices"
 var longCutHelp = `
 The cut command uses the provided selection of package slices
 to create a new filesystem tree in the root location.
+
+The slices cut are recorded in the root, so that a later cut into
+the same root updates its content to match the new selection. With
+--add, the provided slices are cut in addition to the recorded ones.
+
+With --dry-run, the slices, packages, and paths that would be cut
+are shown instead, without fetching any packages or writing into
+the root location.
 `
 
 var cutDescs = map[string]string{
-	"release": "Chisel release directory",
-	"root":    "Root for generated content",
-	"arch":    "Package architecture",
+	"release":     "Chisel release directory",
+	"root":        "Root for generated content",
+	"arch":        "Package architecture",
+	"locked":      "Use the exact packages recorded in chisel.lock",
+	"write-lock":  "Record the packages used into chisel.lock",
+	"dpkg-db":     "Write a dpkg database of the packages used",
+	"manifest":    "Write a JSON manifest of the written content to the file",
+	"sbom":        "Write a software bill of materials to the file",
+	"sbom-format": "Format of the software bill of materials",
+	"output-tar":  "Write the content into a tarball, compressed per its extension",
+	"output-oci":  "Write the content as an OCI image layout into the directory",
+	"timestamp":   "Set modification times to the Unix time (default $SOURCE_DATE_EPOCH)",
+	"add":         "Add the slices to the ones previously cut into the root",
+	"dry-run":     "Show what would be cut without fetching packages or writing content",
+	"format":      "Format of the --dry-run output",
+	"jobs":        "Number of files downloaded concurrently",
+	"retries":     "Number of times failed downloads are retried",
+	"timeout":     "Time limit for each download, such as 30s or 5m",
+	"snapshot":    "Use the archives as they were at the UTC time, such as 20240101T000000Z",
+	"offline":     "Use only the release and archive files previously cached",
+
+	"cache-max-age":  "Prune cache files not used within the duration after cutting",
+	"cache-max-size": "Prune the least recently used cache files after cutting, such as 10G",
 }
 
 type cmdCut struct {
-	Release string `long:"release" value-name:"<dir>"`
-	RootDir string `long:"root" value-name:"<dir>" required:"yes"`
-	Arch    string `long:"arch" value-name:"<arch>"`
+	Release   string `long:"release" value-name:"<dir>"`
+	RootDir   string `long:"root" value-name:"<dir>"`
+	Arch      string `long:"arch" value-name:"<arch>"`
+	Locked    bool   `long:"locked"`
+	WriteLock bool   `long:"write-lock"`
+	DpkgDB    string `long:"dpkg-db" value-name:"<format>" choice:"status" choice:"status.d"`
+	Manifest  string `long:"manifest" value-name:"<file>"`
+
+	SBOM       string `long:"sbom" value-name:"<file>"`
+	SBOMFormat string `long:"sbom-format" value-name:"<format>" choice:"spdx-json" choice:"cyclonedx-json" default:"spdx-json"`
+
+	OutputTar string `long:"output-tar" value-name:"<file>"`
+	OutputOCI string `long:"output-oci" value-name:"<dir>"`
+
+	Timestamp string `long:"timestamp" value-name:"<seconds>"`
+	Add       bool   `long:"add"`
+
+	DryRun bool   `long:"dry-run"`
+	Format string `long:"format" value-name:"<format>" choice:"text" choice:"json"`
+
+	Jobs    int           `long:"jobs" value-name:"<n>" default:"4"`
+	Retries int           `long:"retries" value-name:"<n>" default:"3"`
+	Timeout time.Duration `long:"timeout" value-name:"<duration>"`
+
+	Snapshot string `long:"snapshot" value-name:"<timestamp>"`
+	Offline  bool   `long:"offline"`
+
+	CacheMaxAge  time.Duration `long:"cache-max-age" value-name:"<duration>"`
+	CacheMaxSize string        `long:"cache-max-size" value-name:"<size>"`
 
 	Positional struct {
 		SliceRefs []string `positional-arg-name:"<slice names>" required:"yes"`
@@ -45,34 +114,119 @@ func (cmd *cmdCut) Execute(args []string) error {
 		return ErrExtraArgs
 	}
 
-	sliceKeys := make([]setup.SliceKey, len(cmd.Positional.SliceRefs))
-	for i, sliceRef := range cmd.Positional.SliceRefs {
-		sliceKey, err := setup.ParseSliceKey(sliceRef)
-		if err != nil {
-			return err
+	if cmd.Format != "" && !cmd.DryRun {
+		return fmt.Errorf("cannot use --format without --dry-run")
+	}
+	if cmd.Jobs < 1 {
+		return fmt.Errorf("invalid --jobs value: %d", cmd.Jobs)
+	}
+	if cmd.Retries < 0 {
+		return fmt.Errorf("invalid --retries value: %d", cmd.Retries)
+	}
+	if cmd.Timeout < 0 {
+		return fmt.Errorf("invalid --timeout value: %v", cmd.Timeout)
+	}
+	if cmd.Snapshot != "" {
+		if _, err := snapshot.Parse(cmd.Snapshot); err != nil {
+			return fmt.Errorf("invalid --snapshot value: %q", cmd.Snapshot)
 		}
-		sliceKeys[i] = sliceKey
 	}
 
-	var release *setup.Release
-	var err error
-	if strings.Contains(cmd.Release, "/") {
-		release, err = setup.ReadRelease(cmd.Release)
-	} else {
-		var label, version string
-		if cmd.Release == "" {
-			label, version, err = readReleaseInfo()
+	prune, err := pruneOptions(cmd.CacheMaxAge, cmd.CacheMaxSize, "--cache-max-age", "--cache-max-size")
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Base(cmd.RootDir)
+	if cmd.RootDir == "" && !cmd.DryRun {
+		if cmd.OutputTar == "" && cmd.OutputOCI == "" {
+			return fmt.Errorf("cannot cut without --root, --output-tar, or --output-oci")
+		}
+		if cmd.OutputOCI != "" {
+			name = filepath.Base(cmd.OutputOCI)
 		} else {
-			label, version, err = parseReleaseInfo(cmd.Release)
+			name = strings.SplitN(filepath.Base(cmd.OutputTar), ".", 2)[0]
+		}
+	}
+
+	timestamp, err := cmd.timestamp()
+	if err != nil {
+		return err
+	}
+
+	var state *slicer.State
+	if cmd.RootDir != "" {
+		state, err = slicer.ReadState(cmd.RootDir)
+		if err != nil {
+			return err
 		}
+	}
+	sliceRefs, releaseRef := cmd.Positional.SliceRefs, cmd.Release
+	if cmd.Add {
+		if state == nil {
+			return fmt.Errorf("cannot add slices: no previous cut found in --root")
+		}
+		sliceRefs = append(state.Slices, sliceRefs...)
+		releaseRef, err = stateRelease(state, releaseRef)
 		if err != nil {
 			return err
 		}
-		release, err = setup.FetchRelease(&setup.FetchOptions{
-			Label:   label,
-			Version: version,
-		})
 	}
+	arch, dpkgDB, archiveSnapshot := cmd.Arch, slicer.DpkgDB(cmd.DpkgDB), cmd.Snapshot
+	if state != nil {
+		if arch == "" {
+			arch = state.Arch
+		} else if arch != state.Arch {
+			return fmt.Errorf("cannot cut %s slices into root with %s slices", arch, state.Arch)
+		}
+		if dpkgDB == slicer.DpkgDBNone {
+			dpkgDB = state.DpkgDB
+		}
+		if archiveSnapshot == "" {
+			archiveSnapshot = state.Snapshot
+		}
+	}
+
+	var sliceKeys []setup.SliceKey
+	var sliceNames []string
+	seen := make(map[setup.SliceKey]bool)
+	for _, sliceRef := range sliceRefs {
+		sliceKey, err := setup.ParseSliceKey(sliceRef)
+		if err != nil {
+			return err
+		}
+		if seen[sliceKey] {
+			continue
+		}
+		seen[sliceKey] = true
+		sliceKeys = append(sliceKeys, sliceKey)
+		sliceNames = append(sliceNames, sliceKey.String())
+	}
+
+	netConfig, err := netconf.Load(netconf.DefaultPath())
+	if err != nil {
+		return err
+	}
+	client, err := netConfig.Client()
+	if err != nil {
+		return err
+	}
+
+	localRelease := strings.Contains(releaseRef, "/")
+	if cmd.Locked && !localRelease {
+		return fmt.Errorf("cannot use --locked without a local --release directory")
+	}
+	if cmd.WriteLock && !localRelease {
+		return fmt.Errorf("cannot use --write-lock without a local --release directory")
+	}
+	if cmd.WriteLock && cmd.Locked {
+		return fmt.Errorf("cannot use --write-lock with --locked")
+	}
+	release, err := obtainRelease(releaseRef, &setup.FetchOptions{
+		Timeout: cmd.Timeout,
+		Client:  client,
+		Offline: cmd.Offline,
+	})
 	if err != nil {
 		return err
 	}
@@ -82,35 +236,411 @@ func (cmd *cmdCut) Execute(args []string) error {
 		return err
 	}
 
-	archives := make(map[string]archive.Archive)
-	for archiveName, archiveInfo := range release.Archives {
-		openArchive, err := archive.Open(&archive.Options{
-			Label:      archiveName,
-			Version:    archiveInfo.Version,
-			Arch:       cmd.Arch,
-			Suites:     archiveInfo.Suites,
-			Components: archiveInfo.Components,
-			CacheDir:   cache.DefaultDir("chisel"),
+	// Show the progress of downloads when running on a terminal.
+	var meter *progressMeter
+	var progress func(name string, done, total int64)
+	if isStdoutTTY {
+		meter = newProgressMeter(Stdout)
+		progress = meter.Update
+		defer meter.Clear()
+	}
+
+	cacheDir := cache.DefaultDir("chisel")
+	archiveCache := &cache.Cache{Dir: cacheDir}
+	if !cmd.Offline {
+		archiveCache.Backend, err = remoteCache(netConfig, client, cmd.Timeout)
+		if err != nil {
+			return err
+		}
+		defer archiveCache.Wait()
+	}
+	archives, err := openArchives(release, &archive.Options{
+		Arch:     arch,
+		CacheDir: cacheDir,
+		Cache:    archiveCache,
+		Snapshot: archiveSnapshot,
+		Jobs:     cmd.Jobs,
+		Progress: progress,
+		Timeout:  cmd.Timeout,
+		Retries:  cmd.Retries,
+		Client:   client,
+		Offline:  cmd.Offline,
+	})
+	if err != nil {
+		return err
+	}
+
+	var lock *setup.Lock
+	if cmd.Locked {
+		lock, err = setup.ReadLock(release.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	packages, err := slicer.SelectPackages(&slicer.SelectOptions{
+		Selection: selection,
+		Archives:  archives,
+		Lock:      lock,
+	})
+	if err != nil {
+		return err
+	}
+
+	if cmd.DryRun {
+		plan, err := slicer.NewPlan(&slicer.PlanOptions{
+			Selection: selection,
+			Archives:  archives,
+			Packages:  packages,
+			Cache:     &cache.Cache{Dir: cacheDir},
 		})
 		if err != nil {
 			return err
 		}
-		archives[archiveName] = openArchive
+		meter.Clear()
+		return writePlan(Stdout, plan, cmd.Format)
 	}
 
-	return slicer.Run(&slicer.RunOptions{
+	runOptions := &slicer.RunOptions{
 		Selection: selection,
 		Archives:  archives,
 		TargetDir: cmd.RootDir,
-	})
+		Packages:  packages,
+		DpkgDB:    dpkgDB,
+		Timestamp: timestamp,
+		Jobs:      cmd.Jobs,
+	}
+	var root fsutil.Root = fsutil.Dir(cmd.RootDir)
+	if cmd.RootDir == "" {
+		// Content written only into other outputs is held in memory,
+		// unless mutation scripts need it in actual files, in which case
+		// it is cut into a temporary root instead. Nothing there requires
+		// privileges, as ownership and devices are written into the
+		// outputs as recorded in the manifest.
+		if hasMutations(selection) {
+			tmpDir, err := os.MkdirTemp("", "chisel-root-")
+			if err != nil {
+				return fmt.Errorf("cannot create temporary root: %w", err)
+			}
+			defer os.RemoveAll(tmpDir)
+			runOptions.TargetDir = tmpDir
+			root = fsutil.Dir(tmpDir)
+		} else {
+			tree := fsutil.NewTree()
+			runOptions.Target = tree
+			root = tree
+		}
+	}
+	var manifest *slicer.Manifest
+	if state != nil {
+		manifest, err = slicer.Update(runOptions, state)
+	} else {
+		manifest, err = slicer.Run(runOptions)
+	}
+	meter.Clear()
+	if err != nil {
+		return err
+	}
+	// The architecture is the same for all archives.
+	for _, openArchive := range archives {
+		arch = openArchive.Options().Arch
+		break
+	}
+	if cmd.RootDir != "" {
+		name, err := releaseName(releaseRef)
+		if err != nil {
+			return err
+		}
+		err = slicer.WriteState(cmd.RootDir, &slicer.State{
+			Release:  name,
+			Slices:   sliceNames,
+			Arch:     arch,
+			DpkgDB:   dpkgDB,
+			Snapshot: archiveSnapshot,
+			Manifest: *manifest,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.Manifest != "" {
+		data, err := json.MarshalIndent(manifest, "", "    ")
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(cmd.Manifest, append(data, '\n'), 0644)
+		if err != nil {
+			return fmt.Errorf("cannot write manifest: %w", err)
+		}
+	}
+
+	if cmd.SBOM != "" {
+		err := writeSBOM(cmd.SBOM, &sbom.Options{
+			Format:      sbom.Format(cmd.SBOMFormat),
+			Name:        name,
+			Manifest:    manifest,
+			Root:        root,
+			ToolVersion: chiselcmd.Version,
+			Created:     timestamp,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.OutputTar != "" {
+		err := output.WriteTarFile(cmd.OutputTar, &output.TarOptions{
+			Root:      root,
+			Manifest:  manifest,
+			Timestamp: timestamp,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.OutputOCI != "" {
+		err := output.WriteOCI(&output.OCIOptions{
+			Dir:       cmd.OutputOCI,
+			Root:      root,
+			Manifest:  manifest,
+			Arch:      arch,
+			Timestamp: timestamp,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The lock is only written once the cut is complete, and failing to
+	// write it does not fail the cut.
+	if cmd.WriteLock {
+		err = writeLock(release.Path, packages)
+		if err != nil {
+			logf("Cannot write %s: %v", setup.LockFileName, err)
+		}
+	}
+
+	// The cache is only pruned once everything else is written, including
+	// into the remote cache, and failing to do so does not fail the cut.
+	archiveCache.Wait()
+	if prune != nil {
+		err = pruneWith(&cache.Cache{Dir: cacheDir}, prune)
+		if err != nil {
+			logf("Cannot prune cache: %v", err)
+		}
+	}
+	return nil
+}
+
+// hasMutations returns whether any of the slices in the selection has
+// mutation scripts.
+func hasMutations(selection *setup.Selection) bool {
+	for _, slice := range selection.Slices {
+		if slice.Scripts.Mutate != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeLock records the packages into the lock file of the release
+// directory, keeping the packages recorded there by previous cuts of
+// other slices.
+func writeLock(releaseDir string, packages map[string]*slicer.SelectedPackage) error {
+	lock := &setup.Lock{Packages: make(map[string]*setup.LockedPackage)}
+	if _, err := os.Stat(filepath.Join(releaseDir, setup.LockFileName)); err == nil {
+		lock, err = setup.ReadLock(releaseDir)
+		if err != nil {
+			return err
+		}
+	}
+	for _, selected := range packages {
+		lock.Packages[selected.Info.Name] = &setup.LockedPackage{
+			Name:     selected.Info.Name,
+			Version:  selected.Info.Version,
+			Arch:     selected.Info.Arch,
+			Archive:  selected.Archive,
+			Filename: selected.Info.Filename,
+			SHA256:   selected.Info.SHA256,
+		}
+	}
+	return setup.WriteLock(releaseDir, lock)
+}
+
+// obtainRelease reads the release from the local directory releaseRef when
+// it holds a slash, or otherwise fetches the release it names, such as
+// ubuntu-22.04, or the one of the running system when empty. The options
+// are completed with the label and version of the release fetched.
+func obtainRelease(releaseRef string, options *setup.FetchOptions) (*setup.Release, error) {
+	if strings.Contains(releaseRef, "/") {
+		return setup.ReadRelease(releaseRef)
+	}
+	var err error
+	if releaseRef == "" {
+		options.Label, options.Version, err = readReleaseInfo()
+	} else {
+		options.Label, options.Version, err = parseReleaseInfo(releaseRef)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return setup.FetchRelease(options)
+}
+
+// remoteCache returns the backend for the remote cache set in netConfig,
+// if any, reached with client within timeout for each request.
+func remoteCache(netConfig *netconf.Config, client *http.Client, timeout time.Duration) (cache.Backend, error) {
+	if netConfig.RemoteCache == "" {
+		return nil, nil
+	}
+	cacheURL, err := url.Parse(netConfig.RemoteCache)
+	if err != nil || (cacheURL.Scheme != "http" && cacheURL.Scheme != "https") || cacheURL.Host == "" {
+		return nil, fmt.Errorf("invalid remote cache URL: %q", netConfig.RemoteCache)
+	}
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	backendClient := *client
+	backendClient.Timeout = timeout
+	return &cache.HTTPBackend{URL: netConfig.RemoteCache, Client: &backendClient}, nil
+}
+
+// openArchives opens all the archives of the release, with the options in
+// base completed by the details of each archive. A snapshot set in base
+// takes precedence over the ones of the archives.
+func openArchives(release *setup.Release, base *archive.Options) (map[string]archive.Archive, error) {
+	archives := make(map[string]archive.Archive)
+	for archiveName, archiveInfo := range release.Archives {
+		options := *base
+		options.Label = archiveName
+		options.Version = archiveInfo.Version
+		options.Suites = archiveInfo.Suites
+		options.Components = archiveInfo.Components
+		options.PubKeys = archiveInfo.PubKeys
+		options.URL = archiveInfo.URL
+		options.PortsURL = archiveInfo.PortsURL
+		options.PackagesDir = archiveInfo.PackagesDir
+		if options.Snapshot == "" {
+			options.Snapshot = archiveInfo.Snapshot
+		}
+		openArchive, err := archive.Open(&options)
+		if err != nil {
+			return nil, err
+		}
+		archives[archiveName] = openArchive
+	}
+	return archives, nil
+}
+
+// timestamp returns the time set with --timestamp or SOURCE_DATE_EPOCH
+// for reproducible output, or the zero time if none is set.
+func (cmd *cmdCut) timestamp() (time.Time, error) {
+	value, name := cmd.Timestamp, "--timestamp"
+	if value == "" {
+		value, name = os.Getenv("SOURCE_DATE_EPOCH"), "SOURCE_DATE_EPOCH"
+	}
+	if value == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, fmt.Errorf("invalid %s value: %q", name, value)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+func writePlan(w io.Writer, plan *slicer.Plan, format string) error {
+	if format == "json" {
+		data, err := json.MarshalIndent(plan, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
 
-	return printVersions()
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Slices:")
+	for _, slice := range plan.Slices {
+		fmt.Fprintf(tw, "  %s\n", slice)
+	}
+	fmt.Fprintln(tw, "Packages:")
+	for _, pkg := range plan.Packages {
+		status := "fetch"
+		if pkg.Cached {
+			status = "cached"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%d\t%s\n", pkg.Name, pkg.Version, pkg.Arch, pkg.Archive, pkg.Size, status)
+	}
+	fmt.Fprintln(tw, "Paths:")
+	for _, path := range plan.Paths {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", path.Path, path.Kind, strings.Join(path.Slices, ","))
+	}
+	return tw.Flush()
+}
+
+func writeSBOM(path string, options *sbom.Options) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("cannot write SBOM: %w", err)
+	}
+	err = sbom.Write(file, options)
+	closeErr := file.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("cannot write SBOM: %w", closeErr)
+	}
+	return err
 }
 
 // TODO These need testing, and maybe moving into a common file.
 
 var releaseExp = regexp.MustCompile(`^([a-z](?:-?[a-z0-9]){2,})-([0-9]+(?:\.?[0-9])+)$`)
 
+// releaseName returns the name recorded for the release in the state of
+// a root, which is the absolute path of local releases, and otherwise the
+// label and version of the release, as in "ubuntu-22.04". Either may be
+// given again with --release.
+func releaseName(releaseRef string) (string, error) {
+	if strings.Contains(releaseRef, "/") {
+		return filepath.Abs(releaseRef)
+	}
+	var label, version string
+	var err error
+	if releaseRef == "" {
+		label, version, err = readReleaseInfo()
+	} else {
+		label, version, err = parseReleaseInfo(releaseRef)
+	}
+	if err != nil {
+		return "", err
+	}
+	return label + "-" + version, nil
+}
+
+// stateRelease returns the reference of the release to cut the slices
+// recorded in the state from, which defaults to the recorded release, and
+// must be that release if given, as slices cut from one release cannot be
+// updated with another one.
+func stateRelease(state *slicer.State, releaseRef string) (string, error) {
+	if state.Release == "" {
+		// Recorded before releases were.
+		return releaseRef, nil
+	}
+	if releaseRef == "" {
+		return state.Release, nil
+	}
+	name, err := releaseName(releaseRef)
+	if err != nil {
+		return "", err
+	}
+	if name != state.Release {
+		return "", fmt.Errorf("cannot update slices cut from release %s with release %s", state.Release, name)
+	}
+	return releaseRef, nil
+}
+
 func parseReleaseInfo(release string) (label, version string, err error) {
 	match := releaseExp.FindStringSubmatch(release)
 	if match == nil {
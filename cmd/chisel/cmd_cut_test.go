@@ -0,0 +1,205 @@
+package main_test
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	chisel "github.com/canonical/chisel/cmd/chisel"
+	"github.com/canonical/chisel/internal/setup"
+	"github.com/canonical/chisel/internal/slicer"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+var cutRelease = map[string]string{
+	"chisel.yaml": `
+		format: chisel-v1
+		archives:
+			local:
+				packages-dir: debs
+	`,
+	"slices/pkga.yaml": `
+		package: pkga
+		slices:
+			bins:
+				contents:
+					/usr/bin/pkga:
+			conf:
+				contents:
+					/etc/pkga.conf: {text: data1, mutable: true}
+				mutate: |
+					content.write("/etc/pkga.conf", "data2")
+	`,
+	"slices/pkgb.yaml": `
+		package: pkgb
+		slices:
+			bins:
+				contents:
+					/usr/bin/pkgb:
+	`,
+}
+
+// makeCutRelease writes a release with a local archive into a new
+// directory, and returns the directory.
+func makeCutRelease(c *C) string {
+	releaseDir := c.MkDir()
+	for path, data := range cutRelease {
+		fpath := filepath.Join(releaseDir, path)
+		c.Assert(os.MkdirAll(filepath.Dir(fpath), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(fpath, testutil.Reindent(data), 0644), IsNil)
+	}
+	c.Assert(os.Mkdir(filepath.Join(releaseDir, "debs"), 0755), IsNil)
+	return releaseDir
+}
+
+// writeCutPackage writes a package with a single file into the local
+// archive of the release.
+func writeCutPackage(c *C, releaseDir, pkgName, version string) {
+	control := "Package: " + pkgName + "\nVersion: " + version + "\nArchitecture: amd64\n"
+	data := testutil.MustMakeDeb(control, []testutil.TarEntry{
+		testutil.Dir(0755, "./"),
+		testutil.Dir(0755, "./usr/"),
+		testutil.Dir(0755, "./usr/bin/"),
+		testutil.Reg(0755, "./usr/bin/"+pkgName, pkgName+" "+version),
+	})
+	debPath := filepath.Join(releaseDir, "debs", pkgName+"_"+version+"_amd64.deb")
+	c.Assert(ioutil.WriteFile(debPath, data, 0644), IsNil)
+}
+
+func (s *ChiselSuite) TestCutWriteLock(c *C) {
+	oldCacheHome := os.Getenv("XDG_CACHE_HOME")
+	s.AddCleanup(func() { os.Setenv("XDG_CACHE_HOME", oldCacheHome) })
+	os.Setenv("XDG_CACHE_HOME", c.MkDir())
+	oldConfig := os.Getenv("CHISEL_CONFIG")
+	s.AddCleanup(func() { os.Setenv("CHISEL_CONFIG", oldConfig) })
+	os.Setenv("CHISEL_CONFIG", filepath.Join(c.MkDir(), "config.yaml"))
+
+	releaseDir := makeCutRelease(c) + "/"
+	writeCutPackage(c, releaseDir, "pkga", "1.0")
+	writeCutPackage(c, releaseDir, "pkgb", "1.0")
+
+	cut := func(args ...string) (string, error) {
+		rootDir := c.MkDir()
+		args = append([]string{"cut", "--release", releaseDir, "--root", rootDir, "--arch", "amd64"}, args...)
+		_, err := chisel.Parser().ParseArgs(args)
+		return rootDir, err
+	}
+
+	// The lock is not written unless asked for.
+	_, err := cut("pkga_bins")
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(releaseDir, setup.LockFileName))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	_, err = cut("--write-lock", "--locked", "pkga_bins")
+	c.Assert(err, ErrorMatches, "cannot use --write-lock with --locked")
+
+	// Cutting other slices keeps the packages locked before.
+	_, err = cut("--write-lock", "pkga_bins")
+	c.Assert(err, IsNil)
+	_, err = cut("--write-lock", "pkgb_bins")
+	c.Assert(err, IsNil)
+	lock, err := setup.ReadLock(releaseDir)
+	c.Assert(err, IsNil)
+	c.Assert(lock.Packages["pkga"], NotNil)
+	c.Assert(lock.Packages["pkgb"], NotNil)
+
+	// Newer packages are not used when cutting locked slices.
+	writeCutPackage(c, releaseDir, "pkga", "2.0")
+	rootDir, err := cut("--locked", "pkga_bins")
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Join(rootDir, "usr/bin/pkga"), testutil.FileEquals, "pkga 1.0")
+	rootDir, err = cut("pkga_bins")
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Join(rootDir, "usr/bin/pkga"), testutil.FileEquals, "pkga 2.0")
+}
+
+func (s *ChiselSuite) TestCutOutputTar(c *C) {
+	oldCacheHome := os.Getenv("XDG_CACHE_HOME")
+	s.AddCleanup(func() { os.Setenv("XDG_CACHE_HOME", oldCacheHome) })
+	os.Setenv("XDG_CACHE_HOME", c.MkDir())
+	oldConfig := os.Getenv("CHISEL_CONFIG")
+	s.AddCleanup(func() { os.Setenv("CHISEL_CONFIG", oldConfig) })
+	os.Setenv("CHISEL_CONFIG", filepath.Join(c.MkDir(), "config.yaml"))
+
+	releaseDir := makeCutRelease(c)
+	writeCutPackage(c, releaseDir, "pkga", "1.0")
+
+	// Content is cut without a root directory, in memory unless mutation
+	// scripts require actual files.
+	for _, slices := range [][]string{{"pkga_bins"}, {"pkga_bins", "pkga_conf"}} {
+		c.Logf("Slices: %v", slices)
+		tarPath := filepath.Join(c.MkDir(), "rootfs.tar")
+		args := append([]string{"cut", "--release", releaseDir, "--output-tar", tarPath, "--arch", "amd64"}, slices...)
+		_, err := chisel.Parser().ParseArgs(args)
+		c.Assert(err, IsNil)
+
+		file, err := os.Open(tarPath)
+		c.Assert(err, IsNil)
+		defer file.Close()
+		entries := make(map[string]string)
+		tr := tar.NewReader(file)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, IsNil)
+			data, err := ioutil.ReadAll(tr)
+			c.Assert(err, IsNil)
+			entries[header.Name] = string(data)
+		}
+		c.Assert(entries["usr/bin/pkga"], Equals, "pkga 1.0")
+		if len(slices) > 1 {
+			c.Assert(entries["etc/pkga.conf"], Equals, "data2")
+		} else {
+			_, ok := entries["etc/pkga.conf"]
+			c.Assert(ok, Equals, false)
+		}
+	}
+}
+
+func (s *ChiselSuite) TestCutStateRelease(c *C) {
+	oldCacheHome := os.Getenv("XDG_CACHE_HOME")
+	s.AddCleanup(func() { os.Setenv("XDG_CACHE_HOME", oldCacheHome) })
+	os.Setenv("XDG_CACHE_HOME", c.MkDir())
+	oldConfig := os.Getenv("CHISEL_CONFIG")
+	s.AddCleanup(func() { os.Setenv("CHISEL_CONFIG", oldConfig) })
+	os.Setenv("CHISEL_CONFIG", filepath.Join(c.MkDir(), "config.yaml"))
+
+	releaseDir := makeCutRelease(c)
+	writeCutPackage(c, releaseDir, "pkga", "1.0")
+	writeCutPackage(c, releaseDir, "pkgb", "1.0")
+	otherDir := makeCutRelease(c)
+	writeCutPackage(c, otherDir, "pkgb", "1.0")
+
+	rootDir := c.MkDir()
+	_, err := chisel.Parser().ParseArgs([]string{"cut", "--release", releaseDir + "/", "--root", rootDir, "--arch", "amd64", "pkga_bins"})
+	c.Assert(err, IsNil)
+	state, err := slicer.ReadState(rootDir)
+	c.Assert(err, IsNil)
+	c.Assert(state.Release, Equals, releaseDir)
+
+	// Slices cut from one release are not updated with another one.
+	_, err = chisel.Parser().ParseArgs([]string{"cut", "--release", otherDir, "--root", rootDir, "--add", "pkgb_bins"})
+	c.Assert(err, ErrorMatches, "cannot update slices cut from release "+releaseDir+" with release "+otherDir)
+	_, err = chisel.Parser().ParseArgs([]string{"remove", "--release", otherDir, "--root", rootDir, "pkga_bins"})
+	c.Assert(err, ErrorMatches, "cannot update slices cut from release "+releaseDir+" with release "+otherDir)
+
+	// The recorded release is used unless given.
+	_, err = chisel.Parser().ParseArgs([]string{"cut", "--root", rootDir, "--add", "pkgb_bins"})
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Join(rootDir, "usr/bin/pkgb"), testutil.FileEquals, "pkgb 1.0")
+	_, err = chisel.Parser().ParseArgs([]string{"remove", "--root", rootDir, "pkga_bins"})
+	c.Assert(err, IsNil)
+	_, err = os.Lstat(filepath.Join(rootDir, "usr/bin/pkga"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	state, err = slicer.ReadState(rootDir)
+	c.Assert(err, IsNil)
+	c.Assert(state.Release, Equals, releaseDir)
+	c.Assert(state.Slices, DeepEquals, []string{"pkgb_bins"})
+}
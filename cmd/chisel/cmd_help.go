@@ -158,7 +158,11 @@ var helpCategories = []helpCategory{{
 }, {
 	Label:       "Action",
 	Description: "make things happen",
-	Commands:    []string{"slice"},
+	Commands:    []string{"cut", "remove"},
+}, {
+	Label:       "Cache",
+	Description: "manage downloaded files",
+	Commands:    []string{"cache"},
 }}
 
 var (
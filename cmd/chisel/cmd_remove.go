@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/canonical/chisel/internal/setup"
+	"github.com/canonical/chisel/internal/slicer"
+)
+
+var shortRemoveHelp = "Remove slices from a tree"
+var longRemoveHelp = `
+The remove command removes the provided slices from the ones previously
+cut into the root location, and updates its content to match the slices
+that remain, which are cut again from the release.
+`
+
+var removeDescs = map[string]string{
+	"release":   "Chisel release directory",
+	"root":      "Root previously cut into",
+	"arch":      "Package architecture",
+	"timestamp": "Set modification times to the Unix time (default $SOURCE_DATE_EPOCH)",
+	"jobs":      "Number of files downloaded concurrently",
+	"retries":   "Number of times failed downloads are retried",
+	"timeout":   "Time limit for each download, such as 30s or 5m",
+	"snapshot":  "Use the archives as they were at the UTC time, such as 20240101T000000Z",
+	"offline":   "Use only the release and archive files previously cached",
+}
+
+type cmdRemove struct {
+	Release   string        `long:"release" value-name:"<dir>"`
+	RootDir   string        `long:"root" value-name:"<dir>" required:"yes"`
+	Arch      string        `long:"arch" value-name:"<arch>"`
+	Timestamp string        `long:"timestamp" value-name:"<seconds>"`
+	Jobs      int           `long:"jobs" value-name:"<n>" default:"4"`
+	Retries   int           `long:"retries" value-name:"<n>" default:"3"`
+	Timeout   time.Duration `long:"timeout" value-name:"<duration>"`
+	Snapshot  string        `long:"snapshot" value-name:"<timestamp>"`
+	Offline   bool          `long:"offline"`
+
+	Positional struct {
+		SliceRefs []string `positional-arg-name:"<slice names>" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+func init() {
+	addCommand("remove", shortRemoveHelp, longRemoveHelp, func() flags.Commander { return &cmdRemove{} }, removeDescs, nil)
+}
+
+func (cmd *cmdRemove) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+
+	state, err := slicer.ReadState(cmd.RootDir)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("cannot remove slices: no previous cut found in --root")
+	}
+
+	remove := make(map[string]bool)
+	for _, sliceRef := range cmd.Positional.SliceRefs {
+		sliceKey, err := setup.ParseSliceKey(sliceRef)
+		if err != nil {
+			return err
+		}
+		remove[sliceKey.String()] = true
+	}
+	releaseRef, err := stateRelease(state, cmd.Release)
+	if err != nil {
+		return err
+	}
+	cut := &cmdCut{
+		Release:   releaseRef,
+		RootDir:   cmd.RootDir,
+		Arch:      cmd.Arch,
+		Timestamp: cmd.Timestamp,
+		Jobs:      cmd.Jobs,
+		Retries:   cmd.Retries,
+		Timeout:   cmd.Timeout,
+		Snapshot:  cmd.Snapshot,
+		Offline:   cmd.Offline,
+	}
+	for _, sliceName := range state.Slices {
+		if remove[sliceName] {
+			delete(remove, sliceName)
+		} else {
+			cut.Positional.SliceRefs = append(cut.Positional.SliceRefs, sliceName)
+		}
+	}
+	for _, sliceRef := range cmd.Positional.SliceRefs {
+		sliceKey, _ := setup.ParseSliceKey(sliceRef)
+		if remove[sliceKey.String()] {
+			return fmt.Errorf("cannot remove slice %s: not cut into --root", sliceKey)
+		}
+	}
+	return cut.Execute(nil)
+}
@@ -17,3 +17,9 @@ func FakeIsStdinTTY(t bool) (restore func()) {
 		isStdinTTY = oldIsStdinTTY
 	}
 }
+
+type ProgressMeter = progressMeter
+
+var NewProgressMeter = newProgressMeter
+
+var ParseSize = parseSize
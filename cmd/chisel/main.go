@@ -15,6 +15,7 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/canonical/chisel/internal/archive"
+	"github.com/canonical/chisel/internal/cache"
 	"github.com/canonical/chisel/internal/deb"
 	"github.com/canonical/chisel/internal/setup"
 	"github.com/canonical/chisel/internal/slicer"
@@ -85,6 +86,26 @@ func addCommand(name, shortHelp, longHelp string, builder func() flags.Commander
 	return info
 }
 
+// cacheCommands holds information about all the sub-commands of the cache
+// command.
+var cacheCommands []*cmdInfo
+
+// addCacheCommand replaces parser.addCommand() in a way that is
+// compatible with re-constructing a pristine parser. It is meant for
+// adding sub-commands of the cache command.
+func addCacheCommand(name, shortHelp, longHelp string, builder func() flags.Commander, optDescs map[string]string, argDescs []argDesc) *cmdInfo {
+	info := &cmdInfo{
+		name:      name,
+		shortHelp: shortHelp,
+		longHelp:  longHelp,
+		builder:   builder,
+		optDescs:  optDescs,
+		argDescs:  argDescs,
+	}
+	cacheCommands = append(cacheCommands, info)
+	return info
+}
+
 // addDebugCommand replaces parser.addCommand() in a way that is
 // compatible with re-constructing a pristine parser. It is meant for
 // adding debug commands.
@@ -237,6 +258,12 @@ func Parser() *flags.Parser {
 			c.extra(cmd)
 		}
 	}
+	// Add the cache command
+	cacheCommand, err := parser.AddCommand("cache", shortCacheHelp, strings.TrimSpace(longCacheHelp), &cmdCache{})
+	if err != nil {
+		panicf("cannot add command %q: %v", "cache", err)
+	}
+	addSubCommands(cacheCommand, cacheCommands)
 	// Add the debug command
 	debugCommand, err := parser.AddCommand("debug", shortDebugHelp, longDebugHelp, &cmdDebug{})
 	debugCommand.Hidden = true
@@ -244,14 +271,21 @@ func Parser() *flags.Parser {
 		panicf("cannot add command %q: %v", "debug", err)
 	}
 	// Add all the sub-commands of the debug command
-	for _, c := range debugCommands {
+	addSubCommands(debugCommand, debugCommands)
+	return parser
+}
+
+// addSubCommands adds the commands described by infos as sub-commands of
+// parent.
+func addSubCommands(parent *flags.Command, infos []*cmdInfo) {
+	for _, c := range infos {
 		obj := c.builder()
 		//if x, ok := obj.(clientSetter); ok {
 		//	x.setClient(cli)
 		//}
-		cmd, err := debugCommand.AddCommand(c.name, c.shortHelp, strings.TrimSpace(c.longHelp), obj)
+		cmd, err := parent.AddCommand(c.name, c.shortHelp, strings.TrimSpace(c.longHelp), obj)
 		if err != nil {
-			panicf("cannot add debug command %q: %v", c.name, err)
+			panicf("cannot add %s command %q: %v", parent.Name, c.name, err)
 		}
 		cmd.Hidden = c.hidden
 		opts := cmd.Options()
@@ -289,7 +323,6 @@ func Parser() *flags.Parser {
 			arg.Description = desc
 		}
 	}
-	return parser
 }
 
 var (
@@ -327,6 +360,7 @@ func (e *exitStatus) Error() string {
 
 func run() error {
 	archive.SetLogger(log.Default())
+	cache.SetLogger(log.Default())
 	deb.SetLogger(log.Default())
 	setup.SetLogger(log.Default())
 	slicer.SetLogger(log.Default())
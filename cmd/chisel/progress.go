@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressMeter shows the files being downloaded and how much of each
+// was fetched so far, on a single terminal line which is rewritten as
+// the downloads progress and cleared once they are done.
+type progressMeter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	names   []string
+	files   map[string]*fileProgress
+	shown   bool
+	shownAt time.Time
+}
+
+type fileProgress struct {
+	done  int64
+	total int64
+}
+
+const (
+	progressInterval = 100 * time.Millisecond
+	progressWidth    = 79
+)
+
+func newProgressMeter(w io.Writer) *progressMeter {
+	return &progressMeter{
+		w:     w,
+		files: make(map[string]*fileProgress),
+	}
+}
+
+// Update records the progress of a file, as defined by archive.Options.
+// Files are forgotten once fully fetched or once fetching them fails, so
+// that a retry is shown again from the progress it reports.
+func (m *progressMeter) Update(name string, done, total int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file := m.files[name]
+	if file == nil {
+		file = &fileProgress{}
+		m.files[name] = file
+		m.names = append(m.names, name)
+	}
+	file.done, file.total = done, total
+	if done == total {
+		delete(m.files, name)
+		for i, other := range m.names {
+			if other == name {
+				m.names = append(m.names[:i], m.names[i+1:]...)
+				break
+			}
+		}
+	} else if time.Since(m.shownAt) < progressInterval {
+		return
+	}
+	m.show()
+}
+
+// Clear removes the progress line from the terminal, if shown. It may be
+// called on a nil meter, which does nothing.
+func (m *progressMeter) Clear() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.shown {
+		fmt.Fprint(m.w, "\r\033[K")
+		m.shown = false
+	}
+}
+
+func (m *progressMeter) show() {
+	var parts []string
+	for _, name := range m.names {
+		file := m.files[name]
+		if file.total > 0 {
+			parts = append(parts, fmt.Sprintf("%s %s/%s", name, formatBytes(file.done), formatBytes(file.total)))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s %s", name, formatBytes(file.done)))
+		}
+	}
+	line := strings.Join(parts, ", ")
+	if len(line) > progressWidth {
+		line = line[:progressWidth-3] + "..."
+	}
+	fmt.Fprint(m.w, "\r\033[K"+line)
+	m.shown = line != ""
+	m.shownAt = time.Now()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, prefix := float64(n)/unit, "kMGT"
+	for value >= unit && len(prefix) > 1 {
+		value /= unit
+		prefix = prefix[1:]
+	}
+	return fmt.Sprintf("%.1f%cB", value, prefix[0])
+}
@@ -0,0 +1,48 @@
+package main_test
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+
+	chisel "github.com/canonical/chisel/cmd/chisel"
+)
+
+func (s *ChiselSuite) TestProgressMeter(c *C) {
+	var buf bytes.Buffer
+	meter := chisel.NewProgressMeter(&buf)
+
+	meter.Update("foo.deb", 1500, 3000000)
+	c.Assert(buf.String(), Equals, "\r\033[Kfoo.deb 1.5kB/3.0MB")
+
+	// Further updates are shown at most every so often.
+	buf.Reset()
+	meter.Update("bar.deb", 100, -1)
+	c.Assert(buf.String(), Equals, "")
+
+	// Finished files are removed right away.
+	meter.Update("foo.deb", 3000000, 3000000)
+	c.Assert(buf.String(), Equals, "\r\033[Kbar.deb 100B")
+
+	buf.Reset()
+	meter.Clear()
+	c.Assert(buf.String(), Equals, "\r\033[K")
+
+	buf.Reset()
+	meter.Clear()
+	c.Assert(buf.String(), Equals, "")
+
+	// Failed files are removed as well, as reported by the archive.
+	meter = chisel.NewProgressMeter(&buf)
+	meter.Update("foo.deb", 1500, 3000000)
+	c.Assert(buf.String(), Equals, "\r\033[Kfoo.deb 1.5kB/3.0MB")
+	buf.Reset()
+	meter.Update("foo.deb", 1500, 1500)
+	c.Assert(buf.String(), Equals, "\r\033[K")
+	buf.Reset()
+	meter.Clear()
+	c.Assert(buf.String(), Equals, "")
+
+	var nilMeter *chisel.ProgressMeter
+	nilMeter.Clear()
+}
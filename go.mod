@@ -3,6 +3,7 @@ module github.com/canonical/chisel
 go 1.18
 
 require (
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
 	gopkg.in/yaml.v3 v3.0.0-20220512140231-539c8e751b99
 )
@@ -17,6 +18,5 @@ require (
 	github.com/ulikunitz/xz v0.5.10 // indirect
 	go.starlark.net v0.0.0-20220328144851-d1966c6b9fcd // indirect
 	golang.org/x/crypto v0.0.0-20220518034528-6f7dac969898 // indirect
-	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1 // indirect
 )
@@ -2,36 +2,118 @@ package archive
 
 import (
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/openpgp/packet"
+
 	"github.com/canonical/chisel/internal/cache"
 	"github.com/canonical/chisel/internal/control"
 	"github.com/canonical/chisel/internal/deb"
+	"github.com/canonical/chisel/internal/jobs"
+	"github.com/canonical/chisel/internal/pgputil"
+	"github.com/canonical/chisel/internal/snapshot"
 )
 
 type Archive interface {
 	Options() *Options
 	Fetch(pkg string) (io.ReadCloser, error)
 	Exists(pkg string) bool
+	Info(pkg string) (*PackageInfo, error)
+
+	// Versions returns the details of all the versions of the package
+	// available in the archive, with the most recent version first.
+	Versions(pkg string) []*PackageInfo
+
+	// FetchPackage fetches the exact package described by info, which
+	// must have at least the Name, Filename, and SHA256 fields set.
+	FetchPackage(info *PackageInfo) (io.ReadCloser, error)
 }
 
+// PackageInfo holds the details about a package as found in the archive.
+type PackageInfo struct {
+	Name     string
+	Version  string
+	Arch     string
+	Filename string
+	SHA256   string
+	// Size is the size of the package file in bytes, if known.
+	Size int64
+}
+
+// Options holds the details for opening an archive. When URL is empty the
+// official Ubuntu archives are used. Otherwise, URL is the base location of
+// an APT repository for all architectures or, if PortsURL is also set, for
+// amd64 and i386 only, with PortsURL serving all other architectures. Both
+// may use the file:// scheme for repositories available on disk. When
+// PackagesDir is set, packages are instead obtained from the .deb files in
+// that directory, and all the other repository details are ignored.
 type Options struct {
-	Label      string
-	Version    string
-	Arch       string
-	Suites     []string
-	Components []string
-	CacheDir   string
+	Label       string
+	Version     string
+	Arch        string
+	Suites      []string
+	Components  []string
+	CacheDir    string
+	PubKeys     []*packet.PublicKey
+	URL         string
+	PortsURL    string
+	PackagesDir string
+
+	// Snapshot, if set, is a UTC timestamp such as 20240101T000000Z, and
+	// the archive is used as it was at that time, as kept by a snapshot
+	// service. The official Ubuntu and Debian archives are mapped to
+	// their snapshot services, while for other archives the URLs must
+	// point to a snapshot service, and the timestamp is appended to them.
+	Snapshot string
+
+	// Jobs is the maximum number of index files fetched concurrently
+	// when opening the archive, or one if unset.
+	Jobs int
+
+	// Timeout limits the time for fetching each file from the archive,
+	// or is 30 seconds if unset.
+	Timeout time.Duration
+
+	// Retries is the number of times fetching a file is retried after a
+	// network or server error, waiting longer after each attempt.
+	// Package files partially downloaded are resumed when retrying.
+	Retries int
+
+	// Client, if set, is used for the HTTP requests, such as for going
+	// through proxies or authenticating with the archive.
+	Client *http.Client
+
+	// Offline makes the archive be used only with the files previously
+	// fetched into the cache, without reaching the network.
+	Offline bool
+
+	// Cache, if set, is used for the files fetched instead of a cache
+	// in CacheDir.
+	Cache *cache.Cache
+
+	// Progress, if set, is called as files are downloaded from the
+	// archive with the number of bytes fetched so far and the total
+	// expected, or -1 if unknown. A final call is made with done equal
+	// to total once the file is fully fetched, and also when fetching it
+	// fails, in which case a retry reports its progress again from the
+	// start, or from where it resumed. It may be called concurrently for
+	// different files.
+	Progress func(name string, done, total int64)
 }
 
 func Open(options *Options) (Archive, error) {
-	if options.Label != "ubuntu" {
-		return nil, fmt.Errorf("non-ubuntu archives are not supported yet")
-	}
 	var err error
 	if options.Arch == "" {
 		options.Arch, err = deb.InferArch()
@@ -41,20 +123,32 @@ func Open(options *Options) (Archive, error) {
 	if err != nil {
 		return nil, err
 	}
+	if options.PackagesDir != "" {
+		return openLocal(options)
+	}
 	return openUbuntu(options)
 }
 
-var httpClient = &http.Client{
-	Timeout: 30 * time.Second,
+// Requests are limited by their own timeouts instead of the client's, as
+// these may be set per archive.
+var httpClient = &http.Client{}
+
+var httpDo = func(client *http.Client, req *http.Request) (*http.Response, error) {
+	return client.Do(req)
 }
 
-var httpDo = httpClient.Do
+const (
+	defaultTimeout = 30 * time.Second
+	maxRetryDelay  = 30 * time.Second
+)
+
+var retryDelay = time.Second
 
-var bulkClient = &http.Client{
-	Timeout: 5 * time.Minute,
-}
+var sleep = time.Sleep
+
+var errNotFound = fmt.Errorf("cannot find archive data")
 
-var bulkDo = bulkClient.Do
+var errNotCached = fmt.Errorf("cannot find archive data in cache for offline use")
 
 type ubuntuArchive struct {
 	options Options
@@ -64,13 +158,20 @@ type ubuntuArchive struct {
 
 type ubuntuIndex struct {
 	label     string
+	baseURL   string
 	version   string
 	arch      string
 	suite     string
 	component string
 	release   control.Section
 	packages  control.File
+	pubKeys   []*packet.PublicKey
 	cache     *cache.Cache
+	progress  func(name string, done, total int64)
+	timeout   time.Duration
+	retries   int
+	client    *http.Client
+	offline   bool
 }
 
 func (a *ubuntuArchive) Options() *Options {
@@ -82,6 +183,46 @@ func (a *ubuntuArchive) Exists(pkg string) bool {
 	return err == nil
 }
 
+func (a *ubuntuArchive) Info(pkg string) (*PackageInfo, error) {
+	section, _, err := a.selectPackage(pkg)
+	if err != nil {
+		return nil, err
+	}
+	return sectionInfo(section), nil
+}
+
+func (a *ubuntuArchive) Versions(pkg string) []*PackageInfo {
+	var infos []*PackageInfo
+	seen := make(map[string]bool)
+	for _, index := range a.indexes {
+		section := index.packages.Section(pkg)
+		if section == nil || section.Get("Filename") == "" {
+			continue
+		}
+		info := sectionInfo(section)
+		if !seen[info.Version] {
+			seen[info.Version] = true
+			infos = append(infos, info)
+		}
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return deb.CompareVersions(infos[i].Version, infos[j].Version) > 0
+	})
+	return infos
+}
+
+func sectionInfo(section control.Section) *PackageInfo {
+	size, _ := strconv.ParseInt(section.Get("Size"), 10, 64)
+	return &PackageInfo{
+		Name:     section.Get("Package"),
+		Version:  section.Get("Version"),
+		Arch:     section.Get("Architecture"),
+		Filename: section.Get("Filename"),
+		SHA256:   section.Get("SHA256"),
+		Size:     size,
+	}
+}
+
 func (a *ubuntuArchive) selectPackage(pkg string) (control.Section, *ubuntuIndex, error) {
 	var selectedVersion string
 	var selectedSection control.Section
@@ -104,13 +245,27 @@ func (a *ubuntuArchive) selectPackage(pkg string) (control.Section, *ubuntuIndex
 }
 
 func (a *ubuntuArchive) Fetch(pkg string) (io.ReadCloser, error) {
-	section, index, err := a.selectPackage(pkg)
+	info, err := a.Info(pkg)
 	if err != nil {
 		return nil, err
 	}
-	suffix := section.Get("Filename")
-	logf("Fetching %s...", suffix)
-	reader, err := index.fetch("../../"+suffix, section.Get("SHA256"))
+	return a.FetchPackage(info)
+}
+
+func (a *ubuntuArchive) FetchPackage(info *PackageInfo) (io.ReadCloser, error) {
+	if info.Filename == "" || info.SHA256 == "" {
+		return nil, fmt.Errorf("cannot fetch package %q without filename and digest", info.Name)
+	}
+	// Package files are found relative to the root of the archive, so
+	// any index may be used regardless of the suite listing the package.
+	logf("Fetching %s...", info.Filename)
+	reader, err := a.indexes[0].fetch(info.Filename, info.SHA256, info.Size)
+	if err == errNotFound {
+		return nil, fmt.Errorf("cannot find package %q file %s in archive", info.Name, info.Filename)
+	}
+	if err == errNotCached {
+		return nil, fmt.Errorf("cannot find package %q file %s in cache for offline use", info.Name, info.Filename)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -130,62 +285,136 @@ func openUbuntu(options *Options) (Archive, error) {
 	if len(options.Version) == 0 {
 		return nil, fmt.Errorf("archive options missing version")
 	}
+	if len(options.PubKeys) == 0 {
+		return nil, fmt.Errorf("archive options missing public keys")
+	}
+	if options.PortsURL != "" && options.URL == "" {
+		return nil, fmt.Errorf("archive options have ports URL but no URL")
+	}
+	if options.Snapshot != "" {
+		if _, err := snapshot.Parse(options.Snapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	baseURL, portsURL := options.URL, options.PortsURL
+	if baseURL == "" {
+		baseURL, portsURL = ubuntuURL, ubuntuPortsURL
+	}
+	if portsURL != "" && options.Arch != "amd64" && options.Arch != "i386" {
+		baseURL = portsURL
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	if options.Snapshot != "" {
+		baseURL = snapshotURL(baseURL, options.Snapshot)
+	}
 
 	archive := &ubuntuArchive{
 		options: *options,
-		cache: &cache.Cache{
-			Dir: options.CacheDir,
-		},
+		cache:   options.Cache,
+	}
+	if archive.cache == nil {
+		archive.cache = &cache.Cache{Dir: options.CacheDir}
 	}
 
+	client := options.Client
+	if client == nil {
+		client = httpClient
+	}
 	for _, suite := range options.Suites {
-		var release control.Section
 		for _, component := range options.Components {
-			index := &ubuntuIndex{
+			archive.indexes = append(archive.indexes, &ubuntuIndex{
 				label:     options.Label,
+				baseURL:   baseURL,
 				version:   options.Version,
 				arch:      options.Arch,
 				suite:     suite,
 				component: component,
-				release:   release,
+				pubKeys:   options.PubKeys,
 				cache:     archive.cache,
-			}
-			if release == nil {
-				err := index.fetchRelease()
-				if err != nil {
-					return nil, err
-				}
-				release = index.release
-				err = index.checkComponents(options.Components)
-				if err != nil {
-					return nil, err
-				}
-			}
-			err := index.fetchIndex()
-			if err != nil {
-				return nil, err
-			}
-			archive.indexes = append(archive.indexes, index)
+				progress:  options.Progress,
+				timeout:   options.Timeout,
+				retries:   options.Retries,
+				client:    client,
+				offline:   options.Offline,
+			})
 		}
 	}
 
+	// The release of each suite is fetched through its first index and
+	// shared with the others, and only then are the indexes fetched.
+	components := len(options.Components)
+	err := jobs.Run(options.Jobs, len(options.Suites), func(i int) error {
+		suiteIndexes := archive.indexes[i*components : (i+1)*components]
+		err := suiteIndexes[0].fetchRelease()
+		if err != nil {
+			return err
+		}
+		err = suiteIndexes[0].checkComponents(options.Components)
+		if err != nil {
+			return err
+		}
+		for _, index := range suiteIndexes[1:] {
+			index.release = suiteIndexes[0].release
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = jobs.Run(options.Jobs, len(archive.indexes), func(i int) error {
+		return archive.indexes[i].fetchIndex()
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return archive, nil
 }
 
+// snapshotURLs maps the locations of the official archives to the ones of
+// the snapshot services keeping their past states.
+var snapshotURLs = map[string]string{
+	"archive.ubuntu.com/ubuntu/":      "https://snapshot.ubuntu.com/ubuntu/",
+	"security.ubuntu.com/ubuntu/":     "https://snapshot.ubuntu.com/ubuntu/",
+	"ports.ubuntu.com/ubuntu-ports/":  "https://snapshot.ubuntu.com/ubuntu-ports/",
+	"deb.debian.org/debian/":          "https://snapshot.debian.org/archive/debian/",
+	"deb.debian.org/debian-security/": "https://snapshot.debian.org/archive/debian-security/",
+}
+
+// snapshotURL returns the location of the archive at baseURL as it was at
+// the time of snapshot. Both the given and returned URLs end with a slash.
+func snapshotURL(baseURL, snapshot string) string {
+	location := baseURL
+	for _, scheme := range []string{"http://", "https://"} {
+		location = strings.TrimPrefix(location, scheme)
+	}
+	if serviceURL, ok := snapshotURLs[location]; ok {
+		baseURL = serviceURL
+	}
+	return baseURL + snapshot + "/"
+}
+
 func (index *ubuntuIndex) fetchRelease() error {
 	logf("Fetching %s %s %s suite details...", index.label, index.version, index.suite)
-	reader, err := index.fetch("Release", "")
+	body, err := index.fetchInRelease()
+	if err == errNotFound || err == errNotCached {
+		body, err = index.fetchSignedRelease()
+	}
+	if err == errNotCached {
+		return fmt.Errorf("cannot find %s %s %s suite details in cache for offline use", index.label, index.version, index.suite)
+	}
 	if err != nil {
 		return err
 	}
 
-	ctrl, err := control.ParseReader("Label", reader)
-	if err != nil {
-		return fmt.Errorf("parsing archive Release file: %v", err)
-	}
-	section := ctrl.Section("Ubuntu")
-	if section == nil {
-		return fmt.Errorf("corrupted archive Release file: no Ubuntu section")
+	// Release files hold a single section, and the Label field keying it
+	// varies across distributions and mirrors or may be missing entirely.
+	section := control.ParseSection(string(body))
+	if section.Get("Components") == "" {
+		return fmt.Errorf("corrupted archive Release file: no components")
 	}
 	logf("Release date: %s", section.Get("Date"))
 
@@ -193,6 +422,67 @@ func (index *ubuntuIndex) fetchRelease() error {
 	return nil
 }
 
+// fetchInRelease fetches the clearsigned InRelease file and returns its
+// content after verifying that at least one of its signatures was made by
+// one of the archive public keys. This is in line with what apt does, and
+// unlike gpg --verify which requires all signatures to be valid.
+func (index *ubuntuIndex) fetchInRelease() ([]byte, error) {
+	data, err := index.fetchAll("InRelease")
+	if err != nil {
+		return nil, err
+	}
+	sigs, body, canonicalBody, err := pgputil.DecodeClearSigned(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode clearsigned InRelease file: %v", err)
+	}
+	err = pgputil.VerifyAnySignature(index.pubKeys, sigs, canonicalBody)
+	if err != nil {
+		return nil, fmt.Errorf("cannot verify signature of the InRelease file")
+	}
+	return body, nil
+}
+
+// fetchSignedRelease fetches the Release file together with its detached
+// Release.gpg signature, for archives that do not provide InRelease.
+func (index *ubuntuIndex) fetchSignedRelease() ([]byte, error) {
+	body, err := index.fetchAll("Release")
+	if err != nil {
+		return nil, err
+	}
+	sigData, err := index.fetchAll("Release.gpg")
+	if err == errNotFound {
+		return nil, fmt.Errorf("cannot find signature of the Release file")
+	} else if err != nil {
+		return nil, err
+	}
+	sigs, err := pgputil.DecodeSignatures(sigData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode Release.gpg signature file: %v", err)
+	}
+	err = pgputil.VerifyAnySignature(index.pubKeys, sigs, body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot verify signature of the Release file")
+	}
+	return body, nil
+}
+
+func (index *ubuntuIndex) fetchAll(suffix string) ([]byte, error) {
+	reader, err := index.fetch(suffix, "", -1)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read archive %s file: %v", suffix, err)
+	}
+	return data, nil
+}
+
+// indexExts lists the extensions of the compressed variants of the
+// package index, in order of preference.
+var indexExts = []string{".xz", ".zst", ".gz", ""}
+
 func (index *ubuntuIndex) fetchIndex() error {
 	digests := index.release.Get("SHA256")
 	packagesPath := fmt.Sprintf("%s/binary-%s/Packages", index.component, index.arch)
@@ -202,10 +492,17 @@ func (index *ubuntuIndex) fetchIndex() error {
 	}
 
 	logf("Fetching index for %s %s %s %s component...", index.label, index.version, index.suite, index.component)
-	reader, err := index.fetch(packagesPath+".gz", digest)
+	reader, err := index.cache.Open(digest)
+	if err == cache.MissErr {
+		if index.offline {
+			return fmt.Errorf("cannot find index for %s %s %s %s component in cache for offline use", index.label, index.version, index.suite, index.component)
+		}
+		reader, err = index.fetchIndexFile(packagesPath, digest)
+	}
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
 	ctrl, err := control.ParseReader("Package", reader)
 	if err != nil {
 		return fmt.Errorf("parsing archive Package file: %v", err)
@@ -215,6 +512,39 @@ func (index *ubuntuIndex) fetchIndex() error {
 	return nil
 }
 
+// fetchIndexFile fetches the most compressed variant of the index file at
+// packagesPath listed in the Release file. When the archive supports it,
+// the file is fetched by its hash, which is immutable and so cannot change
+// while the archive is being updated, falling back to its usual location.
+// In either case the content is verified against the digest of the
+// uncompressed file.
+func (index *ubuntuIndex) fetchIndexFile(packagesPath, digest string) (io.ReadCloser, error) {
+	digests := index.release.Get("SHA256")
+	byHash := index.release.Get("Acquire-By-Hash") == "yes"
+	err := errNotFound
+	for _, ext := range indexExts {
+		suffix := packagesPath + ext
+		fileDigest, size, ok := control.ParsePathInfo(digests, suffix)
+		if !ok {
+			continue
+		}
+		name := index.suite + "/" + suffix
+		if byHash {
+			hashURL := index.baseURL + "dists/" + index.suite + "/" + path.Dir(suffix) + "/by-hash/SHA256/" + fileDigest
+			reader, err := index.fetchURL(hashURL, name, suffix, digest, int64(size))
+			if err != errNotFound {
+				return reader, err
+			}
+		}
+		var reader io.ReadCloser
+		reader, err = index.fetchURL(index.baseURL+"dists/"+index.suite+"/"+suffix, name, suffix, digest, int64(size))
+		if err != errNotFound {
+			return reader, err
+		}
+	}
+	return nil, err
+}
+
 func (index *ubuntuIndex) checkComponents(components []string) error {
 	releaseComponents := strings.Fields(index.release.Get("Components"))
 	for _, c1 := range components {
@@ -232,65 +562,287 @@ func (index *ubuntuIndex) checkComponents(components []string) error {
 	return nil
 }
 
-func (index *ubuntuIndex) fetch(suffix, digest string) (io.ReadCloser, error) {
+// fetch fetches the file at suffix, from the cache if it has the content
+// with the given digest. Files without a digest, such as the Release
+// files, are always downloaded, except in offline mode, where the content
+// last downloaded from the same location is used instead.
+func (index *ubuntuIndex) fetch(suffix, digest string, size int64) (io.ReadCloser, error) {
+	var url, name string
+	if strings.HasPrefix(suffix, "pool/") {
+		url = index.baseURL + suffix
+		name = path.Base(suffix)
+	} else {
+		url = index.baseURL + "dists/" + index.suite + "/" + suffix
+		name = index.suite + "/" + suffix
+	}
+
+	var err error
+	if digest == "" && index.offline {
+		digest, err = index.cache.Ref(url)
+		if err == cache.MissErr {
+			return nil, errNotCached
+		} else if err != nil {
+			return nil, err
+		}
+	}
 	reader, err := index.cache.Open(digest)
 	if err == nil {
 		return reader, nil
 	} else if err != cache.MissErr {
 		return nil, err
 	}
+	if index.offline {
+		return nil, errNotCached
+	}
+	return index.fetchURL(url, name, suffix, digest, size)
+}
 
-	baseURL := ubuntuURL
-	if index.arch != "amd64" && index.arch != "i386" {
-		baseURL = ubuntuPortsURL
+// fetchURL downloads the file at url, retrying on temporary failures. The
+// name identifies the file in logs and progress reports, and suffix is the
+// path of the file within the archive, which defines how it is compressed.
+func (index *ubuntuIndex) fetchURL(url, name, suffix, digest string, size int64) (io.ReadCloser, error) {
+	for attempt := 0; ; attempt++ {
+		reader, err := index.download(url, name, suffix, digest, size)
+		if err == nil {
+			return reader, nil
+		}
+		if _, ok := err.(*temporaryError); !ok || attempt >= index.retries {
+			return nil, err
+		}
+		delay := retryDelay << attempt
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+		logf("Cannot fetch %s, retrying in %v: %v", name, delay, err)
+		sleep(delay)
 	}
+}
 
-	var url string
-	if strings.HasPrefix(suffix, "pool/") {
-		url = baseURL + suffix
+// download fetches the file at url into the cache and returns it from
+// there. Package files partially downloaded are kept in the cache so that
+// a later attempt may continue from where this one stopped.
+func (index *ubuntuIndex) download(url, name, suffix, digest string, size int64) (io.ReadCloser, error) {
+	resume := digest != "" && strings.HasPrefix(suffix, "pool/")
+	var writer *cache.Writer
+	if resume {
+		writer = index.cache.Resume(digest)
 	} else {
-		url = baseURL + "dists/" + index.suite + "/" + suffix
+		writer = index.cache.Create(digest)
 	}
+	defer writer.Close()
 
-	req, err := http.NewRequest("GET", url, nil)
+	body, resumed, err := openURL(index.client, url, writer.Offset(), index.timeout)
 	if err != nil {
-		return nil, fmt.Errorf("cannot create HTTP request: %v", err)
+		if writer.Offset() > 0 {
+			writer.Suspend()
+		}
+		return nil, err
 	}
-	resp, err := httpDo(req)
-	if err != nil {
-		return nil, fmt.Errorf("cannot talk to archive: %v", err)
+	defer body.Close()
+	if !resumed && writer.Offset() > 0 {
+		err = writer.Reset()
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch from archive: %v", err)
+		}
 	}
-	defer resp.Body.Close()
 
-	switch resp.StatusCode {
-	case 200:
-		// ok
-	case 401, 404:
-		return nil, fmt.Errorf("cannot find archive data")
-	default:
-		return nil, fmt.Errorf("error from archive: %v", resp.Status)
+	if index.progress != nil {
+		reader := &progressReader{
+			ReadCloser: body,
+			name:       name,
+			done:       writer.Offset(),
+			total:      size,
+			progress:   index.progress,
+		}
+		defer reader.end()
+		body = reader
 	}
 
-	body := resp.Body
 	if strings.HasSuffix(suffix, ".gz") {
 		reader, err := gzip.NewReader(body)
 		if err != nil {
-			return nil, fmt.Errorf("cannot decompress data: %v", err)
+			return nil, &temporaryError{fmt.Errorf("cannot decompress data: %v", err)}
 		}
 		defer reader.Close()
 		body = reader
+	} else if strings.HasSuffix(suffix, ".xz") {
+		reader, err := xz.NewReader(body)
+		if err != nil {
+			return nil, &temporaryError{fmt.Errorf("cannot decompress data: %v", err)}
+		}
+		body = ioutil.NopCloser(reader)
+	} else if strings.HasSuffix(suffix, ".zst") {
+		reader, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, &temporaryError{fmt.Errorf("cannot decompress data: %v", err)}
+		}
+		defer reader.Close()
+		body = ioutil.NopCloser(reader)
 	}
 
-	writer := index.cache.Create(digest)
-	defer writer.Close()
-
 	_, err = io.Copy(writer, body)
+	if err != nil && resume {
+		writer.Suspend()
+	}
 	if err == nil {
 		err = writer.Close()
 	}
 	if err != nil {
-		return nil, fmt.Errorf("cannot fetch from archive: %v", err)
+		// Interrupted or corrupted transfers may succeed when retried.
+		return nil, &temporaryError{fmt.Errorf("cannot fetch from archive: %v", err)}
 	}
 
+	if digest == "" {
+		// Remember where the content came from for offline use.
+		err = index.cache.SetRef(url, writer.Digest())
+		if err != nil {
+			return nil, err
+		}
+	}
 	return index.cache.Open(writer.Digest())
 }
+
+// temporaryError is a failure to fetch from the archive which may not
+// happen again when retrying, such as a network or server error.
+type temporaryError struct {
+	err error
+}
+
+func (e *temporaryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *temporaryError) Unwrap() error {
+	return e.err
+}
+
+// progressReader reports the progress of reading a file being fetched.
+type progressReader struct {
+	io.ReadCloser
+	name     string
+	done     int64
+	total    int64
+	progress func(name string, done, total int64)
+	ended    bool
+}
+
+func (r *progressReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.done += int64(n)
+	if err == io.EOF {
+		r.end()
+	} else if n > 0 {
+		r.progress(r.name, r.done, r.total)
+	}
+	return n, err
+}
+
+// end makes the final progress report, if not yet made, so that a file
+// which failed to be fetched is not reported as still in progress.
+func (r *progressReader) end() {
+	if !r.ended {
+		r.ended = true
+		r.progress(r.name, r.done, r.done)
+	}
+}
+
+// openURL opens the file at url for reading from offset onwards, and
+// reports whether it was resumed from there. Otherwise it is read from the
+// start. HTTP requests are made with client and, including reading the
+// response, are limited to the given timeout.
+func openURL(client *http.Client, url string, offset int64, timeout time.Duration) (body io.ReadCloser, resumed bool, err error) {
+	if strings.HasPrefix(url, "file://") {
+		file, err := os.Open(strings.TrimPrefix(url, "file://"))
+		if os.IsNotExist(err) {
+			return nil, false, errNotFound
+		} else if err != nil {
+			return nil, false, fmt.Errorf("cannot read from archive: %v", err)
+		}
+		if offset > 0 {
+			_, err = file.Seek(offset, io.SeekStart)
+			if err != nil {
+				file.Close()
+				return nil, false, fmt.Errorf("cannot read from archive: %v", err)
+			}
+		}
+		return file, offset > 0, nil
+	}
+
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		cancel()
+		return nil, false, fmt.Errorf("cannot create HTTP request: %v", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := httpDo(client, req)
+	if err != nil {
+		cancel()
+		return nil, false, &temporaryError{fmt.Errorf("cannot talk to archive: %v", err)}
+	}
+	body = &cancelBody{resp.Body, cancel}
+
+	switch resp.StatusCode {
+	case 200:
+		return body, false, nil
+	case 206:
+		if offset > 0 {
+			if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); ok && start == offset {
+				return body, true, nil
+			}
+			// The partial content is not the one requested, so start over.
+			body.Close()
+			return openURL(client, url, 0, timeout)
+		}
+	case 404:
+		body.Close()
+		return nil, false, errNotFound
+	case 401, 403:
+		// Other locations in the same archive would be refused as well.
+		body.Close()
+		return nil, false, fmt.Errorf("cannot authenticate with archive at %s: %v", url, resp.Status)
+	case 416:
+		// The partial content is no longer valid, so start over.
+		body.Close()
+		if offset > 0 {
+			return openURL(client, url, 0, timeout)
+		}
+	case 408, 429, 500, 502, 503, 504:
+		body.Close()
+		return nil, false, &temporaryError{fmt.Errorf("error from archive: %v", resp.Status)}
+	}
+	body.Close()
+	return nil, false, fmt.Errorf("error from archive: %v", resp.Status)
+}
+
+// contentRangeStart returns the position of the first byte in the value
+// of a Content-Range header, such as "bytes 100-199/200".
+func contentRangeStart(value string) (int64, bool) {
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, false
+	}
+	value = strings.TrimPrefix(value, "bytes ")
+	i := strings.IndexByte(value, '-')
+	if i < 0 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(value[:i], 10, 64)
+	return start, err == nil
+}
+
+// cancelBody releases the context of a request once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
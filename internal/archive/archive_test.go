@@ -3,6 +3,8 @@ package archive_test
 import (
 	. "gopkg.in/check.v1"
 
+	"bytes"
+	"crypto/sha256"
 	"debug/elf"
 	"errors"
 	"flag"
@@ -10,17 +12,28 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"path"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp/packet"
 
 	"github.com/canonical/chisel/internal/archive"
 	"github.com/canonical/chisel/internal/archive/testarchive"
+	"github.com/canonical/chisel/internal/cache"
 	"github.com/canonical/chisel/internal/deb"
+	"github.com/canonical/chisel/internal/netconf"
+	"github.com/canonical/chisel/internal/pgputil"
+	"github.com/canonical/chisel/internal/testutil"
 )
 
 type httpSuite struct {
+	mu        sync.Mutex
 	logf      func(string, ...interface{})
 	base      string
 	request   *http.Request
@@ -57,21 +70,33 @@ func (s *httpSuite) Do(req *http.Request) (*http.Response, error) {
 		return nil, fmt.Errorf("test expected base %q, got %q", s.base, req.URL.String())
 	}
 
+	// Archives may fetch files concurrently.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.request = req
 	s.requests = append(s.requests, req)
 	body := s.response
+	status := s.status
 	s.logf("Request: %s", req.URL.String())
 	if response, ok := s.responses[path.Clean(req.URL.Path)]; ok {
 		body = string(response)
+	} else if body == "" {
+		status = 404
 	}
 	rsp := &http.Response{
 		Body:       ioutil.NopCloser(strings.NewReader(body)),
 		Header:     s.header,
-		StatusCode: s.status,
+		StatusCode: status,
 	}
 	return rsp, s.err
 }
 
+var (
+	key1 = testutil.PGPKeys["key1"]
+	key2 = testutil.PGPKeys["key2"]
+)
+
 func (s *httpSuite) TestDoError(c *C) {
 	s.err = errors.New("BAM")
 
@@ -82,6 +107,7 @@ func (s *httpSuite) TestDoError(c *C) {
 		Suites:     []string{"jammy"},
 		Components: []string{"main"},
 		CacheDir:   c.MkDir(),
+		PubKeys:    key1.PubKeys,
 	}
 
 	_, err := archive.Open(&options)
@@ -92,6 +118,7 @@ func (s *httpSuite) prepareArchive(suite, version, arch string, components []str
 	release := &testarchive.Release{
 		Suite:   suite,
 		Version: version,
+		PrivKey: key1.PrivKey,
 	}
 	for i, component := range components {
 		index := &testarchive.PackageIndex{
@@ -108,7 +135,7 @@ func (s *httpSuite) prepareArchive(suite, version, arch string, components []str
 			})
 		}
 		release.Items = append(release.Items, index)
-		release.Items = append(release.Items, &testarchive.Gzip{index})
+		release.Items = append(release.Items, &testarchive.Gzip{Item: index})
 	}
 	base, err := url.Parse(s.base)
 	if err != nil {
@@ -130,14 +157,16 @@ var optionErrorTests = []optionErrorTest{{
 		Arch:       "amd64",
 		Suites:     []string{"jammy"},
 		Components: []string{"main", "other"},
+		PubKeys:    key1.PubKeys,
 	},
 	error: `archive has no component "other"`,
 }, {
 	options: archive.Options{
-		Label:    "ubuntu",
-		Version:  "22.04",
-		Arch:     "amd64",
-		Suites:     []string{"jammy"},
+		Label:   "ubuntu",
+		Version: "22.04",
+		Arch:    "amd64",
+		Suites:  []string{"jammy"},
+		PubKeys: key1.PubKeys,
 	},
 	error: "archive options missing components",
 }, {
@@ -146,8 +175,18 @@ var optionErrorTests = []optionErrorTest{{
 		Version:    "22.04",
 		Arch:       "amd64",
 		Components: []string{"main", "other"},
+		PubKeys:    key1.PubKeys,
 	},
 	error: `archive options missing suites`,
+}, {
+	options: archive.Options{
+		Label:      "ubuntu",
+		Version:    "22.04",
+		Arch:       "amd64",
+		Suites:     []string{"jammy"},
+		Components: []string{"main", "other"},
+	},
+	error: `archive options missing public keys`,
 }, {
 	options: archive.Options{
 		Label:      "ubuntu",
@@ -155,8 +194,31 @@ var optionErrorTests = []optionErrorTest{{
 		Arch:       "foo",
 		Suites:     []string{"jammy"},
 		Components: []string{"main", "other"},
+		PubKeys:    key1.PubKeys,
 	},
 	error: `invalid package architecture: foo`,
+}, {
+	options: archive.Options{
+		Label:      "ubuntu",
+		Version:    "22.04",
+		Arch:       "amd64",
+		Suites:     []string{"jammy"},
+		Components: []string{"main", "other"},
+		PubKeys:    key1.PubKeys,
+		PortsURL:   "http://ports.example.com/ubuntu-ports/",
+	},
+	error: `archive options have ports URL but no URL`,
+}, {
+	options: archive.Options{
+		Label:      "ubuntu",
+		Version:    "22.04",
+		Arch:       "amd64",
+		Suites:     []string{"jammy"},
+		Components: []string{"main"},
+		PubKeys:    key1.PubKeys,
+		Snapshot:   "2024-01-01",
+	},
+	error: `invalid snapshot timestamp: "2024-01-01"`,
 }}
 
 func (s *httpSuite) TestOptionErrors(c *C) {
@@ -180,6 +242,7 @@ func (s *httpSuite) TestFetchPackage(c *C) {
 		Suites:     []string{"jammy"},
 		Components: []string{"main", "universe"},
 		CacheDir:   c.MkDir(),
+		PubKeys:    key1.PubKeys,
 	}
 
 	archive, err := archive.Open(&options)
@@ -196,6 +259,251 @@ func (s *httpSuite) TestFetchPackage(c *C) {
 	c.Assert(read(pkg), Equals, "mypkg4 1.4 data")
 }
 
+func (s *httpSuite) TestFetchProgress(c *C) {
+
+	s.prepareArchive("jammy", "22.04", "amd64", []string{"main", "universe"})
+
+	var mu sync.Mutex
+	progress := make(map[string][]int64)
+	options := archive.Options{
+		Label:      "ubuntu",
+		Version:    "22.04",
+		Arch:       "amd64",
+		Suites:     []string{"jammy"},
+		Components: []string{"main", "universe"},
+		CacheDir:   c.MkDir(),
+		PubKeys:    key1.PubKeys,
+		Jobs:       2,
+		Progress: func(name string, done, total int64) {
+			mu.Lock()
+			progress[name] = append(progress[name], done, total)
+			mu.Unlock()
+		},
+	}
+
+	archive, err := archive.Open(&options)
+	c.Assert(err, IsNil)
+
+	pkg, err := archive.Fetch("mypkg1")
+	c.Assert(err, IsNil)
+	c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+
+	// Cached content is not fetched again.
+	pkg, err = archive.Fetch("mypkg1")
+	c.Assert(err, IsNil)
+	c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+
+	c.Assert(progress, HasLen, 4)
+	for name, calls := range progress {
+		c.Assert(len(calls) >= 2, Equals, true, Commentf("%s", name))
+		done, total := calls[len(calls)-2], calls[len(calls)-1]
+		c.Assert(done, Equals, total, Commentf("%s", name))
+	}
+	size := int64(len("mypkg1 1.1 data"))
+	c.Assert(progress["mypkg1_1.1ubuntu1_amd64.deb"], DeepEquals, []int64{size, size, size, size})
+	c.Assert(progress["jammy/InRelease"], NotNil)
+	c.Assert(progress["jammy/main/binary-amd64/Packages.gz"], NotNil)
+	c.Assert(progress["jammy/universe/binary-amd64/Packages.gz"], NotNil)
+}
+
+type truncatedReader struct {
+	data []byte
+}
+
+func (r *truncatedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (s *httpSuite) TestFetchRetry(c *C) {
+
+	s.prepareArchive("jammy", "22.04", "amd64", []string{"main"})
+
+	var delays []time.Duration
+	restore := archive.FakeSleep(func(d time.Duration) {
+		delays = append(delays, d)
+	})
+	defer restore()
+
+	const pkgPath = "/ubuntu/pool/main/m/mypkg1/mypkg1_1.1ubuntu1_amd64.deb"
+	pkgData := s.responses[pkgPath]
+	var ranges []string
+	var deadlines []time.Duration
+	var progress []int64
+	failures := map[string]int{
+		"/ubuntu/dists/jammy/InRelease": 2,
+		pkgPath:                         1,
+	}
+	restore = archive.FakeDo(func(req *http.Request) (*http.Response, error) {
+		deadline, ok := req.Context().Deadline()
+		c.Assert(ok, Equals, true)
+		deadlines = append(deadlines, time.Until(deadline))
+		if req.URL.Path == pkgPath {
+			ranges = append(ranges, req.Header.Get("Range"))
+		}
+		if failures[req.URL.Path] > 0 {
+			failures[req.URL.Path]--
+			if req.URL.Path == pkgPath {
+				// Send only the first few bytes.
+				return &http.Response{
+					Body:       ioutil.NopCloser(&truncatedReader{pkgData[:5]}),
+					StatusCode: 200,
+				}, nil
+			}
+			return &http.Response{
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+				Status:     "503 Service Unavailable",
+				StatusCode: 503,
+			}, nil
+		}
+		if req.Header.Get("Range") == "bytes=5-" {
+			return &http.Response{
+				Body:       ioutil.NopCloser(bytes.NewReader(pkgData[5:])),
+				StatusCode: 206,
+				Header:     http.Header{"Content-Range": {fmt.Sprintf("bytes 5-%d/%d", len(pkgData)-1, len(pkgData))}},
+			}, nil
+		}
+		return s.Do(req)
+	})
+	defer restore()
+
+	options := archive.Options{
+		Label:      "ubuntu",
+		Version:    "22.04",
+		Arch:       "amd64",
+		Suites:     []string{"jammy"},
+		Components: []string{"main"},
+		CacheDir:   c.MkDir(),
+		PubKeys:    key1.PubKeys,
+		Timeout:    time.Hour,
+		Retries:    2,
+		Progress: func(name string, done, total int64) {
+			if name == "mypkg1_1.1ubuntu1_amd64.deb" {
+				progress = append(progress, done, total)
+			}
+		},
+	}
+
+	archive, err := archive.Open(&options)
+	c.Assert(err, IsNil)
+
+	pkg, err := archive.Fetch("mypkg1")
+	c.Assert(err, IsNil)
+	c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+
+	// The failed attempt is reported as ended, and the retry continues
+	// from where it stopped.
+	size := int64(len(pkgData))
+	c.Assert(progress, DeepEquals, []int64{5, size, 5, 5, size, size, size, size})
+
+	c.Assert(delays, DeepEquals, []time.Duration{time.Second, 2 * time.Second, time.Second})
+	c.Assert(ranges, DeepEquals, []string{"", "bytes=5-"})
+	for _, timeout := range deadlines {
+		c.Assert(timeout > 59*time.Minute && timeout <= time.Hour, Equals, true)
+	}
+}
+
+func (s *httpSuite) TestFetchResumeRangeMismatch(c *C) {
+
+	s.prepareArchive("jammy", "22.04", "amd64", []string{"main"})
+
+	restore := archive.FakeSleep(func(d time.Duration) {})
+	defer restore()
+
+	const pkgPath = "/ubuntu/pool/main/m/mypkg1/mypkg1_1.1ubuntu1_amd64.deb"
+	pkgData := s.responses[pkgPath]
+	var ranges []string
+	truncated := false
+	restore = archive.FakeDo(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != pkgPath {
+			return s.Do(req)
+		}
+		ranges = append(ranges, req.Header.Get("Range"))
+		if !truncated {
+			truncated = true
+			return &http.Response{
+				Body:       ioutil.NopCloser(&truncatedReader{pkgData[:5]}),
+				StatusCode: 200,
+			}, nil
+		}
+		if req.Header.Get("Range") != "" {
+			// The range requested is ignored.
+			return &http.Response{
+				Body:       ioutil.NopCloser(bytes.NewReader(pkgData)),
+				StatusCode: 206,
+				Header:     http.Header{"Content-Range": {fmt.Sprintf("bytes 0-%d/%d", len(pkgData)-1, len(pkgData))}},
+			}, nil
+		}
+		return s.Do(req)
+	})
+	defer restore()
+
+	options := archive.Options{
+		Label:      "ubuntu",
+		Version:    "22.04",
+		Arch:       "amd64",
+		Suites:     []string{"jammy"},
+		Components: []string{"main"},
+		CacheDir:   c.MkDir(),
+		PubKeys:    key1.PubKeys,
+		Retries:    1,
+	}
+
+	archive, err := archive.Open(&options)
+	c.Assert(err, IsNil)
+
+	pkg, err := archive.Fetch("mypkg1")
+	c.Assert(err, IsNil)
+	c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+	c.Assert(ranges, DeepEquals, []string{"", "bytes=5-", ""})
+}
+
+func (s *httpSuite) TestFetchRetryFailure(c *C) {
+
+	s.prepareArchive("jammy", "22.04", "amd64", []string{"main"})
+
+	restore := archive.FakeSleep(func(d time.Duration) {})
+	defer restore()
+
+	options := archive.Options{
+		Label:      "ubuntu",
+		Version:    "22.04",
+		Arch:       "amd64",
+		Suites:     []string{"jammy"},
+		Components: []string{"main"},
+		CacheDir:   c.MkDir(),
+		PubKeys:    key1.PubKeys,
+		Retries:    3,
+	}
+
+	s.status = 502
+	s.response = "bad gateway"
+	_, err := archive.Open(&options)
+	c.Assert(err, ErrorMatches, "error from archive: .*")
+	c.Assert(s.requests, HasLen, 4)
+
+	// Other errors are not retried.
+	s.requests = nil
+	s.status = 400
+	_, err = archive.Open(&options)
+	c.Assert(err, ErrorMatches, "error from archive: .*")
+	c.Assert(s.requests, HasLen, 1)
+
+	// Neither are authentication errors, which are not taken as missing
+	// data either, so no other locations are tried.
+	for _, status := range []int{401, 403} {
+		s.requests = nil
+		s.status = status
+		_, err = archive.Open(&options)
+		c.Assert(err, ErrorMatches, "cannot authenticate with archive at http://archive.ubuntu.com/ubuntu/dists/jammy/InRelease: .*")
+		c.Assert(s.requests, HasLen, 1)
+	}
+}
+
 func (s *httpSuite) TestFetchPortsPackage(c *C) {
 
 	s.base = "http://ports.ubuntu.com/ubuntu-ports/"
@@ -209,6 +517,7 @@ func (s *httpSuite) TestFetchPortsPackage(c *C) {
 		Suites:     []string{"jammy"},
 		Components: []string{"main", "universe"},
 		CacheDir:   c.MkDir(),
+		PubKeys:    key1.PubKeys,
 	}
 
 	archive, err := archive.Open(&options)
@@ -246,6 +555,7 @@ func (s *httpSuite) TestFetchSecurityPackage(c *C) {
 		Arch:       "amd64",
 		Suites:     []string{"jammy", "jammy-security", "jammy-updates"},
 		Components: []string{"main", "universe"},
+		PubKeys:    key1.PubKeys,
 	}
 
 	archive, err := archive.Open(&options)
@@ -260,6 +570,650 @@ func (s *httpSuite) TestFetchSecurityPackage(c *C) {
 	c.Assert(read(pkg), Equals, "mypkg2 1.2 data")
 }
 
+func (s *httpSuite) TestFetchFromURL(c *C) {
+
+	s.base = "http://mirror.example.com/debian/"
+
+	release := &testarchive.Release{
+		Label:   "Debian",
+		Suite:   "bookworm",
+		Version: "12",
+		PrivKey: key1.PrivKey,
+	}
+	index := &testarchive.PackageIndex{
+		Component: "main",
+		Arch:      "arm64",
+		Packages: []testarchive.Item{&testarchive.Package{
+			Name:      "mypkg1",
+			Version:   "1.1",
+			Arch:      "arm64",
+			Component: "main",
+		}},
+	}
+	release.Items = append(release.Items, index, &testarchive.Gzip{Item: index})
+	release.Render("/debian", s.responses)
+
+	options := archive.Options{
+		Label:      "debian",
+		Version:    "12",
+		Arch:       "arm64",
+		Suites:     []string{"bookworm"},
+		Components: []string{"main"},
+		CacheDir:   c.MkDir(),
+		PubKeys:    key1.PubKeys,
+		URL:        "http://mirror.example.com/debian",
+	}
+
+	archive, err := archive.Open(&options)
+	c.Assert(err, IsNil)
+
+	pkg, err := archive.Fetch("mypkg1")
+	c.Assert(err, IsNil)
+	c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+}
+
+type indexVariantTest struct {
+	summary  string
+	exts     []string
+	byHash   bool
+	noByHash bool
+	requests []string
+}
+
+var indexVariantTests = []indexVariantTest{{
+	summary:  "Gzip index",
+	exts:     []string{"", ".gz"},
+	requests: []string{"/ubuntu/dists/jammy/main/binary-amd64/Packages.gz"},
+}, {
+	summary:  "Uncompressed index only",
+	exts:     []string{""},
+	requests: []string{"/ubuntu/dists/jammy/main/binary-amd64/Packages"},
+}, {
+	summary:  "Xz index is preferred",
+	exts:     []string{"", ".gz", ".xz", ".zst"},
+	requests: []string{"/ubuntu/dists/jammy/main/binary-amd64/Packages.xz"},
+}, {
+	summary:  "Zstd index is preferred over gzip",
+	exts:     []string{"", ".gz", ".zst"},
+	requests: []string{"/ubuntu/dists/jammy/main/binary-amd64/Packages.zst"},
+}, {
+	summary:  "Index fetched by hash",
+	exts:     []string{"", ".gz", ".xz"},
+	byHash:   true,
+	requests: []string{"/ubuntu/dists/jammy/main/binary-amd64/by-hash/SHA256/[0-9a-f]{64}"},
+}, {
+	summary:  "Index fetched by hash falls back to usual location",
+	exts:     []string{"", ".xz"},
+	byHash:   true,
+	noByHash: true,
+	requests: []string{
+		"/ubuntu/dists/jammy/main/binary-amd64/by-hash/SHA256/[0-9a-f]{64}",
+		"/ubuntu/dists/jammy/main/binary-amd64/Packages.xz",
+	},
+}}
+
+func (s *httpSuite) TestFetchIndexVariants(c *C) {
+	for _, test := range indexVariantTests {
+		c.Logf("Summary: %s", test.summary)
+
+		s.responses = make(map[string][]byte)
+		s.requests = nil
+
+		release := &testarchive.Release{
+			Suite:         "jammy",
+			Version:       "22.04",
+			PrivKey:       key1.PrivKey,
+			AcquireByHash: test.byHash,
+		}
+		index := &testarchive.PackageIndex{
+			Component: "main",
+			Arch:      "amd64",
+			Packages: []testarchive.Item{&testarchive.Package{
+				Name:      "mypkg1",
+				Version:   "1.1",
+				Arch:      "amd64",
+				Component: "main",
+			}},
+		}
+		for _, ext := range test.exts {
+			switch ext {
+			case "":
+				release.Items = append(release.Items, index)
+			case ".gz":
+				release.Items = append(release.Items, &testarchive.Gzip{Item: index})
+			case ".xz":
+				release.Items = append(release.Items, &testarchive.Xz{Item: index})
+			case ".zst":
+				release.Items = append(release.Items, &testarchive.Zstd{Item: index})
+			}
+		}
+		release.Render("/ubuntu", s.responses)
+		if test.noByHash {
+			for path := range s.responses {
+				if strings.Contains(path, "/by-hash/") {
+					delete(s.responses, path)
+				}
+			}
+		}
+
+		options := archive.Options{
+			Label:      "ubuntu",
+			Version:    "22.04",
+			Arch:       "amd64",
+			Suites:     []string{"jammy"},
+			Components: []string{"main"},
+			CacheDir:   c.MkDir(),
+			PubKeys:    key1.PubKeys,
+		}
+		archive, err := archive.Open(&options)
+		c.Assert(err, IsNil)
+
+		var requests []string
+		for _, req := range s.requests {
+			if strings.Contains(req.URL.Path, "/binary-amd64/") {
+				requests = append(requests, req.URL.Path)
+			}
+		}
+		c.Assert(requests, HasLen, len(test.requests))
+		for i, request := range requests {
+			c.Assert(request, Matches, test.requests[i])
+		}
+
+		pkg, err := archive.Fetch("mypkg1")
+		c.Assert(err, IsNil)
+		c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+	}
+}
+
+func (s *httpSuite) TestFetchIndexByHashMismatch(c *C) {
+	release := &testarchive.Release{
+		Suite:         "jammy",
+		Version:       "22.04",
+		PrivKey:       key1.PrivKey,
+		AcquireByHash: true,
+	}
+	index := &testarchive.PackageIndex{
+		Component: "main",
+		Arch:      "amd64",
+		Packages: []testarchive.Item{&testarchive.Package{
+			Name:      "mypkg1",
+			Version:   "1.1",
+			Arch:      "amd64",
+			Component: "main",
+		}},
+	}
+	release.Items = append(release.Items, index, &testarchive.Gzip{Item: index})
+	release.Render("/ubuntu", s.responses)
+
+	// The archive is updated while the Release file is being used, so
+	// the index at its usual location no longer matches, but the one
+	// fetched by hash still does.
+	packagesPath := "/ubuntu/dists/jammy/main/binary-amd64/Packages"
+	index.Packages = append(index.Packages, &testarchive.Package{
+		Name:      "mypkg2",
+		Version:   "1.2",
+		Arch:      "amd64",
+		Component: "main",
+	})
+	s.responses[packagesPath] = index.Content()
+	s.responses[packagesPath+".gz"] = (&testarchive.Gzip{Item: index}).Content()
+
+	options := archive.Options{
+		Label:      "ubuntu",
+		Version:    "22.04",
+		Arch:       "amd64",
+		Suites:     []string{"jammy"},
+		Components: []string{"main"},
+		CacheDir:   c.MkDir(),
+		PubKeys:    key1.PubKeys,
+	}
+	archive, err := archive.Open(&options)
+	c.Assert(err, IsNil)
+	c.Assert(archive.Exists("mypkg1"), Equals, true)
+	c.Assert(archive.Exists("mypkg2"), Equals, false)
+}
+
+func (s *httpSuite) TestOffline(c *C) {
+	s.prepareArchive("jammy", "22.04", "amd64", []string{"main", "universe"})
+
+	var mu sync.Mutex
+	used := make(map[string]bool)
+	options := archive.Options{
+		Label:      "ubuntu",
+		Version:    "22.04",
+		Arch:       "amd64",
+		Suites:     []string{"jammy"},
+		Components: []string{"main", "universe"},
+		PubKeys:    key1.PubKeys,
+		Cache: &cache.Cache{
+			Dir: c.MkDir(),
+			Used: func(name string) {
+				mu.Lock()
+				used[name] = true
+				mu.Unlock()
+			},
+		},
+	}
+
+	// Nothing is cached yet.
+	options.Offline = true
+	_, err := archive.Open(&options)
+	c.Assert(err, ErrorMatches, "cannot find ubuntu 22.04 jammy suite details in cache for offline use")
+	c.Assert(s.requests, HasLen, 0)
+
+	options.Offline = false
+	testArchive, err := archive.Open(&options)
+	c.Assert(err, IsNil)
+	pkg, err := testArchive.Fetch("mypkg1")
+	c.Assert(err, IsNil)
+	c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+
+	// The release file, the two indexes, and the package.
+	var refs, files int
+	for name := range used {
+		if strings.HasPrefix(name, "refs/") {
+			refs++
+		} else if strings.HasPrefix(name, "sha256/") {
+			files++
+		}
+	}
+	c.Assert(refs, Equals, 1)
+	c.Assert(files, Equals, 4)
+
+	s.requests = nil
+	options.Offline = true
+	testArchive, err = archive.Open(&options)
+	c.Assert(err, IsNil)
+	pkg, err = testArchive.Fetch("mypkg1")
+	c.Assert(err, IsNil)
+	c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+	_, err = testArchive.Fetch("mypkg2")
+	c.Assert(err, ErrorMatches, `cannot find package "mypkg2" file pool/main/m/mypkg2/mypkg2_1.2ubuntu1_amd64.deb in cache for offline use`)
+	c.Assert(s.requests, HasLen, 0)
+}
+
+type snapshotTest struct {
+	summary  string
+	arch     string
+	url      string
+	portsURL string
+	base     string
+}
+
+var snapshotTests = []snapshotTest{{
+	summary: "Ubuntu archive",
+	arch:    "amd64",
+	base:    "https://snapshot.ubuntu.com/ubuntu/20240101T000000Z/",
+}, {
+	summary: "Ubuntu ports archive",
+	arch:    "arm64",
+	base:    "https://snapshot.ubuntu.com/ubuntu-ports/20240101T000000Z/",
+}, {
+	summary: "Debian archive",
+	arch:    "amd64",
+	url:     "https://deb.debian.org/debian",
+	base:    "https://snapshot.debian.org/archive/debian/20240101T000000Z/",
+}, {
+	summary:  "Ubuntu ports archive given explicitly",
+	arch:     "arm64",
+	url:      "http://archive.ubuntu.com/ubuntu/",
+	portsURL: "http://ports.ubuntu.com/ubuntu-ports/",
+	base:     "https://snapshot.ubuntu.com/ubuntu-ports/20240101T000000Z/",
+}, {
+	summary: "Other snapshot service",
+	arch:    "amd64",
+	url:     "http://snapshot.example.com/archive/mirror",
+	base:    "http://snapshot.example.com/archive/mirror/20240101T000000Z/",
+}}
+
+func (s *httpSuite) TestFetchSnapshot(c *C) {
+	for _, test := range snapshotTests {
+		c.Logf("Summary: %s", test.summary)
+
+		s.base = test.base
+		s.responses = make(map[string][]byte)
+		s.prepareArchive("jammy", "22.04", test.arch, []string{"main"})
+
+		options := archive.Options{
+			Label:      "ubuntu",
+			Version:    "22.04",
+			Arch:       test.arch,
+			Suites:     []string{"jammy"},
+			Components: []string{"main"},
+			CacheDir:   c.MkDir(),
+			PubKeys:    key1.PubKeys,
+			URL:        test.url,
+			PortsURL:   test.portsURL,
+			Snapshot:   "20240101T000000Z",
+		}
+		archive, err := archive.Open(&options)
+		c.Assert(err, IsNil)
+
+		pkg, err := archive.Fetch("mypkg1")
+		c.Assert(err, IsNil)
+		c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+	}
+}
+
+func (s *S) TestFetchWithClient(c *C) {
+	responses := make(map[string][]byte)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		data, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	release := &testarchive.Release{
+		Suite:   "jammy",
+		Version: "22.04",
+		PrivKey: key1.PrivKey,
+	}
+	index := &testarchive.PackageIndex{
+		Component: "main",
+		Arch:      "amd64",
+		Packages: []testarchive.Item{&testarchive.Package{
+			Name:      "mypkg1",
+			Version:   "1.1",
+			Arch:      "amd64",
+			Component: "main",
+		}},
+	}
+	release.Items = append(release.Items, index, &testarchive.Gzip{Item: index})
+	release.Render("/private", responses)
+
+	options := archive.Options{
+		Label:      "private",
+		Version:    "22.04",
+		Arch:       "amd64",
+		Suites:     []string{"jammy"},
+		Components: []string{"main"},
+		CacheDir:   c.MkDir(),
+		PubKeys:    key1.PubKeys,
+		URL:        server.URL + "/private/",
+		Client:     server.Client(),
+	}
+
+	// Without credentials the first request is refused, and no other
+	// locations are tried.
+	_, err := archive.Open(&options)
+	c.Assert(err, ErrorMatches, `cannot authenticate with archive at https://.*/private/dists/jammy/InRelease: 401 Unauthorized`)
+
+	authDir := c.MkDir()
+	host := strings.TrimPrefix(server.URL, "https://")
+	err = ioutil.WriteFile(filepath.Join(authDir, "private.conf"), []byte("machine "+host+"/private login user password secret\n"), 0600)
+	c.Assert(err, IsNil)
+	auths, err := netconf.ReadAuthDir(authDir)
+	c.Assert(err, IsNil)
+	options.Client = server.Client()
+	options.Client.Transport = netconf.AuthTransport(auths, options.Client.Transport)
+
+	archive, err := archive.Open(&options)
+	c.Assert(err, IsNil)
+	pkg, err := archive.Fetch("mypkg1")
+	c.Assert(err, IsNil)
+	c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+}
+
+func (s *httpSuite) TestFetchPortsFromURL(c *C) {
+	for _, arch := range []string{"amd64", "arm64"} {
+		s.responses = make(map[string][]byte)
+		if arch == "amd64" {
+			s.base = "http://mirror.example.com/ubuntu/"
+		} else {
+			s.base = "http://mirror.example.com/ubuntu-ports/"
+		}
+		s.prepareArchive("jammy", "22.04", arch, []string{"main", "universe"})
+
+		options := archive.Options{
+			Label:      "ubuntu",
+			Version:    "22.04",
+			Arch:       arch,
+			Suites:     []string{"jammy"},
+			Components: []string{"main", "universe"},
+			CacheDir:   c.MkDir(),
+			PubKeys:    key1.PubKeys,
+			URL:        "http://mirror.example.com/ubuntu/",
+			PortsURL:   "http://mirror.example.com/ubuntu-ports/",
+		}
+
+		archive, err := archive.Open(&options)
+		c.Assert(err, IsNil)
+
+		pkg, err := archive.Fetch("mypkg3")
+		c.Assert(err, IsNil)
+		c.Assert(read(pkg), Equals, "mypkg3 1.3 data")
+	}
+}
+
+func (s *httpSuite) TestFetchFromFileURL(c *C) {
+
+	// Any HTTP request fails with an unexpected base.
+	s.base = "file:///"
+
+	s.prepareArchive("jammy", "22.04", "amd64", []string{"main", "universe"})
+
+	dir := c.MkDir()
+	for path, data := range s.responses {
+		fpath := filepath.Join(dir, path)
+		err := os.MkdirAll(filepath.Dir(fpath), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(fpath, data, 0644)
+		c.Assert(err, IsNil)
+	}
+	s.responses = nil
+
+	options := archive.Options{
+		Label:      "ubuntu",
+		Version:    "22.04",
+		Arch:       "amd64",
+		Suites:     []string{"jammy"},
+		Components: []string{"main", "universe"},
+		CacheDir:   c.MkDir(),
+		PubKeys:    key1.PubKeys,
+		URL:        "file://" + dir,
+	}
+
+	archive, err := archive.Open(&options)
+	c.Assert(err, IsNil)
+
+	pkg, err := archive.Fetch("mypkg3")
+	c.Assert(err, IsNil)
+	c.Assert(read(pkg), Equals, "mypkg3 1.3 data")
+	c.Assert(s.requests, HasLen, 0)
+}
+
+func (s *httpSuite) TestPackageInfo(c *C) {
+
+	s.prepareArchive("jammy", "22.04", "amd64", []string{"main", "universe"})
+
+	options := archive.Options{
+		Label:      "ubuntu",
+		Version:    "22.04",
+		Arch:       "amd64",
+		Suites:     []string{"jammy"},
+		Components: []string{"main", "universe"},
+		CacheDir:   c.MkDir(),
+		PubKeys:    key1.PubKeys,
+	}
+
+	archive, err := archive.Open(&options)
+	c.Assert(err, IsNil)
+
+	info, err := archive.Info("mypkg3")
+	c.Assert(err, IsNil)
+	c.Assert(info.Name, Equals, "mypkg3")
+	c.Assert(info.Version, Equals, "1.3")
+	c.Assert(info.Arch, Equals, "amd64")
+	c.Assert(info.Filename, Equals, "pool/universe/m/mypkg3/mypkg3_1.3ubuntu1_amd64.deb")
+	c.Assert(info.SHA256, Equals, fmt.Sprintf("%x", sha256.Sum256([]byte("mypkg3 1.3 data"))))
+	c.Assert(info.Size, Equals, int64(len("mypkg3 1.3 data")))
+
+	_, err = archive.Info("mypkg99")
+	c.Assert(err, ErrorMatches, `cannot find package "mypkg99" in archive`)
+}
+
+func (s *httpSuite) TestPackageVersions(c *C) {
+
+	for i, suite := range []string{"jammy", "jammy-updates", "jammy-security"} {
+		release := s.prepareArchive(suite, "22.04", "amd64", []string{"main", "universe"})
+		release.Walk(func(item testarchive.Item) error {
+			if p, ok := item.(*testarchive.Package); ok && p.Name == "mypkg1" && i > 0 {
+				p.Version = fmt.Sprintf("1.1.%d", i)
+				p.Data = []byte("package from " + suite)
+			}
+			return nil
+		})
+		release.Render("/ubuntu", s.responses)
+	}
+
+	options := archive.Options{
+		Label:      "ubuntu",
+		Version:    "22.04",
+		CacheDir:   c.MkDir(),
+		Arch:       "amd64",
+		Suites:     []string{"jammy", "jammy-security", "jammy-updates"},
+		Components: []string{"main", "universe"},
+		PubKeys:    key1.PubKeys,
+	}
+
+	archive, err := archive.Open(&options)
+	c.Assert(err, IsNil)
+
+	infos := archive.Versions("mypkg1")
+	var versions []string
+	for _, info := range infos {
+		versions = append(versions, info.Version)
+	}
+	c.Assert(versions, DeepEquals, []string{"1.1.2", "1.1.1", "1.1"})
+
+	pkg, err := archive.FetchPackage(infos[1])
+	c.Assert(err, IsNil)
+	c.Assert(read(pkg), Equals, "package from jammy-updates")
+
+	// Packages may be fetched even if no longer listed in the indexes.
+	info := *infos[2]
+	s.responses["/ubuntu/"+info.Filename] = []byte("mypkg1 1.1 data")
+	pkg, err = archive.FetchPackage(&info)
+	c.Assert(err, IsNil)
+	c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+
+	c.Assert(archive.Versions("mypkg99"), HasLen, 0)
+
+	info.Filename = "pool/main/m/mypkg1/missing.deb"
+	info.SHA256 = strings.Repeat("0", 64)
+	_, err = archive.FetchPackage(&info)
+	c.Assert(err, ErrorMatches, `cannot find package "mypkg1" file pool/main/m/mypkg1/missing.deb in archive`)
+
+	info.SHA256 = ""
+	_, err = archive.FetchPackage(&info)
+	c.Assert(err, ErrorMatches, `cannot fetch package "mypkg1" without filename and digest`)
+}
+
+type verifyTest struct {
+	summary string
+	pubKeys []*packet.PublicKey
+	prepare func(responses map[string][]byte)
+	error   string
+}
+
+var verifyTests = []verifyTest{{
+	summary: "Signed InRelease file",
+	pubKeys: key1.PubKeys,
+}, {
+	summary: "Any of the archive keys may match",
+	pubKeys: append(append([]*packet.PublicKey(nil), key2.PubKeys...), key1.PubKeys...),
+}, {
+	summary: "InRelease signed by an unknown key",
+	pubKeys: key2.PubKeys,
+	error:   "cannot verify signature of the InRelease file",
+}, {
+	summary: "Tampered InRelease content",
+	pubKeys: key1.PubKeys,
+	prepare: func(responses map[string][]byte) {
+		inRelease := "/ubuntu/dists/jammy/InRelease"
+		responses[inRelease] = bytes.Replace(responses[inRelease], []byte("Suite: jammy"), []byte("Suite: jammy-evil"), 1)
+	},
+	error: "cannot verify signature of the InRelease file",
+}, {
+	summary: "InRelease is not clearsigned",
+	pubKeys: key1.PubKeys,
+	prepare: func(responses map[string][]byte) {
+		responses["/ubuntu/dists/jammy/InRelease"] = responses["/ubuntu/dists/jammy/Release"]
+	},
+	error: "cannot decode clearsigned InRelease file: cannot decode clearsign text",
+}, {
+	summary: "Content appended to a signed InRelease",
+	pubKeys: key1.PubKeys,
+	prepare: func(responses map[string][]byte) {
+		inRelease := "/ubuntu/dists/jammy/InRelease"
+		responses[inRelease] = append(responses[inRelease], []byte("Suite: jammy-evil\n")...)
+	},
+	error: "cannot decode clearsigned InRelease file: unexpected content after clearsign text",
+}, {
+	summary: "Fallback to Release and Release.gpg",
+	pubKeys: key1.PubKeys,
+	prepare: func(responses map[string][]byte) {
+		delete(responses, "/ubuntu/dists/jammy/InRelease")
+	},
+}, {
+	summary: "Release.gpg signed by an unknown key",
+	pubKeys: key2.PubKeys,
+	prepare: func(responses map[string][]byte) {
+		delete(responses, "/ubuntu/dists/jammy/InRelease")
+	},
+	error: "cannot verify signature of the Release file",
+}, {
+	summary: "Missing Release.gpg",
+	pubKeys: key1.PubKeys,
+	prepare: func(responses map[string][]byte) {
+		delete(responses, "/ubuntu/dists/jammy/InRelease")
+		delete(responses, "/ubuntu/dists/jammy/Release.gpg")
+	},
+	error: "cannot find signature of the Release file",
+}}
+
+func (s *httpSuite) TestVerifyRelease(c *C) {
+	for _, test := range verifyTests {
+		c.Logf("Summary: %s", test.summary)
+
+		s.responses = make(map[string][]byte)
+		s.prepareArchive("jammy", "22.04", "amd64", []string{"main", "universe"})
+		if test.prepare != nil {
+			test.prepare(s.responses)
+		}
+
+		options := archive.Options{
+			Label:      "ubuntu",
+			Version:    "22.04",
+			Arch:       "amd64",
+			Suites:     []string{"jammy"},
+			Components: []string{"main", "universe"},
+			CacheDir:   c.MkDir(),
+			PubKeys:    test.pubKeys,
+		}
+
+		archive, err := archive.Open(&options)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+
+		pkg, err := archive.Fetch("mypkg1")
+		c.Assert(err, IsNil)
+		c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+	}
+}
+
 func read(r io.Reader) string {
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
@@ -272,6 +1226,7 @@ func read(r io.Reader) string {
 // Real archive tests, only enabled via --real-archive.
 
 var realArchiveFlag = flag.Bool("real-archive", false, "Perform tests against real archive")
+var realArchiveKeyring = flag.String("real-archive-keyring", "/usr/share/keyrings/ubuntu-archive-keyring.gpg", "Keyring used to verify the real archive")
 
 func (s *S) TestRealArchive(c *C) {
 	if !*realArchiveFlag {
@@ -302,6 +1257,11 @@ func (s *S) checkArchitecture(c *C, arch string, binaryPath string) {
 }
 
 func (s *S) testOpenArchiveArch(c *C, arch string) {
+	keyring, err := os.ReadFile(*realArchiveKeyring)
+	c.Assert(err, IsNil)
+	pubKeys, _, err := pgputil.DecodeKeyring(keyring)
+	c.Assert(err, IsNil)
+
 	options := archive.Options{
 		Label:      "ubuntu",
 		Version:    "22.04",
@@ -309,6 +1269,7 @@ func (s *S) testOpenArchiveArch(c *C, arch string) {
 		Suites:     []string{"jammy"},
 		Components: []string{"main", "universe"},
 		CacheDir:   c.MkDir(),
+		PubKeys:    pubKeys,
 	}
 
 	archive, err := archive.Open(&options)
@@ -2,15 +2,23 @@ package archive
 
 import (
 	"net/http"
+	"time"
 )
 
 func FakeDo(do func(req *http.Request) (*http.Response, error)) (restore func()) {
 	_httpDo := httpDo
-	_bulkDo := bulkDo
-	httpDo = do
-	bulkDo = do
+	httpDo = func(client *http.Client, req *http.Request) (*http.Response, error) {
+		return do(req)
+	}
 	return func() {
 		httpDo = _httpDo
-		bulkDo = _bulkDo
+	}
+}
+
+func FakeSleep(f func(d time.Duration)) (restore func()) {
+	_sleep := sleep
+	sleep = f
+	return func() {
+		sleep = _sleep
 	}
 }
@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/canonical/chisel/internal/deb"
+)
+
+// localArchive obtains packages from a flat directory of .deb files,
+// which are indexed on opening by reading their control data.
+type localArchive struct {
+	options Options
+	// packages holds all the versions of each package, most recent first.
+	packages map[string][]*localPackage
+}
+
+type localPackage struct {
+	path string
+	info PackageInfo
+}
+
+func openLocal(options *Options) (Archive, error) {
+	archive := &localArchive{
+		options:  *options,
+		packages: make(map[string][]*localPackage),
+	}
+
+	logf("Indexing packages in %s...", options.PackagesDir)
+	paths, err := filepath.Glob(filepath.Join(options.PackagesDir, "*.deb"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot list packages: %v", err)
+	}
+	for _, path := range paths {
+		pkg, err := readLocalPackage(path)
+		if err != nil {
+			return nil, err
+		}
+		if pkg.info.Arch != options.Arch && pkg.info.Arch != "all" {
+			continue
+		}
+		archive.packages[pkg.info.Name] = append(archive.packages[pkg.info.Name], pkg)
+	}
+	for _, pkgs := range archive.packages {
+		sort.SliceStable(pkgs, func(i, j int) bool {
+			return deb.CompareVersions(pkgs[i].info.Version, pkgs[j].info.Version) > 0
+		})
+	}
+	return archive, nil
+}
+
+func readLocalPackage(path string) (*localPackage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open package: %v", err)
+	}
+	defer file.Close()
+
+	section, err := deb.ReadControl(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read control data of %s: %v", path, err)
+	}
+	pkg := &localPackage{
+		path: path,
+		info: PackageInfo{
+			Name:     section.Get("Package"),
+			Version:  section.Get("Version"),
+			Arch:     section.Get("Architecture"),
+			Filename: filepath.Base(path),
+		},
+	}
+	if pkg.info.Name == "" || pkg.info.Version == "" || pkg.info.Arch == "" {
+		return nil, fmt.Errorf("incomplete control data in %s", path)
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read package: %v", err)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read package: %v", err)
+	}
+	pkg.info.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	pkg.info.Size = size
+	return pkg, nil
+}
+
+func (a *localArchive) Options() *Options {
+	return &a.options
+}
+
+func (a *localArchive) Exists(pkg string) bool {
+	return len(a.packages[pkg]) > 0
+}
+
+func (a *localArchive) Info(pkg string) (*PackageInfo, error) {
+	pkgs := a.packages[pkg]
+	if len(pkgs) == 0 {
+		return nil, fmt.Errorf("cannot find package %q in archive", pkg)
+	}
+	info := pkgs[0].info
+	return &info, nil
+}
+
+func (a *localArchive) Versions(pkg string) []*PackageInfo {
+	var infos []*PackageInfo
+	for _, localPkg := range a.packages[pkg] {
+		info := localPkg.info
+		infos = append(infos, &info)
+	}
+	return infos
+}
+
+func (a *localArchive) Fetch(pkg string) (io.ReadCloser, error) {
+	info, err := a.Info(pkg)
+	if err != nil {
+		return nil, err
+	}
+	return a.FetchPackage(info)
+}
+
+func (a *localArchive) FetchPackage(info *PackageInfo) (io.ReadCloser, error) {
+	for _, localPkg := range a.packages[info.Name] {
+		if localPkg.info.Filename != info.Filename || localPkg.info.SHA256 != info.SHA256 {
+			continue
+		}
+		logf("Fetching %s...", localPkg.path)
+		file, err := os.Open(localPkg.path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open package: %v", err)
+		}
+		return file, nil
+	}
+	return nil, fmt.Errorf("cannot find package %q file %s in archive", info.Name, info.Filename)
+}
@@ -0,0 +1,115 @@
+package archive_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/canonical/chisel/internal/archive"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+func makeLocalDeb(name, version, arch string) []byte {
+	control := fmt.Sprintf("Package: %s\nVersion: %s\nArchitecture: %s\n", name, version, arch)
+	return testutil.MustMakeDeb(control, []testutil.TarEntry{
+		testutil.Dir(0755, "./"),
+		testutil.Reg(0644, "./"+name, name+" "+version+" "+arch),
+	})
+}
+
+func (s *S) TestLocalArchive(c *C) {
+	dir := c.MkDir()
+	debs := map[string][]byte{
+		"mypkg_1.0_amd64.deb":  makeLocalDeb("mypkg", "1.0", "amd64"),
+		"mypkg_1.10_amd64.deb": makeLocalDeb("mypkg", "1.10", "amd64"),
+		"mypkg_1.9_amd64.deb":  makeLocalDeb("mypkg", "1.9", "amd64"),
+		"mypkg_2.0_arm64.deb":  makeLocalDeb("mypkg", "2.0", "arm64"),
+		"other_1.0_all.deb":    makeLocalDeb("other", "1.0", "all"),
+		"README":               []byte("not a package"),
+	}
+	for name, data := range debs {
+		err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644)
+		c.Assert(err, IsNil)
+	}
+
+	archive, err := archive.Open(&archive.Options{
+		Label:       "local",
+		Arch:        "amd64",
+		PackagesDir: dir,
+	})
+	c.Assert(err, IsNil)
+
+	info, err := archive.Info("mypkg")
+	c.Assert(err, IsNil)
+	c.Assert(info.Name, Equals, "mypkg")
+	c.Assert(info.Version, Equals, "1.10")
+	c.Assert(info.Arch, Equals, "amd64")
+	c.Assert(info.SHA256, Equals, fmt.Sprintf("%x", sha256.Sum256(debs["mypkg_1.10_amd64.deb"])))
+	c.Assert(info.Size, Equals, int64(len(debs["mypkg_1.10_amd64.deb"])))
+
+	pkg, err := archive.Fetch("mypkg")
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(pkg)
+	c.Assert(err, IsNil)
+	pkg.Close()
+	c.Assert(data, DeepEquals, debs["mypkg_1.10_amd64.deb"])
+
+	var versions []string
+	for _, info := range archive.Versions("mypkg") {
+		versions = append(versions, info.Version)
+	}
+	c.Assert(versions, DeepEquals, []string{"1.10", "1.9", "1.0"})
+
+	info = archive.Versions("mypkg")[2]
+	c.Assert(info.Filename, Equals, "mypkg_1.0_amd64.deb")
+	pkg, err = archive.FetchPackage(info)
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadAll(pkg)
+	c.Assert(err, IsNil)
+	pkg.Close()
+	c.Assert(data, DeepEquals, debs["mypkg_1.0_amd64.deb"])
+
+	info.SHA256 = "0000"
+	_, err = archive.FetchPackage(info)
+	c.Assert(err, ErrorMatches, `cannot find package "mypkg" file mypkg_1.0_amd64.deb in archive`)
+
+	info, err = archive.Info("other")
+	c.Assert(err, IsNil)
+	c.Assert(info.Version, Equals, "1.0")
+	c.Assert(info.Arch, Equals, "all")
+
+	c.Assert(archive.Exists("mypkg"), Equals, true)
+	c.Assert(archive.Exists("missing"), Equals, false)
+	_, err = archive.Info("missing")
+	c.Assert(err, ErrorMatches, `cannot find package "missing" in archive`)
+	_, err = archive.Fetch("missing")
+	c.Assert(err, ErrorMatches, `cannot find package "missing" in archive`)
+}
+
+func (s *S) TestLocalArchiveErrors(c *C) {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "broken.deb"), []byte("!<arch>\n"), 0644)
+	c.Assert(err, IsNil)
+
+	_, err = archive.Open(&archive.Options{
+		Label:       "local",
+		Arch:        "amd64",
+		PackagesDir: dir,
+	})
+	c.Assert(err, ErrorMatches, `cannot read control data of .*/broken.deb: no control payload`)
+
+	dir = c.MkDir()
+	data := testutil.MustMakeDeb("Package: mypkg\n", nil)
+	err = ioutil.WriteFile(filepath.Join(dir, "mypkg.deb"), data, 0644)
+	c.Assert(err, IsNil)
+
+	_, err = archive.Open(&archive.Options{
+		Label:       "local",
+		Arch:        "amd64",
+		PackagesDir: dir,
+	})
+	c.Assert(err, ErrorMatches, `incomplete control data in .*/mypkg.deb`)
+}
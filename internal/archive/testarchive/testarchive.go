@@ -3,10 +3,18 @@ package testarchive
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto"
 	"crypto/sha256"
 	"fmt"
 	"path"
 	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
 
 	"github.com/canonical/chisel/internal/testutil"
 )
@@ -54,6 +62,46 @@ func (gz *Gzip) Content() []byte {
 	return makeGzip(gz.Item.Content())
 }
 
+type Xz struct {
+	Item Item
+}
+
+func (x *Xz) Path() string {
+	return x.Item.Path() + ".xz"
+}
+
+func (x *Xz) Walk(f func(Item) error) error {
+	return CallWalkFunc(x, f, x.Item)
+}
+
+func (x *Xz) Section() []byte {
+	return x.Item.Section()
+}
+
+func (x *Xz) Content() []byte {
+	return makeXz(x.Item.Content())
+}
+
+type Zstd struct {
+	Item Item
+}
+
+func (z *Zstd) Path() string {
+	return z.Item.Path() + ".zst"
+}
+
+func (z *Zstd) Walk(f func(Item) error) error {
+	return CallWalkFunc(z, f, z.Item)
+}
+
+func (z *Zstd) Section() []byte {
+	return z.Item.Section()
+}
+
+func (z *Zstd) Content() []byte {
+	return makeZstd(z.Item.Content())
+}
+
 type Package struct {
 	Name      string
 	Version   string
@@ -99,9 +147,15 @@ func (p *Package) Content() []byte {
 }
 
 type Release struct {
+	Label   string
 	Suite   string
 	Version string
 	Items   []Item
+	PrivKey *packet.PrivateKey
+
+	// AcquireByHash makes the index files also available by their
+	// digest, as announced in the Release file.
+	AcquireByHash bool
 }
 
 func (r *Release) Walk(f func(Item) error) error {
@@ -122,34 +176,107 @@ func (r *Release) Content() []byte {
 		content := item.Content()
 		digests.WriteString(fmt.Sprintf(" %s  %d  %s\n", makeSha256(content), len(content), item.Path()))
 	}
+	label := r.Label
+	if label == "" {
+		label = "Ubuntu"
+	}
 	content := fmt.Sprintf(string(testutil.Reindent(`
-		Origin: Ubuntu
-		Label: Ubuntu
+		Origin: %s
+		Label: %s
 		Suite: %s
 		Version: %s
 		Codename: codename
 		Date: Thu, 21 Apr 2022 17:16:08 UTC
 		Architectures: amd64 arm64 armhf i386 ppc64el riscv64 s390x
 		Components: main restricted universe multiverse
-		Description: Ubuntu %s
+		Description: %s %s
 		SHA256:
 		%s
-	`)), r.Suite, r.Version, r.Version, digests.String())
+	`)), label, label, r.Suite, r.Version, label, r.Version, digests.String())
+	if r.AcquireByHash {
+		content = "Acquire-By-Hash: yes\n" + content
+	}
 
 	return []byte(content)
 }
 
 func (r *Release) Render(prefix string, content map[string][]byte) error {
-	return r.Walk(func(item Item) error {
+	err := r.Walk(func(item Item) error {
 		itemPath := item.Path()
 		if strings.HasPrefix(itemPath, "pool/") {
 			itemPath = path.Join(prefix, itemPath)
 		} else {
 			itemPath = path.Join(prefix, "dists", r.Suite, itemPath)
+			if r.AcquireByHash {
+				hashPath := path.Join(path.Dir(itemPath), "by-hash", "SHA256", makeSha256(item.Content()))
+				content[hashPath] = item.Content()
+			}
 		}
 		content[itemPath] = item.Content()
 		return nil
 	})
+	if err != nil || r.PrivKey == nil {
+		return err
+	}
+	releaseContent := r.Content()
+	inRelease, err := clearSign(releaseContent, r.PrivKey)
+	if err != nil {
+		return err
+	}
+	releaseSig, err := detachSign(releaseContent, r.PrivKey)
+	if err != nil {
+		return err
+	}
+	content[path.Join(prefix, "dists", r.Suite, "InRelease")] = inRelease
+	content[path.Join(prefix, "dists", r.Suite, "Release.gpg")] = releaseSig
+	return nil
+}
+
+func clearSign(data []byte, privKey *packet.PrivateKey) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := clearsign.Encode(&buf, privKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func detachSign(data []byte, privKey *packet.PrivateKey) ([]byte, error) {
+	sig := &packet.Signature{
+		SigType:      packet.SigTypeBinary,
+		PubKeyAlgo:   privKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &privKey.KeyId,
+	}
+	hash := sig.Hash.New()
+	hash.Write(data)
+	err := sig.Sign(hash, privKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writer, err := armor.Encode(&buf, "PGP SIGNATURE", nil)
+	if err != nil {
+		return nil, err
+	}
+	err = sig.Serialize(writer)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func MergeSections(items []Item) []byte {
@@ -199,3 +326,29 @@ func makeGzip(b []byte) []byte {
 	}
 	return buf.Bytes()
 }
+
+func makeXz(b []byte) []byte {
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	if err != nil {
+		panic(err)
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		panic(err)
+	}
+	err = w.Close()
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func makeZstd(b []byte) []byte {
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	defer w.Close()
+	return w.EncodeAll(b, nil)
+}
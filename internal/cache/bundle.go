@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/fslock"
+)
+
+// Export writes the files with the given paths relative to the cache
+// directory into w as a tar bundle, which may be imported into another
+// cache with Import.
+func (c *Cache) Export(w io.Writer, names []string) error {
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		err := c.exportFile(tw, name)
+		if err != nil {
+			return fmt.Errorf("cannot export %s from cache: %w", name, err)
+		}
+	}
+	return tw.Close()
+}
+
+func (c *Cache) exportFile(tw *tar.Writer, name string) error {
+	file, err := os.Open(filepath.Join(c.Dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	finfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     finfo.Size(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// releasesDir holds the releases fetched into the cache, which are written
+// while holding the lock file within it.
+const releasesDir = "releases"
+
+// Import reads the files in the tar bundle from r, as written by Export,
+// into the cache. The content of cached files is verified against their
+// digests, and only cached files, references, and releases are imported.
+func (c *Cache) Import(r io.Reader) error {
+	if c.Dir == "" {
+		return fmt.Errorf("internal error: cache directory is unset")
+	}
+	var releasesLock *fslock.Lock
+	defer func() {
+		if releasesLock != nil {
+			releasesLock.Unlock()
+		}
+	}()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read cache bundle: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(header.Name)
+		if !importable(name) {
+			return fmt.Errorf("invalid path in cache bundle: %q", header.Name)
+		}
+		if releasesLock == nil && strings.HasPrefix(name, releasesDir+"/") {
+			releasesLock, err = c.lockReleases()
+			if err != nil {
+				return fmt.Errorf("cannot import %s into cache: %w", name, err)
+			}
+		}
+		err = c.importFile(name, tr)
+		if err != nil {
+			return fmt.Errorf("cannot import %s into cache: %w", name, err)
+		}
+	}
+}
+
+// importable returns whether the cleaned path of a bundle entry names a
+// cached file, a reference, or a file of a release.
+func importable(name string) bool {
+	dir := path.Dir(name)
+	if dir == digestKind || dir == refsDir {
+		return true
+	}
+	return strings.HasPrefix(name, releasesDir+"/") && name != releasesDir+"/.lock"
+}
+
+// lockReleases takes the lock held while writing releases into the cache.
+func (c *Cache) lockReleases() (*fslock.Lock, error) {
+	dir := filepath.Join(c.Dir, releasesDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	lock := fslock.New(filepath.Join(dir, ".lock"))
+	err = lock.LockWithTimeout(10 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+func (c *Cache) importFile(name string, r io.Reader) error {
+	if path.Dir(name) == digestKind {
+		writer := c.Create(path.Base(name))
+		_, err := io.Copy(writer, r)
+		if err == nil {
+			err = writer.Close()
+		}
+		return err
+	}
+	filePath := filepath.Join(c.Dir, name)
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return err
+	}
+	return writeFile(filePath, r)
+}
@@ -7,8 +7,13 @@ import (
 	"hash"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -31,6 +36,18 @@ func DefaultDir(suffix string) string {
 
 type Cache struct {
 	Dir string
+
+	// Used, if set, is called with the path relative to Dir of every
+	// file read from or written into the cache, such as for finding the
+	// files needed by an operation. It may be called concurrently.
+	Used func(name string)
+
+	// Backend, if set, is where content missing from the cache is looked
+	// for, and where content written into the cache is stored as well,
+	// in the background until Wait is called.
+	Backend Backend
+
+	uploads sync.WaitGroup
 }
 
 type Writer struct {
@@ -38,7 +55,15 @@ type Writer struct {
 	digest string
 	hash   hash.Hash
 	file   *os.File
+	offset int64
 	err    error
+	used   func(name string)
+	// backend, if set, receives the content once complete, tracked
+	// by uploads while in progress.
+	backend Backend
+	uploads *sync.WaitGroup
+	// partial is set when the content may be continued via Resume.
+	partial bool
 }
 
 func (cw *Writer) fail(err error) error {
@@ -66,10 +91,6 @@ func (cw *Writer) Close() error {
 	if cw.err != nil {
 		return cw.err
 	}
-	err := cw.file.Close()
-	if err != nil {
-		return cw.fail(err)
-	}
 	sum := cw.hash.Sum(nil)
 	digest := hex.EncodeToString(sum[:])
 	if cw.digest == "" {
@@ -77,12 +98,31 @@ func (cw *Writer) Close() error {
 	} else if digest != cw.digest {
 		return cw.fail(fmt.Errorf("expected digest %s, got %s", cw.digest, digest))
 	}
+	// The file is only closed once renamed into place, so that partial
+	// files remain locked until then, as done by Resume.
 	fname := cw.file.Name()
-	err = os.Rename(fname, filepath.Join(filepath.Dir(fname), cw.digest))
+	target := filepath.Join(filepath.Dir(fname), cw.digest)
+	err := os.Rename(fname, target)
 	if err != nil {
 		return cw.fail(err)
 	}
 	cw.err = io.EOF
+	err = cw.file.Close()
+	if err != nil {
+		os.Remove(target)
+		cw.err = err
+		return err
+	}
+	if cw.used != nil {
+		cw.used(path.Join(digestKind, cw.digest))
+	}
+	if cw.backend != nil {
+		cw.uploads.Add(1)
+		go func() {
+			defer cw.uploads.Done()
+			putBackend(cw.backend, target, cw.digest)
+		}()
+	}
 	return nil
 }
 
@@ -90,6 +130,45 @@ func (cw *Writer) Digest() string {
 	return cw.digest
 }
 
+// Offset returns the size of the content previously written into the
+// writer, when obtained via Resume.
+func (cw *Writer) Offset() int64 {
+	return cw.offset
+}
+
+// Suspend closes the writer, keeping the content written so far so that
+// it may be continued later via Resume. Content written by writers not
+// obtained via Resume, or which could not continue previous content, is
+// discarded instead.
+func (cw *Writer) Suspend() error {
+	if cw.err != nil {
+		return cw.err
+	}
+	if !cw.partial {
+		cw.fail(fmt.Errorf("internal error: cache writer was suspended"))
+		return nil
+	}
+	cw.err = fmt.Errorf("internal error: cache writer was suspended")
+	return cw.file.Close()
+}
+
+// Reset discards the content written so far, including any resumed content.
+func (cw *Writer) Reset() error {
+	if cw.err != nil {
+		return cw.err
+	}
+	_, err := cw.file.Seek(0, io.SeekStart)
+	if err == nil {
+		err = cw.file.Truncate(0)
+	}
+	if err != nil {
+		return cw.fail(err)
+	}
+	cw.hash.Reset()
+	cw.offset = 0
+	return nil
+}
+
 const digestKind = "sha256"
 
 var MissErr = fmt.Errorf("not cached")
@@ -106,23 +185,98 @@ func (c *Cache) Create(digest string) *Writer {
 	if err != nil {
 		return &Writer{err: fmt.Errorf("cannot create cache directory: %v", err)}
 	}
-	var file *os.File
-	if digest == "" {
-		file, err = os.CreateTemp(c.filePath(""), "tmp.*")
-	} else {
-		file, err = os.Create(c.filePath(digest + ".tmp"))
+	// The same content may be written concurrently, so each writer uses
+	// its own temporary file until renaming it into place.
+	file, err := os.CreateTemp(c.filePath(""), "tmp.*")
+	if err == nil {
+		// Temporary files are only readable by their owner, while the
+		// cached content is not.
+		err = file.Chmod(0644)
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
 	}
 	if err != nil {
 		return &Writer{err: fmt.Errorf("cannot create cache file: %v", err)}
 	}
 	return &Writer{
-		dir:    c.Dir,
-		digest: digest,
-		hash:   sha256.New(),
-		file:   file,
+		dir:     c.Dir,
+		digest:  digest,
+		hash:    sha256.New(),
+		file:    file,
+		used:    c.Used,
+		backend: c.Backend,
+		uploads: &c.uploads,
 	}
 }
 
+// Wait waits for the content written into the cache to be stored into
+// the backend, which is done in the background.
+func (c *Cache) Wait() {
+	c.uploads.Wait()
+}
+
+// Resume returns a writer for the content with the given digest which
+// continues after the content kept by a previous writer via Suspend, if
+// any, as reported by its Offset. The digest must not be empty.
+func (c *Cache) Resume(digest string) *Writer {
+	if c.Dir == "" {
+		return &Writer{err: fmt.Errorf("internal error: cache directory is unset")}
+	}
+	if digest == "" {
+		return &Writer{err: fmt.Errorf("internal error: cannot resume content without digest")}
+	}
+	err := os.MkdirAll(filepath.Join(c.Dir, digestKind), 0755)
+	if err != nil {
+		return &Writer{err: fmt.Errorf("cannot create cache directory: %v", err)}
+	}
+	file, err := os.OpenFile(c.filePath(digest+partialSuffix), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return &Writer{err: fmt.Errorf("cannot create cache file: %v", err)}
+	}
+	// Other writers, possibly in other processes, may be resuming the
+	// same content. The partial file is locked while written, and when
+	// it cannot be locked, the content is written anew by this writer
+	// into its own temporary file instead.
+	if !lockPartial(file) {
+		file.Close()
+		return c.Create(digest)
+	}
+	cw := &Writer{
+		dir:     c.Dir,
+		digest:  digest,
+		hash:    sha256.New(),
+		file:    file,
+		used:    c.Used,
+		backend: c.Backend,
+		uploads: &c.uploads,
+		partial: true,
+	}
+	cw.offset, err = io.Copy(cw.hash, file)
+	if err != nil {
+		cw.fail(fmt.Errorf("cannot read cache file: %v", err))
+	}
+	return cw
+}
+
+// lockPartial locks the partial file for writing, and returns whether it
+// was locked and is still the partial file, which may have been renamed
+// into place after completed by its previous writer. The lock is released
+// once the file is closed.
+func lockPartial(file *os.File) bool {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		return false
+	}
+	finfo, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	pinfo, err := os.Stat(file.Name())
+	return err == nil && os.SameFile(finfo, pinfo)
+}
+
 func (c *Cache) Write(digest string, data []byte) error {
 	f := c.Create(digest)
 	_, err1 := f.Write(data)
@@ -139,6 +293,13 @@ func (c *Cache) Open(digest string) (io.ReadCloser, error) {
 	}
 	filePath := c.filePath(digest)
 	file, err := os.Open(filePath)
+	if os.IsNotExist(err) && c.Backend != nil {
+		err = c.fetchBackend(digest)
+		if err != nil {
+			return nil, err
+		}
+		file, err = os.Open(filePath)
+	}
 	if os.IsNotExist(err) {
 		return nil, MissErr
 	} else if err != nil {
@@ -149,9 +310,22 @@ func (c *Cache) Open(digest string) (io.ReadCloser, error) {
 	if err := os.Chtimes(filePath, now, now); err != nil {
 		return nil, fmt.Errorf("cannot update cached file timestamp: %v", err)
 	}
+	if c.Used != nil {
+		c.Used(path.Join(digestKind, digest))
+	}
 	return file, nil
 }
 
+// Has returns whether the content with the given digest is cached, without
+// updating its last reuse time.
+func (c *Cache) Has(digest string) bool {
+	if c.Dir == "" || digest == "" {
+		return false
+	}
+	_, err := os.Stat(c.filePath(digest))
+	return err == nil
+}
+
 func (c *Cache) Read(digest string) ([]byte, error) {
 	file, err := c.Open(digest)
 	if err != nil {
@@ -165,20 +339,77 @@ func (c *Cache) Read(digest string) ([]byte, error) {
 	return data, nil
 }
 
-func (c *Cache) Expire(timeout time.Duration) error {
-	list, err := ioutil.ReadDir(filepath.Join(c.Dir, digestKind))
+const refsDir = "refs"
+
+func (c *Cache) refPath(name string) string {
+	return filepath.Join(c.Dir, refsDir, url.PathEscape(name))
+}
+
+// SetRef records that the content with the given digest is the one found
+// under name, such as the URL it was fetched from, so that it may later
+// be found by name with Ref.
+func (c *Cache) SetRef(name, digest string) error {
+	if c.Dir == "" {
+		return fmt.Errorf("internal error: cache directory is unset")
+	}
+	err := os.MkdirAll(filepath.Join(c.Dir, refsDir), 0755)
 	if err != nil {
-		return fmt.Errorf("cannot list cache directory: %v", err)
+		return fmt.Errorf("cannot create cache directory: %v", err)
 	}
-	expired := time.Now().Add(-timeout)
-	for _, finfo := range list {
-		if finfo.ModTime().After(expired) {
-			continue
-		}
-		err = os.Remove(filepath.Join(c.Dir, digestKind, finfo.Name()))
-		if err != nil {
-			return fmt.Errorf("cannot expire cache entry: %v", err)
-		}
+	err = writeFile(c.refPath(name), strings.NewReader(digest))
+	if err != nil {
+		return fmt.Errorf("cannot write cache reference: %v", err)
+	}
+	if c.Used != nil {
+		c.Used(path.Join(refsDir, url.PathEscape(name)))
 	}
 	return nil
 }
+
+// Ref returns the digest of the content last recorded under name with
+// SetRef, or MissErr if there is none.
+func (c *Cache) Ref(name string) (string, error) {
+	if c.Dir == "" {
+		return "", MissErr
+	}
+	data, err := ioutil.ReadFile(c.refPath(name))
+	if os.IsNotExist(err) {
+		return "", MissErr
+	} else if err != nil {
+		return "", fmt.Errorf("cannot read cache reference: %v", err)
+	}
+	if c.Used != nil {
+		c.Used(path.Join(refsDir, url.PathEscape(name)))
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// writeFile writes the data into a temporary file next to the one at
+// filePath, and then renames it into place, so that the file is never
+// observed partially written.
+func writeFile(filePath string, data io.Reader) error {
+	file, err := os.CreateTemp(filepath.Dir(filePath), "tmp.*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// Expire removes the content not used within timeout.
+func (c *Cache) Expire(timeout time.Duration) error {
+	_, err := c.Prune(&PruneOptions{MaxAge: timeout})
+	return err
+}
@@ -3,10 +3,18 @@ package cache_test
 import (
 	. "gopkg.in/check.v1"
 
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/canonical/chisel/internal/cache"
@@ -44,7 +52,7 @@ func (s *S) TestDefaultDir(c *C) {
 
 
 func (s *S) TestCacheEmpty(c *C) {
-	cc := cache.Cache{c.MkDir()}
+	cc := cache.Cache{Dir: c.MkDir()}
 
 	_, err := cc.Open(data1Digest)
 	c.Assert(err, Equals, cache.MissErr)
@@ -78,6 +86,11 @@ func (s *S) TestCacheReadWrite(c *C) {
 	_, err = cc.Read("")
 	c.Assert(err, Equals, cache.MissErr)
 
+	c.Assert(cc.Has(data1Digest), Equals, true)
+	c.Assert(cc.Has(data2Digest), Equals, true)
+	c.Assert(cc.Has(data3Digest), Equals, false)
+	c.Assert(cc.Has(""), Equals, false)
+
 	_, err = os.Stat(data1Path)
 	c.Assert(err, IsNil)
 	_, err = os.Stat(data2Path)
@@ -117,6 +130,11 @@ func (s *S) TestCacheCreate(c *C) {
 	data1, err := cc.Read(data1Digest)
 	c.Assert(err, IsNil)
 	c.Assert(string(data1), Equals, "data1")
+
+	// Cached content is readable by others.
+	finfo, err := os.Stat(filepath.Join(cc.Dir, "sha256", data1Digest))
+	c.Assert(err, IsNil)
+	c.Assert(finfo.Mode().Perm(), Equals, os.FileMode(0644))
 }
 
 func (s *S) TestCacheWrongDigest(c *C) {
@@ -152,3 +170,536 @@ func (s *S) TestCacheOpen(c *C) {
 
 	c.Assert(string(data1), Equals, "data1")
 }
+
+func (s *S) TestCacheResume(c *C) {
+	cc := cache.Cache{Dir: c.MkDir()}
+
+	w := cc.Resume(data1Digest)
+	c.Assert(w.Offset(), Equals, int64(0))
+	_, err := w.Write([]byte("da"))
+	c.Assert(err, IsNil)
+	err = w.Suspend()
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), NotNil)
+
+	_, err = cc.Read(data1Digest)
+	c.Assert(err, Equals, cache.MissErr)
+
+	w = cc.Resume(data1Digest)
+	c.Assert(w.Offset(), Equals, int64(2))
+	_, err = w.Write([]byte("ta1"))
+	c.Assert(err, IsNil)
+	err = w.Close()
+	c.Assert(err, IsNil)
+
+	data1, err := cc.Read(data1Digest)
+	c.Assert(err, IsNil)
+	c.Assert(string(data1), Equals, "data1")
+
+	// Content may be discarded when it cannot be continued.
+	w = cc.Resume(data2Digest)
+	_, err = w.Write([]byte("wrong"))
+	c.Assert(err, IsNil)
+	c.Assert(w.Suspend(), IsNil)
+	w = cc.Resume(data2Digest)
+	c.Assert(w.Offset(), Equals, int64(5))
+	c.Assert(w.Reset(), IsNil)
+	c.Assert(w.Offset(), Equals, int64(0))
+	_, err = w.Write([]byte("data2"))
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	data2, err := cc.Read(data2Digest)
+	c.Assert(err, IsNil)
+	c.Assert(string(data2), Equals, "data2")
+}
+
+func (s *S) TestCacheRefs(c *C) {
+	cc := cache.Cache{Dir: c.MkDir()}
+
+	_, err := cc.Ref("http://example.com/dists/jammy/InRelease")
+	c.Assert(err, Equals, cache.MissErr)
+
+	err = cc.SetRef("http://example.com/dists/jammy/InRelease", data1Digest)
+	c.Assert(err, IsNil)
+	digest, err := cc.Ref("http://example.com/dists/jammy/InRelease")
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, data1Digest)
+
+	err = cc.SetRef("http://example.com/dists/jammy/InRelease", data2Digest)
+	c.Assert(err, IsNil)
+	digest, err = cc.Ref("http://example.com/dists/jammy/InRelease")
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, data2Digest)
+
+	_, err = cc.Ref("http://example.com/dists/jammy/Release")
+	c.Assert(err, Equals, cache.MissErr)
+}
+
+func (s *S) TestCacheUsed(c *C) {
+	var used []string
+	cc := cache.Cache{
+		Dir:  c.MkDir(),
+		Used: func(name string) { used = append(used, name) },
+	}
+
+	err := cc.Write("", []byte("data1"))
+	c.Assert(err, IsNil)
+	err = cc.SetRef("ref1", data1Digest)
+	c.Assert(err, IsNil)
+	_, err = cc.Ref("ref1")
+	c.Assert(err, IsNil)
+	_, err = cc.Read(data1Digest)
+	c.Assert(err, IsNil)
+	_, err = cc.Read(data2Digest)
+	c.Assert(err, Equals, cache.MissErr)
+	c.Assert(cc.Has(data1Digest), Equals, true)
+
+	c.Assert(used, DeepEquals, []string{
+		"sha256/" + data1Digest,
+		"refs/ref1",
+		"refs/ref1",
+		"sha256/" + data1Digest,
+	})
+}
+
+func (s *S) TestCacheExportImport(c *C) {
+	cc := cache.Cache{Dir: c.MkDir()}
+	err := cc.Write(data1Digest, []byte("data1"))
+	c.Assert(err, IsNil)
+	err = cc.Write(data2Digest, []byte("data2"))
+	c.Assert(err, IsNil)
+	err = cc.SetRef("http://example.com/InRelease", data1Digest)
+	c.Assert(err, IsNil)
+	err = os.MkdirAll(filepath.Join(cc.Dir, "releases/ubuntu-22.04"), 0755)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(cc.Dir, "releases/ubuntu-22.04/chisel.yaml"), []byte("format: chisel-v1\n"), 0644)
+	c.Assert(err, IsNil)
+
+	var bundle bytes.Buffer
+	err = cc.Export(&bundle, []string{
+		"sha256/" + data1Digest,
+		"refs/http:%2F%2Fexample.com%2FInRelease",
+		"releases/ubuntu-22.04/chisel.yaml",
+	})
+	c.Assert(err, IsNil)
+
+	other := cache.Cache{Dir: c.MkDir()}
+	err = other.Import(bytes.NewReader(bundle.Bytes()))
+	c.Assert(err, IsNil)
+
+	digest, err := other.Ref("http://example.com/InRelease")
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, data1Digest)
+	data1, err := other.Read(data1Digest)
+	c.Assert(err, IsNil)
+	c.Assert(string(data1), Equals, "data1")
+	c.Assert(other.Has(data2Digest), Equals, false)
+	data, err := ioutil.ReadFile(filepath.Join(other.Dir, "releases/ubuntu-22.04/chisel.yaml"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "format: chisel-v1\n")
+
+	err = cc.Export(&bundle, []string{"sha256/" + data3Digest})
+	c.Assert(err, ErrorMatches, "cannot export sha256/"+data3Digest+" from cache: .*")
+}
+
+func (s *S) TestCacheImportErrors(c *C) {
+	cc := cache.Cache{Dir: c.MkDir()}
+
+	var bundle bytes.Buffer
+	tw := tar.NewWriter(&bundle)
+	err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "sha256/" + data1Digest, Mode: 0644, Size: 5})
+	c.Assert(err, IsNil)
+	_, err = tw.Write([]byte("data2"))
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+	err = cc.Import(&bundle)
+	c.Assert(err, ErrorMatches, "cannot import sha256/"+data1Digest+" into cache: expected digest "+data1Digest+", got "+data2Digest)
+
+	invalid := []string{"../evil", "/etc/passwd", "sha256/../../evil", "sha256/sub/" + data1Digest, "other/file", "releases/.lock"}
+	for _, name := range invalid {
+		c.Logf("Name: %s", name)
+		bundle.Reset()
+		tw = tar.NewWriter(&bundle)
+		err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644})
+		c.Assert(err, IsNil)
+		c.Assert(tw.Close(), IsNil)
+		err = cc.Import(&bundle)
+		c.Assert(err, ErrorMatches, fmt.Sprintf("invalid path in cache bundle: %q", name))
+	}
+}
+
+func (s *S) TestCacheEntries(c *C) {
+	cc := cache.Cache{Dir: c.MkDir()}
+
+	entries, err := cc.Entries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+
+	c.Assert(cc.Write(data1Digest, []byte("data1")), IsNil)
+	c.Assert(cc.Write(data2Digest, []byte("data2")), IsNil)
+	w := cc.Resume(data3Digest)
+	_, err = w.Write([]byte("da"))
+	c.Assert(err, IsNil)
+	c.Assert(w.Suspend(), IsNil)
+
+	now := time.Now()
+	setLastUse(c, &cc, data1Digest, now.Add(-time.Minute))
+	setLastUse(c, &cc, data2Digest, now.Add(-time.Hour))
+	setLastUse(c, &cc, data3Digest+".partial", now)
+
+	entries, err = cc.Entries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 3)
+	c.Assert(*entries[0], DeepEquals, cache.Entry{Digest: data2Digest, Size: 5, LastUse: entries[0].LastUse})
+	c.Assert(*entries[1], DeepEquals, cache.Entry{Digest: data1Digest, Size: 5, LastUse: entries[1].LastUse})
+	c.Assert(*entries[2], DeepEquals, cache.Entry{Digest: data3Digest, Size: 2, LastUse: entries[2].LastUse, Partial: true})
+}
+
+func (s *S) TestCacheVerify(c *C) {
+	cc := cache.Cache{Dir: c.MkDir()}
+
+	c.Assert(cc.Write(data1Digest, []byte("data1")), IsNil)
+	c.Assert(cc.Write(data2Digest, []byte("data2")), IsNil)
+	err := ioutil.WriteFile(filepath.Join(cc.Dir, "sha256", data2Digest), []byte("data3"), 0644)
+	c.Assert(err, IsNil)
+
+	corrupted, err := cc.Verify()
+	c.Assert(err, IsNil)
+	c.Assert(corrupted, HasLen, 1)
+	c.Assert(corrupted[0].Digest, Equals, data2Digest)
+
+	c.Assert(cc.Has(data1Digest), Equals, true)
+	c.Assert(cc.Has(data2Digest), Equals, false)
+
+	corrupted, err = cc.Verify()
+	c.Assert(err, IsNil)
+	c.Assert(corrupted, HasLen, 0)
+}
+
+type pruneTest struct {
+	summary string
+	options cache.PruneOptions
+	removed []string
+}
+
+var pruneTests = []pruneTest{{
+	summary: "No limits",
+}, {
+	summary: "Maximum age",
+	options: cache.PruneOptions{MaxAge: 30 * time.Minute},
+	removed: []string{data3Digest, data2Digest},
+}, {
+	summary: "Maximum size removes the least recently used",
+	options: cache.PruneOptions{MaxSize: 10},
+	removed: []string{data3Digest},
+}, {
+	summary: "Maximum size below any entry",
+	options: cache.PruneOptions{MaxSize: 1},
+	removed: []string{data3Digest, data2Digest, data1Digest},
+}, {
+	summary: "Both limits",
+	options: cache.PruneOptions{MaxAge: 90 * time.Minute, MaxSize: 5},
+	removed: []string{data3Digest, data2Digest},
+}}
+
+func (s *S) TestCachePrune(c *C) {
+	for _, test := range pruneTests {
+		c.Logf("Summary: %s", test.summary)
+
+		cc := cache.Cache{Dir: c.MkDir()}
+		c.Assert(cc.Write(data1Digest, []byte("data1")), IsNil)
+		c.Assert(cc.Write(data2Digest, []byte("data2")), IsNil)
+		c.Assert(cc.Write(data3Digest, []byte("data3")), IsNil)
+		c.Assert(cc.SetRef("ref3", data3Digest), IsNil)
+		now := time.Now()
+		setLastUse(c, &cc, data1Digest, now)
+		setLastUse(c, &cc, data2Digest, now.Add(-time.Hour))
+		setLastUse(c, &cc, data3Digest, now.Add(-2*time.Hour))
+
+		removed, err := cc.Prune(&test.options)
+		c.Assert(err, IsNil)
+		var digests []string
+		for _, entry := range removed {
+			digests = append(digests, entry.Digest)
+		}
+		c.Assert(digests, DeepEquals, test.removed)
+
+		removedDigests := make(map[string]bool)
+		for _, digest := range test.removed {
+			removedDigests[digest] = true
+		}
+		for _, digest := range []string{data1Digest, data2Digest, data3Digest} {
+			c.Assert(cc.Has(digest), Equals, !removedDigests[digest])
+		}
+		_, err = cc.Ref("ref3")
+		if removedDigests[data3Digest] {
+			c.Assert(err, Equals, cache.MissErr)
+		} else {
+			c.Assert(err, IsNil)
+		}
+	}
+}
+
+func setLastUse(c *C, cc *cache.Cache, name string, t time.Time) {
+	err := os.Chtimes(filepath.Join(cc.Dir, "sha256", name), t, t)
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestCacheResumeLocked(c *C) {
+	cc := cache.Cache{Dir: c.MkDir()}
+
+	w1 := cc.Resume(data1Digest)
+	_, err := w1.Write([]byte("da"))
+	c.Assert(err, IsNil)
+
+	// The partial content is being written, so another writer cannot
+	// continue it and starts over on its own.
+	w2 := cc.Resume(data1Digest)
+	c.Assert(w2.Offset(), Equals, int64(0))
+	_, err = w2.Write([]byte("data1"))
+	c.Assert(err, IsNil)
+	c.Assert(w2.Close(), IsNil)
+
+	_, err = w1.Write([]byte("ta1"))
+	c.Assert(err, IsNil)
+	c.Assert(w1.Close(), IsNil)
+
+	data1, err := cc.Read(data1Digest)
+	c.Assert(err, IsNil)
+	c.Assert(string(data1), Equals, "data1")
+
+	// Once suspended, the partial content may be continued.
+	w1 = cc.Resume(data2Digest)
+	_, err = w1.Write([]byte("da"))
+	c.Assert(err, IsNil)
+	c.Assert(w1.Suspend(), IsNil)
+	w2 = cc.Resume(data2Digest)
+	c.Assert(w2.Offset(), Equals, int64(2))
+	c.Assert(w2.Close(), ErrorMatches, "expected digest "+data2Digest+", got .*")
+}
+
+func (s *S) TestCacheConcurrentWriters(c *C) {
+	cc := cache.Cache{Dir: c.MkDir()}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	const writers = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			var w *cache.Writer
+			if i%2 == 0 {
+				w = cc.Create(digest)
+			} else {
+				w = cc.Resume(digest)
+			}
+			// Interrupt some writers so that others resume them.
+			if i%4 == 1 {
+				end := w.Offset() + int64(len(data)/3)
+				if end > int64(len(data)) {
+					end = int64(len(data))
+				}
+				_, err := w.Write(data[w.Offset():end])
+				if err == nil {
+					err = w.Suspend()
+				}
+				errs <- err
+				return
+			}
+			for pos := w.Offset(); pos < int64(len(data)); pos += 4096 {
+				end := pos + 4096
+				if end > int64(len(data)) {
+					end = int64(len(data))
+				}
+				if _, err := w.Write(data[pos:end]); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- w.Close()
+		}(i)
+		// Readers observe either no content or the complete content.
+		go func() {
+			defer wg.Done()
+			read, err := cc.Read(digest)
+			if err == cache.MissErr {
+				errs <- nil
+			} else if err != nil {
+				errs <- err
+			} else if !bytes.Equal(read, data) {
+				errs <- fmt.Errorf("read %d bytes of incomplete content", len(read))
+			} else {
+				errs <- nil
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err, IsNil)
+	}
+
+	read, err := cc.Read(digest)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(read, data), Equals, true)
+
+	// No temporary files are left behind.
+	names, err := filepath.Glob(filepath.Join(cc.Dir, "sha256", "tmp.*"))
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 0)
+}
+
+// remoteServer serves the content in store as a remote cache would,
+// recording the requests made.
+func remoteServer(c *C, store map[string]string, requests *[]string) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		*requests = append(*requests, r.Method+" "+r.URL.Path)
+		switch r.Method {
+		case "GET":
+			data, ok := store[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(data))
+		case "PUT":
+			if strings.HasPrefix(r.URL.Path, "/readonly/") {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			data, err := ioutil.ReadAll(r.Body)
+			c.Check(err, IsNil)
+			store[r.URL.Path] = string(data)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+}
+
+func (s *S) TestCacheRemote(c *C) {
+	store := make(map[string]string)
+	var requests []string
+	server := remoteServer(c, store, &requests)
+	defer server.Close()
+
+	// Content written is stored remotely as well.
+	cc1 := cache.Cache{Dir: c.MkDir(), Backend: &cache.HTTPBackend{URL: server.URL + "/cache/"}}
+	err := cc1.Write(data1Digest, []byte("data1"))
+	c.Assert(err, IsNil)
+	cc1.Wait()
+	c.Assert(store, DeepEquals, map[string]string{"/cache/sha256/" + data1Digest: "data1"})
+	c.Assert(requests, DeepEquals, []string{"PUT /cache/sha256/" + data1Digest})
+
+	// Content missing is fetched from the remote cache, and not stored
+	// back into it.
+	requests = nil
+	cc2 := cache.Cache{Dir: c.MkDir(), Backend: &cache.HTTPBackend{URL: server.URL + "/cache"}}
+	data, err := cc2.Read(data1Digest)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data1")
+	c.Assert(cc2.Has(data1Digest), Equals, true)
+	c.Assert(requests, DeepEquals, []string{"GET /cache/sha256/" + data1Digest})
+
+	// Content cached locally is not fetched.
+	requests = nil
+	data, err = cc2.Read(data1Digest)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data1")
+	c.Assert(requests, IsNil)
+
+	// Content missing remotely is missing.
+	_, err = cc2.Read(data2Digest)
+	c.Assert(err, Equals, cache.MissErr)
+
+	// Content not matching its digest is ignored.
+	store["/cache/sha256/"+data2Digest] = "bad"
+	_, err = cc2.Read(data2Digest)
+	c.Assert(err, Equals, cache.MissErr)
+	c.Assert(cc2.Has(data2Digest), Equals, false)
+	entries, err := ioutil.ReadDir(filepath.Join(cc2.Dir, "sha256"))
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+
+	// Failing to store content remotely is not an error.
+	cc3 := cache.Cache{Dir: c.MkDir(), Backend: &cache.HTTPBackend{URL: server.URL + "/readonly"}}
+	err = cc3.Write(data2Digest, []byte("data2"))
+	c.Assert(err, IsNil)
+	cc3.Wait()
+	c.Assert(cc3.Has(data2Digest), Equals, true)
+	c.Assert(c.GetTestLog(), Matches, "(?s).*Cannot use remote cache: cannot store in remote cache: 403 Forbidden\n.*")
+
+	// Unreachable remote caches are treated as missing content.
+	server.Close()
+	_, err = cc2.Read(data3Digest)
+	c.Assert(err, Equals, cache.MissErr)
+}
+
+type failingTransport struct {
+	requests int
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	return nil, fmt.Errorf("connection refused")
+}
+
+func (s *S) TestCacheRemoteUnreachable(c *C) {
+	transport := &failingTransport{}
+	backend := &cache.HTTPBackend{URL: "http://example.com", Client: &http.Client{Transport: transport}}
+	cc := cache.Cache{Dir: c.MkDir(), Backend: backend}
+
+	// The first failure to reach the remote cache is logged.
+	_, err := cc.Read(data1Digest)
+	c.Assert(err, Equals, cache.MissErr)
+	c.Assert(transport.requests, Equals, 1)
+	c.Assert(c.GetTestLog(), Matches, "(?s).*Cannot use remote cache: cannot fetch from remote cache: .*connection refused\n.*")
+
+	// The remote cache is no longer used afterwards.
+	_, err = cc.Read(data2Digest)
+	c.Assert(err, Equals, cache.MissErr)
+	err = cc.Write(data1Digest, []byte("data1"))
+	c.Assert(err, IsNil)
+	cc.Wait()
+	c.Assert(cc.Has(data1Digest), Equals, true)
+	c.Assert(transport.requests, Equals, 1)
+
+	_, err = backend.Open(data1Digest)
+	c.Assert(err, Equals, cache.MissErr)
+	err = backend.Put(data1Digest, strings.NewReader("data1"), 5)
+	c.Assert(err, IsNil)
+	c.Assert(transport.requests, Equals, 1)
+}
+
+func (s *S) TestHTTPBackend(c *C) {
+	store := map[string]string{"/sha256/" + data1Digest: "data1"}
+	var requests []string
+	server := remoteServer(c, store, &requests)
+	defer server.Close()
+
+	backend := &cache.HTTPBackend{URL: server.URL}
+	reader, err := backend.Open(data1Digest)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data1")
+
+	_, err = backend.Open(data2Digest)
+	c.Assert(err, Equals, cache.MissErr)
+
+	err = backend.Put(data2Digest, strings.NewReader("data2"), 5)
+	c.Assert(err, IsNil)
+	c.Assert(store["/sha256/"+data2Digest], Equals, "data2")
+
+	backend.URL = server.URL + "/readonly"
+	err = backend.Put(data2Digest, strings.NewReader("data2"), 5)
+	c.Assert(err, ErrorMatches, "cannot store in remote cache: 403 Forbidden")
+}
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry describes content kept in the cache.
+type Entry struct {
+	Digest string
+	Size   int64
+	// LastUse is when the content was last written or opened.
+	LastUse time.Time
+	// Partial reports whether the content was only partially fetched,
+	// and is kept so that fetching it may be resumed.
+	Partial bool
+}
+
+const partialSuffix = ".partial"
+
+// Entries returns the content kept in the cache, ordered from the least
+// to the most recently used. Temporary files being written are ignored.
+func (c *Cache) Entries() ([]*Entry, error) {
+	list, err := ioutil.ReadDir(filepath.Join(c.Dir, digestKind))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot list cache directory: %v", err)
+	}
+	var entries []*Entry
+	for _, finfo := range list {
+		name := finfo.Name()
+		if !finfo.Mode().IsRegular() || strings.HasPrefix(name, "tmp.") {
+			continue
+		}
+		entries = append(entries, &Entry{
+			Digest:  strings.TrimSuffix(name, partialSuffix),
+			Size:    finfo.Size(),
+			LastUse: finfo.ModTime(),
+			Partial: strings.HasSuffix(name, partialSuffix),
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUse.Before(entries[j].LastUse)
+	})
+	return entries, nil
+}
+
+func (c *Cache) entryPath(entry *Entry) string {
+	if entry.Partial {
+		return c.filePath(entry.Digest + partialSuffix)
+	}
+	return c.filePath(entry.Digest)
+}
+
+// Verify checks the content of every complete entry against its digest,
+// and removes the ones that do not match, which are returned.
+func (c *Cache) Verify() ([]*Entry, error) {
+	entries, err := c.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var corrupted []*Entry
+	for _, entry := range entries {
+		if entry.Partial {
+			continue
+		}
+		ok, err := c.verifyEntry(entry)
+		if err != nil {
+			return corrupted, err
+		}
+		if ok {
+			continue
+		}
+		err = os.Remove(c.entryPath(entry))
+		if err != nil && !os.IsNotExist(err) {
+			return corrupted, fmt.Errorf("cannot remove cache entry: %v", err)
+		}
+		corrupted = append(corrupted, entry)
+	}
+	return corrupted, nil
+}
+
+func (c *Cache) verifyEntry(entry *Entry) (bool, error) {
+	file, err := os.Open(c.entryPath(entry))
+	if os.IsNotExist(err) {
+		// Removed concurrently.
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("cannot open cache file: %v", err)
+	}
+	defer file.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return false, fmt.Errorf("cannot read cache file: %v", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)) == entry.Digest, nil
+}
+
+// PruneOptions holds the limits for pruning the cache. Unset limits are
+// not enforced.
+type PruneOptions struct {
+	// MaxAge is the time after its last use when content is removed.
+	MaxAge time.Duration
+	// MaxSize is the total size in bytes of the content kept, with the
+	// least recently used content removed first.
+	MaxSize int64
+}
+
+// Prune removes the content of the cache exceeding the limits in options,
+// and returns the entries removed. Temporary files older than MaxAge,
+// left behind by interrupted writes, and the references to content no
+// longer cached are removed as well.
+func (c *Cache) Prune(options *PruneOptions) ([]*Entry, error) {
+	entries, err := c.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var totalSize int64
+	for _, entry := range entries {
+		totalSize += entry.Size
+	}
+	expired := time.Now().Add(-options.MaxAge)
+	var removed []*Entry
+	for _, entry := range entries {
+		tooOld := options.MaxAge > 0 && !entry.LastUse.After(expired)
+		tooBig := options.MaxSize > 0 && totalSize > options.MaxSize
+		if !tooOld && !tooBig {
+			continue
+		}
+		err := os.Remove(c.entryPath(entry))
+		if err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("cannot remove cache entry: %v", err)
+		}
+		totalSize -= entry.Size
+		removed = append(removed, entry)
+	}
+
+	if options.MaxAge > 0 {
+		list, err := ioutil.ReadDir(filepath.Join(c.Dir, digestKind))
+		if err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("cannot list cache directory: %v", err)
+		}
+		for _, finfo := range list {
+			if strings.HasPrefix(finfo.Name(), "tmp.") && !finfo.ModTime().After(expired) {
+				err := os.Remove(filepath.Join(c.Dir, digestKind, finfo.Name()))
+				if err != nil && !os.IsNotExist(err) {
+					return removed, fmt.Errorf("cannot remove cache entry: %v", err)
+				}
+			}
+		}
+	}
+
+	if len(removed) > 0 {
+		err = c.pruneRefs()
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// pruneRefs removes the references to content no longer cached.
+func (c *Cache) pruneRefs() error {
+	list, err := ioutil.ReadDir(filepath.Join(c.Dir, refsDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot list cache references: %v", err)
+	}
+	for _, finfo := range list {
+		if strings.HasPrefix(finfo.Name(), "tmp.") {
+			continue
+		}
+		name, err := url.PathUnescape(finfo.Name())
+		if err != nil {
+			continue
+		}
+		digest, err := c.Ref(name)
+		if err == MissErr {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if c.Has(digest) {
+			continue
+		}
+		err = os.Remove(c.refPath(name))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove cache reference: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Backend is a store of content shared between caches, such as a remote
+// server used by several machines. Content missing from the cache is read
+// from the backend, and content written into the cache is written into
+// the backend as well. As content is always verified against its digest
+// before being cached, a backend cannot alter the content used.
+type Backend interface {
+	// Open returns the content with the given digest, or MissErr if the
+	// backend does not hold it.
+	Open(digest string) (io.ReadCloser, error)
+	// Put stores the content with the given digest and size.
+	Put(digest string, r io.Reader, size int64) error
+}
+
+// HTTPBackend is a backend storing content on an HTTP server, at the
+// sha256/<digest> path relative to URL, fetched with GET requests and
+// stored with PUT requests. That is supported by most artifact stores,
+// as well as by S3-compatible object stores through suitable credentials
+// or pre-authorized buckets.
+//
+// Once the server cannot be reached, the backend is no longer used, and
+// behaves as an empty one which discards the content stored.
+type HTTPBackend struct {
+	URL string
+	// Client, if set, is used for the HTTP requests.
+	Client *http.Client
+
+	unreachable int32
+}
+
+func (b *HTTPBackend) url(digest string) string {
+	return strings.TrimSuffix(b.URL, "/") + "/" + digestKind + "/" + digest
+}
+
+func (b *HTTPBackend) client() *http.Client {
+	if b.Client != nil {
+		return b.Client
+	}
+	return http.DefaultClient
+}
+
+func (b *HTTPBackend) Open(digest string) (io.ReadCloser, error) {
+	if atomic.LoadInt32(&b.unreachable) != 0 {
+		return nil, MissErr
+	}
+	resp, err := b.client().Get(b.url(digest))
+	if err != nil {
+		atomic.StoreInt32(&b.unreachable, 1)
+		return nil, fmt.Errorf("cannot fetch from remote cache: %v", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, MissErr
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("cannot fetch from remote cache: %v", resp.Status)
+	}
+}
+
+func (b *HTTPBackend) Put(digest string, r io.Reader, size int64) error {
+	if atomic.LoadInt32(&b.unreachable) != 0 {
+		return nil
+	}
+	req, err := http.NewRequest("PUT", b.url(digest), r)
+	if err != nil {
+		return fmt.Errorf("cannot store in remote cache: %v", err)
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := b.client().Do(req)
+	if err != nil {
+		atomic.StoreInt32(&b.unreachable, 1)
+		return fmt.Errorf("cannot store in remote cache: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("cannot store in remote cache: %v", resp.Status)
+	}
+	return nil
+}
+
+// fetchBackend writes the content with the given digest from the backend
+// into the cache, returning MissErr if the backend does not hold it or
+// cannot provide it, as the content may still be obtained elsewhere.
+func (c *Cache) fetchBackend(digest string) error {
+	reader, err := c.Backend.Open(digest)
+	if err != nil {
+		if err != MissErr {
+			logf("Cannot use remote cache: %v", err)
+		}
+		return MissErr
+	}
+	defer reader.Close()
+	writer := c.Create(digest)
+	// The content came from the backend, so it is not stored back.
+	writer.backend = nil
+	_, err = io.Copy(writer, reader)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		writer.fail(err)
+		logf("Cannot use remote cache: %v", err)
+		return MissErr
+	}
+	return nil
+}
+
+// putBackend stores the cached content with the given digest into the
+// backend. Failing to do so is not an error, as the backend only saves
+// other caches from obtaining the content elsewhere.
+func putBackend(backend Backend, filePath, digest string) {
+	file, err := os.Open(filePath)
+	if err == nil {
+		defer file.Close()
+		var finfo os.FileInfo
+		finfo, err = file.Stat()
+		if err == nil {
+			err = backend.Put(digest, file, finfo.Size())
+		}
+	}
+	if err != nil {
+		logf("Cannot use remote cache: %v", err)
+	}
+}
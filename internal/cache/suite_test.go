@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/cache"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -11,3 +13,13 @@ func Test(t *testing.T) { TestingT(t) }
 type S struct{}
 
 var _ = Suite(&S{})
+
+func (s *S) SetUpTest(c *C) {
+	cache.SetDebug(true)
+	cache.SetLogger(c)
+}
+
+func (s *S) TearDownTest(c *C) {
+	cache.SetDebug(false)
+	cache.SetLogger(nil)
+}
@@ -102,6 +102,17 @@ type ctrlPos struct {
 	start, end int
 }
 
+// ParseSection returns the first section in content, ignoring any others.
+// It's useful for files such as archive Release files that hold a single
+// section which isn't keyed by any field that is known to be present.
+func ParseSection(content string) Section {
+	content = strings.TrimLeft(content, "\n")
+	if end := strings.Index(content, "\n\n"); end >= 0 {
+		content = content[:end]
+	}
+	return &ctrlSection{content}
+}
+
 func ParseReader(sectionKey string, content io.Reader) (File, error) {
 	data, err := ioutil.ReadAll(content)
 	if err != nil {
@@ -80,6 +80,13 @@ func (s *S) TestParseReader(c *C) {
 	}
 }
 
+func (s *S) TestParseSection(c *C) {
+	section := control.ParseSection("\n" + testFile)
+	for key, value := range testFileResults["one"] {
+		c.Assert(section.Get(key), Equals, value, Commentf("Key %q", key))
+	}
+}
+
 func BenchmarkParse(b *testing.B) {
 	data, err := ioutil.ReadFile("Packages")
 	if err != nil {
@@ -0,0 +1,56 @@
+package deb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// VersionConstraint restricts the acceptable versions of a package using
+// one of the relations supported in Debian package dependencies.
+type VersionConstraint struct {
+	Op      string
+	Version string
+}
+
+var versionExp = regexp.MustCompile(`^(?:[0-9]+:)?[0-9][A-Za-z0-9.+~-]*$`)
+
+// ParseVersionConstraint parses a constraint such as ">= 2.35-0ubuntu3".
+// A version with no relation is an exact constraint, as if prefixed by "=".
+func ParseVersionConstraint(constraint string) (*VersionConstraint, error) {
+	constraint = strings.TrimSpace(constraint)
+	op := "="
+	for _, prefix := range []string{">=", "<=", ">>", "<<", "="} {
+		if strings.HasPrefix(constraint, prefix) {
+			op = prefix
+			constraint = strings.TrimSpace(constraint[len(prefix):])
+			break
+		}
+	}
+	if !versionExp.MatchString(constraint) {
+		return nil, fmt.Errorf("invalid version constraint: %q", constraint)
+	}
+	return &VersionConstraint{Op: op, Version: constraint}, nil
+}
+
+// Match returns whether the version satisfies the constraint.
+func (vc *VersionConstraint) Match(version string) bool {
+	cmp := CompareVersions(version, vc.Version)
+	switch vc.Op {
+	case "=":
+		return cmp == 0
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">>":
+		return cmp > 0
+	case "<<":
+		return cmp < 0
+	}
+	return false
+}
+
+func (vc *VersionConstraint) String() string {
+	return vc.Op + " " + vc.Version
+}
@@ -0,0 +1,82 @@
+package deb_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/deb"
+)
+
+var constraintTests = []struct {
+	constraint string
+	op         string
+	version    string
+	match      []string
+	nomatch    []string
+	error      string
+}{{
+	constraint: "2.35-0ubuntu3",
+	op:         "=",
+	version:    "2.35-0ubuntu3",
+	match:      []string{"2.35-0ubuntu3"},
+	nomatch:    []string{"2.35-0ubuntu3.1", "2.35-0ubuntu2"},
+}, {
+	constraint: "= 1:2.0",
+	op:         "=",
+	version:    "1:2.0",
+	match:      []string{"1:2.0"},
+	nomatch:    []string{"2.0"},
+}, {
+	constraint: ">= 2.35-0ubuntu3",
+	op:         ">=",
+	version:    "2.35-0ubuntu3",
+	match:      []string{"2.35-0ubuntu3", "2.35-0ubuntu3.1", "2.36"},
+	nomatch:    []string{"2.35-0ubuntu2", "2.35~rc1"},
+}, {
+	constraint: "<=2.0",
+	op:         "<=",
+	version:    "2.0",
+	match:      []string{"2.0", "1.9", "2.0~beta"},
+	nomatch:    []string{"2.0.1"},
+}, {
+	constraint: ">> 2.0",
+	op:         ">>",
+	version:    "2.0",
+	match:      []string{"2.0.1", "2.0+b1"},
+	nomatch:    []string{"2.0", "1.0"},
+}, {
+	constraint: "<< 2.0",
+	op:         "<<",
+	version:    "2.0",
+	match:      []string{"1.9", "2.0~rc1"},
+	nomatch:    []string{"2.0", "3.0"},
+}, {
+	constraint: "> 2.0",
+	error:      `invalid version constraint: "> 2.0"`,
+}, {
+	constraint: ">=",
+	error:      `invalid version constraint: ""`,
+}, {
+	constraint: "latest",
+	error:      `invalid version constraint: "latest"`,
+}}
+
+func (s *S) TestVersionConstraint(c *C) {
+	for _, test := range constraintTests {
+		c.Logf("Constraint: %q", test.constraint)
+		constraint, err := deb.ParseVersionConstraint(test.constraint)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(constraint.Op, Equals, test.op)
+		c.Assert(constraint.Version, Equals, test.version)
+		c.Assert(constraint.String(), Equals, test.op+" "+test.version)
+		for _, version := range test.match {
+			c.Assert(constraint.Match(version), Equals, true, Commentf("Version %q", version))
+		}
+		for _, version := range test.nomatch {
+			c.Assert(constraint.Match(version), Equals, false, Commentf("Version %q", version))
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package deb
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/blakesmith/ar"
+
+	"github.com/canonical/chisel/internal/control"
+)
+
+// ReadControl returns the fields from the control file of the package.
+func ReadControl(pkgReader io.Reader) (control.Section, error) {
+	arReader := ar.NewReader(pkgReader)
+	for {
+		arHeader, err := arReader.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no control payload")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(arHeader.Name, "control.tar") {
+			continue
+		}
+		data, err := readControlFile(arHeader.Name, arReader)
+		if err != nil {
+			return nil, err
+		}
+		return control.ParseSection(data), nil
+	}
+}
+
+// readControlFile returns the content of the control file in the named
+// control payload of a package.
+func readControlFile(name string, payload io.Reader) (string, error) {
+	reader, err := decompress(name, payload)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	tarReader := tar.NewReader(reader)
+	for {
+		tarHeader, err := tarReader.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("no control file in control payload")
+		}
+		if err != nil {
+			return "", err
+		}
+		if tarHeader.Name != "./control" && tarHeader.Name != "control" {
+			continue
+		}
+		data, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
@@ -0,0 +1,29 @@
+package deb_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"bytes"
+
+	"github.com/canonical/chisel/internal/deb"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+func (s *S) TestReadControl(c *C) {
+	section, err := deb.ReadControl(bytes.NewReader(testutil.PackageData["base-files"]))
+	c.Assert(err, IsNil)
+	c.Assert(section.Get("Package"), Equals, "base-files")
+	c.Assert(section.Get("Architecture"), Equals, "amd64")
+
+	data := testutil.MustMakeDeb("Package: mypkg\nVersion: 1.0-1\nArchitecture: all\n", nil)
+	section, err = deb.ReadControl(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Assert(section.Get("Package"), Equals, "mypkg")
+	c.Assert(section.Get("Version"), Equals, "1.0-1")
+	c.Assert(section.Get("Architecture"), Equals, "all")
+}
+
+func (s *S) TestReadControlErrors(c *C) {
+	_, err := deb.ReadControl(bytes.NewReader([]byte("!<arch>\n")))
+	c.Assert(err, ErrorMatches, "no control payload")
+}
@@ -8,7 +8,6 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"sort"
 	"strings"
 
@@ -25,19 +24,40 @@ type ExtractOptions struct {
 	TargetDir string
 	Extract   map[string][]ExtractInfo
 	Globbed   map[string][]string
+
+	// Target, if set, receives the extracted content instead of the
+	// target directory.
+	Target fsutil.Root
+
+	// Control is called with the content of the package control file,
+	// if set, before any data is extracted.
+	Control func(data string) error
+
+	// Created is called, if set, with the path of every entry created
+	// in the target directory, relative to it, and the package header
+	// describing the entry.
+	Created func(path string, header *tar.Header)
 }
 
 type ExtractInfo struct {
 	Path     string
 	Mode     uint
 	Optional bool
+	// UID and GID override the ownership defined in the package, if set.
+	UID *int
+	GID *int
+	// Xattrs holds extended attributes to set in addition to the ones
+	// defined in the package.
+	Xattrs map[string]string
 }
 
 func checkExtractOptions(options *ExtractOptions) error {
 	for extractPath, extractInfos := range options.Extract {
 		isGlob := strings.ContainsAny(extractPath, "*?")
 		if isGlob {
-			if len(extractInfos) != 1 || extractInfos[0].Path != extractPath || extractInfos[0].Mode != 0 {
+			if len(extractInfos) != 1 || extractInfos[0].Path != extractPath || extractInfos[0].Mode != 0 ||
+				extractInfos[0].UID != nil || extractInfos[0].GID != nil ||
+				extractInfos[0].Xattrs != nil {
 				return fmt.Errorf("when using wildcards source and target paths must match: %s", extractPath)
 			}
 		}
@@ -45,6 +65,10 @@ func checkExtractOptions(options *ExtractOptions) error {
 	return nil
 }
 
+// Extract extracts the selected content of the package read from
+// pkgReader. Hard links whose target is not also extracted have the
+// target content copied instead, which requires the package to be read
+// again, so pkgReader must then implement io.Seeker as well.
 func Extract(pkgReader io.Reader, options *ExtractOptions) (err error) {
 	defer func() {
 		if err != nil {
@@ -59,50 +83,115 @@ func Extract(pkgReader io.Reader, options *ExtractOptions) (err error) {
 		return err
 	}
 
-	_, err = os.Stat(options.TargetDir)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("target directory does not exist")
-	} else if err != nil {
+	target := options.Target
+	if target == nil {
+		_, err = os.Stat(options.TargetDir)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("target directory does not exist")
+		} else if err != nil {
+			return err
+		}
+		target = fsutil.Dir(options.TargetDir)
+	}
+
+	dataReader, err := openData(pkgReader, options.Control)
+	if err != nil {
+		return err
+	}
+	defer dataReader.Close()
+	pendingLinks, err := extractData(dataReader, target, options)
+	if err != nil || len(pendingLinks) == 0 {
+		return err
+	}
+
+	// Some hard links point to content which was not extracted, so
+	// go over the package again to copy it.
+	seeker, ok := pkgReader.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("cannot extract hard link %s: package cannot be read again", pendingLinks[0].path)
+	}
+	_, err = seeker.Seek(0, io.SeekStart)
+	if err != nil {
 		return err
 	}
+	dataReader, err = openData(pkgReader, nil)
+	if err != nil {
+		return err
+	}
+	defer dataReader.Close()
+	return extractLinkTargets(dataReader, pendingLinks, target, options)
+}
 
+// openData returns a reader for the data tarball of the package, calling
+// control with the content of the control file first if it is set.
+func openData(pkgReader io.Reader, control func(data string) error) (io.ReadCloser, error) {
 	arReader := ar.NewReader(pkgReader)
-	var dataReader io.Reader
-	for dataReader == nil {
+	var hasControl bool
+	for {
 		arHeader, err := arReader.Next()
 		if err == io.EOF {
-			return fmt.Errorf("no data payload")
+			return nil, fmt.Errorf("no data payload")
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 		switch arHeader.Name {
-		case "data.tar.gz":
-			gzipReader, err := gzip.NewReader(arReader)
-			if err != nil {
-				return err
+		case "data.tar.gz", "data.tar.xz", "data.tar.zst":
+			if control != nil && !hasControl {
+				return nil, fmt.Errorf("no control payload")
+			}
+			return decompress(arHeader.Name, arReader)
+		default:
+			if control == nil || !strings.HasPrefix(arHeader.Name, "control.tar") {
+				continue
 			}
-			defer gzipReader.Close()
-			dataReader = gzipReader
-		case "data.tar.xz":
-			xzReader, err := xz.NewReader(arReader)
+			data, err := readControlFile(arHeader.Name, arReader)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			dataReader = xzReader
-		case "data.tar.zst":
-			zstdReader, err := zstd.NewReader(arReader)
+			err = control(data)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			defer zstdReader.Close()
-			dataReader = zstdReader
+			hasControl = true
 		}
 	}
-	return extractData(dataReader, options)
 }
 
-func extractData(dataReader io.Reader, options *ExtractOptions) error {
+// decompress returns a reader for the uncompressed content of the named
+// package member, according to the compression implied by its suffix.
+func decompress(name string, reader io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return gzip.NewReader(reader)
+	case strings.HasSuffix(name, ".xz"):
+		xzReader, err := xz.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xzReader), nil
+	case strings.HasSuffix(name, ".zst"):
+		zstdReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader.IOReadCloser(), nil
+	case strings.HasSuffix(name, ".tar"):
+		return ioutil.NopCloser(reader), nil
+	}
+	return nil, fmt.Errorf("unsupported compression of %s", name)
+}
+
+// pendingLink is a hard link to be extracted, whose target was not.
+type pendingLink struct {
+	// source is the path of the link target in the package.
+	source string
+	// path is the path of the link in the target directory.
+	path   string
+	header tar.Header
+}
+
+func extractData(dataReader io.Reader, target fsutil.Root, options *ExtractOptions) ([]*pendingLink, error) {
 
 	shouldExtract := func(pkgPath string) (globPath string, ok bool) {
 		if pkgPath == "" {
@@ -141,6 +230,11 @@ func extractData(dataReader io.Reader, options *ExtractOptions) error {
 		}
 	}
 
+	// Extracted maps the source path of regular files to the first
+	// target path they were extracted to, for linking to them.
+	extracted := make(map[string]string)
+	var pendingLinks []*pendingLink
+
 	tarReader := tar.NewReader(dataReader)
 	for {
 		tarHeader, err := tarReader.Next()
@@ -148,7 +242,7 @@ func extractData(dataReader io.Reader, options *ExtractOptions) error {
 			break
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		sourcePath := tarHeader.Name
@@ -180,12 +274,18 @@ func extractData(dataReader io.Reader, options *ExtractOptions) error {
 				// Base directory for extracted content. Relevant mainly to preserve
 				// the metadata, since the extracted content itself will also create
 				// any missing directories unaccounted for in the options.
-				err := fsutil.Create(&fsutil.CreateOptions{
-					Path: filepath.Join(options.TargetDir, sourcePath),
-					Mode: tarHeader.FileInfo().Mode(),
+				err := target.Create(&fsutil.CreateOptions{
+					Path:   sourcePath,
+					Mode:   tarHeader.FileInfo().Mode(),
+					UID:    tarHeader.Uid,
+					GID:    tarHeader.Gid,
+					Xattrs: Xattrs(tarHeader),
 				})
 				if err != nil {
-					return err
+					return nil, err
+				}
+				if options.Created != nil {
+					options.Created(sourcePath, tarHeader)
 				}
 				continue
 			}
@@ -201,7 +301,7 @@ func extractData(dataReader io.Reader, options *ExtractOptions) error {
 			// is speed over memory efficiency.
 			data, err := ioutil.ReadAll(tarReader)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			contentCache = data
 		}
@@ -211,23 +311,59 @@ func extractData(dataReader io.Reader, options *ExtractOptions) error {
 			if contentIsCached {
 				pathReader = bytes.NewReader(contentCache)
 			}
-			var targetPath string
+			relPath := sourcePath
 			if globPath == "" {
-				targetPath = filepath.Join(options.TargetDir, extractInfo.Path)
-			} else {
-				targetPath = filepath.Join(options.TargetDir, sourcePath)
+				relPath = extractInfo.Path
 			}
+			// Overrides apply only to this target path, so work on a copy.
+			header := *tarHeader
 			if extractInfo.Mode != 0 {
-				tarHeader.Mode = int64(extractInfo.Mode)
+				header.Mode = int64(extractInfo.Mode)
+			}
+			if extractInfo.UID != nil {
+				header.Uid = *extractInfo.UID
+			}
+			if extractInfo.GID != nil {
+				header.Gid = *extractInfo.GID
 			}
-			err := fsutil.Create(&fsutil.CreateOptions{
-				Path: targetPath,
-				Mode: tarHeader.FileInfo().Mode(),
-				Data: pathReader,
-				Link: tarHeader.Linkname,
+			if extractInfo.Xattrs != nil {
+				header.PAXRecords = addXattrs(header.PAXRecords, extractInfo.Xattrs)
+			}
+			link := header.Linkname
+			if header.Typeflag == tar.TypeLink {
+				linkSource := sourceLinkPath(header.Linkname)
+				link = extracted[linkSource]
+				if link == "" {
+					pendingLinks = append(pendingLinks, &pendingLink{
+						source: linkSource,
+						path:   relPath,
+						header: header,
+					})
+					if globPath != "" {
+						break
+					}
+					continue
+				}
+			}
+			err := target.Create(&fsutil.CreateOptions{
+				Path:     relPath,
+				Mode:     header.FileInfo().Mode(),
+				Data:     pathReader,
+				Link:     link,
+				UID:      header.Uid,
+				GID:      header.Gid,
+				DevMajor: uint32(header.Devmajor),
+				DevMinor: uint32(header.Devminor),
+				Xattrs:   Xattrs(&header),
 			})
 			if err != nil {
-				return err
+				return nil, err
+			}
+			if header.Typeflag == tar.TypeReg && extracted[sourcePath] == "" {
+				extracted[sourcePath] = relPath
+			}
+			if options.Created != nil {
+				options.Created(relPath, &header)
 			}
 			if globPath != "" {
 				break
@@ -241,12 +377,104 @@ func extractData(dataReader io.Reader, options *ExtractOptions) error {
 			pendingList = append(pendingList, pendingPath)
 		}
 		if len(pendingList) == 1 {
-			return fmt.Errorf("no content at %s", pendingList[0])
+			return nil, fmt.Errorf("no content at %s", pendingList[0])
 		} else {
 			sort.Strings(pendingList)
-			return fmt.Errorf("no content at:\n- %s", strings.Join(pendingList, "\n- "))
+			return nil, fmt.Errorf("no content at:\n- %s", strings.Join(pendingList, "\n- "))
 		}
 	}
 
+	return pendingLinks, nil
+}
+
+// extractLinkTargets copies the content of the hard link targets which
+// were not extracted into the first of the pending links to each of them,
+// and links the others to it.
+func extractLinkTargets(dataReader io.Reader, pendingLinks []*pendingLink, target fsutil.Root, options *ExtractOptions) error {
+	bySource := make(map[string][]*pendingLink)
+	for _, link := range pendingLinks {
+		bySource[link.source] = append(bySource[link.source], link)
+	}
+	tarReader := tar.NewReader(dataReader)
+	for len(bySource) > 0 {
+		tarHeader, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sourcePath := sourceLinkPath(tarHeader.Name)
+		links := bySource[sourcePath]
+		if links == nil || tarHeader.Typeflag != tar.TypeReg {
+			continue
+		}
+		delete(bySource, sourcePath)
+		var firstPath string
+		for _, link := range links {
+			header := link.header
+			header.Typeflag = tar.TypeReg
+			header.PAXRecords = addXattrs(tarHeader.PAXRecords, Xattrs(&link.header))
+			err := target.Create(&fsutil.CreateOptions{
+				Path:   link.path,
+				Mode:   header.FileInfo().Mode(),
+				Data:   tarReader,
+				Link:   firstPath,
+				UID:    header.Uid,
+				GID:    header.Gid,
+				Xattrs: Xattrs(&header),
+			})
+			if err != nil {
+				return err
+			}
+			if firstPath == "" {
+				firstPath = link.path
+			}
+			if options.Created != nil {
+				options.Created(link.path, &header)
+			}
+		}
+	}
+	for _, link := range pendingLinks {
+		if bySource[link.source] != nil {
+			return fmt.Errorf("cannot extract hard link %s: no content at %s", link.path, link.source)
+		}
+	}
 	return nil
 }
+
+// xattrPrefix prefixes the names of extended attributes in PAX records.
+const xattrPrefix = "SCHILY.xattr."
+
+// Xattrs returns the extended attributes in the PAX records of header.
+func Xattrs(header *tar.Header) map[string]string {
+	var xattrs map[string]string
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, xattrPrefix) {
+			continue
+		}
+		if xattrs == nil {
+			xattrs = make(map[string]string)
+		}
+		xattrs[key[len(xattrPrefix):]] = value
+	}
+	return xattrs
+}
+
+// addXattrs returns a copy of records with the extended attributes added.
+func addXattrs(records map[string]string, xattrs map[string]string) map[string]string {
+	result := make(map[string]string, len(records)+len(xattrs))
+	for key, value := range records {
+		result[key] = value
+	}
+	for name, value := range xattrs {
+		result[xattrPrefix+name] = value
+	}
+	return result
+}
+
+// sourceLinkPath returns the package path for the name of a tarball entry,
+// as used in hard link targets.
+func sourceLinkPath(name string) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(name, "."), "/")
+}
@@ -1,11 +1,17 @@
 package deb_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
 
 	. "gopkg.in/check.v1"
 
 	"github.com/canonical/chisel/internal/deb"
+	"github.com/canonical/chisel/internal/fsutil"
 	"github.com/canonical/chisel/internal/testutil"
 )
 
@@ -48,7 +54,7 @@ var extractTests = []extractTest{{
 		},
 	},
 	result: map[string]string{
-		"/tmp/":               "dir 01775",
+		"/tmp/":               "dir 01777",
 		"/usr/":               "dir 0755",
 		"/usr/bin/":           "dir 0755",
 		"/usr/bin/hello":      "file 0775 eaf29575",
@@ -263,7 +269,7 @@ var extractTests = []extractTest{{
 		"/etc/":     "dir 0755",
 		"/usr/":     "dir 0755",
 		"/usr/bin/": "dir 0755",
-		"/tmp/":     "dir 01775",
+		"/tmp/":     "dir 01777",
 	},
 }, {
 	summary: "Optional entries mixed in cannot be missing",
@@ -311,3 +317,192 @@ func (s *S) TestExtract(c *C) {
 		c.Assert(result, DeepEquals, test.result)
 	}
 }
+
+func (s *S) TestExtractControl(c *C) {
+	var control string
+	options := deb.ExtractOptions{
+		Package:   "base-files",
+		TargetDir: c.MkDir(),
+		Control: func(data string) error {
+			control = data
+			return nil
+		},
+	}
+	err := deb.Extract(bytes.NewBuffer(testutil.PackageData["base-files"]), &options)
+	c.Assert(err, IsNil)
+	c.Assert(control, Matches, "(?s)Package: base-files\n.*Architecture: amd64\n.*")
+
+	options.Control = func(data string) error {
+		return fmt.Errorf("failed")
+	}
+	err = deb.Extract(bytes.NewBuffer(testutil.PackageData["base-files"]), &options)
+	c.Assert(err, ErrorMatches, `cannot extract from package "base-files": failed`)
+}
+
+func (s *S) TestExtractCreated(c *C) {
+	var created []string
+	options := deb.ExtractOptions{
+		Package:   "base-files",
+		TargetDir: c.MkDir(),
+		Extract: map[string][]deb.ExtractInfo{
+			"/usr/bin/hello": []deb.ExtractInfo{{
+				Path: "/usr/bin/hallo",
+			}},
+			"/etc/d*": []deb.ExtractInfo{{
+				Path: "/etc/d*",
+			}},
+		},
+		Created: func(path string, header *tar.Header) {
+			created = append(created, path)
+		},
+	}
+	err := deb.Extract(bytes.NewBuffer(testutil.PackageData["base-files"]), &options)
+	c.Assert(err, IsNil)
+	c.Assert(created, DeepEquals, []string{"/etc/debian_version", "/usr/", "/usr/bin/", "/usr/bin/hallo"})
+}
+
+var hardLinkPkg = testutil.MustMakeDeb("Package: mypkg\n", []testutil.TarEntry{
+	testutil.Dir(0755, "./"),
+	testutil.Dir(0755, "./usr/"),
+	testutil.Dir(0755, "./usr/bin/"),
+	testutil.Reg(0755, "./usr/bin/multi", "data"),
+	testutil.Hln(0755, "./usr/bin/one", "./usr/bin/multi"),
+	testutil.Hln(0755, "./usr/bin/two", "./usr/bin/multi"),
+})
+
+func (s *S) TestExtractHardLinks(c *C) {
+	dir := c.MkDir()
+	err := deb.Extract(bytes.NewReader(hardLinkPkg), &deb.ExtractOptions{
+		Package:   "mypkg",
+		TargetDir: dir,
+		Extract: map[string][]deb.ExtractInfo{
+			"/usr/bin/multi": []deb.ExtractInfo{{Path: "/usr/bin/multi"}},
+			"/usr/bin/one":   []deb.ExtractInfo{{Path: "/usr/bin/one"}},
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(dir), DeepEquals, map[string]string{
+		"/usr/":          "dir 0755",
+		"/usr/bin/":      "dir 0755",
+		"/usr/bin/multi": "file 0755 3a6eb079",
+		"/usr/bin/one":   "file 0755 3a6eb079",
+	})
+	assertSameFile(c, filepath.Join(dir, "/usr/bin/multi"), filepath.Join(dir, "/usr/bin/one"))
+
+	// The link target is not extracted, so its content is copied.
+	dir = c.MkDir()
+	var created []string
+	err = deb.Extract(bytes.NewReader(hardLinkPkg), &deb.ExtractOptions{
+		Package:   "mypkg",
+		TargetDir: dir,
+		Extract: map[string][]deb.ExtractInfo{
+			"/usr/bin/one": []deb.ExtractInfo{{Path: "/usr/bin/one"}},
+			"/usr/bin/two": []deb.ExtractInfo{{Path: "/usr/bin/two"}},
+		},
+		Created: func(path string, header *tar.Header) {
+			created = append(created, path)
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(dir), DeepEquals, map[string]string{
+		"/usr/":        "dir 0755",
+		"/usr/bin/":    "dir 0755",
+		"/usr/bin/one": "file 0755 3a6eb079",
+		"/usr/bin/two": "file 0755 3a6eb079",
+	})
+	assertSameFile(c, filepath.Join(dir, "/usr/bin/one"), filepath.Join(dir, "/usr/bin/two"))
+	c.Assert(created, DeepEquals, []string{"/usr/", "/usr/bin/", "/usr/bin/one", "/usr/bin/two"})
+
+	// Copying the content requires reading the package again.
+	err = deb.Extract(bytes.NewBuffer(hardLinkPkg), &deb.ExtractOptions{
+		Package:   "mypkg",
+		TargetDir: c.MkDir(),
+		Extract: map[string][]deb.ExtractInfo{
+			"/usr/bin/one": []deb.ExtractInfo{{Path: "/usr/bin/one"}},
+		},
+	})
+	c.Assert(err, ErrorMatches, `cannot extract from package "mypkg": cannot extract hard link /usr/bin/one: package cannot be read again`)
+}
+
+func assertSameFile(c *C, path1, path2 string) {
+	finfo1, err := os.Stat(path1)
+	c.Assert(err, IsNil)
+	finfo2, err := os.Stat(path2)
+	c.Assert(err, IsNil)
+	c.Assert(os.SameFile(finfo1, finfo2), Equals, true)
+}
+
+func (s *S) TestExtractSpecialFiles(c *C) {
+	pkgData := testutil.MustMakeDeb("Package: mypkg\n", []testutil.TarEntry{
+		testutil.Dir(0755, "./"),
+		testutil.Dir(0755, "./dev/"),
+		testutil.Fifo(0620, "./dev/initctl"),
+		testutil.Chr(0666, "./dev/null", 1, 3),
+	})
+	dir := c.MkDir()
+	err := deb.Extract(bytes.NewReader(pkgData), &deb.ExtractOptions{
+		Package:   "mypkg",
+		TargetDir: dir,
+		Extract: map[string][]deb.ExtractInfo{
+			"/dev/initctl": []deb.ExtractInfo{{Path: "/dev/initctl"}},
+			"/dev/null":    []deb.ExtractInfo{{Path: "/dev/null"}},
+		},
+	})
+	c.Assert(err, IsNil)
+	result := map[string]string{
+		"/dev/":        "dir 0755",
+		"/dev/initctl": "fifo 0620",
+	}
+	// Devices are only created when running as root.
+	if os.Geteuid() == 0 {
+		result["/dev/null"] = "chardev 0666"
+	}
+	c.Assert(testutil.TreeDump(dir), DeepEquals, result)
+}
+
+func (s *S) TestExtractXattrs(c *C) {
+	caps, err := fsutil.EncodeCapabilities("cap_net_raw=ep")
+	c.Assert(err, IsNil)
+	entry := testutil.Reg(0755, "./usr/bin/ping", "data")
+	entry.Header.PAXRecords = map[string]string{
+		"SCHILY.xattr." + fsutil.CapabilityXattr: caps,
+	}
+	pkgData := testutil.MustMakeDeb("Package: mypkg\n", []testutil.TarEntry{
+		testutil.Dir(0755, "./"),
+		testutil.Dir(0755, "./usr/"),
+		testutil.Dir(0755, "./usr/bin/"),
+		entry,
+		testutil.Reg(0755, "./usr/bin/pong", "data"),
+	})
+
+	dir := c.MkDir()
+	xattrs := make(map[string]map[string]string)
+	err = deb.Extract(bytes.NewReader(pkgData), &deb.ExtractOptions{
+		Package:   "mypkg",
+		TargetDir: dir,
+		Extract: map[string][]deb.ExtractInfo{
+			"/usr/bin/ping": []deb.ExtractInfo{{Path: "/usr/bin/ping"}},
+			"/usr/bin/pong": []deb.ExtractInfo{{
+				Path:   "/usr/bin/pong",
+				Xattrs: map[string]string{"user.comment": "pong"},
+			}},
+		},
+		Created: func(path string, header *tar.Header) {
+			xattrs[path] = deb.Xattrs(header)
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(xattrs, DeepEquals, map[string]map[string]string{
+		"/usr/":         nil,
+		"/usr/bin/":     nil,
+		"/usr/bin/ping": {fsutil.CapabilityXattr: caps},
+		"/usr/bin/pong": {"user.comment": "pong"},
+	})
+
+	if os.Geteuid() == 0 {
+		value := make([]byte, 64)
+		n, err := syscall.Getxattr(filepath.Join(dir, "/usr/bin/ping"), fsutil.CapabilityXattr, value)
+		c.Assert(err, IsNil)
+		c.Assert(string(value[:n]), Equals, caps)
+	}
+}
@@ -0,0 +1,23 @@
+package deb
+
+import (
+	"strings"
+)
+
+// StatusEntry returns the entry describing the package with the provided
+// control data as installed in a dpkg status database.
+func StatusEntry(controlData string) string {
+	var entry strings.Builder
+	lines := strings.Split(strings.TrimSpace(controlData), "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "Status:") {
+			continue
+		}
+		entry.WriteString(line)
+		entry.WriteByte('\n')
+		if strings.HasPrefix(line, "Package:") {
+			entry.WriteString("Status: install ok installed\n")
+		}
+	}
+	return entry.String()
+}
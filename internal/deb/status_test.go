@@ -0,0 +1,24 @@
+package deb_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/deb"
+)
+
+var statusEntryTests = []struct {
+	control string
+	entry   string
+}{{
+	control: "Package: mypkg\nVersion: 1.0\nArchitecture: amd64\n",
+	entry:   "Package: mypkg\nStatus: install ok installed\nVersion: 1.0\nArchitecture: amd64\n",
+}, {
+	control: "Package: mypkg\nStatus: deinstall ok config-files\nVersion: 1.0\nDescription: Summary\n Long description.\n\n",
+	entry:   "Package: mypkg\nStatus: install ok installed\nVersion: 1.0\nDescription: Summary\n Long description.\n",
+}}
+
+func (s *S) TestStatusEntry(c *C) {
+	for _, test := range statusEntryTests {
+		c.Assert(deb.StatusEntry(test.control), Equals, test.entry)
+	}
+}
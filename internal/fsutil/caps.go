@@ -0,0 +1,115 @@
+package fsutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// CapabilityXattr is the extended attribute holding file capabilities.
+const CapabilityXattr = "security.capability"
+
+var capNames = map[string]uint{
+	"cap_chown":              0,
+	"cap_dac_override":       1,
+	"cap_dac_read_search":    2,
+	"cap_fowner":             3,
+	"cap_fsetid":             4,
+	"cap_kill":               5,
+	"cap_setgid":             6,
+	"cap_setuid":             7,
+	"cap_setpcap":            8,
+	"cap_linux_immutable":    9,
+	"cap_net_bind_service":   10,
+	"cap_net_broadcast":      11,
+	"cap_net_admin":          12,
+	"cap_net_raw":            13,
+	"cap_ipc_lock":           14,
+	"cap_ipc_owner":          15,
+	"cap_sys_module":         16,
+	"cap_sys_rawio":          17,
+	"cap_sys_chroot":         18,
+	"cap_sys_ptrace":         19,
+	"cap_sys_pacct":          20,
+	"cap_sys_admin":          21,
+	"cap_sys_boot":           22,
+	"cap_sys_nice":           23,
+	"cap_sys_resource":       24,
+	"cap_sys_time":           25,
+	"cap_sys_tty_config":     26,
+	"cap_mknod":              27,
+	"cap_lease":              28,
+	"cap_audit_write":        29,
+	"cap_audit_control":      30,
+	"cap_setfcap":            31,
+	"cap_mac_override":       32,
+	"cap_mac_admin":          33,
+	"cap_syslog":             34,
+	"cap_wake_alarm":         35,
+	"cap_block_suspend":      36,
+	"cap_audit_read":         37,
+	"cap_perfmon":            38,
+	"cap_bpf":                39,
+	"cap_checkpoint_restore": 40,
+}
+
+const (
+	vfsCapRevision2       = 0x02000000
+	vfsCapFlagsEffective  = 0x000001
+	vfsCapRevision2Length = 20
+)
+
+// EncodeCapabilities returns the value of the security.capability extended
+// attribute for the file capabilities in text, written as by getcap in
+// clauses such as "cap_net_raw,cap_net_admin=ep". The effective flag
+// applies to the whole file, so it is set when any clause includes it.
+func EncodeCapabilities(text string) (string, error) {
+	var permitted, inheritable uint64
+	var effective bool
+	clauses := strings.Fields(text)
+	if len(clauses) == 0 {
+		return "", fmt.Errorf("invalid capabilities: %q", text)
+	}
+	for _, clause := range clauses {
+		i := strings.IndexAny(clause, "+=")
+		if i < 0 {
+			return "", fmt.Errorf("invalid capabilities: %q", text)
+		}
+		var caps uint64
+		for _, name := range strings.Split(clause[:i], ",") {
+			bit, ok := capNames[strings.ToLower(name)]
+			if !ok {
+				return "", fmt.Errorf("invalid capability: %q", name)
+			}
+			caps |= 1 << bit
+		}
+		flags := clause[i+1:]
+		if flags == "" {
+			return "", fmt.Errorf("invalid capabilities: %q", text)
+		}
+		for _, flag := range flags {
+			switch flag {
+			case 'e':
+				effective = true
+			case 'p':
+				permitted |= caps
+			case 'i':
+				inheritable |= caps
+			default:
+				return "", fmt.Errorf("invalid capability flag in %q: %q", clause, flag)
+			}
+		}
+	}
+
+	data := make([]byte, vfsCapRevision2Length)
+	magic := uint32(vfsCapRevision2)
+	if effective {
+		magic |= vfsCapFlagsEffective
+	}
+	binary.LittleEndian.PutUint32(data[0:], magic)
+	binary.LittleEndian.PutUint32(data[4:], uint32(permitted))
+	binary.LittleEndian.PutUint32(data[8:], uint32(inheritable))
+	binary.LittleEndian.PutUint32(data[12:], uint32(permitted>>32))
+	binary.LittleEndian.PutUint32(data[16:], uint32(inheritable>>32))
+	return string(data), nil
+}
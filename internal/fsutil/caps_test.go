@@ -0,0 +1,52 @@
+package fsutil_test
+
+import (
+	"encoding/hex"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/fsutil"
+)
+
+var encodeCapabilitiesTests = []struct {
+	text  string
+	value string
+	error string
+}{{
+	text:  "cap_net_raw=ep",
+	value: "0100000200200000000000000000000000000000",
+}, {
+	text:  "cap_net_raw,CAP_NET_ADMIN+p",
+	value: "0000000200300000000000000000000000000000",
+}, {
+	text:  "cap_chown=i cap_bpf=p",
+	value: "0000000200000000010000008000000000000000",
+}, {
+	text:  "",
+	error: `invalid capabilities: ""`,
+}, {
+	text:  "cap_net_raw",
+	error: `invalid capabilities: "cap_net_raw"`,
+}, {
+	text:  "cap_net_raw=",
+	error: `invalid capabilities: "cap_net_raw="`,
+}, {
+	text:  "cap_foo=ep",
+	error: `invalid capability: "cap_foo"`,
+}, {
+	text:  "cap_net_raw=ex",
+	error: `invalid capability flag in "cap_net_raw=ex": 'x'`,
+}}
+
+func (s *S) TestEncodeCapabilities(c *C) {
+	for _, test := range encodeCapabilitiesTests {
+		c.Logf("Text: %q", test.text)
+		value, err := fsutil.EncodeCapabilities(test.text)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(hex.EncodeToString([]byte(value)), Equals, test.value)
+	}
+}
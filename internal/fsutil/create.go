@@ -6,28 +6,117 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 type CreateOptions struct {
 	Path string
 	Mode fs.FileMode
 	Data io.Reader
+	// Link is the target of a symlink, or of a hard link when the
+	// mode is of a regular file.
 	Link string
+	// UID and GID define the ownership of the entry, which is only
+	// changed when running as root.
+	UID int
+	GID int
+	// DevMajor and DevMinor define the number of a device.
+	DevMajor uint32
+	DevMinor uint32
+	// Xattrs holds extended attributes to set on the entry, which are
+	// skipped when not permitted.
+	Xattrs map[string]string
 }
 
 func Create(o *CreateOptions) error {
 	var err error
 	switch o.Mode & fs.ModeType {
 	case 0:
+		if o.Link != "" {
+			// The hard link shares the mode and ownership of its target.
+			return createHardLink(o)
+		}
 		err = createFile(o)
 	case fs.ModeDir:
 		err = createDir(o)
 	case fs.ModeSymlink:
 		err = createSymlink(o)
+	case fs.ModeNamedPipe:
+		err = createNode(o)
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+		if os.Geteuid() != 0 {
+			logf("Skipping device %s: creating devices requires root privileges", o.Path)
+			return nil
+		}
+		err = createNode(o)
 	default:
 		err = fmt.Errorf("unsupported file type: %s", o.Path)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	err = changeOwner(o)
+	if err != nil {
+		return err
+	}
+	// Changing the ownership drops file capabilities, so these go last.
+	return setXattrs(o)
+}
+
+// specialModes holds the mode bits which may be dropped on creation or
+// when changing ownership, and so must be applied again afterwards.
+const specialModes = fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+func changeOwner(o *CreateOptions) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	debugf("Changing owner: %s (%d:%d)", o.Path, o.UID, o.GID)
+	err := os.Lchown(o.Path, o.UID, o.GID)
+	if err != nil {
+		return err
+	}
+	if o.Mode&specialModes != 0 && o.Mode&fs.ModeSymlink == 0 {
+		return os.Chmod(o.Path, o.Mode)
+	}
+	return nil
+}
+
+func setXattrs(o *CreateOptions) error {
+	if len(o.Xattrs) == 0 {
+		return nil
+	}
+	if o.Mode&fs.ModeSymlink != 0 {
+		logf("Skipping extended attributes of symlink %s", o.Path)
+		return nil
+	}
+	return SetXattrs(o.Path, o.Xattrs)
+}
+
+// SetXattrs sets the extended attributes of the entry at path, skipping
+// the ones which are not permitted.
+func SetXattrs(path string, xattrs map[string]string) error {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		debugf("Setting extended attribute: %s (%s)", path, name)
+		err := syscall.Setxattr(path, name, []byte(xattrs[name]), 0)
+		if err == syscall.EPERM || err == syscall.EACCES || err == syscall.ENOTSUP {
+			logf("Cannot set extended attribute %s on %s: %v", name, path, err)
+			continue
+		}
+		if err != nil {
+			return &os.PathError{Op: "setxattr", Path: path, Err: err}
+		}
+	}
+	return nil
 }
 
 func createDir(o *CreateOptions) error {
@@ -37,7 +126,8 @@ func createDir(o *CreateOptions) error {
 		return err
 	}
 	err = os.Mkdir(o.Path, o.Mode)
-	if os.IsExist(err) {
+	if os.IsExist(err) || err == nil && o.Mode&specialModes != 0 {
+		// The setgid bit in particular is ignored by mkdir.
 		err = os.Chmod(o.Path, o.Mode)
 	}
 	return err
@@ -67,5 +157,88 @@ func createSymlink(o *CreateOptions) error {
 	if err != nil && !os.IsExist(err) {
 		return err
 	}
-	return os.Symlink(o.Link, o.Path)
+	return replaceExisting(o.Path, func() error {
+		return os.Symlink(o.Link, o.Path)
+	})
+}
+
+func createHardLink(o *CreateOptions) error {
+	debugf("Creating hard link: %s => %s", o.Path, o.Link)
+	err := os.MkdirAll(filepath.Dir(o.Path), 0755)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	return replaceExisting(o.Path, func() error {
+		return os.Link(o.Link, o.Path)
+	})
+}
+
+func createNode(o *CreateOptions) error {
+	debugf("Creating node: %s (mode %#o)", o.Path, o.Mode)
+	err := os.MkdirAll(filepath.Dir(o.Path), 0755)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	var nodeMode uint32
+	switch o.Mode & fs.ModeType {
+	case fs.ModeNamedPipe:
+		nodeMode = syscall.S_IFIFO
+	case fs.ModeDevice:
+		nodeMode = syscall.S_IFBLK
+	default:
+		nodeMode = syscall.S_IFCHR
+	}
+	err = replaceExisting(o.Path, func() error {
+		err := syscall.Mknod(o.Path, nodeMode|uint32(o.Mode.Perm()), mkdev(o.DevMajor, o.DevMinor))
+		if err != nil {
+			return &os.PathError{Op: "mknod", Path: o.Path, Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The mode given to mknod is subject to the umask.
+	return os.Chmod(o.Path, o.Mode)
+}
+
+// replaceExisting calls create, and when the entry at path already exists,
+// as when cutting again into the same root, replaces it with the one
+// created. Directories are never replaced.
+func replaceExisting(path string, create func() error) error {
+	err := create()
+	if !os.IsExist(err) {
+		return err
+	}
+	finfo, lstatErr := os.Lstat(path)
+	if lstatErr != nil || finfo.IsDir() {
+		return err
+	}
+	debugf("Replacing existing entry: %s", path)
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+	return create()
+}
+
+// mkdev returns the device number with the given major and minor numbers,
+// as encoded by glibc.
+func mkdev(major, minor uint32) int {
+	dev := uint64(minor&0xff) |
+		uint64(major&0xfff)<<8 |
+		uint64(minor&^0xff)<<12 |
+		uint64(major&^0xfff)<<32
+	return int(dev)
+}
+
+// SetModTime sets the modification and access times of the entry at path,
+// which is not followed if it is a symlink.
+func SetModTime(path string, mtime time.Time) error {
+	ts := unix.NsecToTimespec(mtime.UnixNano())
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return &os.PathError{Op: "utimensat", Path: path, Err: err}
+	}
+	return nil
 }
@@ -3,7 +3,10 @@ package fsutil_test
 import (
 	"bytes"
 	"io/fs"
+	"os"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	. "gopkg.in/check.v1"
 
@@ -54,6 +57,34 @@ var createTests = []createTest{{
 	result: map[string]string{
 		"/tmp/":     "dir 01775",
 	},
+}, {
+	options: fsutil.CreateOptions{
+		Path: "foo",
+		Mode: fs.ModeDir | fs.ModeSetgid | 02775,
+	},
+	result: map[string]string{
+		"/foo/": "dir 02775",
+	},
+}, {
+	options: fsutil.CreateOptions{
+		Path: "foo",
+		Data: bytes.NewBufferString("data1"),
+		Mode: fs.ModeSetuid | 0755,
+		UID:  1000,
+		GID:  1000,
+	},
+	result: map[string]string{
+		"/foo": "file 04755 5b41362b",
+	},
+}, {
+	options: fsutil.CreateOptions{
+		Path: "foo/bar",
+		Mode: fs.ModeNamedPipe | 0620,
+	},
+	result: map[string]string{
+		"/foo/":    "dir 0755",
+		"/foo/bar": "fifo 0620",
+	},
 }}
 
 func (s *S) TestCreate(c *C) {
@@ -74,3 +105,200 @@ func (s *S) TestCreate(c *C) {
 		c.Assert(result, DeepEquals, test.result)
 	}
 }
+
+func (s *S) TestCreateOwnership(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("ownership may only be changed as root")
+	}
+
+	dir := c.MkDir()
+	for _, options := range []fsutil.CreateOptions{{
+		Path: filepath.Join(dir, "file"),
+		Data: bytes.NewBufferString("data1"),
+		Mode: fs.ModeSetgid | 0755,
+		UID:  1000,
+		GID:  2000,
+	}, {
+		Path: filepath.Join(dir, "dir"),
+		Mode: fs.ModeDir | 0755,
+		UID:  1000,
+		GID:  2000,
+	}, {
+		Path: filepath.Join(dir, "link"),
+		Link: "file",
+		Mode: fs.ModeSymlink,
+		UID:  1000,
+		GID:  2000,
+	}} {
+		err := fsutil.Create(&options)
+		c.Assert(err, IsNil)
+		finfo, err := os.Lstat(options.Path)
+		c.Assert(err, IsNil)
+		stat := finfo.Sys().(*syscall.Stat_t)
+		c.Assert(stat.Uid, Equals, uint32(1000))
+		c.Assert(stat.Gid, Equals, uint32(2000))
+		// Changing the ownership must not drop the setgid bit.
+		c.Assert(finfo.Mode()&fs.ModeSetgid, Equals, options.Mode&fs.ModeSetgid)
+	}
+}
+
+func (s *S) TestCreateHardLink(c *C) {
+	dir := c.MkDir()
+	err := fsutil.Create(&fsutil.CreateOptions{
+		Path: filepath.Join(dir, "foo"),
+		Data: bytes.NewBufferString("data1"),
+		Mode: 0644,
+	})
+	c.Assert(err, IsNil)
+	err = fsutil.Create(&fsutil.CreateOptions{
+		Path: filepath.Join(dir, "bar/baz"),
+		Link: filepath.Join(dir, "foo"),
+		Mode: 0600,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(dir), DeepEquals, map[string]string{
+		"/bar/":    "dir 0755",
+		"/bar/baz": "file 0644 5b41362b",
+		"/foo":     "file 0644 5b41362b",
+	})
+	finfo1, err := os.Stat(filepath.Join(dir, "foo"))
+	c.Assert(err, IsNil)
+	finfo2, err := os.Stat(filepath.Join(dir, "bar/baz"))
+	c.Assert(err, IsNil)
+	c.Assert(os.SameFile(finfo1, finfo2), Equals, true)
+}
+
+func (s *S) TestCreateExisting(c *C) {
+	dir := c.MkDir()
+	create := func(data, link string) error {
+		for _, options := range []fsutil.CreateOptions{{
+			Path: filepath.Join(dir, "dir"),
+			Mode: fs.ModeDir | 0755,
+		}, {
+			Path: filepath.Join(dir, "dir/file"),
+			Data: bytes.NewBufferString(data),
+			Mode: 0644,
+		}, {
+			Path: filepath.Join(dir, "dir/hardlink"),
+			Link: filepath.Join(dir, "dir/file"),
+			Mode: 0644,
+		}, {
+			Path: filepath.Join(dir, "dir/symlink"),
+			Link: link,
+			Mode: fs.ModeSymlink | 0777,
+		}, {
+			Path: filepath.Join(dir, "dir/fifo"),
+			Mode: fs.ModeNamedPipe | 0620,
+		}} {
+			err := fsutil.Create(&options)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Creating the same entries again into the same directory replaces them.
+	err := create("data1", "file")
+	c.Assert(err, IsNil)
+	err = create("data2", "hardlink")
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(dir), DeepEquals, map[string]string{
+		"/dir/":         "dir 0755",
+		"/dir/fifo":     "fifo 0620",
+		"/dir/file":     "file 0644 d98cf53e",
+		"/dir/hardlink": "file 0644 d98cf53e",
+		"/dir/symlink":  "symlink hardlink",
+	})
+	finfo1, err := os.Stat(filepath.Join(dir, "dir/file"))
+	c.Assert(err, IsNil)
+	finfo2, err := os.Stat(filepath.Join(dir, "dir/hardlink"))
+	c.Assert(err, IsNil)
+	c.Assert(os.SameFile(finfo1, finfo2), Equals, true)
+
+	// Directories are not replaced.
+	err = fsutil.Create(&fsutil.CreateOptions{
+		Path: filepath.Join(dir, "dir"),
+		Link: "other",
+		Mode: fs.ModeSymlink | 0777,
+	})
+	c.Assert(err, ErrorMatches, "symlink other .*/dir: file exists")
+}
+
+func (s *S) TestCreateDevice(c *C) {
+	dir := c.MkDir()
+	options := fsutil.CreateOptions{
+		Path:     filepath.Join(dir, "null"),
+		Mode:     fs.ModeDevice | fs.ModeCharDevice | 0666,
+		DevMajor: 1,
+		DevMinor: 3,
+	}
+	err := fsutil.Create(&options)
+	c.Assert(err, IsNil)
+	if os.Geteuid() != 0 {
+		// Devices are skipped without root privileges.
+		c.Assert(testutil.TreeDump(dir), DeepEquals, map[string]string{})
+		return
+	}
+	c.Assert(testutil.TreeDump(dir), DeepEquals, map[string]string{
+		"/null": "chardev 0666",
+	})
+	finfo, err := os.Lstat(options.Path)
+	c.Assert(err, IsNil)
+	c.Assert(finfo.Sys().(*syscall.Stat_t).Rdev, Equals, uint64(0x103))
+}
+
+func (s *S) TestCreateXattrs(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("file capabilities may only be set as root")
+	}
+
+	caps, err := fsutil.EncodeCapabilities("cap_net_raw=ep")
+	c.Assert(err, IsNil)
+	options := fsutil.CreateOptions{
+		Path:   filepath.Join(c.MkDir(), "ping"),
+		Data:   bytes.NewBufferString("data1"),
+		Mode:   0755,
+		UID:    1000,
+		Xattrs: map[string]string{fsutil.CapabilityXattr: caps},
+	}
+	err = fsutil.Create(&options)
+	c.Assert(err, IsNil)
+
+	// The capabilities must survive the change of ownership.
+	value := make([]byte, 64)
+	n, err := syscall.Getxattr(options.Path, fsutil.CapabilityXattr, value)
+	c.Assert(err, IsNil)
+	c.Assert(string(value[:n]), Equals, caps)
+}
+
+func (s *S) TestSetModTime(c *C) {
+	dir := c.MkDir()
+	err := fsutil.Create(&fsutil.CreateOptions{
+		Path: filepath.Join(dir, "foo"),
+		Data: bytes.NewBufferString("data1"),
+		Mode: 0644,
+	})
+	c.Assert(err, IsNil)
+	err = fsutil.Create(&fsutil.CreateOptions{
+		Path: filepath.Join(dir, "bar"),
+		Link: "foo",
+		Mode: fs.ModeSymlink,
+	})
+	c.Assert(err, IsNil)
+
+	mtime := time.Unix(1000, 0)
+	err = fsutil.SetModTime(filepath.Join(dir, "bar"), mtime)
+	c.Assert(err, IsNil)
+
+	// The symlink is changed rather than its target.
+	finfo, err := os.Lstat(filepath.Join(dir, "bar"))
+	c.Assert(err, IsNil)
+	c.Assert(finfo.ModTime().Equal(mtime), Equals, true)
+	finfo, err = os.Lstat(filepath.Join(dir, "foo"))
+	c.Assert(err, IsNil)
+	c.Assert(finfo.ModTime().Equal(mtime), Equals, false)
+
+	err = fsutil.SetModTime(filepath.Join(dir, "baz"), mtime)
+	c.Assert(err, ErrorMatches, "utimensat .*/baz: no such file or directory")
+}
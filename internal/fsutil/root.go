@@ -0,0 +1,86 @@
+package fsutil
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Root holds the entries created under it, identified by their paths
+// relative to it, such as "/usr/bin/hello". Dir holds them in an actual
+// directory, while Tree holds them in memory, so that they may be written
+// elsewhere without the privileges required for creating them.
+type Root interface {
+	// Create creates the entry as described in the options, with the
+	// target of hard links also being relative to the root.
+	Create(o *CreateOptions) error
+	Lstat(path string) (fs.FileInfo, error)
+	Readlink(path string) (string, error)
+	Open(path string) (io.ReadCloser, error)
+	Remove(path string) error
+	SetModTime(path string, mtime time.Time) error
+	SetXattrs(path string, xattrs map[string]string) error
+}
+
+// Dir is a Root holding the entries in the directory it names.
+type Dir string
+
+var _ Root = Dir("")
+
+func (d Dir) path(path string) string {
+	return filepath.Join(string(d), path)
+}
+
+func (d Dir) Create(o *CreateOptions) error {
+	dirOptions := *o
+	dirOptions.Path = d.path(o.Path)
+	if o.Mode&fs.ModeType == 0 && o.Link != "" {
+		dirOptions.Link = d.path(o.Link)
+	}
+	return Create(&dirOptions)
+}
+
+func (d Dir) Lstat(path string) (fs.FileInfo, error) {
+	return os.Lstat(d.path(path))
+}
+
+func (d Dir) Readlink(path string) (string, error) {
+	return os.Readlink(d.path(path))
+}
+
+func (d Dir) Open(path string) (io.ReadCloser, error) {
+	return os.Open(d.path(path))
+}
+
+func (d Dir) Remove(path string) error {
+	return os.Remove(d.path(path))
+}
+
+func (d Dir) SetModTime(path string, mtime time.Time) error {
+	return SetModTime(d.path(path), mtime)
+}
+
+func (d Dir) SetXattrs(path string, xattrs map[string]string) error {
+	return SetXattrs(d.path(path), xattrs)
+}
+
+// FileID identifies a file which may be reached through multiple hard links.
+type FileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// LinkInfo returns the identity of the file described by finfo, as
+// obtained with the Lstat method of a Root, and its number of hard links.
+func LinkInfo(finfo fs.FileInfo) (id FileID, nlink uint64) {
+	switch sys := finfo.Sys().(type) {
+	case *syscall.Stat_t:
+		return FileID{uint64(sys.Dev), uint64(sys.Ino)}, uint64(sys.Nlink)
+	case *treeNode:
+		return FileID{0, sys.ino}, sys.nlink
+	}
+	return FileID{}, 1
+}
@@ -0,0 +1,305 @@
+package fsutil
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Tree is a Root holding the entries in memory. Entries are created as
+// they would be in a directory, following the symlinks in the parent
+// directories of a path without leaving the tree, but devices are created
+// without requiring privileges. Only the content, mode, and links of the
+// entries are kept, so their ownership, device numbers, and extended
+// attributes must be recorded elsewhere.
+type Tree struct {
+	nodes   map[string]*treeNode
+	lastIno uint64
+}
+
+var _ Root = (*Tree)(nil)
+
+// treeNode holds the details of an entry, which are shared by all the
+// hard links to it.
+type treeNode struct {
+	ino   uint64
+	nlink uint64
+	mode  fs.FileMode
+	data  []byte
+	link  string
+	mtime time.Time
+}
+
+func NewTree() *Tree {
+	t := &Tree{nodes: make(map[string]*treeNode)}
+	t.nodes["/"] = t.newNode(fs.ModeDir | 0755)
+	return t
+}
+
+func (t *Tree) newNode(mode fs.FileMode) *treeNode {
+	t.lastIno++
+	return &treeNode{ino: t.lastIno, nlink: 1, mode: mode}
+}
+
+// maxLinks is the maximum number of symlinks followed when resolving a path.
+const maxLinks = 40
+
+// resolve returns the path of the entry at path within the tree after
+// following the symlinks of its parent directories, and of the entry
+// itself when follow is set.
+func (t *Tree) resolve(path string, follow bool) (string, error) {
+	resolved := "/"
+	names := strings.Split(filepath.Clean("/"+path), "/")
+	links := 0
+	for len(names) > 0 {
+		name := names[0]
+		names = names[1:]
+		if name == "" {
+			continue
+		}
+		next := filepath.Join(resolved, name)
+		node := t.nodes[next]
+		if node == nil || node.mode&fs.ModeSymlink == 0 || len(names) == 0 && !follow {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxLinks {
+			return "", &fs.PathError{Op: "resolve", Path: path, Err: syscall.ELOOP}
+		}
+		target := node.link
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(resolved, target)
+		}
+		names = append(strings.Split(filepath.Clean(target), "/"), names...)
+		resolved = "/"
+	}
+	return resolved, nil
+}
+
+// lookup returns the path and node of the entry at path, or an error
+// for op if there is none.
+func (t *Tree) lookup(op, path string, follow bool) (string, *treeNode, error) {
+	resolved, err := t.resolve(path, follow)
+	if err != nil {
+		return "", nil, err
+	}
+	node := t.nodes[resolved]
+	if node == nil {
+		return "", nil, &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+	}
+	return resolved, node, nil
+}
+
+// makeParents creates the missing parent directories of the resolved
+// path, as done by os.MkdirAll.
+func (t *Tree) makeParents(path string) error {
+	dir := filepath.Dir(path)
+	if node := t.nodes[dir]; node != nil {
+		if !node.mode.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	err := t.makeParents(dir)
+	if err != nil {
+		return err
+	}
+	t.nodes[dir] = t.newNode(fs.ModeDir | 0755)
+	return nil
+}
+
+// unlink removes the entry at the resolved path, if any, unless it is
+// a directory.
+func (t *Tree) unlink(path string) error {
+	node := t.nodes[path]
+	if node == nil {
+		return nil
+	}
+	if node.mode.IsDir() {
+		return &fs.PathError{Op: "create", Path: path, Err: syscall.EISDIR}
+	}
+	node.nlink--
+	delete(t.nodes, path)
+	return nil
+}
+
+func (t *Tree) Create(o *CreateOptions) error {
+	path, err := t.resolve(o.Path, false)
+	if err != nil {
+		return err
+	}
+	if path == "/" {
+		return nil
+	}
+	err = t.makeParents(path)
+	if err != nil {
+		return err
+	}
+	existing := t.nodes[path]
+	var node *treeNode
+	switch o.Mode & fs.ModeType {
+	case 0:
+		if o.Link != "" {
+			_, node, err = t.lookup("link", o.Link, false)
+			if err != nil {
+				return err
+			}
+			if !node.mode.IsRegular() {
+				return &fs.PathError{Op: "link", Path: o.Link, Err: syscall.EPERM}
+			}
+			if existing == node {
+				return nil
+			}
+			err = t.unlink(path)
+			if err != nil {
+				return err
+			}
+			// The hard link shares the mode of its target.
+			node.nlink++
+			t.nodes[path] = node
+			return nil
+		}
+		var data []byte
+		if o.Data != nil {
+			data, err = ioutil.ReadAll(o.Data)
+			if err != nil {
+				return err
+			}
+		}
+		if existing != nil && existing.mode.IsRegular() {
+			// The content of an existing file is replaced, keeping its mode.
+			existing.data = data
+			return nil
+		}
+		node = t.newNode(o.Mode)
+		node.data = data
+	case fs.ModeDir:
+		if existing != nil {
+			if !existing.mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: o.Path, Err: syscall.EEXIST}
+			}
+			existing.mode = o.Mode
+			return nil
+		}
+		node = t.newNode(o.Mode)
+	case fs.ModeSymlink:
+		node = t.newNode(o.Mode | 0777)
+		node.link = o.Link
+	case fs.ModeNamedPipe, fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+		node = t.newNode(o.Mode)
+	default:
+		return &fs.PathError{Op: "create", Path: o.Path, Err: syscall.EINVAL}
+	}
+	err = t.unlink(path)
+	if err != nil {
+		return err
+	}
+	t.nodes[path] = node
+	return nil
+}
+
+func (t *Tree) Lstat(path string) (fs.FileInfo, error) {
+	resolved, node, err := t.lookup("lstat", path, false)
+	if err != nil {
+		return nil, err
+	}
+	return &treeFileInfo{name: filepath.Base(resolved), node: node}, nil
+}
+
+func (t *Tree) Readlink(path string) (string, error) {
+	_, node, err := t.lookup("readlink", path, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: path, Err: syscall.EINVAL}
+	}
+	return node.link, nil
+}
+
+func (t *Tree) Open(path string) (io.ReadCloser, error) {
+	_, node, err := t.lookup("open", path, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsRegular() {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: syscall.EINVAL}
+	}
+	return ioutil.NopCloser(bytes.NewReader(node.data)), nil
+}
+
+func (t *Tree) Remove(path string) error {
+	resolved, node, err := t.lookup("remove", path, false)
+	if err != nil {
+		return err
+	}
+	if resolved == "/" {
+		return &fs.PathError{Op: "remove", Path: path, Err: syscall.EBUSY}
+	}
+	if node.mode.IsDir() {
+		prefix := resolved + "/"
+		for other := range t.nodes {
+			if strings.HasPrefix(other, prefix) {
+				return &fs.PathError{Op: "remove", Path: path, Err: syscall.ENOTEMPTY}
+			}
+		}
+	}
+	node.nlink--
+	delete(t.nodes, resolved)
+	return nil
+}
+
+func (t *Tree) SetModTime(path string, mtime time.Time) error {
+	_, node, err := t.lookup("utimensat", path, false)
+	if err != nil {
+		return err
+	}
+	node.mtime = mtime
+	return nil
+}
+
+// SetXattrs does not keep the extended attributes, as documented in Tree.
+func (t *Tree) SetXattrs(path string, xattrs map[string]string) error {
+	_, _, err := t.lookup("setxattr", path, true)
+	return err
+}
+
+// Paths returns the paths of all the entries in the tree, sorted, with
+// directories having a trailing slash.
+func (t *Tree) Paths() []string {
+	paths := make([]string, 0, len(t.nodes))
+	for path, node := range t.nodes {
+		if node.mode.IsDir() && path != "/" {
+			path += "/"
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// treeFileInfo describes an entry of a tree.
+type treeFileInfo struct {
+	name string
+	node *treeNode
+}
+
+func (fi *treeFileInfo) Name() string       { return fi.name }
+func (fi *treeFileInfo) Mode() fs.FileMode  { return fi.node.mode }
+func (fi *treeFileInfo) ModTime() time.Time { return fi.node.mtime }
+func (fi *treeFileInfo) IsDir() bool        { return fi.node.mode.IsDir() }
+func (fi *treeFileInfo) Sys() interface{}   { return fi.node }
+
+func (fi *treeFileInfo) Size() int64 {
+	if fi.node.mode&fs.ModeSymlink != 0 {
+		return int64(len(fi.node.link))
+	}
+	return int64(len(fi.node.data))
+}
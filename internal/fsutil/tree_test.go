@@ -0,0 +1,262 @@
+package fsutil_test
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/fsutil"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+type treeTest struct {
+	summary string
+	options []fsutil.CreateOptions
+	result  map[string]string
+	error   string
+}
+
+var treeTests = []treeTest{{
+	summary: "Parent directories are created",
+	options: []fsutil.CreateOptions{{
+		Path: "/foo/bar",
+		Data: bytes.NewBufferString("data1"),
+		Mode: 0444,
+	}, {
+		Path: "/foo/baz",
+		Link: "../bar",
+		Mode: fs.ModeSymlink | 0777,
+	}, {
+		Path: "/tmp/",
+		Mode: fs.ModeDir | fs.ModeSticky | 0775,
+	}},
+	result: map[string]string{
+		"/foo/":    "dir 0755",
+		"/foo/bar": "file 0444 5b41362b",
+		"/foo/baz": "symlink ../bar",
+		"/tmp/":    "dir 01775",
+	},
+}, {
+	summary: "Devices and FIFOs are created without privileges",
+	options: []fsutil.CreateOptions{{
+		Path:     "/dev/null",
+		Mode:     fs.ModeDevice | fs.ModeCharDevice | 0666,
+		DevMajor: 1,
+		DevMinor: 3,
+	}, {
+		Path: "/dev/fifo",
+		Mode: fs.ModeNamedPipe | 0620,
+	}},
+	result: map[string]string{
+		"/dev/":     "dir 0755",
+		"/dev/null": "chardev 0666",
+		"/dev/fifo": "fifo 0620",
+	},
+}, {
+	summary: "Symlinks in parent directories are followed within the tree",
+	options: []fsutil.CreateOptions{{
+		Path: "/usr/lib/",
+		Mode: fs.ModeDir | 0755,
+	}, {
+		Path: "/lib",
+		Link: "usr/lib",
+		Mode: fs.ModeSymlink | 0777,
+	}, {
+		Path: "/etc",
+		Link: "/../../var",
+		Mode: fs.ModeSymlink | 0777,
+	}, {
+		Path: "/lib/foo",
+		Data: bytes.NewBufferString("data1"),
+		Mode: 0644,
+	}, {
+		Path: "/etc/bar",
+		Data: bytes.NewBufferString("data2"),
+		Mode: 0644,
+	}},
+	result: map[string]string{
+		"/etc":         "symlink /../../var",
+		"/lib":         "symlink usr/lib",
+		"/usr/":        "dir 0755",
+		"/usr/lib/":    "dir 0755",
+		"/usr/lib/foo": "file 0644 5b41362b",
+		"/var/":        "dir 0755",
+		"/var/bar":     "file 0644 d98cf53e",
+	},
+}, {
+	summary: "Existing entries are replaced",
+	options: []fsutil.CreateOptions{{
+		Path: "/foo",
+		Data: bytes.NewBufferString("data1"),
+		Mode: 0755,
+	}, {
+		Path: "/foo",
+		Data: bytes.NewBufferString("data2"),
+		Mode: 0644,
+	}, {
+		Path: "/bar",
+		Link: "foo",
+		Mode: fs.ModeSymlink | 0777,
+	}, {
+		Path: "/bar",
+		Link: "baz",
+		Mode: fs.ModeSymlink | 0777,
+	}, {
+		Path: "/dir/",
+		Mode: fs.ModeDir | 0755,
+	}, {
+		Path: "/dir/",
+		Mode: fs.ModeDir | 0700,
+	}},
+	result: map[string]string{
+		"/foo":  "file 0755 d98cf53e",
+		"/bar":  "symlink baz",
+		"/dir/": "dir 0700",
+	},
+}, {
+	summary: "Directories are not replaced",
+	options: []fsutil.CreateOptions{{
+		Path: "/foo/",
+		Mode: fs.ModeDir | 0755,
+	}, {
+		Path: "/foo",
+		Link: "bar",
+		Mode: fs.ModeSymlink | 0777,
+	}},
+	error: "create /foo: is a directory",
+}, {
+	summary: "Parent directories must be directories",
+	options: []fsutil.CreateOptions{{
+		Path: "/foo",
+		Data: bytes.NewBufferString("data1"),
+		Mode: 0644,
+	}, {
+		Path: "/foo/bar",
+		Data: bytes.NewBufferString("data2"),
+		Mode: 0644,
+	}},
+	error: "mkdir /foo: not a directory",
+}}
+
+func (s *S) TestTreeCreate(c *C) {
+	for _, test := range treeTests {
+		c.Logf("Summary: %s", test.summary)
+		tree := fsutil.NewTree()
+		var err error
+		for _, options := range test.options {
+			err = tree.Create(&options)
+			if err != nil {
+				break
+			}
+		}
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(testutil.MemTreeDump(tree), DeepEquals, test.result)
+	}
+}
+
+func (s *S) TestTreeHardLink(c *C) {
+	tree := fsutil.NewTree()
+	err := tree.Create(&fsutil.CreateOptions{
+		Path: "/foo",
+		Data: bytes.NewBufferString("data1"),
+		Mode: 0644,
+	})
+	c.Assert(err, IsNil)
+	err = tree.Create(&fsutil.CreateOptions{
+		Path: "/bar/baz",
+		Link: "/foo",
+		Mode: 0600,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.MemTreeDump(tree), DeepEquals, map[string]string{
+		"/bar/":    "dir 0755",
+		"/bar/baz": "file 0644 5b41362b",
+		"/foo":     "file 0644 5b41362b",
+	})
+
+	finfo1, err := tree.Lstat("/foo")
+	c.Assert(err, IsNil)
+	finfo2, err := tree.Lstat("/bar/baz")
+	c.Assert(err, IsNil)
+	id1, nlink1 := fsutil.LinkInfo(finfo1)
+	id2, nlink2 := fsutil.LinkInfo(finfo2)
+	c.Assert(id1, Equals, id2)
+	c.Assert(nlink1, Equals, uint64(2))
+	c.Assert(nlink2, Equals, uint64(2))
+
+	err = tree.Remove("/foo")
+	c.Assert(err, IsNil)
+	_, nlink2 = fsutil.LinkInfo(finfo2)
+	c.Assert(nlink2, Equals, uint64(1))
+
+	err = tree.Create(&fsutil.CreateOptions{
+		Path: "/bar/qux",
+		Link: "/foo",
+		Mode: 0644,
+	})
+	c.Assert(err, ErrorMatches, "link /foo: file does not exist")
+}
+
+func (s *S) TestTreeAccess(c *C) {
+	tree := fsutil.NewTree()
+	for _, options := range []fsutil.CreateOptions{{
+		Path: "/dir/file",
+		Data: bytes.NewBufferString("data1"),
+		Mode: 0644,
+	}, {
+		Path: "/link",
+		Link: "dir/file",
+		Mode: fs.ModeSymlink | 0777,
+	}} {
+		err := tree.Create(&options)
+		c.Assert(err, IsNil)
+	}
+
+	finfo, err := tree.Lstat("/dir/file")
+	c.Assert(err, IsNil)
+	c.Assert(finfo.Name(), Equals, "file")
+	c.Assert(finfo.Size(), Equals, int64(5))
+	c.Assert(finfo.Mode(), Equals, fs.FileMode(0644))
+
+	// Symlinks are followed when opening files only.
+	finfo, err = tree.Lstat("/link")
+	c.Assert(err, IsNil)
+	c.Assert(finfo.Mode()&fs.ModeSymlink, Not(Equals), fs.FileMode(0))
+	file, err := tree.Open("/link")
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(file)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data1")
+	_, err = tree.Readlink("/dir/file")
+	c.Assert(err, ErrorMatches, "readlink /dir/file: invalid argument")
+
+	mtime := time.Unix(1000, 0)
+	err = tree.SetModTime("/link", mtime)
+	c.Assert(err, IsNil)
+	finfo, err = tree.Lstat("/link")
+	c.Assert(err, IsNil)
+	c.Assert(finfo.ModTime().Equal(mtime), Equals, true)
+	finfo, err = tree.Lstat("/dir/file")
+	c.Assert(err, IsNil)
+	c.Assert(finfo.ModTime().Equal(mtime), Equals, false)
+
+	// Directories are only removed when empty.
+	err = tree.Remove("/dir/")
+	c.Assert(os.IsExist(err), Equals, true)
+	err = tree.Remove("/dir/file")
+	c.Assert(err, IsNil)
+	err = tree.Remove("/dir/")
+	c.Assert(err, IsNil)
+	_, err = tree.Lstat("/dir/file")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	err = tree.Remove("/dir/")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
@@ -0,0 +1,45 @@
+// Package jobs runs work concurrently with a bounded number of workers.
+package jobs
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Run calls f for every index from zero to n, with up to jobs calls
+// running concurrently, and returns the error from the lowest index that
+// failed, if any. No further calls are started after a failure.
+func Run(jobs, n int, f func(i int) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	errs := make([]error, n)
+	var failed int32
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, jobs)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		if atomic.LoadInt32(&failed) != 0 {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = f(i)
+			if errs[i] != nil {
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
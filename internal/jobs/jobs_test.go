@@ -0,0 +1,92 @@
+package jobs_test
+
+import (
+	"fmt"
+	"sync"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/jobs"
+)
+
+var runTests = []struct {
+	summary string
+	jobs    int
+	n       int
+	fail    []int
+	error   string
+}{{
+	summary: "All calls succeed",
+	jobs:    3,
+	n:       10,
+}, {
+	summary: "Jobs default to one",
+	jobs:    0,
+	n:       3,
+}, {
+	summary: "No calls",
+	jobs:    2,
+	n:       0,
+}, {
+	summary: "Error from the lowest index is returned",
+	jobs:    10,
+	n:       10,
+	fail:    []int{7, 3},
+	error:   "failed 3",
+}}
+
+func (s *S) TestRun(c *C) {
+	for _, test := range runTests {
+		c.Logf("Summary: %s", test.summary)
+		var mu sync.Mutex
+		var running, maxRunning int
+		called := make(map[int]bool)
+		err := jobs.Run(test.jobs, test.n, func(i int) error {
+			mu.Lock()
+			called[i] = true
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				running--
+				mu.Unlock()
+			}()
+			for _, failed := range test.fail {
+				if i == failed {
+					return fmt.Errorf("failed %d", i)
+				}
+			}
+			return nil
+		})
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(called, HasLen, test.n)
+		jobs := test.jobs
+		if jobs < 1 {
+			jobs = 1
+		}
+		c.Assert(maxRunning <= jobs, Equals, true)
+	}
+}
+
+func (s *S) TestRunStopsAfterFailure(c *C) {
+	var mu sync.Mutex
+	var called []int
+	err := jobs.Run(1, 5, func(i int) error {
+		mu.Lock()
+		called = append(called, i)
+		mu.Unlock()
+		if i == 1 {
+			return fmt.Errorf("failed %d", i)
+		}
+		return nil
+	})
+	c.Assert(err, ErrorMatches, "failed 1")
+	c.Assert(called, DeepEquals, []int{0, 1})
+}
@@ -0,0 +1,128 @@
+package netconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Auth holds the credentials for a server, as defined in an APT auth.conf
+// file. Machine is the server host, optionally preceded by the scheme and
+// followed by a port and path prefix. Requests are authenticated with the
+// Token as a bearer token when set, which is an extension to the APT
+// format, or otherwise with Login and Password.
+type Auth struct {
+	Machine  string
+	Login    string
+	Password string
+	Token    string
+}
+
+// Match returns whether the credentials apply to u. As done by APT, a
+// machine without a scheme only matches https URLs.
+func (a *Auth) Match(u *url.URL) bool {
+	machine := a.Machine
+	scheme := "https"
+	if i := strings.Index(machine, "://"); i >= 0 {
+		scheme, machine = machine[:i], machine[i+3:]
+	}
+	if u.Scheme != scheme {
+		return false
+	}
+	host, path := machine, ""
+	if i := strings.Index(machine, "/"); i >= 0 {
+		host, path = machine[:i], machine[i:]
+	}
+	if strings.Contains(host, ":") {
+		if host != u.Host {
+			return false
+		}
+	} else if host != u.Hostname() {
+		return false
+	}
+	return strings.HasPrefix(u.Path, path)
+}
+
+// ParseAuth parses the content of an APT auth.conf file, which holds
+// entries such as:
+//
+//	machine example.com/ubuntu login user password secret
+//
+// Comments start with # and run until the end of the line.
+func ParseAuth(data []byte) ([]*Auth, error) {
+	var words []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		words = append(words, strings.Fields(line)...)
+	}
+
+	var auths []*Auth
+	var auth *Auth
+	for i := 0; i < len(words); i += 2 {
+		keyword := words[i]
+		if i+1 == len(words) {
+			return nil, fmt.Errorf("%q has no value", keyword)
+		}
+		value := words[i+1]
+		if keyword == "machine" {
+			auth = &Auth{Machine: value}
+			auths = append(auths, auth)
+			continue
+		}
+		if auth == nil {
+			return nil, fmt.Errorf("%q comes before any machine", keyword)
+		}
+		switch keyword {
+		case "login":
+			auth.Login = value
+		case "password":
+			auth.Password = value
+		case "token":
+			auth.Token = value
+		default:
+			return nil, fmt.Errorf("unknown keyword %q", keyword)
+		}
+	}
+	return auths, nil
+}
+
+// ReadAuthDir reads the credentials from all the files in dir, in order
+// of their names. Files without the .conf extension are ignored, as done
+// by APT.
+func ReadAuthDir(dir string) ([]*Auth, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read credentials: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".conf") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var auths []*Auth
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read credentials: %w", err)
+		}
+		fileAuths, err := ParseAuth(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse credentials in %s: %w", path, err)
+		}
+		auths = append(auths, fileAuths...)
+	}
+	return auths, nil
+}
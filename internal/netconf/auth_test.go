@@ -0,0 +1,117 @@
+package netconf_test
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/netconf"
+)
+
+var parseAuthTests = []struct {
+	summary string
+	input   string
+	auths   []*netconf.Auth
+	error   string
+}{{
+	summary: "Entries on one or multiple lines",
+	input: `
+		machine example.com login user password secret
+		# Registry token.
+		machine https://registry.example.com/private/
+			token abc # Trailing comment.
+	`,
+	auths: []*netconf.Auth{{
+		Machine:  "example.com",
+		Login:    "user",
+		Password: "secret",
+	}, {
+		Machine: "https://registry.example.com/private/",
+		Token:   "abc",
+	}},
+}, {
+	summary: "Empty file",
+	input: `
+		# Nothing here.
+	`,
+}, {
+	summary: "Keyword before machine",
+	input:   "login user machine example.com",
+	error:   `"login" comes before any machine`,
+}, {
+	summary: "Keyword without value",
+	input:   "machine example.com login",
+	error:   `"login" has no value`,
+}, {
+	summary: "Unknown keyword",
+	input:   "machine example.com user foo",
+	error:   `unknown keyword "user"`,
+}}
+
+func (s *S) TestParseAuth(c *C) {
+	for _, test := range parseAuthTests {
+		c.Logf("Summary: %s", test.summary)
+		auths, err := netconf.ParseAuth([]byte(test.input))
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(auths, DeepEquals, test.auths)
+	}
+}
+
+var authMatchTests = []struct {
+	machine string
+	url     string
+	match   bool
+}{
+	{"example.com", "https://example.com/ubuntu/dists/jammy/InRelease", true},
+	{"example.com", "http://example.com/ubuntu/dists/jammy/InRelease", false},
+	{"http://example.com", "http://example.com/ubuntu/", true},
+	{"example.com", "https://other.com/ubuntu/", false},
+	{"example.com", "https://example.com:8443/ubuntu/", true},
+	{"example.com:8443", "https://example.com:8443/ubuntu/", true},
+	{"example.com:8443", "https://example.com/ubuntu/", false},
+	{"example.com/ubuntu", "https://example.com/ubuntu/pool/foo.deb", true},
+	{"example.com/ubuntu", "https://example.com/debian/pool/foo.deb", false},
+}
+
+func (s *S) TestAuthMatch(c *C) {
+	for _, test := range authMatchTests {
+		u, err := url.Parse(test.url)
+		c.Assert(err, IsNil)
+		auth := &netconf.Auth{Machine: test.machine}
+		c.Assert(auth.Match(u), Equals, test.match, Commentf("%s %s", test.machine, test.url))
+	}
+}
+
+func (s *S) TestReadAuthDir(c *C) {
+	dir := c.MkDir()
+	files := map[string]string{
+		"20-other.conf": "machine other.com login other password secret2\n",
+		"10-mine.conf":  "machine example.com login user password secret1\n",
+		"ignored.txt":   "machine ignored.com login user password secret3\n",
+	}
+	for name, data := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600)
+		c.Assert(err, IsNil)
+	}
+	auths, err := netconf.ReadAuthDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(auths, DeepEquals, []*netconf.Auth{
+		{Machine: "example.com", Login: "user", Password: "secret1"},
+		{Machine: "other.com", Login: "other", Password: "secret2"},
+	})
+
+	err = ioutil.WriteFile(filepath.Join(dir, "30-bad.conf"), []byte("login user"), 0600)
+	c.Assert(err, IsNil)
+	_, err = netconf.ReadAuthDir(dir)
+	c.Assert(err, ErrorMatches, `cannot parse credentials in .*/30-bad.conf: "login" comes before any machine`)
+
+	auths, err = netconf.ReadAuthDir(filepath.Join(dir, "missing"))
+	c.Assert(err, IsNil)
+	c.Assert(auths, HasLen, 0)
+}
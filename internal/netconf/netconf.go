@@ -0,0 +1,207 @@
+// Package netconf configures how remote servers, such as package archives,
+// are reached, including proxies, trusted certificates, and credentials.
+package netconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the network settings. Proxies are given as URLs, and
+// NoProxy lists the hosts and domains reached directly, separated by
+// commas, or "*" for all of them. CACerts lists files with additional
+// PEM certificates trusted for TLS, and AuthDir is a directory with
+// credentials in files as found in APT's auth.conf.d directory.
+// RemoteCache is the URL of an HTTP server sharing the files fetched
+// between machines.
+type Config struct {
+	HTTPProxy   string   `yaml:"http-proxy"`
+	HTTPSProxy  string   `yaml:"https-proxy"`
+	NoProxy     string   `yaml:"no-proxy"`
+	CACerts     []string `yaml:"ca-certs"`
+	AuthDir     string   `yaml:"auth-dir"`
+	RemoteCache string   `yaml:"remote-cache"`
+}
+
+// DefaultPath returns the location of the configuration file, which is
+// set with $CHISEL_CONFIG or is config.yaml in the chisel directory
+// within the user configuration directory.
+func DefaultPath() string {
+	if path := os.Getenv("CHISEL_CONFIG"); path != "" {
+		return path
+	}
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		homeDir := os.Getenv("HOME")
+		if homeDir == "" {
+			return ""
+		}
+		configDir = filepath.Join(homeDir, ".config")
+	}
+	return filepath.Join(configDir, "chisel", "config.yaml")
+}
+
+// Load reads the configuration from the file at path, if it exists, and
+// then applies the settings from the environment, which take precedence:
+// the usual proxy variables, $CHISEL_CA_CERTS with additional certificate
+// files separated by colons, $CHISEL_AUTH_DIR, and $CHISEL_REMOTE_CACHE.
+func Load(path string) (*Config, error) {
+	config := &Config{}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot read config: %w", err)
+		}
+		err = yaml.Unmarshal(data, config)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse config %s: %w", path, err)
+		}
+	}
+
+	envs := []struct {
+		names []string
+		value *string
+	}{
+		{[]string{"HTTP_PROXY", "http_proxy"}, &config.HTTPProxy},
+		{[]string{"HTTPS_PROXY", "https_proxy"}, &config.HTTPSProxy},
+		{[]string{"NO_PROXY", "no_proxy"}, &config.NoProxy},
+		{[]string{"CHISEL_AUTH_DIR"}, &config.AuthDir},
+		{[]string{"CHISEL_REMOTE_CACHE"}, &config.RemoteCache},
+	}
+	for _, env := range envs {
+		for _, name := range env.names {
+			if value := os.Getenv(name); value != "" {
+				*env.value = value
+				break
+			}
+		}
+	}
+	if value := os.Getenv("CHISEL_CA_CERTS"); value != "" {
+		config.CACerts = append(config.CACerts, filepath.SplitList(value)...)
+	}
+	return config, nil
+}
+
+// Client returns an HTTP client which uses the proxies, trusts the
+// certificates, and authenticates with the credentials configured.
+func (c *Config) Client() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	httpProxy, err := parseProxy(c.HTTPProxy)
+	if err != nil {
+		return nil, err
+	}
+	httpsProxy, err := parseProxy(c.HTTPSProxy)
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if matchNoProxy(c.NoProxy, req.URL.Hostname()) {
+			return nil, nil
+		}
+		if req.URL.Scheme == "https" {
+			return httpsProxy, nil
+		}
+		return httpProxy, nil
+	}
+
+	if len(c.CACerts) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, path := range c.CACerts {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read CA certificates: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no CA certificates found in %s", path)
+			}
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if c.AuthDir != "" {
+		auths, err := ReadAuthDir(c.AuthDir)
+		if err != nil {
+			return nil, err
+		}
+		roundTripper = AuthTransport(auths, transport)
+	}
+	return &http.Client{Transport: roundTripper}, nil
+}
+
+func parseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	// As with the environment variables, the scheme may be omitted.
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL: %q", proxy)
+	}
+	return proxyURL, nil
+}
+
+func matchNoProxy(noProxy, host string) bool {
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "*" {
+			return true
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		if entry != "" && (host == entry || strings.HasSuffix(host, "."+entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthTransport returns a round tripper which authenticates requests with
+// the first of the credentials matching them, unless already authorized,
+// before sending them through transport.
+func AuthTransport(auths []*Auth, transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &authTransport{auths: auths, transport: transport}
+}
+
+type authTransport struct {
+	auths     []*Auth
+	transport http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return t.transport.RoundTrip(req)
+	}
+	for _, auth := range t.auths {
+		if !auth.Match(req.URL) {
+			continue
+		}
+		// Requests must not be modified by round trippers.
+		req = req.Clone(req.Context())
+		if auth.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+auth.Token)
+		} else {
+			req.SetBasicAuth(auth.Login, auth.Password)
+		}
+		break
+	}
+	return t.transport.RoundTrip(req)
+}
@@ -0,0 +1,219 @@
+package netconf_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/netconf"
+)
+
+func fakeEnv(env map[string]string) (restore func()) {
+	old := make(map[string]*string)
+	for name, value := range env {
+		if oldValue, ok := os.LookupEnv(name); ok {
+			old[name] = &oldValue
+		} else {
+			old[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, value := range old {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+	}
+}
+
+func (s *S) TestDefaultPath(c *C) {
+	restore := fakeEnv(map[string]string{
+		"CHISEL_CONFIG":   "",
+		"XDG_CONFIG_HOME": "",
+		"HOME":            "/home/user",
+	})
+	defer restore()
+	c.Assert(netconf.DefaultPath(), Equals, "/home/user/.config/chisel/config.yaml")
+
+	os.Setenv("XDG_CONFIG_HOME", "/xdg/config")
+	c.Assert(netconf.DefaultPath(), Equals, "/xdg/config/chisel/config.yaml")
+
+	os.Setenv("CHISEL_CONFIG", "/etc/chisel.yaml")
+	c.Assert(netconf.DefaultPath(), Equals, "/etc/chisel.yaml")
+}
+
+func (s *S) TestLoad(c *C) {
+	restore := fakeEnv(map[string]string{
+		"HTTP_PROXY":          "",
+		"http_proxy":          "",
+		"HTTPS_PROXY":         "",
+		"https_proxy":         "",
+		"NO_PROXY":            "",
+		"no_proxy":            "",
+		"CHISEL_AUTH_DIR":     "",
+		"CHISEL_CA_CERTS":     "",
+		"CHISEL_REMOTE_CACHE": "",
+	})
+	defer restore()
+
+	path := filepath.Join(c.MkDir(), "config.yaml")
+	config, err := netconf.Load(path)
+	c.Assert(err, IsNil)
+	c.Assert(config, DeepEquals, &netconf.Config{})
+
+	err = ioutil.WriteFile(path, []byte(`
+http-proxy: http://proxy.example.com:3128
+https-proxy: http://proxy.example.com:3129
+no-proxy: localhost,.internal
+ca-certs: [/etc/ca.pem]
+auth-dir: /etc/chisel/auth.conf.d
+remote-cache: https://cache.example.com/chisel
+`), 0644)
+	c.Assert(err, IsNil)
+	config, err = netconf.Load(path)
+	c.Assert(err, IsNil)
+	c.Assert(config, DeepEquals, &netconf.Config{
+		HTTPProxy:   "http://proxy.example.com:3128",
+		HTTPSProxy:  "http://proxy.example.com:3129",
+		NoProxy:     "localhost,.internal",
+		CACerts:     []string{"/etc/ca.pem"},
+		AuthDir:     "/etc/chisel/auth.conf.d",
+		RemoteCache: "https://cache.example.com/chisel",
+	})
+
+	// The environment takes precedence.
+	os.Setenv("https_proxy", "http://other.example.com:8080")
+	os.Setenv("CHISEL_AUTH_DIR", "/other/auth.conf.d")
+	os.Setenv("CHISEL_CA_CERTS", "/other/ca1.pem:/other/ca2.pem")
+	os.Setenv("CHISEL_REMOTE_CACHE", "http://other.example.com/cache")
+	config, err = netconf.Load(path)
+	c.Assert(err, IsNil)
+	c.Assert(config, DeepEquals, &netconf.Config{
+		HTTPProxy:   "http://proxy.example.com:3128",
+		HTTPSProxy:  "http://other.example.com:8080",
+		NoProxy:     "localhost,.internal",
+		CACerts:     []string{"/etc/ca.pem", "/other/ca1.pem", "/other/ca2.pem"},
+		AuthDir:     "/other/auth.conf.d",
+		RemoteCache: "http://other.example.com/cache",
+	})
+
+	err = ioutil.WriteFile(path, []byte("ca-certs: foo: bar"), 0644)
+	c.Assert(err, IsNil)
+	_, err = netconf.Load(path)
+	c.Assert(err, ErrorMatches, `cannot parse config .*/config.yaml: .*`)
+}
+
+func (s *S) TestClientProxy(c *C) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct"))
+	}))
+	defer direct.Close()
+
+	config := &netconf.Config{
+		HTTPProxy: strings.TrimPrefix(proxy.URL, "http://"),
+		NoProxy:   "example.org, .internal",
+	}
+	client, err := config.Client()
+	c.Assert(err, IsNil)
+
+	c.Assert(get(c, client, "http://archive.example.com/ubuntu/"), Equals, "proxied")
+	c.Assert(get(c, client, "http://internal.example.com/ubuntu/"), Equals, "proxied")
+	c.Assert(proxied, DeepEquals, []string{
+		"http://archive.example.com/ubuntu/",
+		"http://internal.example.com/ubuntu/",
+	})
+
+	config.NoProxy = "127.0.0.1"
+	client, err = config.Client()
+	c.Assert(err, IsNil)
+	c.Assert(get(c, client, direct.URL), Equals, "direct")
+
+	config.HTTPProxy = "http://"
+	_, err = config.Client()
+	c.Assert(err, ErrorMatches, `invalid proxy URL: "http://"`)
+}
+
+func (s *S) TestClientCACerts(c *C) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("trusted"))
+	}))
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := (&netconf.Config{}).Client()
+	c.Assert(err, IsNil)
+	_, err = client.Get(server.URL)
+	c.Assert(err, ErrorMatches, ".*certificate.*")
+
+	dir := c.MkDir()
+	certPath := filepath.Join(dir, "ca.pem")
+	certData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err = ioutil.WriteFile(certPath, certData, 0644)
+	c.Assert(err, IsNil)
+
+	client, err = (&netconf.Config{CACerts: []string{certPath}}).Client()
+	c.Assert(err, IsNil)
+	c.Assert(get(c, client, server.URL), Equals, "trusted")
+
+	badPath := filepath.Join(dir, "bad.pem")
+	err = ioutil.WriteFile(badPath, []byte("bad"), 0644)
+	c.Assert(err, IsNil)
+	_, err = (&netconf.Config{CACerts: []string{badPath}}).Client()
+	c.Assert(err, ErrorMatches, `no CA certificates found in .*/bad.pem`)
+	_, err = (&netconf.Config{CACerts: []string{filepath.Join(dir, "missing.pem")}}).Client()
+	c.Assert(err, ErrorMatches, `cannot read CA certificates: .*`)
+}
+
+func (s *S) TestClientAuth(c *C) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+
+	dir := c.MkDir()
+	certPath := filepath.Join(dir, "ca.pem")
+	certData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err := ioutil.WriteFile(certPath, certData, 0644)
+	c.Assert(err, IsNil)
+
+	authDir := filepath.Join(dir, "auth.conf.d")
+	err = os.Mkdir(authDir, 0755)
+	c.Assert(err, IsNil)
+	host := strings.TrimPrefix(server.URL, "https://")
+	err = ioutil.WriteFile(filepath.Join(authDir, "private.conf"), []byte(
+		"machine "+host+"/basic login user password secret\n"+
+			"machine "+host+"/token token abc\n"), 0600)
+	c.Assert(err, IsNil)
+
+	client, err := (&netconf.Config{CACerts: []string{certPath}, AuthDir: authDir}).Client()
+	c.Assert(err, IsNil)
+	c.Assert(get(c, client, server.URL+"/basic/pool/foo.deb"), Equals, "Basic dXNlcjpzZWNyZXQ=")
+	c.Assert(get(c, client, server.URL+"/token/pool/foo.deb"), Equals, "Bearer abc")
+	c.Assert(get(c, client, server.URL+"/public/pool/foo.deb"), Equals, "")
+}
+
+func get(c *C, client *http.Client, url string) string {
+	resp, err := client.Get(url)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	return string(data)
+}
@@ -0,0 +1,228 @@
+package output
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/canonical/chisel/internal/fsutil"
+	"github.com/canonical/chisel/internal/slicer"
+)
+
+type OCIOptions struct {
+	// Dir is where the OCI image layout is written.
+	Dir string
+	// Root holds the content written by the cut.
+	Root fsutil.Root
+	// Manifest describes the content written by the cut.
+	Manifest *slicer.Manifest
+	// Arch is the Debian architecture of the content.
+	Arch string
+	// Tag names the image in the layout, "latest" if unset.
+	Tag string
+	// Timestamp, if set, is the modification time given to the cut
+	// content, as documented in TarOptions.
+	Timestamp time.Time
+}
+
+const (
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociConfig struct {
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Variant      string          `json:"variant,omitempty"`
+	Config       struct{}        `json:"config"`
+	RootFS       ociConfigRootFS `json:"rootfs"`
+}
+
+type ociConfigRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// ociPlatforms maps Debian architectures to OCI platforms.
+var ociPlatforms = map[string]ociPlatform{
+	"amd64":   {Architecture: "amd64", OS: "linux"},
+	"arm64":   {Architecture: "arm64", OS: "linux", Variant: "v8"},
+	"armhf":   {Architecture: "arm", OS: "linux", Variant: "v7"},
+	"i386":    {Architecture: "386", OS: "linux"},
+	"ppc64el": {Architecture: "ppc64le", OS: "linux"},
+	"riscv64": {Architecture: "riscv64", OS: "linux"},
+	"s390x":   {Architecture: "s390x", OS: "linux"},
+}
+
+// WriteOCI writes an OCI image layout holding a single image with one
+// layer containing the content described in the manifest.
+func WriteOCI(options *OCIOptions) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("cannot write OCI image: %w", err)
+		}
+	}()
+
+	platform, ok := ociPlatforms[options.Arch]
+	if !ok {
+		return fmt.Errorf("unsupported architecture: %q", options.Arch)
+	}
+	tag := options.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+
+	blobsDir := filepath.Join(options.Dir, "blobs", "sha256")
+	err = os.MkdirAll(blobsDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write the layer into a temporary file first, as its digest
+	// is only known at the end.
+	layerFile, err := ioutil.TempFile(blobsDir, ".layer-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(layerFile.Name())
+	layerDigest := sha256.New()
+	diffDigest := sha256.New()
+	layerSize := &countWriter{w: io.MultiWriter(layerFile, layerDigest)}
+	gzipWriter := gzip.NewWriter(layerSize)
+	err = WriteTar(io.MultiWriter(gzipWriter, diffDigest), &TarOptions{
+		Root:      options.Root,
+		Manifest:  options.Manifest,
+		Timestamp: options.Timestamp,
+	})
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	closeErr := layerFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	layer := ociDescriptor{
+		MediaType: ociLayerMediaType,
+		Digest:    digestString(layerDigest),
+		Size:      layerSize.n,
+	}
+	err = os.Rename(layerFile.Name(), filepath.Join(blobsDir, layer.Digest[len("sha256:"):]))
+	if err != nil {
+		return err
+	}
+
+	config := ociConfig{
+		Architecture: platform.Architecture,
+		OS:           platform.OS,
+		Variant:      platform.Variant,
+		RootFS: ociConfigRootFS{
+			Type:    "layers",
+			DiffIDs: []string{digestString(diffDigest)},
+		},
+	}
+	configDesc, err := writeOCIBlob(blobsDir, ociConfigMediaType, config)
+	if err != nil {
+		return err
+	}
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        *configDesc,
+		Layers:        []ociDescriptor{layer},
+	}
+	manifestDesc, err := writeOCIBlob(blobsDir, ociManifestMediaType, manifest)
+	if err != nil {
+		return err
+	}
+	manifestDesc.Platform = &platform
+	manifestDesc.Annotations = map[string]string{
+		"org.opencontainers.image.ref.name": tag,
+	}
+
+	index := ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociIndexMediaType,
+		Manifests:     []ociDescriptor{*manifestDesc},
+	}
+	indexData, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(options.Dir, "index.json"), indexData, 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(options.Dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
+
+func writeOCIBlob(blobsDir, mediaType string, content interface{}) (*ociDescriptor, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	err = ioutil.WriteFile(filepath.Join(blobsDir, fmt.Sprintf("%x", digest)), data, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &ociDescriptor{
+		MediaType: mediaType,
+		Digest:    fmt.Sprintf("sha256:%x", digest),
+		Size:      int64(len(data)),
+	}, nil
+}
+
+func digestString(h hash.Hash) string {
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(data []byte) (int, error) {
+	n, err := cw.w.Write(data)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,115 @@
+package output_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/fsutil"
+	"github.com/canonical/chisel/internal/output"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    map[string]string `json:"platform"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// readBlob reads the blob referred to by the descriptor and checks
+// its digest and size.
+func readBlob(c *C, dir string, desc *ociDescriptor) []byte {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", desc.Digest[len("sha256:"):]))
+	c.Assert(err, IsNil)
+	c.Assert(fmt.Sprintf("sha256:%x", sha256.Sum256(data)), Equals, desc.Digest)
+	c.Assert(int64(len(data)), Equals, desc.Size)
+	return data
+}
+
+func (s *S) TestWriteOCI(c *C) {
+	rootDir := makeRootDir(c)
+	dir := c.MkDir()
+	err := output.WriteOCI(&output.OCIOptions{
+		Dir:      dir,
+		Root:     fsutil.Dir(rootDir),
+		Manifest: testManifest,
+		Arch:     "arm64",
+	})
+	c.Assert(err, IsNil)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "oci-layout"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"imageLayoutVersion":"1.0.0"}`)
+
+	var index struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		Manifests     []ociDescriptor `json:"manifests"`
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	c.Assert(err, IsNil)
+	err = json.Unmarshal(data, &index)
+	c.Assert(err, IsNil)
+	c.Assert(index.SchemaVersion, Equals, 2)
+	c.Assert(index.Manifests, HasLen, 1)
+	c.Assert(index.Manifests[0].MediaType, Equals, "application/vnd.oci.image.manifest.v1+json")
+	c.Assert(index.Manifests[0].Platform, DeepEquals, map[string]string{
+		"architecture": "arm64",
+		"os":           "linux",
+		"variant":      "v8",
+	})
+	c.Assert(index.Manifests[0].Annotations, DeepEquals, map[string]string{
+		"org.opencontainers.image.ref.name": "latest",
+	})
+
+	var manifest struct {
+		Config ociDescriptor   `json:"config"`
+		Layers []ociDescriptor `json:"layers"`
+	}
+	err = json.Unmarshal(readBlob(c, dir, &index.Manifests[0]), &manifest)
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Config.MediaType, Equals, "application/vnd.oci.image.config.v1+json")
+	c.Assert(manifest.Layers, HasLen, 1)
+	c.Assert(manifest.Layers[0].MediaType, Equals, "application/vnd.oci.image.layer.v1.tar+gzip")
+
+	layerReader, err := gzip.NewReader(bytes.NewReader(readBlob(c, dir, &manifest.Layers[0])))
+	c.Assert(err, IsNil)
+	layerData, err := ioutil.ReadAll(layerReader)
+	c.Assert(err, IsNil)
+	c.Assert(tarDump(c, bytes.NewReader(layerData)), DeepEquals, testTarDump)
+
+	var config struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		RootFS       struct {
+			Type    string   `json:"type"`
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	err = json.Unmarshal(readBlob(c, dir, &manifest.Config), &config)
+	c.Assert(err, IsNil)
+	c.Assert(config.Architecture, Equals, "arm64")
+	c.Assert(config.OS, Equals, "linux")
+	c.Assert(config.RootFS.Type, Equals, "layers")
+	c.Assert(config.RootFS.DiffIDs, DeepEquals, []string{fmt.Sprintf("sha256:%x", sha256.Sum256(layerData))})
+
+	blobs, err := ioutil.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	c.Assert(err, IsNil)
+	c.Assert(blobs, HasLen, 3)
+}
+
+func (s *S) TestWriteOCIUnsupportedArch(c *C) {
+	err := output.WriteOCI(&output.OCIOptions{
+		Dir:      c.MkDir(),
+		Root:     fsutil.Dir(c.MkDir()),
+		Manifest: testManifest,
+		Arch:     "mips",
+	})
+	c.Assert(err, ErrorMatches, `cannot write OCI image: unsupported architecture: "mips"`)
+}
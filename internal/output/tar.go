@@ -0,0 +1,196 @@
+package output
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/canonical/chisel/internal/fsutil"
+	"github.com/canonical/chisel/internal/slicer"
+)
+
+type TarOptions struct {
+	// Root holds the content written by the cut.
+	Root fsutil.Root
+	// Manifest describes the content written by the cut, which is
+	// written into the tarball in the order listed.
+	Manifest *slicer.Manifest
+	// Timestamp, if set, is the modification time given to the cut
+	// content, and later times in the root are clamped to it.
+	// Otherwise all entries have the Unix epoch as their modification
+	// time, so that the tarball only depends on the content.
+	Timestamp time.Time
+}
+
+// WriteTar writes the content described in the manifest into w as an
+// uncompressed tarball. Ownership, extended attributes and devices are
+// taken from the manifest rather than from the root, as these may have
+// been written into a directory without the privileges for creating them.
+func WriteTar(w io.Writer, options *TarOptions) error {
+	tw := tar.NewWriter(w)
+	links := make(map[fsutil.FileID]string)
+	for _, mpath := range options.Manifest.Paths {
+		if mpath.Removed {
+			continue
+		}
+		err := writeTarEntry(tw, options, mpath, links)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, options *TarOptions, mpath *slicer.ManifestPath, links map[fsutil.FileID]string) error {
+	header := &tar.Header{
+		Name:    strings.TrimPrefix(mpath.Path, "/"),
+		Uid:     mpath.UID,
+		Gid:     mpath.GID,
+		ModTime: time.Unix(0, 0),
+	}
+	for name, value := range mpath.Xattrs {
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords["SCHILY.xattr."+name] = string(value)
+	}
+	if mpath.Kind == "chardev" || mpath.Kind == "blockdev" {
+		return writeTarDevice(tw, options, mpath, header)
+	}
+
+	finfo, err := options.Root.Lstat(mpath.Path)
+	if err != nil {
+		return err
+	}
+	header.Mode = tarMode(finfo.Mode())
+	if !options.Timestamp.IsZero() {
+		header.ModTime = finfo.ModTime()
+		if header.ModTime.After(options.Timestamp) {
+			header.ModTime = options.Timestamp
+		}
+		header.ModTime = header.ModTime.Truncate(time.Second)
+	}
+	switch finfo.Mode() & fs.ModeType {
+	case 0:
+		header.Typeflag = tar.TypeReg
+		header.Size = finfo.Size()
+		if id, nlink := fsutil.LinkInfo(finfo); nlink > 1 {
+			if link, ok := links[id]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = link
+				header.Size = 0
+			} else {
+				links[id] = header.Name
+			}
+		}
+	case fs.ModeDir:
+		header.Typeflag = tar.TypeDir
+	case fs.ModeSymlink:
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname, err = options.Root.Readlink(mpath.Path)
+		if err != nil {
+			return err
+		}
+	case fs.ModeNamedPipe:
+		header.Typeflag = tar.TypeFifo
+	default:
+		return fmt.Errorf("unsupported file type: %s", mpath.Path)
+	}
+	err = tw.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	file, err := options.Root.Open(mpath.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// writeTarDevice writes the entry of a device as described in the manifest,
+// as devices are only created in a root directory when running as root.
+func writeTarDevice(tw *tar.Writer, options *TarOptions, mpath *slicer.ManifestPath, header *tar.Header) error {
+	mode, err := strconv.ParseInt(mpath.Mode, 8, 64)
+	if err != nil {
+		return fmt.Errorf("invalid mode of %s: %q", mpath.Path, mpath.Mode)
+	}
+	header.Mode = mode
+	header.Typeflag = tar.TypeChar
+	if mpath.Kind == "blockdev" {
+		header.Typeflag = tar.TypeBlock
+	}
+	header.Devmajor = mpath.Major
+	header.Devminor = mpath.Minor
+	if !options.Timestamp.IsZero() {
+		header.ModTime = options.Timestamp.Truncate(time.Second)
+	}
+	return tw.WriteHeader(header)
+}
+
+func tarMode(mode fs.FileMode) int64 {
+	tarMode := int64(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		tarMode |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		tarMode |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		tarMode |= 01000
+	}
+	return tarMode
+}
+
+// WriteTarFile writes the content described in the manifest as a tarball
+// into the file at path, compressed according to its extension with
+// gzip (.gz or .tgz) or zstd (.zst), or uncompressed otherwise.
+func WriteTarFile(path string, options *TarOptions) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("cannot write tarball: %w", err)
+		}
+	}()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	var compressor io.WriteCloser
+	switch {
+	case strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz"):
+		compressor = gzip.NewWriter(file)
+	case strings.HasSuffix(path, ".zst"):
+		compressor, err = zstd.NewWriter(file)
+		if err != nil {
+			return err
+		}
+	default:
+		return WriteTar(file, options)
+	}
+	err = WriteTar(compressor, options)
+	closeErr := compressor.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
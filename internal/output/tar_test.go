@@ -0,0 +1,216 @@
+package output_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/fsutil"
+	"github.com/canonical/chisel/internal/output"
+	"github.com/canonical/chisel/internal/slicer"
+)
+
+var testManifest = &slicer.Manifest{
+	Paths: []*slicer.ManifestPath{
+		{Path: "/etc/", Kind: "dir"},
+		{Path: "/etc/removed", Kind: "file", Removed: true},
+		{Path: "/tmp/", Kind: "dir"},
+		{Path: "/usr/", Kind: "dir", UID: 1000, GID: 1000, Xattrs: slicer.Xattrs{"user.comment": []byte("usr")}},
+		{Path: "/usr/bin/", Kind: "dir"},
+		{Path: "/usr/bin/fifo", Kind: "fifo"},
+		{Path: "/usr/bin/hallo", Kind: "file", UID: 1000, GID: 1001},
+		{Path: "/usr/bin/hello", Kind: "file", UID: 1000, GID: 1001},
+		{Path: "/usr/bin/link", Kind: "symlink"},
+		{Path: "/usr/bin/null", Kind: "chardev", Mode: "0666", Major: 1, Minor: 3},
+	},
+}
+
+// makeRootDir creates the content described by testManifest.
+func makeRootDir(c *C) string {
+	rootDir := c.MkDir()
+	for _, dir := range []string{"etc", "tmp", "usr/bin"} {
+		err := os.MkdirAll(filepath.Join(rootDir, dir), 0755)
+		c.Assert(err, IsNil)
+	}
+	err := os.Chmod(filepath.Join(rootDir, "tmp"), 0777|os.ModeSticky)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(rootDir, "usr/bin/hello"), []byte("hello"), 0755)
+	c.Assert(err, IsNil)
+	err = os.Chmod(filepath.Join(rootDir, "usr/bin/hello"), 0755|os.ModeSetuid)
+	c.Assert(err, IsNil)
+	err = os.Link(filepath.Join(rootDir, "usr/bin/hello"), filepath.Join(rootDir, "usr/bin/hallo"))
+	c.Assert(err, IsNil)
+	err = os.Symlink("hello", filepath.Join(rootDir, "usr/bin/link"))
+	c.Assert(err, IsNil)
+	err = syscall.Mkfifo(filepath.Join(rootDir, "usr/bin/fifo"), 0644)
+	c.Assert(err, IsNil)
+	return rootDir
+}
+
+// makeRootTree creates the content described by testManifest in memory.
+func makeRootTree(c *C) *fsutil.Tree {
+	tree := fsutil.NewTree()
+	for _, options := range []fsutil.CreateOptions{
+		{Path: "/etc/", Mode: fs.ModeDir | 0755},
+		{Path: "/tmp/", Mode: fs.ModeDir | fs.ModeSticky | 0777},
+		{Path: "/usr/bin/", Mode: fs.ModeDir | 0755},
+		{Path: "/usr/bin/hello", Mode: fs.ModeSetuid | 0755, Data: bytes.NewBufferString("hello")},
+		{Path: "/usr/bin/hallo", Mode: 0755, Link: "/usr/bin/hello"},
+		{Path: "/usr/bin/link", Mode: fs.ModeSymlink | 0777, Link: "hello"},
+		{Path: "/usr/bin/fifo", Mode: fs.ModeNamedPipe | 0644},
+	} {
+		err := tree.Create(&options)
+		c.Assert(err, IsNil)
+	}
+	return tree
+}
+
+// tarDump returns a description of the entries in the tarball.
+func tarDump(c *C, r io.Reader) []string {
+	var result []string
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		entry := fmt.Sprintf("%s %c %#o %d:%d", header.Name, header.Typeflag, header.Mode, header.Uid, header.Gid)
+		switch header.Typeflag {
+		case tar.TypeReg:
+			data, err := ioutil.ReadAll(tr)
+			c.Assert(err, IsNil)
+			entry += " " + string(data)
+		case tar.TypeSymlink, tar.TypeLink:
+			entry += " " + header.Linkname
+		case tar.TypeChar, tar.TypeBlock:
+			entry += fmt.Sprintf(" %d,%d", header.Devmajor, header.Devminor)
+		}
+		for key, value := range header.PAXRecords {
+			entry += fmt.Sprintf(" %s=%s", key, value)
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+var testTarDump = []string{
+	"etc/ 5 0755 0:0",
+	"tmp/ 5 01777 0:0",
+	"usr/ 5 0755 1000:1000 SCHILY.xattr.user.comment=usr",
+	"usr/bin/ 5 0755 0:0",
+	"usr/bin/fifo 6 0644 0:0",
+	"usr/bin/hallo 0 04755 1000:1001 hello",
+	"usr/bin/hello 1 04755 1000:1001 usr/bin/hallo",
+	"usr/bin/link 2 0777 0:0 hello",
+	"usr/bin/null 3 0666 0:0 1,3",
+}
+
+func (s *S) TestWriteTar(c *C) {
+	rootDir := makeRootDir(c)
+	var buf bytes.Buffer
+	err := output.WriteTar(&buf, &output.TarOptions{
+		Root:     fsutil.Dir(rootDir),
+		Manifest: testManifest,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(tarDump(c, &buf), DeepEquals, testTarDump)
+}
+
+func (s *S) TestWriteTarTree(c *C) {
+	var buf bytes.Buffer
+	err := output.WriteTar(&buf, &output.TarOptions{
+		Root:     makeRootTree(c),
+		Manifest: testManifest,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(tarDump(c, &buf), DeepEquals, testTarDump)
+}
+
+func (s *S) TestWriteTarFile(c *C) {
+	rootDir := makeRootDir(c)
+	for _, name := range []string{"rootfs.tar", "rootfs.tar.gz", "rootfs.tgz", "rootfs.tar.zst"} {
+		c.Logf("File: %s", name)
+		path := filepath.Join(c.MkDir(), name)
+		err := output.WriteTarFile(path, &output.TarOptions{
+			Root:     fsutil.Dir(rootDir),
+			Manifest: testManifest,
+		})
+		c.Assert(err, IsNil)
+		file, err := os.Open(path)
+		c.Assert(err, IsNil)
+		defer file.Close()
+		var reader io.Reader = file
+		switch filepath.Ext(name) {
+		case ".gz", ".tgz":
+			reader, err = gzip.NewReader(file)
+			c.Assert(err, IsNil)
+		case ".zst":
+			reader, err = zstd.NewReader(file)
+			c.Assert(err, IsNil)
+		}
+		c.Assert(tarDump(c, reader), DeepEquals, testTarDump)
+	}
+}
+
+func (s *S) TestWriteTarModTimes(c *C) {
+	rootDir := makeRootDir(c)
+	err := os.Chtimes(filepath.Join(rootDir, "usr/bin/hello"), time.Unix(1000, 0), time.Unix(1000, 0))
+	c.Assert(err, IsNil)
+
+	tests := []struct {
+		timestamp time.Time
+		hello     time.Time
+		others    time.Time
+	}{{
+		timestamp: time.Time{},
+		hello:     time.Unix(0, 0),
+		others:    time.Unix(0, 0),
+	}, {
+		timestamp: time.Unix(2000, 0),
+		hello:     time.Unix(1000, 0),
+		others:    time.Unix(2000, 0),
+	}}
+	for _, test := range tests {
+		c.Logf("Timestamp: %s", test.timestamp)
+		var buf bytes.Buffer
+		err := output.WriteTar(&buf, &output.TarOptions{
+			Root:      fsutil.Dir(rootDir),
+			Manifest:  testManifest,
+			Timestamp: test.timestamp,
+		})
+		c.Assert(err, IsNil)
+		tr := tar.NewReader(&buf)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, IsNil)
+			mtime := test.others
+			if header.Name == "usr/bin/hello" || header.Name == "usr/bin/hallo" {
+				mtime = test.hello
+			}
+			c.Assert(header.ModTime.Equal(mtime), Equals, true, Commentf("%s: %s", header.Name, header.ModTime))
+		}
+	}
+}
+
+func (s *S) TestWriteTarMissingPath(c *C) {
+	err := output.WriteTarFile(filepath.Join(c.MkDir(), "rootfs.tar"), &output.TarOptions{
+		Root:     fsutil.Dir(c.MkDir()),
+		Manifest: testManifest,
+	})
+	c.Assert(err, ErrorMatches, "cannot write tarball: lstat .*/etc: no such file or directory")
+}
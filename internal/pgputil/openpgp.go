@@ -0,0 +1,135 @@
+package pgputil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// DecodeKeys decodes public and private key packets from armored data.
+func DecodeKeys(armoredData []byte) (pubKeys []*packet.PublicKey, privKeys []*packet.PrivateKey, err error) {
+	block, err := armor.Decode(bytes.NewReader(armoredData))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot decode armored data: %w", err)
+	}
+	return readKeys(block.Body)
+}
+
+// DecodeKeyring decodes public and private key packets from a binary
+// keyring such as the ones shipped under /usr/share/keyrings.
+func DecodeKeyring(data []byte) (pubKeys []*packet.PublicKey, privKeys []*packet.PrivateKey, err error) {
+	return readKeys(bytes.NewReader(data))
+}
+
+func readKeys(r io.Reader) (pubKeys []*packet.PublicKey, privKeys []*packet.PrivateKey, err error) {
+	reader := packet.NewReader(r)
+	for {
+		p, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		switch key := p.(type) {
+		case *packet.PublicKey:
+			pubKeys = append(pubKeys, key)
+		case *packet.PrivateKey:
+			privKeys = append(privKeys, key)
+		}
+	}
+	return pubKeys, privKeys, nil
+}
+
+// DecodeClearSigned decodes the clearsigned message in the data and returns
+// the signatures, the message body, and the canonical form of the body with
+// <CR><LF> line endings which must be used when verifying the signatures.
+// Content outside of the signed message is not accepted, so that it cannot
+// be mistaken for signed content by the caller.
+func DecodeClearSigned(clearData []byte) (sigs []*packet.Signature, body []byte, canonicalBody []byte, err error) {
+	block, rest := clearsign.Decode(clearData)
+	if block == nil || !bytes.HasPrefix(clearData, []byte("-----BEGIN PGP SIGNED MESSAGE-----")) {
+		return nil, nil, nil, fmt.Errorf("cannot decode clearsign text")
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, nil, nil, fmt.Errorf("unexpected content after clearsign text")
+	}
+	sigs, err = readSignatures(block.ArmoredSignature.Body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return sigs, block.Plaintext, block.Bytes, nil
+}
+
+// DecodeSignatures decodes the armored detached signatures in the data.
+func DecodeSignatures(armoredData []byte) ([]*packet.Signature, error) {
+	block, err := armor.Decode(bytes.NewReader(armoredData))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode armored data: %w", err)
+	}
+	return readSignatures(block.Body)
+}
+
+func readSignatures(r io.Reader) ([]*packet.Signature, error) {
+	var sigs []*packet.Signature
+	reader := packet.NewReader(r)
+	for {
+		p, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse signature: %w", err)
+		}
+		sig, ok := p.(*packet.Signature)
+		if !ok {
+			return nil, fmt.Errorf("non-signature packet found")
+		}
+		sigs = append(sigs, sig)
+	}
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("no signatures found")
+	}
+	return sigs, nil
+}
+
+// VerifySignature returns nil if sig is a valid signature of body by pubKey.
+func VerifySignature(pubKey *packet.PublicKey, sig *packet.Signature, body []byte) error {
+	if sig.IssuerKeyId != nil && *sig.IssuerKeyId != pubKey.KeyId {
+		return fmt.Errorf("signature issued by key %X, not %s", *sig.IssuerKeyId, pubKey.KeyIdString())
+	}
+	if !sig.Hash.Available() {
+		return fmt.Errorf("signature uses unsupported hash function")
+	}
+	hash := sig.Hash.New()
+	_, err := hash.Write(body)
+	if err != nil {
+		return err
+	}
+	return pubKey.VerifySignature(hash, sig)
+}
+
+// VerifyAnySignature returns nil if any of the signatures is a valid
+// signature of body by any of the public keys.
+func VerifyAnySignature(pubKeys []*packet.PublicKey, sigs []*packet.Signature, body []byte) error {
+	var err error
+	for _, sig := range sigs {
+		for _, pubKey := range pubKeys {
+			if sig.IssuerKeyId != nil && *sig.IssuerKeyId != pubKey.KeyId {
+				continue
+			}
+			err = VerifySignature(pubKey, sig, body)
+			if err == nil {
+				return nil
+			}
+		}
+	}
+	if err == nil {
+		return fmt.Errorf("cannot find public key for any of the signatures")
+	}
+	return err
+}
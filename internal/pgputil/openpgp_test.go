@@ -0,0 +1,129 @@
+package pgputil_test
+
+import (
+	"bytes"
+
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/pgputil"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+var (
+	key1 = testutil.PGPKeys["key1"]
+	key2 = testutil.PGPKeys["key2"]
+)
+
+func (s *S) TestDecodeKeys(c *C) {
+	pubKeys, privKeys, err := pgputil.DecodeKeys([]byte(key1.PubKeyArmor))
+	c.Assert(err, IsNil)
+	c.Assert(privKeys, HasLen, 0)
+	c.Assert(len(pubKeys) > 0, Equals, true)
+	c.Assert(pubKeys[0].KeyIdString(), Equals, key1.ID)
+
+	pubKeys, privKeys, err = pgputil.DecodeKeys([]byte(key1.PrivKeyArmor))
+	c.Assert(err, IsNil)
+	c.Assert(pubKeys, HasLen, 0)
+	c.Assert(len(privKeys) > 0, Equals, true)
+	c.Assert(privKeys[0].KeyIdString(), Equals, key1.ID)
+
+	_, _, err = pgputil.DecodeKeys([]byte("invalid"))
+	c.Assert(err, ErrorMatches, "cannot decode armored data: .*")
+}
+
+func clearSign(c *C, text string, privKey *packet.PrivateKey) []byte {
+	var buf bytes.Buffer
+	writer, err := clearsign.Encode(&buf, privKey, nil)
+	c.Assert(err, IsNil)
+	_, err = writer.Write([]byte(text))
+	c.Assert(err, IsNil)
+	c.Assert(writer.Close(), IsNil)
+	return buf.Bytes()
+}
+
+type verifyTest struct {
+	summary string
+	data    func(c *C) []byte
+	pubKeys []*packet.PublicKey
+	body    string
+	decerr  string
+	error   string
+}
+
+var verifyTests = []verifyTest{{
+	summary: "Valid signature",
+	data: func(c *C) []byte {
+		return clearSign(c, "Origin: Ubuntu\nLabel: Ubuntu\n", key1.PrivKey)
+	},
+	pubKeys: key1.PubKeys,
+	body:    "Origin: Ubuntu\nLabel: Ubuntu\n",
+}, {
+	summary: "Any public key may match",
+	data: func(c *C) []byte {
+		return clearSign(c, "Origin: Ubuntu\n", key1.PrivKey)
+	},
+	pubKeys: append(append([]*packet.PublicKey(nil), key2.PubKeys...), key1.PubKeys...),
+	body:    "Origin: Ubuntu\n",
+}, {
+	summary: "Signature by unknown key",
+	data: func(c *C) []byte {
+		return clearSign(c, "Origin: Ubuntu\n", key1.PrivKey)
+	},
+	pubKeys: key2.PubKeys,
+	error:   "cannot find public key for any of the signatures",
+}, {
+	summary: "No public keys",
+	data: func(c *C) []byte {
+		return clearSign(c, "Origin: Ubuntu\n", key1.PrivKey)
+	},
+	error: "cannot find public key for any of the signatures",
+}, {
+	summary: "Tampered content",
+	data: func(c *C) []byte {
+		data := clearSign(c, "Origin: Ubuntu\n", key1.PrivKey)
+		return bytes.Replace(data, []byte("Ubuntu"), []byte("Evil"), 1)
+	},
+	pubKeys: key1.PubKeys,
+	error:   "openpgp: invalid signature: .*",
+}, {
+	summary: "Not clearsigned",
+	data: func(c *C) []byte {
+		return []byte("Origin: Ubuntu\n")
+	},
+	decerr: "cannot decode clearsign text",
+}, {
+	summary: "Content before the clearsigned message",
+	data: func(c *C) []byte {
+		return append([]byte("Origin: Evil\n\n"), clearSign(c, "Origin: Ubuntu\n", key1.PrivKey)...)
+	},
+	decerr: "cannot decode clearsign text",
+}, {
+	summary: "Content after the clearsigned message",
+	data: func(c *C) []byte {
+		return append(clearSign(c, "Origin: Ubuntu\n", key1.PrivKey), []byte("Origin: Evil\n")...)
+	},
+	decerr: "unexpected content after clearsign text",
+}}
+
+func (s *S) TestVerifyClearSigned(c *C) {
+	for _, test := range verifyTests {
+		c.Logf("Summary: %s", test.summary)
+
+		sigs, body, canonicalBody, err := pgputil.DecodeClearSigned(test.data(c))
+		if test.decerr != "" {
+			c.Assert(err, ErrorMatches, test.decerr)
+			continue
+		}
+		c.Assert(err, IsNil)
+
+		err = pgputil.VerifyAnySignature(test.pubKeys, sigs, canonicalBody)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, test.body)
+	}
+}
@@ -0,0 +1,125 @@
+package sbom
+
+import (
+	"time"
+)
+
+// Types below follow the CycloneDX 1.4 JSON schema.
+
+type cdxDoc struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     []cdxTool    `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTool struct {
+	Vendor  string `json:"vendor"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type cdxComponent struct {
+	BOMRef     string        `json:"bom-ref,omitempty"`
+	Type       string        `json:"type"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	Hashes     []cdxHash     `json:"hashes,omitempty"`
+	Licenses   []cdxLicense  `json:"licenses,omitempty"`
+	PURL       string        `json:"purl,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+// cdxLicense holds either a single license or an SPDX license expression.
+type cdxLicense struct {
+	License    *cdxLicenseChoice `json:"license,omitempty"`
+	Expression string            `json:"expression,omitempty"`
+}
+
+type cdxLicenseChoice struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func cyclonedxDocument(doc *document) *cdxDoc {
+	cdoc := &cdxDoc{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + doc.uuid,
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: doc.created.Format(time.RFC3339),
+			Tools: []cdxTool{{
+				Vendor:  "Canonical",
+				Name:    "chisel",
+				Version: doc.toolVersion,
+			}},
+			Component: cdxComponent{
+				Type: "file",
+				Name: doc.name,
+			},
+		},
+		Components: []cdxComponent{},
+	}
+	for _, pkg := range doc.packages {
+		component := cdxComponent{
+			BOMRef:  pkg.purl,
+			Type:    "library",
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			PURL:    pkg.purl,
+			Properties: []cdxProperty{{
+				Name:  "chisel:archive",
+				Value: pkg.Archive,
+			}, {
+				Name:  "chisel:source",
+				Value: pkg.Source,
+			}},
+		}
+		if pkg.SHA256 != "" {
+			component.Hashes = []cdxHash{{Alg: "SHA-256", Content: pkg.SHA256}}
+		}
+		if pkg.copyright.Expr != nil {
+			component.Licenses = []cdxLicense{cdxLicenseOf(pkg.copyright.Expr)}
+		}
+		for _, slice := range pkg.Slices {
+			component.Properties = append(component.Properties, cdxProperty{
+				Name:  "chisel:slice",
+				Value: slice,
+			})
+		}
+		cdoc.Components = append(cdoc.Components, component)
+	}
+	return cdoc
+}
+
+// cdxLicenseOf returns the license of a component declared with expr, which
+// is a single license when possible, and an SPDX expression otherwise.
+func cdxLicenseOf(expr *LicenseExpr) cdxLicense {
+	license := expr.License
+	if license == nil || expr.Exception != "" {
+		return cdxLicense{Expression: spdxLicenseExpr(expr)}
+	}
+	if license.SPDX != "" {
+		return cdxLicense{License: &cdxLicenseChoice{ID: license.SPDX}}
+	}
+	return cdxLicense{License: &cdxLicenseChoice{Name: license.Name}}
+}
@@ -0,0 +1,3 @@
+package sbom
+
+var SPDXLicenseExpr = spdxLicenseExpr
@@ -0,0 +1,291 @@
+package sbom
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// License is a license found in a package copyright file.
+type License struct {
+	// Name is the short name of the license as used in the file.
+	Name string
+	// SPDX is the SPDX identifier of the license, if known.
+	SPDX string
+	// Text is the full license text, if provided in the file.
+	Text string
+}
+
+// Copyright holds the licensing details found in a package copyright file.
+type Copyright struct {
+	// Licenses holds the licenses referred to in the file, sorted by name.
+	Licenses []*License
+	// Expr combines the License fields of the paragraphs describing the
+	// files of the package, or is nil if there are none.
+	Expr *LicenseExpr
+}
+
+// LicenseExpr is a license expression as found in License fields. It
+// either refers to a License, followed by the name of an Exception to it
+// if any, or combines the expressions in Args with Op, which is "AND" or
+// "OR".
+type LicenseExpr struct {
+	License   *License
+	Exception string
+	Op        string
+	Args      []*LicenseExpr
+}
+
+var (
+	licenseOrExp   = regexp.MustCompile(`(?i)\s+or\s+`)
+	licenseAndExp  = regexp.MustCompile(`(?i)\s+and\s+`)
+	licenseWithExp = regexp.MustCompile(`(?i)\s+with\s+`)
+	licenseConnExp = regexp.MustCompile(`(?i)^(or|and)\s+`)
+)
+
+// ParseCopyright returns the licenses listed in the License fields of a
+// copyright file in the machine-readable format defined by DEP-5. Copyright
+// files in other formats have no licenses listed.
+func ParseCopyright(data []byte) *Copyright {
+	copyright := &Copyright{}
+	content := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if !strings.HasPrefix(content, "Format:") {
+		return copyright
+	}
+	licenses := make(map[string]*License)
+	lookup := func(name string) *License {
+		license := licenses[name]
+		if license == nil {
+			license = &License{Name: name, SPDX: spdxLicenseIDs[strings.ToLower(name)]}
+			licenses[name] = license
+		}
+		return license
+	}
+	var exprs []*LicenseExpr
+	seen := make(map[string]bool)
+	for i, paragraph := range paragraphs(content) {
+		name, text := licenseField(paragraph)
+		if name == "" {
+			continue
+		}
+		expr := parseLicenseExpr(name, lookup)
+		if expr == nil {
+			continue
+		}
+		// The text is only provided for a single license.
+		if expr.License != nil && expr.License.Text == "" {
+			expr.License.Text = text
+		}
+		// Standalone License paragraphs only provide license texts, while
+		// the ones of the header and of Files paragraphs apply to content.
+		if i > 0 && !hasField(paragraph, "Files") {
+			continue
+		}
+		key := strings.ToLower(strings.Join(strings.Fields(name), " "))
+		if !seen[key] {
+			seen[key] = true
+			exprs = append(exprs, expr)
+		}
+	}
+	for _, license := range licenses {
+		copyright.Licenses = append(copyright.Licenses, license)
+	}
+	sort.Slice(copyright.Licenses, func(i, j int) bool {
+		return copyright.Licenses[i].Name < copyright.Licenses[j].Name
+	})
+	for _, expr := range exprs {
+		copyright.Expr = combineLicenseExprs("AND", copyright.Expr, expr)
+	}
+	return copyright
+}
+
+// parseLicenseExpr parses the short name of a License field, such as
+// "GPL-2+ or Artistic, and BSD-3-clause", as defined by DEP-5: "and" takes
+// precedence over "or", and commas separate expressions which are combined
+// with the connective following them, or with "and" if there is none.
+func parseLicenseExpr(field string, lookup func(name string) *License) *LicenseExpr {
+	var result *LicenseExpr
+	for i, group := range strings.Split(field, ",") {
+		group = strings.TrimSpace(group)
+		op := "AND"
+		if m := licenseConnExp.FindStringSubmatch(group); m != nil && i > 0 {
+			op = strings.ToUpper(m[1])
+			group = group[len(m[0]):]
+		}
+		var alternatives *LicenseExpr
+		for _, alternative := range licenseOrExp.Split(group, -1) {
+			var terms *LicenseExpr
+			for _, term := range licenseAndExp.Split(alternative, -1) {
+				var exception string
+				if parts := licenseWithExp.Split(term, 2); len(parts) == 2 {
+					term, exception = parts[0], strings.TrimSpace(parts[1])
+				}
+				term = strings.TrimSpace(term)
+				if term == "" {
+					continue
+				}
+				terms = combineLicenseExprs("AND", terms, &LicenseExpr{License: lookup(term), Exception: exception})
+			}
+			alternatives = combineLicenseExprs("OR", alternatives, terms)
+		}
+		result = combineLicenseExprs(op, result, alternatives)
+	}
+	return result
+}
+
+// combineLicenseExprs returns the expressions a and b combined with op,
+// either of which may be nil.
+func combineLicenseExprs(op string, a, b *LicenseExpr) *LicenseExpr {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	var args []*LicenseExpr
+	for _, expr := range []*LicenseExpr{a, b} {
+		if expr.Op == op {
+			args = append(args, expr.Args...)
+		} else {
+			args = append(args, expr)
+		}
+	}
+	return &LicenseExpr{Op: op, Args: args}
+}
+
+// spdxLicenseID returns the SPDX identifier of the license, or a
+// LicenseRef identifier when it has none.
+func spdxLicenseID(license *License) string {
+	if license.SPDX != "" {
+		return license.SPDX
+	}
+	return "LicenseRef-" + idString(license.Name)
+}
+
+// spdxLicenseExpr returns the SPDX license expression equivalent to expr.
+func spdxLicenseExpr(expr *LicenseExpr) string {
+	if expr.License != nil {
+		result := spdxLicenseID(expr.License)
+		if expr.Exception != "" {
+			exception := spdxExceptionIDs[strings.ToLower(expr.Exception)]
+			if exception == "" {
+				exception = idString(expr.Exception)
+			}
+			result += " WITH " + exception
+		}
+		return result
+	}
+	parts := make([]string, len(expr.Args))
+	for i, arg := range expr.Args {
+		parts[i] = spdxLicenseExpr(arg)
+		if arg.License == nil {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, " "+expr.Op+" ")
+}
+
+func hasField(lines []string, name string) bool {
+	for _, line := range lines {
+		if strings.HasPrefix(line, name+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// licenseField returns the short name in the License field of the
+// paragraph, and the license text that may follow it on other lines.
+func licenseField(lines []string) (name, text string) {
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "License:") {
+			continue
+		}
+		name = strings.TrimSpace(line[len("License:"):])
+		var textLines []string
+		for _, line := range lines[i+1:] {
+			if line[0] != ' ' && line[0] != '\t' {
+				break
+			}
+			line = strings.TrimSpace(line)
+			if line == "." {
+				line = ""
+			}
+			textLines = append(textLines, line)
+		}
+		return name, strings.Join(textLines, "\n")
+	}
+	return "", ""
+}
+
+// paragraphs returns the lines of each paragraph in the content, which
+// are separated by blank lines.
+func paragraphs(content string) [][]string {
+	var result [][]string
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if len(lines) > 0 {
+				result = append(result, lines)
+				lines = nil
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) > 0 {
+		result = append(result, lines)
+	}
+	return result
+}
+
+// spdxLicenseIDs maps the lowercased short names commonly used in Debian
+// copyright files to SPDX license identifiers.
+var spdxLicenseIDs = map[string]string{
+	"agpl-3":       "AGPL-3.0-only",
+	"agpl-3+":      "AGPL-3.0-or-later",
+	"apache-2":     "Apache-2.0",
+	"apache-2.0":   "Apache-2.0",
+	"artistic":     "Artistic-1.0-Perl",
+	"artistic-2.0": "Artistic-2.0",
+	"bsd-2-clause": "BSD-2-Clause",
+	"bsd-3-clause": "BSD-3-Clause",
+	"bsd-4-clause": "BSD-4-Clause",
+	"cc0-1.0":      "CC0-1.0",
+	"curl":         "curl",
+	"expat":        "MIT",
+	"gfdl-1.2":     "GFDL-1.2-only",
+	"gfdl-1.2+":    "GFDL-1.2-or-later",
+	"gfdl-1.3":     "GFDL-1.3-only",
+	"gfdl-1.3+":    "GFDL-1.3-or-later",
+	"gpl-1":        "GPL-1.0-only",
+	"gpl-1+":       "GPL-1.0-or-later",
+	"gpl-2":        "GPL-2.0-only",
+	"gpl-2+":       "GPL-2.0-or-later",
+	"gpl-3":        "GPL-3.0-only",
+	"gpl-3+":       "GPL-3.0-or-later",
+	"isc":          "ISC",
+	"lgpl-2":       "LGPL-2.0-only",
+	"lgpl-2+":      "LGPL-2.0-or-later",
+	"lgpl-2.1":     "LGPL-2.1-only",
+	"lgpl-2.1+":    "LGPL-2.1-or-later",
+	"lgpl-3":       "LGPL-3.0-only",
+	"lgpl-3+":      "LGPL-3.0-or-later",
+	"mit":          "MIT",
+	"mpl-1.1":      "MPL-1.1",
+	"mpl-2.0":      "MPL-2.0",
+	"openssl":      "OpenSSL",
+	"psf-2":        "PSF-2.0",
+	"zlib":         "Zlib",
+}
+
+// spdxExceptionIDs maps the lowercased names of license exceptions commonly
+// used in Debian copyright files to SPDX exception identifiers.
+var spdxExceptionIDs = map[string]string{
+	"autoconf exception":  "Autoconf-exception-2.0",
+	"bison exception":     "Bison-exception-2.2",
+	"classpath exception": "Classpath-exception-2.0",
+	"font exception":      "Font-exception-2.0",
+	"libtool exception":   "Libtool-exception",
+	"llvm exception":      "LLVM-exception",
+}
@@ -0,0 +1,135 @@
+package sbom_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/sbom"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+type copyrightTest struct {
+	summary   string
+	copyright string
+	licenses  []*sbom.License
+	expr      string
+}
+
+var copyrightTests = []copyrightTest{{
+	summary: "Machine-readable copyright file",
+	copyright: `
+		Format: https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/
+		Upstream-Name: mypkg
+
+		Files: *
+		Copyright: 2020 Someone
+		License: GPL-2+
+
+		Files: lib/*
+		Copyright: 2021 Someone Else
+		License: BSD-3-clause or Custom-License
+
+		License: GPL-2+
+		 On Debian systems, the complete text of the GNU General
+		 Public License version 2 can be found in /usr/share/common-licenses/GPL-2.
+
+		License: Custom-License
+		 Permission is granted.
+		 .
+		 No warranty.
+	`,
+	licenses: []*sbom.License{{
+		Name: "BSD-3-clause",
+		SPDX: "BSD-3-Clause",
+	}, {
+		Name: "Custom-License",
+		Text: "Permission is granted.\n\nNo warranty.",
+	}, {
+		Name: "GPL-2+",
+		SPDX: "GPL-2.0-or-later",
+		Text: "On Debian systems, the complete text of the GNU General\nPublic License version 2 can be found in /usr/share/common-licenses/GPL-2.",
+	}},
+	expr: "GPL-2.0-or-later AND (BSD-3-Clause OR LicenseRef-Custom-License)",
+}, {
+	summary: "License exceptions are kept",
+	copyright: `
+		Format: https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/
+
+		Files: *
+		License: GPL-2+ with OpenSSL exception, Expat
+	`,
+	licenses: []*sbom.License{{
+		Name: "Expat",
+		SPDX: "MIT",
+	}, {
+		Name: "GPL-2+",
+		SPDX: "GPL-2.0-or-later",
+	}},
+	expr: "GPL-2.0-or-later WITH OpenSSL-exception AND MIT",
+}, {
+	summary: "Conjunctions take precedence over disjunctions",
+	copyright: `
+		Format: https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/
+
+		Files: *
+		License: GPL-2+ or Artistic and Expat
+
+		Files: debian/*
+		License: GPL-2+ or Artistic, and Expat
+
+		Files: lib/*
+		License: gpl-2+ OR  Artistic and Expat
+	`,
+	licenses: []*sbom.License{{
+		Name: "Artistic",
+		SPDX: "Artistic-1.0-Perl",
+	}, {
+		Name: "Expat",
+		SPDX: "MIT",
+	}, {
+		Name: "GPL-2+",
+		SPDX: "GPL-2.0-or-later",
+	}, {
+		Name: "gpl-2+",
+		SPDX: "GPL-2.0-or-later",
+	}},
+	expr: "(GPL-2.0-or-later OR (Artistic-1.0-Perl AND MIT)) AND (GPL-2.0-or-later OR Artistic-1.0-Perl) AND MIT",
+}, {
+	summary: "Commas may introduce disjunctions",
+	copyright: `
+		Format: https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/
+		License: Expat, or Apache-2.0 with LLVM exception
+	`,
+	licenses: []*sbom.License{{
+		Name: "Apache-2.0",
+		SPDX: "Apache-2.0",
+	}, {
+		Name: "Expat",
+		SPDX: "MIT",
+	}},
+	expr: "MIT OR Apache-2.0 WITH LLVM-exception",
+}, {
+	summary: "Free-form copyright file",
+	copyright: `
+		This package was debianized by someone.
+
+		License: GPL-2
+	`,
+	licenses: nil,
+}}
+
+func (s *S) TestParseCopyright(c *C) {
+	for _, test := range copyrightTests {
+		c.Logf("Summary: %s", test.summary)
+		copyright := sbom.ParseCopyright(testutil.Reindent(test.copyright))
+		if test.licenses == nil {
+			c.Assert(copyright.Licenses, HasLen, 0)
+		} else {
+			c.Assert(copyright.Licenses, DeepEquals, test.licenses)
+		}
+		if test.expr == "" {
+			c.Assert(copyright.Expr, IsNil)
+		} else {
+			c.Assert(sbom.SPDXLicenseExpr(copyright.Expr), Equals, test.expr)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package sbom
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/canonical/chisel/internal/fsutil"
+	"github.com/canonical/chisel/internal/slicer"
+)
+
+type Format string
+
+const (
+	SPDXJSON      Format = "spdx-json"
+	CycloneDXJSON Format = "cyclonedx-json"
+)
+
+type Options struct {
+	Format Format
+	// Name identifies the described content, such as the root directory.
+	Name string
+	// Manifest describes the content written by the cut.
+	Manifest *slicer.Manifest
+	// Root holds the content written by the cut, where the package
+	// copyright files are looked up.
+	Root fsutil.Root
+	// ToolVersion is the version of chisel recorded as the creator.
+	ToolVersion string
+
+	// Created is the creation time of the document, or the current
+	// time if unset.
+	Created time.Time
+	// UUID uniquely identifies the document, or a random UUID is
+	// used if unset.
+	UUID string
+}
+
+// Write writes a software bill of materials describing the packages in
+// the manifest and the slices selected from them, in the given format.
+func Write(w io.Writer, options *Options) error {
+	doc, err := newDocument(options)
+	if err != nil {
+		return err
+	}
+	var data interface{}
+	switch options.Format {
+	case SPDXJSON:
+		data = spdxDocument(doc)
+	case CycloneDXJSON:
+		data = cyclonedxDocument(doc)
+	default:
+		return fmt.Errorf("unsupported SBOM format: %q", options.Format)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "    ")
+	return enc.Encode(data)
+}
+
+// document holds the details common to all formats.
+type document struct {
+	name        string
+	toolVersion string
+	created     time.Time
+	uuid        string
+	packages    []*pkgInfo
+}
+
+type pkgInfo struct {
+	*slicer.ManifestPackage
+	purl      string
+	copyright *Copyright
+}
+
+func newDocument(options *Options) (*document, error) {
+	doc := &document{
+		name:        options.Name,
+		toolVersion: options.ToolVersion,
+		created:     options.Created,
+		uuid:        options.UUID,
+	}
+	if doc.created.IsZero() {
+		doc.created = time.Now()
+	}
+	doc.created = doc.created.UTC().Truncate(time.Second)
+	if doc.uuid == "" {
+		var err error
+		doc.uuid, err = randomUUID()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, mpkg := range options.Manifest.Packages {
+		var data []byte
+		file, err := options.Root.Open("/usr/share/doc/" + mpkg.Name + "/copyright")
+		if err == nil {
+			data, err = ioutil.ReadAll(file)
+			file.Close()
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot read copyright of package %q: %w", mpkg.Name, err)
+		}
+		doc.packages = append(doc.packages, &pkgInfo{
+			ManifestPackage: mpkg,
+			purl:            packageURL(mpkg),
+			copyright:       ParseCopyright(data),
+		})
+	}
+	sort.Slice(doc.packages, func(i, j int) bool {
+		return doc.packages[i].Name < doc.packages[j].Name
+	})
+	return doc, nil
+}
+
+// packageURL returns the purl identifying the package, using the name of
+// its archive as the vendor namespace.
+func packageURL(mpkg *slicer.ManifestPackage) string {
+	version := strings.ReplaceAll(mpkg.Version, ":", "%3A")
+	purl := fmt.Sprintf("pkg:deb/%s/%s@%s?arch=%s", mpkg.Archive, mpkg.Name, version, mpkg.Arch)
+	if mpkg.Source != "" && mpkg.Source != mpkg.Name {
+		purl += "&upstream=" + mpkg.Source
+	}
+	return purl
+}
+
+var idInvalidExp = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// idString returns s with characters not allowed in identifiers replaced.
+func idString(s string) string {
+	return idInvalidExp.ReplaceAllString(s, "-")
+}
+
+func randomUUID() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", fmt.Errorf("cannot generate UUID: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
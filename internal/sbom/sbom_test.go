@@ -0,0 +1,274 @@
+package sbom_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/fsutil"
+	"github.com/canonical/chisel/internal/sbom"
+	"github.com/canonical/chisel/internal/slicer"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+var testManifest = &slicer.Manifest{
+	Packages: []*slicer.ManifestPackage{{
+		Name:    "mypkg",
+		Version: "1:1.0-1",
+		Arch:    "amd64",
+		Source:  "mysrc",
+		Archive: "ubuntu",
+		SHA256:  "f0f1f2f3",
+		Slices:  []string{"mypkg_bins", "mypkg_config"},
+	}, {
+		Name:    "otherpkg",
+		Version: "2.0",
+		Arch:    "all",
+		Source:  "otherpkg",
+		Archive: "ubuntu",
+		SHA256:  "e0e1e2e3",
+		Slices:  []string{"otherpkg_libs"},
+	}},
+}
+
+var testCopyright = `
+	Format: https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/
+
+	Files: *
+	License: GPL-2+ or Custom
+`
+
+type sbomTest struct {
+	format sbom.Format
+	result string
+	error  string
+}
+
+var sbomTests = []sbomTest{{
+	format: sbom.SPDXJSON,
+	result: `
+		{
+			"spdxVersion": "SPDX-2.3",
+			"dataLicense": "CC0-1.0",
+			"SPDXID": "SPDXRef-DOCUMENT",
+			"name": "rootfs",
+			"documentNamespace": "https://spdx.org/spdxdocs/chisel-rootfs-11111111-2222-4333-8444-555555555555",
+			"creationInfo": {
+				"created": "2023-01-02T03:04:05Z",
+				"creators": [
+					"Tool: chisel-1.2.3"
+				]
+			},
+			"packages": [
+				{
+					"name": "mypkg",
+					"SPDXID": "SPDXRef-Package-deb-mypkg",
+					"versionInfo": "1:1.0-1",
+					"supplier": "NOASSERTION",
+					"downloadLocation": "NOASSERTION",
+					"filesAnalyzed": false,
+					"checksums": [
+						{
+							"algorithm": "SHA256",
+							"checksumValue": "f0f1f2f3"
+						}
+					],
+					"licenseConcluded": "NOASSERTION",
+					"licenseDeclared": "GPL-2.0-or-later OR LicenseRef-Custom",
+					"copyrightText": "NOASSERTION",
+					"sourceInfo": "built package from: mysrc",
+					"comment": "Slices: mypkg_bins, mypkg_config",
+					"externalRefs": [
+						{
+							"referenceCategory": "PACKAGE-MANAGER",
+							"referenceType": "purl",
+							"referenceLocator": "pkg:deb/ubuntu/mypkg@1%3A1.0-1?arch=amd64&upstream=mysrc"
+						}
+					]
+				},
+				{
+					"name": "otherpkg",
+					"SPDXID": "SPDXRef-Package-deb-otherpkg",
+					"versionInfo": "2.0",
+					"supplier": "NOASSERTION",
+					"downloadLocation": "NOASSERTION",
+					"filesAnalyzed": false,
+					"checksums": [
+						{
+							"algorithm": "SHA256",
+							"checksumValue": "e0e1e2e3"
+						}
+					],
+					"licenseConcluded": "NOASSERTION",
+					"licenseDeclared": "NOASSERTION",
+					"copyrightText": "NOASSERTION",
+					"sourceInfo": "built package from: otherpkg",
+					"comment": "Slices: otherpkg_libs",
+					"externalRefs": [
+						{
+							"referenceCategory": "PACKAGE-MANAGER",
+							"referenceType": "purl",
+							"referenceLocator": "pkg:deb/ubuntu/otherpkg@2.0?arch=all"
+						}
+					]
+				}
+			],
+			"relationships": [
+				{
+					"spdxElementId": "SPDXRef-DOCUMENT",
+					"relationshipType": "DESCRIBES",
+					"relatedSpdxElement": "SPDXRef-Package-deb-mypkg"
+				},
+				{
+					"spdxElementId": "SPDXRef-DOCUMENT",
+					"relationshipType": "DESCRIBES",
+					"relatedSpdxElement": "SPDXRef-Package-deb-otherpkg"
+				}
+			],
+			"hasExtractedLicensingInfos": [
+				{
+					"licenseId": "LicenseRef-Custom",
+					"name": "Custom",
+					"extractedText": "Custom"
+				}
+			]
+		}
+	`,
+}, {
+	format: sbom.CycloneDXJSON,
+	result: `
+		{
+			"bomFormat": "CycloneDX",
+			"specVersion": "1.4",
+			"serialNumber": "urn:uuid:11111111-2222-4333-8444-555555555555",
+			"version": 1,
+			"metadata": {
+				"timestamp": "2023-01-02T03:04:05Z",
+				"tools": [
+					{
+						"vendor": "Canonical",
+						"name": "chisel",
+						"version": "1.2.3"
+					}
+				],
+				"component": {
+					"type": "file",
+					"name": "rootfs"
+				}
+			},
+			"components": [
+				{
+					"bom-ref": "pkg:deb/ubuntu/mypkg@1%3A1.0-1?arch=amd64&upstream=mysrc",
+					"type": "library",
+					"name": "mypkg",
+					"version": "1:1.0-1",
+					"hashes": [
+						{
+							"alg": "SHA-256",
+							"content": "f0f1f2f3"
+						}
+					],
+					"licenses": [
+						{
+							"expression": "GPL-2.0-or-later OR LicenseRef-Custom"
+						}
+					],
+					"purl": "pkg:deb/ubuntu/mypkg@1%3A1.0-1?arch=amd64&upstream=mysrc",
+					"properties": [
+						{
+							"name": "chisel:archive",
+							"value": "ubuntu"
+						},
+						{
+							"name": "chisel:source",
+							"value": "mysrc"
+						},
+						{
+							"name": "chisel:slice",
+							"value": "mypkg_bins"
+						},
+						{
+							"name": "chisel:slice",
+							"value": "mypkg_config"
+						}
+					]
+				},
+				{
+					"bom-ref": "pkg:deb/ubuntu/otherpkg@2.0?arch=all",
+					"type": "library",
+					"name": "otherpkg",
+					"version": "2.0",
+					"hashes": [
+						{
+							"alg": "SHA-256",
+							"content": "e0e1e2e3"
+						}
+					],
+					"purl": "pkg:deb/ubuntu/otherpkg@2.0?arch=all",
+					"properties": [
+						{
+							"name": "chisel:archive",
+							"value": "ubuntu"
+						},
+						{
+							"name": "chisel:source",
+							"value": "otherpkg"
+						},
+						{
+							"name": "chisel:slice",
+							"value": "otherpkg_libs"
+						}
+					]
+				}
+			]
+		}
+	`,
+}, {
+	format: "xml",
+	error:  `unsupported SBOM format: "xml"`,
+}}
+
+func (s *S) TestWrite(c *C) {
+	rootDir := c.MkDir()
+	copyrightPath := filepath.Join(rootDir, "usr/share/doc/mypkg/copyright")
+	err := os.MkdirAll(filepath.Dir(copyrightPath), 0755)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(copyrightPath, testutil.Reindent(testCopyright), 0644)
+	c.Assert(err, IsNil)
+
+	for _, test := range sbomTests {
+		c.Logf("Format: %s", test.format)
+		var buf bytes.Buffer
+		err := sbom.Write(&buf, &sbom.Options{
+			Format:      test.format,
+			Name:        "rootfs",
+			Manifest:    testManifest,
+			Root:        fsutil.Dir(rootDir),
+			ToolVersion: "1.2.3",
+			Created:     time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+			UUID:        "11111111-2222-4333-8444-555555555555",
+		})
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(buf.String(), Equals, strings.TrimSpace(string(testutil.Reindent(test.result)))+"\n")
+	}
+}
+
+func (s *S) TestWriteRandomUUID(c *C) {
+	var buf bytes.Buffer
+	err := sbom.Write(&buf, &sbom.Options{
+		Format:   sbom.CycloneDXJSON,
+		Manifest: &slicer.Manifest{},
+		Root:     fsutil.Dir(c.MkDir()),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Matches, `(?s).*"serialNumber": "urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}".*`)
+}
@@ -0,0 +1,134 @@
+package sbom
+
+import (
+	"strings"
+	"time"
+)
+
+// Types below follow the SPDX 2.3 JSON schema.
+
+type spdxDoc struct {
+	SPDXVersion       string                 `json:"spdxVersion"`
+	DataLicense       string                 `json:"dataLicense"`
+	SPDXID            string                 `json:"SPDXID"`
+	Name              string                 `json:"name"`
+	DocumentNamespace string                 `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo       `json:"creationInfo"`
+	Packages          []spdxPackage          `json:"packages"`
+	Relationships     []spdxRelationship     `json:"relationships"`
+	ExtractedLicenses []spdxExtractedLicense `json:"hasExtractedLicensingInfos,omitempty"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo"`
+	Supplier         string            `json:"supplier"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	Comment          string            `json:"comment,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+type spdxExtractedLicense struct {
+	LicenseID     string `json:"licenseId"`
+	Name          string `json:"name"`
+	ExtractedText string `json:"extractedText"`
+}
+
+const spdxNoAssertion = "NOASSERTION"
+
+func spdxDocument(doc *document) *spdxDoc {
+	sdoc := &spdxDoc{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              doc.name,
+		DocumentNamespace: "https://spdx.org/spdxdocs/chisel-" + idString(doc.name) + "-" + doc.uuid,
+		CreationInfo: spdxCreationInfo{
+			Created:  doc.created.Format(time.RFC3339),
+			Creators: []string{"Tool: chisel-" + doc.toolVersion},
+		},
+		Packages:      []spdxPackage{},
+		Relationships: []spdxRelationship{},
+	}
+	extracted := make(map[string]bool)
+	for _, pkg := range doc.packages {
+		for _, license := range pkg.copyright.Licenses {
+			id := spdxLicenseID(license)
+			if license.SPDX == "" && !extracted[id] {
+				extracted[id] = true
+				text := license.Text
+				if text == "" {
+					text = license.Name
+				}
+				sdoc.ExtractedLicenses = append(sdoc.ExtractedLicenses, spdxExtractedLicense{
+					LicenseID:     id,
+					Name:          license.Name,
+					ExtractedText: text,
+				})
+			}
+		}
+		declared := spdxNoAssertion
+		if pkg.copyright.Expr != nil {
+			declared = spdxLicenseExpr(pkg.copyright.Expr)
+		}
+		spkg := spdxPackage{
+			Name:             pkg.Name,
+			SPDXID:           "SPDXRef-Package-deb-" + idString(pkg.Name),
+			VersionInfo:      pkg.Version,
+			Supplier:         spdxNoAssertion,
+			DownloadLocation: spdxNoAssertion,
+			LicenseConcluded: spdxNoAssertion,
+			LicenseDeclared:  declared,
+			CopyrightText:    spdxNoAssertion,
+			SourceInfo:       "built package from: " + pkg.Source,
+			Comment:          "Slices: " + strings.Join(pkg.Slices, ", "),
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  pkg.purl,
+			}},
+		}
+		if pkg.SHA256 != "" {
+			spkg.Checksums = []spdxChecksum{{
+				Algorithm:     "SHA256",
+				ChecksumValue: pkg.SHA256,
+			}}
+		}
+		sdoc.Packages = append(sdoc.Packages, spkg)
+		sdoc.Relationships = append(sdoc.Relationships, spdxRelationship{
+			SPDXElementID:      sdoc.SPDXID,
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: spkg.SPDXID,
+		})
+	}
+	return sdoc
+}
@@ -3,6 +3,7 @@ package scripts
 import (
 	"go.starlark.net/starlark"
 	"go.starlark.net/resolve"
+	"go.starlark.net/starlarkstruct"
 
 	"fmt"
 	"io/ioutil"
@@ -71,12 +72,22 @@ func (c *ContentValue) Attr(name string) (Value, error) {
 		return starlark.NewBuiltin("Content.write", c.Write), nil
 	case "list":
 		return starlark.NewBuiltin("Content.list", c.List), nil
+	case "exists":
+		return starlark.NewBuiltin("Content.exists", c.Exists), nil
+	case "stat":
+		return starlark.NewBuiltin("Content.stat", c.Stat), nil
+	case "readlink":
+		return starlark.NewBuiltin("Content.readlink", c.Readlink), nil
+	case "remove":
+		return starlark.NewBuiltin("Content.remove", c.Remove), nil
+	case "chmod":
+		return starlark.NewBuiltin("Content.chmod", c.Chmod), nil
 	}
 	return nil, nil
 }
 
 func (c *ContentValue) AttrNames() []string {
-	return []string{"read", "write", "list"}
+	return []string{"read", "write", "list", "exists", "stat", "readlink", "remove", "chmod"}
 }
 
 // Content methods
@@ -91,6 +102,27 @@ const (
 )
 
 func (c *ContentValue) RealPath(path string, what Check) (string, error) {
+	rpath, err := c.checkPath(path, what)
+	if err != nil {
+		return "", err
+	}
+	if lname, err := os.Readlink(rpath); err == nil {
+		lpath := filepath.Join(filepath.Dir(rpath), lname)
+		lrel, err := filepath.Rel(c.RootDir, lpath)
+		if err != nil || !filepath.IsAbs(lpath) || lpath != c.RootDir && !strings.HasPrefix(lpath, c.RootDir+string(filepath.Separator)) {
+			return "", fmt.Errorf("invalid content symlink: %s", path)
+		}
+		_, err = c.RealPath("/"+lrel, what)
+		if err != nil {
+			return "", err
+		}
+	}
+	return rpath, nil
+}
+
+// checkPath is like RealPath, but does not follow path itself when it is
+// a symlink, so that the symlink may be inspected or removed.
+func (c *ContentValue) checkPath(path string, what Check) (string, error) {
 	if !filepath.IsAbs(c.RootDir) {
 		return "", fmt.Errorf("internal error: content defined with relative root: %s", c.RootDir)
 	}
@@ -117,17 +149,6 @@ func (c *ContentValue) RealPath(path string, what Check) (string, error) {
 	if !filepath.IsAbs(rpath) || rpath != c.RootDir && !strings.HasPrefix(rpath, c.RootDir+string(filepath.Separator)) {
 		return "", fmt.Errorf("invalid content path: %s", path)
 	}
-	if lname, err := os.Readlink(rpath); err == nil {
-		lpath := filepath.Join(filepath.Dir(rpath), lname)
-		lrel, err := filepath.Rel(c.RootDir, lpath)
-		if err != nil || !filepath.IsAbs(lpath) || lpath != c.RootDir && !strings.HasPrefix(lpath, c.RootDir+string(filepath.Separator)) {
-			return "", fmt.Errorf("invalid content symlink: %s", path)
-		}
-		_, err = c.RealPath("/"+lrel, what)
-		if err != nil {
-			return "", err
-		}
-	}
 	return rpath, nil
 }
 
@@ -208,3 +229,139 @@ func (c *ContentValue) List(thread *starlark.Thread, fn *starlark.Builtin, args
 	}
 	return starlark.NewList(values), nil
 }
+
+// Exists reports whether the path exists, without following it when it
+// is a symlink, so that dangling symlinks exist as well.
+func (c *ContentValue) Exists(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	err := starlark.UnpackArgs("Content.exists", args, kwargs, "path", &path)
+	if err != nil {
+		return nil, err
+	}
+
+	fpath, err := c.checkPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Lstat(fpath)
+	if os.IsNotExist(err) {
+		return starlark.False, nil
+	} else if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	return starlark.True, nil
+}
+
+// Stat returns a struct with the kind of the path, which is one of "file",
+// "dir", "symlink", or "other", its permission bits as mode, and its size.
+// Symlinks are not followed, and their targets are obtained via Readlink.
+func (c *ContentValue) Stat(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	err := starlark.UnpackArgs("Content.stat", args, kwargs, "path", &path)
+	if err != nil {
+		return nil, err
+	}
+
+	fpath, err := c.checkPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	finfo, err := os.Lstat(fpath)
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	kind := "other"
+	switch finfo.Mode() & os.ModeType {
+	case 0:
+		kind = "file"
+	case os.ModeDir:
+		kind = "dir"
+	case os.ModeSymlink:
+		kind = "symlink"
+	}
+	mode := finfo.Mode().Perm()
+	if finfo.Mode()&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if finfo.Mode()&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if finfo.Mode()&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"kind": starlark.String(kind),
+		"mode": starlark.MakeInt(int(mode)),
+		"size": starlark.MakeInt64(finfo.Size()),
+	}), nil
+}
+
+func (c *ContentValue) Readlink(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	err := starlark.UnpackArgs("Content.readlink", args, kwargs, "path", &path)
+	if err != nil {
+		return nil, err
+	}
+
+	fpath, err := c.checkPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	target, err := os.Readlink(fpath)
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	return starlark.String(target), nil
+}
+
+// Remove removes the file, symlink, or empty directory at path. Symlinks
+// are removed themselves rather than their targets.
+func (c *ContentValue) Remove(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	err := starlark.UnpackArgs("Content.remove", args, kwargs, "path", &path)
+	if err != nil {
+		return nil, err
+	}
+
+	fpath, err := c.checkPath(path.GoString(), CheckWrite)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Remove(fpath)
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	return starlark.None, nil
+}
+
+func (c *ContentValue) Chmod(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var mode int
+	err := starlark.UnpackArgs("Content.chmod", args, kwargs, "path", &path, "mode", &mode)
+	if err != nil {
+		return nil, err
+	}
+	if mode < 0 || mode > 07777 {
+		return nil, fmt.Errorf("invalid content mode: %#o", mode)
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckWrite)
+	if err != nil {
+		return nil, err
+	}
+	fmode := os.FileMode(mode).Perm()
+	if mode&04000 != 0 {
+		fmode |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fmode |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		fmode |= os.ModeSticky
+	}
+	err = os.Chmod(fpath, fmode)
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	return starlark.None, nil
+}
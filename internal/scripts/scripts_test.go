@@ -200,6 +200,196 @@ var scriptsTests = []scriptsTest{{
 		return nil
 	},
 	error: `no write: /foo/file2.txt`,
+}, {
+	summary: "Check whether paths exist",
+	content: map[string]string{
+		"foo/file1.txt": ``,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("missing.txt", filepath.Join(dir, "foo/link")), IsNil)
+	},
+	script: `
+		exists = [content.exists(p) for p in ["/foo/file1.txt", "/foo/file2.txt", "/foo/link"]]
+		content.write("/foo/file1.txt", " ".join([str(e) for e in exists]))
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 79ecc2c3", // "True False True"
+		"/foo/link":      "symlink missing.txt",
+	},
+}, {
+	summary: "Stat paths",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+		"foo/file2.txt": ``,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("file1.txt", filepath.Join(dir, "foo/link")), IsNil)
+	},
+	script: `
+		f = content.stat("/foo/file1.txt")
+		d = content.stat("/foo/")
+		l = content.stat("/foo/link")
+		content.write("/foo/file2.txt", "%s %o %d, %s %o, %s" % (f.kind, f.mode, f.size, d.kind, d.mode, l.kind))
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 5b41362b",
+		"/foo/file2.txt": "file 0644 fb0aca77", // "file 644 5, dir 755, symlink"
+		"/foo/link":      "symlink file1.txt",
+	},
+}, {
+	summary: "Read symlinks",
+	content: map[string]string{
+		"foo/file1.txt": ``,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("file1.txt", filepath.Join(dir, "foo/link1")), IsNil)
+		c.Assert(os.Symlink("/usr/lib/x", filepath.Join(dir, "foo/link2")), IsNil)
+	},
+	script: `
+		content.write("/foo/file1.txt", content.readlink("/foo/link1") + "," + content.readlink("/foo/link2"))
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 352b8086", // "file1.txt,/usr/lib/x"
+		"/foo/link1":     "symlink file1.txt",
+		"/foo/link2":     "symlink /usr/lib/x",
+	},
+}, {
+	summary: "Remove paths",
+	content: map[string]string{
+		"foo/file1.txt": ``,
+		"foo/file2.txt": ``,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("file1.txt", filepath.Join(dir, "foo/link")), IsNil)
+		c.Assert(os.Mkdir(filepath.Join(dir, "bar"), 0755), IsNil)
+	},
+	script: `
+		content.remove("/foo/link")
+		content.remove("/foo/file2.txt")
+		content.remove("/bar/")
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 empty",
+	},
+}, {
+	summary: "Change modes",
+	content: map[string]string{
+		"foo/file1.txt": ``,
+		"foo/file2.txt": ``,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("file2.txt", filepath.Join(dir, "foo/link")), IsNil)
+	},
+	script: `
+		content.chmod("/foo/file1.txt", 0o755)
+		content.chmod("/foo/link", 0o4700)
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0755 empty",
+		"/foo/file2.txt": "file 04700 empty",
+		"/foo/link":      "symlink file2.txt",
+	},
+}, {
+	summary: "Forbid invalid modes",
+	content: map[string]string{
+		"foo/file1.txt": ``,
+	},
+	script: `
+		content.chmod("/foo/file1.txt", 0o10000)
+	`,
+	error: `invalid content mode: 010000`,
+}, {
+	summary: "Stat errors refer to the root",
+	content: map[string]string{},
+	script: `
+		content.stat("/foo/file1.txt")
+	`,
+	error: `lstat /foo/file1.txt: no such file or directory`,
+}, {
+	summary: "Remove errors refer to the root",
+	content: map[string]string{},
+	script: `
+		content.remove("/foo/file1.txt")
+	`,
+	error: `remove /foo/file1.txt: no such file or directory`,
+}, {
+	summary: "Check exists",
+	content: map[string]string{
+		"foo/file1.txt": ``,
+	},
+	script: `
+		content.exists("/foo/file1.txt")
+	`,
+	checkr: func(p string) error { return fmt.Errorf("no read: %s", p) },
+	error:  `no read: /foo/file1.txt`,
+}, {
+	summary: "Check stats",
+	content: map[string]string{
+		"foo/file1.txt": ``,
+	},
+	script: `
+		content.stat("/foo/../foo/")
+	`,
+	checkr: func(p string) error { return fmt.Errorf("no read: %s", p) },
+	error:  `no read: /foo/`,
+}, {
+	summary: "Check readlinks",
+	content: map[string]string{
+		"foo/file1.txt": ``,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("file1.txt", filepath.Join(dir, "foo/link")), IsNil)
+	},
+	script: `
+		content.readlink("/foo/link")
+	`,
+	checkr: func(p string) error { return fmt.Errorf("no read: %s", p) },
+	error:  `no read: /foo/link`,
+}, {
+	summary: "Check removes",
+	content: map[string]string{
+		"foo/file1.txt": ``,
+	},
+	script: `
+		content.remove("/foo/file1.txt")
+	`,
+	checkw: func(p string) error { return fmt.Errorf("no write: %s", p) },
+	error:  `no write: /foo/file1.txt`,
+}, {
+	summary: "Check chmods on symlinks",
+	content: map[string]string{
+		"foo/file2.txt": ``,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("file2.txt", filepath.Join(dir, "foo/file1.txt")), IsNil)
+	},
+	script: `
+		content.chmod("/foo/file1.txt", 0o755)
+	`,
+	checkw: func(p string) error {
+		if p == "/foo/file2.txt" {
+			return fmt.Errorf("no write: %s", p)
+		}
+		return nil
+	},
+	error: `no write: /foo/file2.txt`,
+}, {
+	summary: "Forbid changing modes beyond the content root via symlinks",
+	content: map[string]string{
+		"foo/file2.txt": ``,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("../../bar", filepath.Join(dir, "foo/file1.txt")), IsNil)
+	},
+	script: `
+		content.chmod("/foo/file1.txt", 0o755)
+	`,
+	error: `invalid content symlink: /foo/file1.txt`,
 }}
 
 func (s *S) TestScripts(c *C) {
@@ -3,6 +3,7 @@ package setup
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -22,11 +23,19 @@ type FetchOptions struct {
 	Label    string
 	Version  string
 	CacheDir string
+	// Timeout limits the time for fetching the release, or is five
+	// minutes if unset.
+	Timeout time.Duration
+	// Client, if set, is used for the HTTP requests.
+	Client *http.Client
+	// Offline makes the release be read from the cache, as previously
+	// fetched, without reaching the network.
+	Offline bool
 }
 
-var bulkClient = &http.Client{
-	Timeout: 5 * time.Minute,
-}
+var bulkClient = &http.Client{}
+
+const defaultFetchTimeout = 5 * time.Minute
 
 const baseURL = "https://codeload.github.com/canonical/chisel-releases/tar.gz/refs/heads/"
 
@@ -51,19 +60,41 @@ func FetchRelease(options *FetchOptions) (*Release, error) {
 		return nil, fmt.Errorf("cannot create cache directory: %w", err)
 	}
 
+	if options.Offline {
+		_, err := os.Stat(filepath.Join(dirName, "chisel.yaml"))
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot find %s-%s release in cache for offline use", options.Label, options.Version)
+		} else if err != nil {
+			return nil, err
+		}
+		logf("Using cached %s-%s release.", options.Label, options.Version)
+		return ReadRelease(dirName)
+	}
+
 	tagName := filepath.Join(dirName, ".etag")
 	tagData, err := ioutil.ReadFile(tagName)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("GET", baseURL + options.Label + "-" + options.Version, nil)
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = defaultFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL + options.Label + "-" + options.Version, nil)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create request for release information: %w", err)
 	}
 	req.Header.Add("If-None-Match", string(tagData))
 
-	resp, err := bulkClient.Do(req)
+	client := options.Client
+	if client == nil {
+		client = bulkClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("cannot talk to release repository: %w", err)
 	}
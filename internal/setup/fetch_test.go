@@ -49,3 +49,26 @@ func (s *S) TestFetch(c *C) {
 		}
 	}
 }
+
+func (s *S) TestFetchOffline(c *C) {
+	options := &setup.FetchOptions{
+		Label:    "ubuntu",
+		Version:  "22.04",
+		CacheDir: c.MkDir(),
+		Offline:  true,
+	}
+
+	_, err := setup.FetchRelease(options)
+	c.Assert(err, ErrorMatches, "cannot find ubuntu-22.04 release in cache for offline use")
+
+	releaseDir := filepath.Join(options.CacheDir, "releases", "ubuntu-22.04")
+	err = os.MkdirAll(filepath.Join(releaseDir, "slices"), 0755)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(releaseDir, "chisel.yaml"), []byte("format: chisel-v1\narchives:\n  local:\n    packages-dir: /srv/debs\n"), 0644)
+	c.Assert(err, IsNil)
+
+	release, err := setup.FetchRelease(options)
+	c.Assert(err, IsNil)
+	c.Assert(release.Path, Equals, releaseDir)
+	c.Assert(release.Archives["local"].PackagesDir, Equals, "/srv/debs")
+}
@@ -0,0 +1,133 @@
+package setup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Lock records the exact packages used when cutting a release, so that
+// later cuts may obtain the very same packages.
+type Lock struct {
+	Packages map[string]*LockedPackage
+}
+
+// LockedPackage holds the details identifying a package in an archive.
+type LockedPackage struct {
+	Name     string
+	Version  string
+	Arch     string
+	Archive  string
+	Filename string
+	SHA256   string
+}
+
+const LockFileName = "chisel.lock"
+
+const yamlLockFormat = "chisel-lock-v1"
+
+type yamlLock struct {
+	Format   string                       `yaml:"format"`
+	Packages map[string]yamlLockedPackage `yaml:"packages"`
+}
+
+type yamlLockedPackage struct {
+	Version  string `yaml:"version"`
+	Arch     string `yaml:"arch"`
+	Archive  string `yaml:"archive"`
+	Filename string `yaml:"filename"`
+	SHA256   string `yaml:"sha256"`
+}
+
+// ReadLock reads the lock file in the release directory.
+func ReadLock(releaseDir string) (*Lock, error) {
+	filePath := filepath.Join(releaseDir, LockFileName)
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read lock file: %v", err)
+	}
+	return parseLock(data)
+}
+
+func parseLock(data []byte) (*Lock, error) {
+	yamlVar := yamlLock{}
+	dec := yaml.NewDecoder(bytes.NewBuffer(data))
+	dec.KnownFields(true)
+	err := dec.Decode(&yamlVar)
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot parse lock file: %v", LockFileName, err)
+	}
+	if yamlVar.Format != yamlLockFormat {
+		return nil, fmt.Errorf("%s: expected format %q, got %q", LockFileName, yamlLockFormat, yamlVar.Format)
+	}
+	lock := &Lock{
+		Packages: make(map[string]*LockedPackage, len(yamlVar.Packages)),
+	}
+	for pkgName, details := range yamlVar.Packages {
+		switch {
+		case details.Version == "":
+			return nil, fmt.Errorf("%s: package %q missing version field", LockFileName, pkgName)
+		case details.Arch == "":
+			return nil, fmt.Errorf("%s: package %q missing arch field", LockFileName, pkgName)
+		case details.Archive == "":
+			return nil, fmt.Errorf("%s: package %q missing archive field", LockFileName, pkgName)
+		case details.Filename == "":
+			return nil, fmt.Errorf("%s: package %q missing filename field", LockFileName, pkgName)
+		case details.SHA256 == "":
+			return nil, fmt.Errorf("%s: package %q missing sha256 field", LockFileName, pkgName)
+		}
+		lock.Packages[pkgName] = &LockedPackage{
+			Name:     pkgName,
+			Version:  details.Version,
+			Arch:     details.Arch,
+			Archive:  details.Archive,
+			Filename: details.Filename,
+			SHA256:   details.SHA256,
+		}
+	}
+	return lock, nil
+}
+
+// WriteLock writes the lock file into the release directory.
+func WriteLock(releaseDir string, lock *Lock) error {
+	yamlVar := yamlLock{
+		Format:   yamlLockFormat,
+		Packages: make(map[string]yamlLockedPackage, len(lock.Packages)),
+	}
+	for pkgName, pkg := range lock.Packages {
+		yamlVar.Packages[pkgName] = yamlLockedPackage{
+			Version:  pkg.Version,
+			Arch:     pkg.Arch,
+			Archive:  pkg.Archive,
+			Filename: pkg.Filename,
+			SHA256:   pkg.SHA256,
+		}
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(4)
+	err := enc.Encode(&yamlVar)
+	if err == nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot encode lock file: %v", err)
+	}
+
+	// Write it in full before replacing any previous lock file.
+	filePath := filepath.Join(releaseDir, LockFileName)
+	tmpPath := filePath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, buf.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("cannot write lock file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package setup_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/setup"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+var testLock = &setup.Lock{
+	Packages: map[string]*setup.LockedPackage{
+		"mypkg": {
+			Name:     "mypkg",
+			Version:  "1.0-1",
+			Arch:     "amd64",
+			Archive:  "ubuntu",
+			Filename: "pool/main/m/mypkg/mypkg_1.0-1_amd64.deb",
+			SHA256:   "a6e6d2e0bb6b0b7d4e3a5f8c2d1c3b0f5e9a8d7c6b5a4f3e2d1c0b9a8f7e6d5c",
+		},
+		"otherpkg": {
+			Name:     "otherpkg",
+			Version:  "2:3.0",
+			Arch:     "all",
+			Archive:  "local",
+			Filename: "otherpkg_3.0_all.deb",
+			SHA256:   "f7e6d5c4b3a2f1e0d9c8b7a6f5e4d3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6",
+		},
+	},
+}
+
+var testLockData = `
+	format: chisel-lock-v1
+	packages:
+		mypkg:
+			version: 1.0-1
+			arch: amd64
+			archive: ubuntu
+			filename: pool/main/m/mypkg/mypkg_1.0-1_amd64.deb
+			sha256: a6e6d2e0bb6b0b7d4e3a5f8c2d1c3b0f5e9a8d7c6b5a4f3e2d1c0b9a8f7e6d5c
+		otherpkg:
+			version: "2:3.0"
+			arch: all
+			archive: local
+			filename: otherpkg_3.0_all.deb
+			sha256: f7e6d5c4b3a2f1e0d9c8b7a6f5e4d3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6`
+
+func (s *S) TestWriteReadLock(c *C) {
+	dir := c.MkDir()
+	err := setup.WriteLock(dir, testLock)
+	c.Assert(err, IsNil)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "chisel.lock"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, string(testutil.Reindent(testLockData)))
+
+	lock, err := setup.ReadLock(dir)
+	c.Assert(err, IsNil)
+	c.Assert(lock, DeepEquals, testLock)
+}
+
+var lockErrorTests = []struct {
+	summary string
+	data    string
+	error   string
+}{{
+	summary: "Missing lock file",
+	error:   `cannot read lock file: open .*/chisel.lock: no such file or directory`,
+}, {
+	summary: "Unknown format",
+	data: `
+		format: foo
+	`,
+	error: `chisel.lock: expected format "chisel-lock-v1", got "foo"`,
+}, {
+	summary: "Unknown field",
+	data: `
+		format: chisel-lock-v1
+		packages:
+			mypkg:
+				foo: bar
+	`,
+	error: `(?s)chisel.lock: cannot parse lock file: .*field foo not found.*`,
+}, {
+	summary: "Missing digest",
+	data: `
+		format: chisel-lock-v1
+		packages:
+			mypkg:
+				version: 1.0-1
+				arch: amd64
+				archive: ubuntu
+				filename: pool/main/m/mypkg/mypkg_1.0-1_amd64.deb
+	`,
+	error: `chisel.lock: package "mypkg" missing sha256 field`,
+}}
+
+func (s *S) TestReadLockErrors(c *C) {
+	for _, test := range lockErrorTests {
+		c.Logf("Summary: %s", test.summary)
+		dir := c.MkDir()
+		if test.data != "" {
+			err := ioutil.WriteFile(filepath.Join(dir, "chisel.lock"), testutil.Reindent(test.data), 0644)
+			c.Assert(err, IsNil)
+		}
+		_, err := setup.ReadLock(dir)
+		c.Assert(err, ErrorMatches, test.error)
+	}
+}
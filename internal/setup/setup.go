@@ -4,14 +4,20 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
+	"golang.org/x/crypto/openpgp/packet"
 	"gopkg.in/yaml.v3"
 
 	"github.com/canonical/chisel/internal/deb"
+	"github.com/canonical/chisel/internal/fsutil"
+	"github.com/canonical/chisel/internal/pgputil"
+	"github.com/canonical/chisel/internal/snapshot"
 	"github.com/canonical/chisel/internal/strdist"
 )
 
@@ -25,18 +31,38 @@ type Release struct {
 }
 
 // Archive is the location from which binary packages are obtained.
+//
+// When a package is not pinned to a specific archive, it is obtained from
+// the archive with the highest priority that provides it, with ties decided
+// in favour of the default archive and then of the most recent version.
+// Archives with a negative priority are only used by packages pinned to them.
+//
+// PackagesDir, if set, holds the .deb files of a local archive, in which
+// case the fields describing an APT repository are unused.
 type Archive struct {
-	Name       string
-	Version    string
-	Suites     []string
-	Components []string
+	Name        string
+	Version     string
+	Suites      []string
+	Components  []string
+	Priority    int
+	PubKeys     []*packet.PublicKey
+	URL         string
+	PortsURL    string
+	PackagesDir string
+
+	// Snapshot, if set, is the timestamp of the archive snapshot used,
+	// as described in archive.Options.
+	Snapshot string
 }
 
 // Package holds a collection of slices that represent parts of themselves.
+// Archive is empty unless the package is pinned to a specific archive, and
+// Version is nil unless the acceptable package versions are constrained.
 type Package struct {
 	Name    string
 	Path    string
 	Archive string
+	Version *deb.VersionConstraint
 	Slices  map[string]*Slice
 }
 
@@ -77,6 +103,13 @@ type PathInfo struct {
 	Kind PathKind
 	Info string
 	Mode uint
+	// UID and GID define the ownership of the path, if set. Otherwise
+	// copied content keeps the ownership defined in the package, and
+	// other content is owned by root.
+	UID *int
+	GID *int
+	// Caps holds the file capabilities of the path, as in "cap_net_raw=ep".
+	Caps string
 
 	Mutable bool
 	Until   PathUntil
@@ -91,9 +124,19 @@ func (pi *PathInfo) SameContent(other *PathInfo) bool {
 	return (pi.Kind == other.Kind &&
 		pi.Info == other.Info &&
 		pi.Mode == other.Mode &&
+		sameID(pi.UID, other.UID) &&
+		sameID(pi.GID, other.GID) &&
+		pi.Caps == other.Caps &&
 		pi.Mutable == other.Mutable)
 }
 
+func sameID(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
 type SliceKey struct {
 	Package string
 	Slice   string
@@ -306,8 +349,8 @@ func readSlices(release *Release, baseDir, dirName string) error {
 		if err != nil {
 			return err
 		}
-		if pkg.Archive == "" {
-			pkg.Archive = release.DefaultArchive
+		if pkg.Archive != "" && release.Archives[pkg.Archive] == nil {
+			return fmt.Errorf("%s: package refers to undefined archive %q", pkg.Path, pkg.Archive)
 		}
 
 		release.Packages[pkg.Name] = pkg
@@ -317,31 +360,47 @@ func readSlices(release *Release, baseDir, dirName string) error {
 
 type yamlRelease struct {
 	Format   string                 `yaml:"format"`
-	Archives map[string]yamlArchive `yaml:"archives`
+	Archives map[string]yamlArchive `yaml:"archives"`
+	PubKeys  map[string]yamlPubKey  `yaml:"public-keys"`
 }
 
 const yamlReleaseFormat = "chisel-v1"
 
 type yamlArchive struct {
-	Version    string   `yaml:"version"`
-	Suites     []string `yaml:"suites"`
-	Components []string `yaml:"components"`
-	Default    bool     `yaml:"default"`
+	Version     string   `yaml:"version"`
+	Suites      []string `yaml:"suites"`
+	Components  []string `yaml:"components"`
+	Default     bool     `yaml:"default"`
+	Priority    int      `yaml:"priority"`
+	PubKeys     []string `yaml:"public-keys"`
+	URL         string   `yaml:"url"`
+	PortsURL    string   `yaml:"ports-url"`
+	PackagesDir string   `yaml:"packages-dir"`
+	Snapshot    string   `yaml:"snapshot"`
+}
+
+type yamlPubKey struct {
+	ID    string `yaml:"id"`
+	Armor string `yaml:"armor"`
 }
 
 type yamlPackage struct {
 	Name    string               `yaml:"package"`
 	Archive string               `yaml:"archive"`
+	Version string               `yaml:"version"`
 	Slices  map[string]yamlSlice `yaml:"slices"`
 }
 
 type yamlPath struct {
-	Dir     bool   `yaml:"make"`
-	Mode    uint   `yaml:"mode"`
-	Copy    string `yaml:"copy"`
-	Text    string `yaml:"text"`
-	Symlink string `yaml:"symlink"`
-	Mutable bool   `yaml:"mutable"`
+	Dir     bool    `yaml:"make"`
+	Mode    uint    `yaml:"mode"`
+	Copy    string  `yaml:"copy"`
+	Text    string  `yaml:"text"`
+	Symlink string  `yaml:"symlink"`
+	Mutable bool    `yaml:"mutable"`
+	User    *string `yaml:"user"`
+	Group   *string `yaml:"group"`
+	Caps    string  `yaml:"caps"`
 
 	Until PathUntil `yaml:"until"`
 	Arch  yamlArch  `yaml:"arch"`
@@ -357,9 +416,32 @@ func (yp *yamlPath) SameContent(other *yamlPath) bool {
 		yp.Copy == other.Copy &&
 		yp.Text == other.Text &&
 		yp.Symlink == other.Symlink &&
+		sameString(yp.User, other.User) &&
+		sameString(yp.Group, other.Group) &&
+		yp.Caps == other.Caps &&
 		yp.Mutable == other.Mutable)
 }
 
+func sameString(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// parseID parses the user or group ID of a path, if set. Only numeric IDs
+// are supported, as names depend on the system the content is used in.
+func parseID(value *string) (*int, error) {
+	if value == nil {
+		return nil, nil
+	}
+	id, err := strconv.Atoi(*value)
+	if err != nil || id < 0 {
+		return nil, fmt.Errorf("invalid ID: %q", *value)
+	}
+	return &id, nil
+}
+
 type yamlArch struct {
 	list []string
 }
@@ -413,14 +495,43 @@ func parseRelease(baseDir, filePath string, data []byte) (*Release, error) {
 	if len(yamlVar.Archives) == 0 {
 		return nil, fmt.Errorf("%s: no archives defined", fileName)
 	}
-	if len(yamlVar.Archives) > 1 {
-		return nil, fmt.Errorf("%s: multiple archives not yet supported", fileName)
+
+	pubKeys := make(map[string][]*packet.PublicKey, len(yamlVar.PubKeys))
+	for keyName, yamlPubKey := range yamlVar.PubKeys {
+		keys, err := decodePubKeys(&yamlPubKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: public key %q %v", fileName, keyName, err)
+		}
+		pubKeys[keyName] = keys
 	}
 
 	for archiveName, details := range yamlVar.Archives {
-		const ubuntuArchive = "ubuntu"
-		if archiveName != ubuntuArchive {
-			return nil, fmt.Errorf("%s: only %q archives are supported for now", fileName, ubuntuArchive)
+		if len(yamlVar.Archives) == 1 {
+			details.Default = true
+		} else if details.Default && release.DefaultArchive != "" {
+			return nil, fmt.Errorf("%s: more than one default archive: %s, %s", fileName, release.DefaultArchive, archiveName)
+		}
+		if details.Default {
+			release.DefaultArchive = archiveName
+		}
+		if details.PackagesDir != "" {
+			if details.URL != "" || details.PortsURL != "" {
+				return nil, fmt.Errorf("%s: archive %q cannot have both packages-dir and url fields", fileName, archiveName)
+			}
+			if details.Snapshot != "" {
+				return nil, fmt.Errorf("%s: archive %q cannot have both packages-dir and snapshot fields", fileName, archiveName)
+			}
+			packagesDir := filepath.Clean(details.PackagesDir)
+			if !filepath.IsAbs(packagesDir) {
+				packagesDir = filepath.Join(baseDir, packagesDir)
+			}
+			release.Archives[archiveName] = &Archive{
+				Name:        archiveName,
+				Version:     details.Version,
+				Priority:    details.Priority,
+				PackagesDir: packagesDir,
+			}
+			continue
 		}
 		if details.Version == "" {
 			return nil, fmt.Errorf("%s: archive %q missing version field", fileName, archiveName)
@@ -435,25 +546,87 @@ func parseRelease(baseDir, filePath string, data []byte) (*Release, error) {
 		if len(details.Components) == 0 {
 			return nil, fmt.Errorf("%s: archive %q missing components field", fileName, archiveName)
 		}
-		if len(yamlVar.Archives) == 1 {
-			details.Default = true
-		} else if details.Default && release.DefaultArchive != "" {
-			return nil, fmt.Errorf("%s: more than one default archive: %s, %s", fileName, release.DefaultArchive, archiveName)
+		if details.PortsURL != "" && details.URL == "" {
+			return nil, fmt.Errorf("%s: archive %q has ports-url field but no url field", fileName, archiveName)
 		}
-		if details.Default {
-			release.DefaultArchive = archiveName
+		for _, archiveURL := range []string{details.URL, details.PortsURL} {
+			if archiveURL != "" && !validArchiveURL(archiveURL) {
+				return nil, fmt.Errorf("%s: archive %q has invalid URL: %q", fileName, archiveName, archiveURL)
+			}
+		}
+		if details.Snapshot != "" {
+			if _, err := snapshot.Parse(details.Snapshot); err != nil {
+				return nil, fmt.Errorf("%s: archive %q has %v", fileName, archiveName, err)
+			}
+		}
+		if len(details.PubKeys) == 0 {
+			return nil, fmt.Errorf("%s: archive %q missing public-keys field", fileName, archiveName)
+		}
+		var archiveKeys []*packet.PublicKey
+		for _, keyName := range details.PubKeys {
+			keys, ok := pubKeys[keyName]
+			if !ok {
+				return nil, fmt.Errorf("%s: archive %q refers to undefined public key %q", fileName, archiveName, keyName)
+			}
+			archiveKeys = append(archiveKeys, keys...)
 		}
 		release.Archives[archiveName] = &Archive{
 			Name:       archiveName,
 			Version:    details.Version,
 			Suites:     details.Suites,
 			Components: details.Components,
+			Priority:   details.Priority,
+			PubKeys:    archiveKeys,
+			URL:        details.URL,
+			PortsURL:   details.PortsURL,
+			Snapshot:   details.Snapshot,
 		}
 	}
 
 	return release, err
 }
 
+// validArchiveURL returns whether the archive URL is either an absolute
+// http(s) URL or a file URL with an absolute path and no host.
+func validArchiveURL(archiveURL string) bool {
+	u, err := url.Parse(archiveURL)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return u.Host != ""
+	case "file":
+		return u.Host == "" && path.IsAbs(u.Path)
+	}
+	return false
+}
+
+// decodePubKeys decodes the armored public key and its subkeys, and ensures
+// the ID of the primary key matches the declared one.
+func decodePubKeys(yamlPubKey *yamlPubKey) ([]*packet.PublicKey, error) {
+	if yamlPubKey.ID == "" {
+		return nil, fmt.Errorf("missing id field")
+	}
+	if yamlPubKey.Armor == "" {
+		return nil, fmt.Errorf("missing armor field")
+	}
+	pubKeys, privKeys, err := pgputil.DecodeKeys([]byte(yamlPubKey.Armor))
+	if err != nil {
+		return nil, fmt.Errorf("armor is invalid: %v", err)
+	}
+	if len(privKeys) > 0 {
+		return nil, fmt.Errorf("armor contains private key")
+	}
+	if len(pubKeys) == 0 || pubKeys[0].IsSubkey {
+		return nil, fmt.Errorf("armor contains no public key")
+	}
+	if id := pubKeys[0].KeyIdString(); id != yamlPubKey.ID {
+		return nil, fmt.Errorf("armor has incorrect ID: expected %q, got %q", yamlPubKey.ID, id)
+	}
+	return pubKeys, nil
+}
+
 func parsePackage(baseDir, pkgName, pkgPath string, data []byte) (*Package, error) {
 	pkg := Package{
 		Name:   pkgName,
@@ -472,6 +645,12 @@ func parsePackage(baseDir, pkgName, pkgPath string, data []byte) (*Package, erro
 		return nil, fmt.Errorf("%s: filename and 'package' field (%q) disagree", pkgPath, yamlPkg.Name)
 	}
 	pkg.Archive = yamlPkg.Archive
+	if yamlPkg.Version != "" {
+		pkg.Version, err = deb.ParseVersionConstraint(yamlPkg.Version)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", pkgPath, err)
+		}
+	}
 
 	zeroPath := yamlPath{}
 	for sliceName, yamlSlice := range yamlPkg.Slices {
@@ -511,11 +690,17 @@ func parsePackage(baseDir, pkgName, pkgPath string, data []byte) (*Package, erro
 			var kinds = make([]PathKind, 0, 3)
 			var info string
 			var mode uint
+			var uid, gid *int
+			var caps string
 			var mutable bool
 			var until PathUntil
 			var arch []string
 			if strings.ContainsAny(contPath, "*?") {
 				if yamlPath != nil {
+					if yamlPath.User != nil || yamlPath.Group != nil {
+						return nil, fmt.Errorf("slice %s_%s path %s cannot have 'user' or 'group' as it has wildcards",
+							pkgName, sliceName, contPath)
+					}
 					if !yamlPath.SameContent(&zeroPath) {
 						return nil, fmt.Errorf("slice %s_%s path %s has invalid wildcard options",
 							pkgName, sliceName, contPath)
@@ -526,6 +711,20 @@ func parsePackage(baseDir, pkgName, pkgPath string, data []byte) (*Package, erro
 			if yamlPath != nil {
 				mode = yamlPath.Mode
 				mutable = yamlPath.Mutable
+				uid, err = parseID(yamlPath.User)
+				if err != nil {
+					return nil, fmt.Errorf("slice %s_%s has invalid 'user' for path %s: %s (expected a non-negative numeric ID)", pkgName, sliceName, contPath, *yamlPath.User)
+				}
+				gid, err = parseID(yamlPath.Group)
+				if err != nil {
+					return nil, fmt.Errorf("slice %s_%s has invalid 'group' for path %s: %s (expected a non-negative numeric ID)", pkgName, sliceName, contPath, *yamlPath.Group)
+				}
+				caps = yamlPath.Caps
+				if caps != "" {
+					if _, err := fsutil.EncodeCapabilities(caps); err != nil {
+						return nil, fmt.Errorf("slice %s_%s has invalid 'caps' for path %s: %q", pkgName, sliceName, contPath, caps)
+					}
+				}
 				if yamlPath.Dir {
 					if !strings.HasSuffix(contPath, "/") {
 						return nil, fmt.Errorf("slice %s_%s path %s must end in / for 'make' to be valid",
@@ -574,10 +773,16 @@ func parsePackage(baseDir, pkgName, pkgPath string, data []byte) (*Package, erro
 			if mutable && kinds[0] != TextPath && (kinds[0] != CopyPath || isDir) {
 				return nil, fmt.Errorf("slice %s_%s mutable is not a regular file: %s", pkgName, sliceName, contPath)
 			}
+			if caps != "" && kinds[0] != TextPath && (kinds[0] != CopyPath || isDir) {
+				return nil, fmt.Errorf("slice %s_%s path with caps is not a regular file: %s", pkgName, sliceName, contPath)
+			}
 			slice.Contents[contPath] = PathInfo{
 				Kind:    kinds[0],
 				Info:    info,
 				Mode:    mode,
+				UID:     uid,
+				GID:     gid,
+				Caps:    caps,
 				Mutable: mutable,
 				Until:   until,
 				Arch:    arch,
@@ -7,6 +7,7 @@ import (
 
 	. "gopkg.in/check.v1"
 
+	"github.com/canonical/chisel/internal/deb"
 	"github.com/canonical/chisel/internal/setup"
 	"github.com/canonical/chisel/internal/testutil"
 )
@@ -39,23 +40,372 @@ var setupTests = []setupTest{{
 	},
 	relerror: `chisel.yaml: no archives defined`,
 }, {
-	summary: "Multiple archives",
+	summary: "Multiple archives with priorities",
 	input: map[string]string{
 		"chisel.yaml": `
 			format: chisel-v1
-			archives: {one: {version: 1}, two: {version: two}}
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main, universe]
+					suites: [jammy]
+					default: true
+					public-keys: [test-key]
+				ubuntu-updates:
+					version: 22.04
+					components: [main, universe]
+					suites: [jammy-updates]
+					priority: 10
+					public-keys: [test-key]
+				private:
+					version: 22.04
+					components: [main]
+					suites: [jammy]
+					priority: -1
+					public-keys: [test-key]
+			public-keys:
+				test-key:
+					id: ` + testKey.ID + `
+					armor: |` + "\n" + testutil.PrefixEachLine(testKey.PubKeyArmor, "\t\t\t\t\t\t") + `
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			archive: private
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main", "universe"},
+				PubKeys:    testKey.PubKeys,
+			},
+			"ubuntu-updates": {
+				Name:       "ubuntu-updates",
+				Version:    "22.04",
+				Suites:     []string{"jammy-updates"},
+				Components: []string{"main", "universe"},
+				Priority:   10,
+				PubKeys:    testKey.PubKeys,
+			},
+			"private": {
+				Name:       "private",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main"},
+				Priority:   -1,
+				PubKeys:    testKey.PubKeys,
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "private",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices:  map[string]*setup.Slice{},
+			},
+		},
+	},
+}, {
+	summary: "Archives with custom URLs",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				debian:
+					version: 12
+					suites: [bookworm]
+					components: [main]
+					url: http://mirror.example.com/debian/
+					public-keys: [test-key]
+				ubuntu:
+					version: 22.04
+					components: [main]
+					url: https://mirror.example.com/ubuntu/
+					ports-url: https://mirror.example.com/ubuntu-ports/
+					public-keys: [test-key]
+			public-keys:
+				test-key:
+					id: ` + testKey.ID + `
+					armor: |` + "\n" + testutil.PrefixEachLine(testKey.PubKeyArmor, "\t\t\t\t\t\t") + `
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+	},
+	release: &setup.Release{
+		Archives: map[string]*setup.Archive{
+			"debian": {
+				Name:       "debian",
+				Version:    "12",
+				Suites:     []string{"bookworm"},
+				Components: []string{"main"},
+				PubKeys:    testKey.PubKeys,
+				URL:        "http://mirror.example.com/debian/",
+			},
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main"},
+				PubKeys:    testKey.PubKeys,
+				URL:        "https://mirror.example.com/ubuntu/",
+				PortsURL:   "https://mirror.example.com/ubuntu-ports/",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Name:   "mypkg",
+				Path:   "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{},
+			},
+		},
+	},
+}, {
+	summary: "Local archives",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					url: file:///srv/mirror/ubuntu
+					default: true
+					public-keys: [test-key]
+				local:
+					packages-dir: /srv/debs
+					priority: 10
+			public-keys:
+				test-key:
+					id: ` + testKey.ID + `
+					armor: |` + "\n" + testutil.PrefixEachLine(testKey.PubKeyArmor, "\t\t\t\t\t\t") + `
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main"},
+				PubKeys:    testKey.PubKeys,
+				URL:        "file:///srv/mirror/ubuntu",
+			},
+			"local": {
+				Name:        "local",
+				Priority:    10,
+				PackagesDir: "/srv/debs",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Name:   "mypkg",
+				Path:   "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{},
+			},
+		},
+	},
+}, {
+	summary: "Local archives cannot have a URL",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				local:
+					packages-dir: /srv/debs
+					url: http://mirror.example.com/ubuntu/
+		`,
+	},
+	relerror: `chisel.yaml: archive "local" cannot have both packages-dir and url fields`,
+}, {
+	summary: "Local archives cannot have a snapshot",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				local:
+					packages-dir: /srv/debs
+					snapshot: 20240101T000000Z
+		`,
+	},
+	relerror: `chisel.yaml: archive "local" cannot have both packages-dir and snapshot fields`,
+}, {
+	summary: "Archive snapshot must be a timestamp",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					snapshot: 2024-01-01
+					public-keys: [test-key]
+		`,
+	},
+	relerror: `chisel.yaml: archive "ubuntu" has invalid snapshot timestamp: "2024-01-01"`,
+}, {
+	summary: "Archive snapshot",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					snapshot: 20240101T000000Z
+					public-keys: [test-key]
+			public-keys:
+				test-key:
+					id: ` + testKey.ID + `
+					armor: |` + "\n" + testutil.PrefixEachLine(testKey.PubKeyArmor, "\t\t\t\t\t\t") + `
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main"},
+				PubKeys:    testKey.PubKeys,
+				Snapshot:   "20240101T000000Z",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Name:   "mypkg",
+				Path:   "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{},
+			},
+		},
+	},
+}, {
+	summary: "Archive file URL must not have a host",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					url: file://srv/mirror/ubuntu
+					public-keys: [test-key]
 		`,
 	},
-	relerror: `chisel.yaml: multiple archives not yet supported`,
+	relerror: `chisel.yaml: archive "ubuntu" has invalid URL: "file://srv/mirror/ubuntu"`,
 }, {
-	summary: "Only ubuntu archives for now",
+	summary: "Archive ports-url requires url",
 	input: map[string]string{
 		"chisel.yaml": `
 			format: chisel-v1
-			archives: {other: {version: 1}}
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					ports-url: https://mirror.example.com/ubuntu-ports/
+					public-keys: [test-key]
 		`,
 	},
-	relerror: `chisel.yaml: only "ubuntu" archives are supported for now`,
+	relerror: `chisel.yaml: archive "ubuntu" has ports-url field but no url field`,
+}, {
+	summary: "Archive URL must be valid",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					url: ftp://mirror.example.com/ubuntu/
+					public-keys: [test-key]
+		`,
+	},
+	relerror: `chisel.yaml: archive "ubuntu" has invalid URL: "ftp://mirror.example.com/ubuntu/"`,
+}, {
+	summary: "Only one default archive",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				one:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+				two:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+			public-keys:
+				test-key:
+					id: ` + testKey.ID + `
+					armor: |` + "\n" + testutil.PrefixEachLine(testKey.PubKeyArmor, "\t\t\t\t\t\t") + `
+		`,
+	},
+	relerror: `chisel.yaml: more than one default archive: (one, two|two, one)`,
+}, {
+	summary: "Package must refer to a defined archive",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			archive: unknown
+		`,
+	},
+	relerror: `slices/mydir/mypkg.yaml: package refers to undefined archive "unknown"`,
+}, {
+	summary: "Package version constraint",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			version: ">= 2.35-0ubuntu3"
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main", "universe"},
+				PubKeys:    testKey.PubKeys,
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Version: &deb.VersionConstraint{Op: ">=", Version: "2.35-0ubuntu3"},
+				Slices:  map[string]*setup.Slice{},
+			},
+		},
+	},
+}, {
+	summary: "Package version constraint must be valid",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			version: "> 2.35"
+		`,
+	},
+	relerror: `slices/mydir/mypkg.yaml: invalid version constraint: "> 2.35"`,
 }, {
 	summary: "Enforce matching filename and package name",
 	input: map[string]string{
@@ -74,6 +424,11 @@ var setupTests = []setupTest{{
 					version: 22.04
 					components: [main, other]
 					suites: [jammy, jammy-security]
+					public-keys: [test-key]
+			public-keys:
+				test-key:
+					id: ` + testKey.ID + `
+					armor: |` + "\n" + testutil.PrefixEachLine(testKey.PubKeyArmor, "\t\t\t\t\t\t") + `
 		`,
 		"slices/mydir/mypkg.yaml": `
 			package: mypkg
@@ -82,12 +437,19 @@ var setupTests = []setupTest{{
 	release: &setup.Release{
 		DefaultArchive: "ubuntu",
 
-		Archives: map[string]*setup.Archive{"ubuntu": {"ubuntu", "22.04", []string{"jammy", "jammy-security"}, []string{"main", "other"}}},
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy", "jammy-security"},
+				Components: []string{"main", "other"},
+				PubKeys:    testKey.PubKeys,
+			},
+		},
 		Packages: map[string]*setup.Package{
 			"mypkg": {
-				Archive: "ubuntu",
-				Name:    "mypkg",
-				Path:    "slices/mydir/mypkg.yaml",
+				Name:   "mypkg",
+				Path:   "slices/mydir/mypkg.yaml",
 				Slices: map[string]*setup.Slice{},
 			},
 		},
@@ -118,12 +480,19 @@ var setupTests = []setupTest{{
 	release: &setup.Release{
 		DefaultArchive: "ubuntu",
 
-		Archives: map[string]*setup.Archive{"ubuntu": {"ubuntu", "22.04", []string{"jammy"}, []string{"main", "universe"}}},
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main", "universe"},
+				PubKeys:    testKey.PubKeys,
+			},
+		},
 		Packages: map[string]*setup.Package{
 			"mypkg": {
-				Archive: "ubuntu",
-				Name:    "mypkg",
-				Path:    "slices/mydir/mypkg.yaml",
+				Name: "mypkg",
+				Path: "slices/mydir/mypkg.yaml",
 				Slices: map[string]*setup.Slice{
 					"myslice1": {
 						Package: "mypkg",
@@ -172,12 +541,19 @@ var setupTests = []setupTest{{
 	release: &setup.Release{
 		DefaultArchive: "ubuntu",
 
-		Archives: map[string]*setup.Archive{"ubuntu": {"ubuntu", "22.04", []string{"jammy"}, []string{"main", "universe"}}},
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main", "universe"},
+				PubKeys:    testKey.PubKeys,
+			},
+		},
 		Packages: map[string]*setup.Package{
 			"mypkg": {
-				Archive: "ubuntu",
-				Name:    "mypkg",
-				Path:    "slices/mydir/mypkg.yaml",
+				Name: "mypkg",
+				Path: "slices/mydir/mypkg.yaml",
 				Slices: map[string]*setup.Slice{
 					"myslice1": {
 						Package: "mypkg",
@@ -352,7 +728,7 @@ var setupTests = []setupTest{{
 						/path1: {copy: /other}
 		`,
 	},
-	relerror:  "slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /path1",
+	relerror: "slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /path1",
 }, {
 	summary: "Conflicting paths across packages",
 	input: map[string]string{
@@ -371,7 +747,7 @@ var setupTests = []setupTest{{
 						/path1:
 		`,
 	},
-	relerror:  "slices mypkg1_myslice1 and mypkg2_myslice1 conflict on /path1",
+	relerror: "slices mypkg1_myslice1 and mypkg2_myslice1 conflict on /path1",
 }, {
 	summary: "Directories must be suffixed with /",
 	input: map[string]string{
@@ -425,12 +801,19 @@ var setupTests = []setupTest{{
 	release: &setup.Release{
 		DefaultArchive: "ubuntu",
 
-		Archives: map[string]*setup.Archive{"ubuntu": {"ubuntu", "22.04", []string{"jammy"}, []string{"main", "universe"}}},
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main", "universe"},
+				PubKeys:    testKey.PubKeys,
+			},
+		},
 		Packages: map[string]*setup.Package{
 			"mypkg": {
-				Archive: "ubuntu",
-				Name:    "mypkg",
-				Path:    "slices/mydir/mypkg.yaml",
+				Name: "mypkg",
+				Path: "slices/mydir/mypkg.yaml",
 				Slices: map[string]*setup.Slice{
 					"myslice1": {
 						Package: "mypkg",
@@ -468,7 +851,7 @@ var setupTests = []setupTest{{
 						/file/foob*r:
 		`,
 	},
-	relerror:  `slices mypkg1_myslice and mypkg2_myslice conflict on /file/f\*obar and /file/foob\*r`,
+	relerror: `slices mypkg1_myslice and mypkg2_myslice conflict on /file/f\*obar and /file/foob\*r`,
 }, {
 	summary: "Conflicting globs and plain copies",
 	input: map[string]string{
@@ -487,7 +870,7 @@ var setupTests = []setupTest{{
 						/file/foob*r:
 		`,
 	},
-	relerror:  `slices mypkg1_myslice and mypkg2_myslice conflict on /file/foobar and /file/foob\*r`,
+	relerror: `slices mypkg1_myslice and mypkg2_myslice conflict on /file/foobar and /file/foob\*r`,
 }, {
 	summary: "Conflicting matching globs",
 	input: map[string]string{
@@ -506,7 +889,7 @@ var setupTests = []setupTest{{
 						/file/foob*r:
 		`,
 	},
-	relerror:  `slices mypkg1_myslice and mypkg2_myslice conflict on /file/foob\*r`,
+	relerror: `slices mypkg1_myslice and mypkg2_myslice conflict on /file/foob\*r`,
 }, {
 	summary: "Conflicting globs in same package is okay",
 	input: map[string]string{
@@ -534,7 +917,7 @@ var setupTests = []setupTest{{
 						/file/foob*r: {text: foo}
 		`,
 	},
-	relerror:  `slice mypkg_myslice path /file/foob\*r has invalid wildcard options`,
+	relerror: `slice mypkg_myslice path /file/foob\*r has invalid wildcard options`,
 }, {
 	summary: "Until is an okay option for globs",
 	input: map[string]string{
@@ -557,7 +940,7 @@ var setupTests = []setupTest{{
 						/path/: {mutable: true}
 		`,
 	},
-	relerror:  `slice mypkg_myslice mutable is not a regular file: /path/`,
+	relerror: `slice mypkg_myslice mutable is not a regular file: /path/`,
 }, {
 	summary: "Mutable does not work for directory making",
 	input: map[string]string{
@@ -569,7 +952,7 @@ var setupTests = []setupTest{{
 						/path/: {make: true, mutable: true}
 		`,
 	},
-	relerror:  `slice mypkg_myslice mutable is not a regular file: /path/`,
+	relerror: `slice mypkg_myslice mutable is not a regular file: /path/`,
 }, {
 	summary: "Mutable does not work for symlinks",
 	input: map[string]string{
@@ -581,7 +964,7 @@ var setupTests = []setupTest{{
 						/path: {symlink: /other, mutable: true}
 		`,
 	},
-	relerror:  `slice mypkg_myslice mutable is not a regular file: /path`,
+	relerror: `slice mypkg_myslice mutable is not a regular file: /path`,
 }, {
 	summary: "Until checks its value for validity",
 	input: map[string]string{
@@ -593,7 +976,7 @@ var setupTests = []setupTest{{
 						/path: {until: foo}
 		`,
 	},
-	relerror:  `slice mypkg_myslice has invalid 'until' for path /path: "foo"`,
+	relerror: `slice mypkg_myslice has invalid 'until' for path /path: "foo"`,
 }, {
 	summary: "Arch checks its value for validity",
 	input: map[string]string{
@@ -605,7 +988,7 @@ var setupTests = []setupTest{{
 						/path: {arch: foo}
 		`,
 	},
-	relerror:  `slice mypkg_myslice has invalid 'arch' for path /path: "foo"`,
+	relerror: `slice mypkg_myslice has invalid 'arch' for path /path: "foo"`,
 }, {
 	summary: "Arch checks its value for validity",
 	input: map[string]string{
@@ -617,7 +1000,7 @@ var setupTests = []setupTest{{
 						/path: {arch: [i386, foo]}
 		`,
 	},
-	relerror:  `slice mypkg_myslice has invalid 'arch' for path /path: "foo"`,
+	relerror: `slice mypkg_myslice has invalid 'arch' for path /path: "foo"`,
 }, {
 	summary: "Single architecture selection",
 	input: map[string]string{
@@ -632,12 +1015,19 @@ var setupTests = []setupTest{{
 	release: &setup.Release{
 		DefaultArchive: "ubuntu",
 
-		Archives: map[string]*setup.Archive{"ubuntu": {"ubuntu", "22.04", []string{"jammy"}, []string{"main", "universe"}}},
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main", "universe"},
+				PubKeys:    testKey.PubKeys,
+			},
+		},
 		Packages: map[string]*setup.Package{
 			"mypkg": {
-				Archive: "ubuntu",
-				Name:    "mypkg",
-				Path:    "slices/mydir/mypkg.yaml",
+				Name: "mypkg",
+				Path: "slices/mydir/mypkg.yaml",
 				Slices: map[string]*setup.Slice{
 					"myslice": {
 						Package: "mypkg",
@@ -664,12 +1054,19 @@ var setupTests = []setupTest{{
 	release: &setup.Release{
 		DefaultArchive: "ubuntu",
 
-		Archives: map[string]*setup.Archive{"ubuntu": {"ubuntu", "22.04", []string{"jammy"}, []string{"main", "universe"}}},
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main", "universe"},
+				PubKeys:    testKey.PubKeys,
+			},
+		},
 		Packages: map[string]*setup.Package{
 			"mypkg": {
-				Archive: "ubuntu",
-				Name:    "mypkg",
-				Path:    "slices/mydir/mypkg.yaml",
+				Name: "mypkg",
+				Path: "slices/mydir/mypkg.yaml",
 				Slices: map[string]*setup.Slice{
 					"myslice": {
 						Package: "mypkg",
@@ -682,22 +1079,317 @@ var setupTests = []setupTest{{
 			},
 		},
 	},
+}, {
+	summary: "Ownership of paths",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path1: {user: 1000}
+						/path2/: {make: true, user: 0, group: 50}
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main", "universe"},
+				PubKeys:    testKey.PubKeys,
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Name: "mypkg",
+				Path: "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice": {
+						Package: "mypkg",
+						Name:    "myslice",
+						Contents: map[string]setup.PathInfo{
+							"/path1":  {Kind: "copy", UID: intPtr(1000)},
+							"/path2/": {Kind: "dir", UID: intPtr(0), GID: intPtr(50)},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "User must not be negative",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path: {user: -1}
+		`,
+	},
+	relerror: `slice mypkg_myslice has invalid 'user' for path /path: -1 \(expected a non-negative numeric ID\)`,
+}, {
+	summary: "Group must not be negative",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path: {group: -1}
+		`,
+	},
+	relerror: `slice mypkg_myslice has invalid 'group' for path /path: -1 \(expected a non-negative numeric ID\)`,
+}, {
+	summary: "User and group must be numeric IDs",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path: {user: root}
+		`,
+	},
+	relerror: `slice mypkg_myslice has invalid 'user' for path /path: root \(expected a non-negative numeric ID\)`,
+}, {
+	summary: "Ownership is not an option for globs",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/file/foob*r: {user: 1000}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /file/foob\*r cannot have 'user' or 'group' as it has wildcards`,
+}, {
+	summary: "Group is not an option for globs",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/file/**: {group: 0}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /file/\*\* cannot have 'user' or 'group' as it has wildcards`,
+}, {
+	summary: "Paths with different ownership conflict",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/path1: {text: same, user: 1000}
+				myslice2:
+					contents:
+						/path1: {text: same, user: 1001}
+		`,
+	},
+	relerror: "slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /path1",
+}, {
+	summary: "File capabilities",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/bin/ping: {caps: cap_net_raw=ep}
+						/bin/text: {text: data, caps: "cap_chown,cap_fowner+p"}
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:       "ubuntu",
+				Version:    "22.04",
+				Suites:     []string{"jammy"},
+				Components: []string{"main", "universe"},
+				PubKeys:    testKey.PubKeys,
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Name: "mypkg",
+				Path: "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice": {
+						Package: "mypkg",
+						Name:    "myslice",
+						Contents: map[string]setup.PathInfo{
+							"/bin/ping": {Kind: "copy", Caps: "cap_net_raw=ep"},
+							"/bin/text": {Kind: "text", Info: "data", Caps: "cap_chown,cap_fowner+p"},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Capabilities must be valid",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/bin/ping: {caps: cap_foo=ep}
+		`,
+	},
+	relerror: `slice mypkg_myslice has invalid 'caps' for path /bin/ping: "cap_foo=ep"`,
+}, {
+	summary: "Capabilities only apply to regular files",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/bin/: {make: true, caps: cap_net_raw=ep}
+		`,
+	},
+	relerror: `slice mypkg_myslice path with caps is not a regular file: /bin/`,
+}, {
+	summary: "Capabilities are not an option for globs",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/bin/p*ng: {caps: cap_net_raw=ep}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /bin/p\*ng has invalid wildcard options`,
+}, {
+	summary: "Archives must refer to public keys",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main, universe]
+		`,
+	},
+	relerror: `chisel.yaml: archive "ubuntu" missing public-keys field`,
+}, {
+	summary: "Archives must refer to defined public keys",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main, universe]
+					public-keys: [unknown-key]
+		`,
+	},
+	relerror: `chisel.yaml: archive "ubuntu" refers to undefined public key "unknown-key"`,
+}, {
+	summary: "Public key ID must match the armor",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main, universe]
+					public-keys: [test-key]
+			public-keys:
+				test-key:
+					id: ` + testutil.PGPKeys["key2"].ID + `
+					armor: |` + "\n" + testutil.PrefixEachLine(testKey.PubKeyArmor, "\t\t\t\t\t\t") + `
+		`,
+	},
+	relerror: `chisel.yaml: public key "test-key" armor has incorrect ID: expected "` + testutil.PGPKeys["key2"].ID + `", got "` + testKey.ID + `"`,
+}, {
+	summary: "Public key armor must be valid",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main, universe]
+					public-keys: [test-key]
+			public-keys:
+				test-key:
+					id: ` + testKey.ID + `
+					armor: foo
+		`,
+	},
+	relerror: `chisel.yaml: public key "test-key" armor is invalid: .*`,
+}, {
+	summary: "Public key armor must not contain private keys",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main, universe]
+					public-keys: [test-key]
+			public-keys:
+				test-key:
+					id: ` + testKey.ID + `
+					armor: |` + "\n" + testutil.PrefixEachLine(testKey.PrivKeyArmor, "\t\t\t\t\t\t") + `
+		`,
+	},
+	relerror: `chisel.yaml: public key "test-key" armor contains private key`,
+}, {
+	summary: "Public key requires an ID",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main, universe]
+					public-keys: [test-key]
+			public-keys:
+				test-key:
+					armor: |` + "\n" + testutil.PrefixEachLine(testKey.PubKeyArmor, "\t\t\t\t\t\t") + `
+		`,
+	},
+	relerror: `chisel.yaml: public key "test-key" missing id field`,
 }}
 
-const defaultChiselYaml = `
+var testKey = testutil.PGPKeys["key1"]
+
+func intPtr(i int) *int {
+	return &i
+}
+
+var defaultChiselYaml = `
 	format: chisel-v1
 	archives:
 		ubuntu:
 			version: 22.04
 			components: [main, universe]
-`
+			public-keys: [test-key]
+	public-keys:
+		test-key:
+			id: ` + testKey.ID + `
+			armor: |` + "\n" + testutil.PrefixEachLine(testKey.PubKeyArmor, "\t\t\t\t")
 
 func (s *S) TestParseRelease(c *C) {
 	for _, test := range setupTests {
 		c.Logf("Summary: %s", test.summary)
 
 		if _, ok := test.input["chisel.yaml"]; !ok {
-			test.input["chisel.yaml"] = string(defaultChiselYaml)
+			test.input["chisel.yaml"] = defaultChiselYaml
 		}
 
 		dir := c.MkDir()
@@ -742,3 +1434,29 @@ func (s *S) TestParseRelease(c *C) {
 		}
 	}
 }
+
+func (s *S) TestLocalArchiveRelativeDir(c *C) {
+	dir := c.MkDir()
+	input := map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				local:
+					packages-dir: debs
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+	}
+	for path, data := range input {
+		fpath := filepath.Join(dir, path)
+		err := os.MkdirAll(filepath.Dir(fpath), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(fpath, testutil.Reindent(data), 0644)
+		c.Assert(err, IsNil)
+	}
+
+	release, err := setup.ReadRelease(dir)
+	c.Assert(err, IsNil)
+	c.Assert(release.Archives["local"].PackagesDir, Equals, filepath.Join(dir, "debs"))
+}
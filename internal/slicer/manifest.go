@@ -0,0 +1,346 @@
+package slicer
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/canonical/chisel/internal/control"
+	"github.com/canonical/chisel/internal/fsutil"
+	"github.com/canonical/chisel/internal/setup"
+	"github.com/canonical/chisel/internal/strdist"
+)
+
+// Manifest describes the packages used and the paths written by a cut.
+type Manifest struct {
+	Packages []*ManifestPackage `json:"packages"`
+	Paths    []*ManifestPath    `json:"paths"`
+}
+
+// ManifestPackage describes a package which contributed slices to a cut.
+// Source holds the name of the source package it was built from.
+type ManifestPackage struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Arch    string   `json:"arch"`
+	Source  string   `json:"source"`
+	Archive string   `json:"archive"`
+	SHA256  string   `json:"sha256"`
+	Slices  []string `json:"slices"`
+}
+
+// ManifestPath describes a path written by a cut. Directories have a
+// trailing slash, and content extracted from a package records its name
+// and version. Paths removed due to "until: mutate" are still listed,
+// as they were before the removal. Devices record their major and minor
+// numbers, and are listed as defined in the package even when cutting
+// without the privileges for creating them.
+type ManifestPath struct {
+	Path    string   `json:"path"`
+	Kind    string   `json:"kind"`
+	Mode    string   `json:"mode"`
+	Size    int64    `json:"size,omitempty"`
+	SHA256  string   `json:"sha256,omitempty"`
+	Link    string   `json:"link,omitempty"`
+	Major   int64    `json:"major,omitempty"`
+	Minor   int64    `json:"minor,omitempty"`
+	UID     int      `json:"uid"`
+	GID     int      `json:"gid"`
+	Xattrs  Xattrs   `json:"xattrs,omitempty"`
+	Slices  []string `json:"slices,omitempty"`
+	Package string   `json:"package,omitempty"`
+	Version string   `json:"version,omitempty"`
+	Mutated bool     `json:"mutated,omitempty"`
+	Removed bool     `json:"removed,omitempty"`
+}
+
+// Xattrs maps the names of extended attributes to their values, which
+// may hold binary data and so are encoded in base64.
+type Xattrs map[string][]byte
+
+// manifestBuilder tracks the paths written while running, so that the
+// manifest may be put together at the end.
+type manifestBuilder struct {
+	target    fsutil.Root
+	selection *setup.Selection
+	packages  map[string]*SelectedPackage
+	controls  map[string]string
+
+	created map[string]*createdPath
+	mutated map[string]bool
+	paths   map[string]*ManifestPath
+}
+
+func newManifestBuilder(target fsutil.Root, selection *setup.Selection, packages map[string]*SelectedPackage, controls map[string]string) *manifestBuilder {
+	return &manifestBuilder{
+		target:    target,
+		selection: selection,
+		packages:  packages,
+		controls:  controls,
+		created:   make(map[string]*createdPath),
+		mutated:   make(map[string]bool),
+	}
+}
+
+// createdPath holds the details of a created path which cannot be
+// obtained from the target.
+type createdPath struct {
+	// pkgName is the package the path was extracted from, if any.
+	pkgName string
+	uid     int
+	gid     int
+	xattrs  map[string]string
+	// mtime is the modification time defined in the package, if any.
+	mtime time.Time
+	// device is the package entry of a device, which is only created
+	// in a target directory when running as root.
+	device *tar.Header
+}
+
+func (b *manifestBuilder) addCreated(path string, created *createdPath) {
+	b.created[path] = created
+	// Parent directories are implicitly created when missing.
+	for dir := parentDir(path); dir != "/"; dir = parentDir(dir) {
+		if _, ok := b.created[dir]; ok {
+			break
+		}
+		b.created[dir] = &createdPath{}
+	}
+}
+
+func (b *manifestBuilder) addMutated(path string) {
+	b.mutated[path] = true
+}
+
+// setMutatedXattrs sets again the extended attributes of the mutated
+// paths, as writing into a file drops its capabilities.
+func (b *manifestBuilder) setMutatedXattrs() error {
+	for path := range b.mutated {
+		created := b.created[path]
+		if created == nil || len(created.xattrs) == 0 {
+			continue
+		}
+		err := b.target.SetXattrs(path, created.xattrs)
+		// Mutable paths may have been removed by scripts.
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan inspects the created paths as they are in the target.
+func (b *manifestBuilder) scan() error {
+	b.paths = make(map[string]*ManifestPath)
+	for path, created := range b.created {
+		pkgName := created.pkgName
+		finfo, err := b.target.Lstat(path)
+		if os.IsNotExist(err) && created.device != nil {
+			finfo, err = created.device.FileInfo(), nil
+		}
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		mpath := &ManifestPath{
+			Path:    path,
+			Mode:    fmt.Sprintf("%#o", unixPerm(finfo.Mode())),
+			UID:     created.uid,
+			GID:     created.gid,
+			Slices:  b.slicesOf(path, pkgName),
+			Package: pkgName,
+		}
+		if pkgName != "" {
+			mpath.Version = b.packages[pkgName].Info.Version
+		}
+		for name, value := range created.xattrs {
+			if mpath.Xattrs == nil {
+				mpath.Xattrs = make(Xattrs)
+			}
+			mpath.Xattrs[name] = []byte(value)
+		}
+		switch finfo.Mode() & fs.ModeType {
+		case 0:
+			mpath.Kind = "file"
+			mpath.Size = finfo.Size()
+			mpath.SHA256, err = fileDigest(b.target, path)
+			if err != nil {
+				return err
+			}
+			mpath.Mutated = b.mutated[path]
+		case fs.ModeDir:
+			mpath.Kind = "dir"
+		case fs.ModeSymlink:
+			mpath.Kind = "symlink"
+			mpath.Link, err = b.target.Readlink(path)
+			if err != nil {
+				return err
+			}
+		case fs.ModeNamedPipe:
+			mpath.Kind = "fifo"
+		case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+			mpath.Kind = "blockdev"
+			if finfo.Mode()&fs.ModeCharDevice != 0 {
+				mpath.Kind = "chardev"
+			}
+			if created.device != nil {
+				mpath.Major = created.device.Devmajor
+				mpath.Minor = created.device.Devminor
+			}
+		default:
+			return fmt.Errorf("unsupported file type: %s", path)
+		}
+		b.paths[path] = mpath
+	}
+	return nil
+}
+
+// setModTimes sets the modification time of the created paths which
+// remain in the target to timestamp, or to the time defined
+// in the package they were extracted from when older and not mutated.
+func (b *manifestBuilder) setModTimes(timestamp time.Time) error {
+	for path, created := range b.created {
+		if mpath := b.paths[path]; mpath == nil || mpath.Removed {
+			continue
+		}
+		mtime := timestamp
+		if !created.mtime.IsZero() && created.mtime.Before(timestamp) && !b.mutated[path] {
+			mtime = created.mtime
+		}
+		err := b.target.SetModTime(path, mtime)
+		if os.IsNotExist(err) && created.device != nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *manifestBuilder) addRemoved(path string) {
+	if mpath, ok := b.paths[path]; ok {
+		mpath.Removed = true
+	}
+}
+
+func (b *manifestBuilder) build() *Manifest {
+	manifest := &Manifest{
+		Packages: []*ManifestPackage{},
+		Paths:    []*ManifestPath{},
+	}
+	pkgSlices := make(map[string][]string)
+	for _, slice := range b.selection.Slices {
+		pkgSlices[slice.Package] = append(pkgSlices[slice.Package], slice.String())
+	}
+	for pkgName, selected := range b.packages {
+		if pkgSlices[pkgName] == nil {
+			continue
+		}
+		manifest.Packages = append(manifest.Packages, &ManifestPackage{
+			Name:    pkgName,
+			Version: selected.Info.Version,
+			Arch:    selected.Info.Arch,
+			Source:  sourceName(pkgName, b.controls[pkgName]),
+			Archive: selected.Archive,
+			SHA256:  selected.Info.SHA256,
+			Slices:  pkgSlices[pkgName],
+		})
+	}
+	sort.Slice(manifest.Packages, func(i, j int) bool {
+		return manifest.Packages[i].Name < manifest.Packages[j].Name
+	})
+	for _, mpath := range b.paths {
+		manifest.Paths = append(manifest.Paths, mpath)
+	}
+	sort.Slice(manifest.Paths, func(i, j int) bool {
+		return manifest.Paths[i].Path < manifest.Paths[j].Path
+	})
+	return manifest
+}
+
+// slicesOf returns the slices which selected the path. Directories are
+// selected by the slices selecting any of their content, and paths which
+// were extracted without being selected by any slice, such as copyright
+// files, are attributed to all the selected slices of their package.
+func (b *manifestBuilder) slicesOf(path, pkgName string) []string {
+	var slices []string
+	isDir := strings.HasSuffix(path, "/")
+	for _, slice := range b.selection.Slices {
+		for targetPath, pathInfo := range slice.Contents {
+			if targetPath == path ||
+				pathInfo.Kind == setup.GlobPath && strdist.GlobPath(targetPath, path) ||
+				isDir && strings.HasPrefix(targetPath, path) {
+				slices = append(slices, slice.String())
+				break
+			}
+		}
+	}
+	if slices == nil && pkgName != "" {
+		for _, slice := range b.selection.Slices {
+			if slice.Package == pkgName {
+				slices = append(slices, slice.String())
+			}
+		}
+	}
+	return slices
+}
+
+// sourceName returns the name of the source package from the control data
+// of a binary package, which omits it when both names are the same.
+func sourceName(pkgName, controlData string) string {
+	source := control.ParseSection(controlData).Get("Source")
+	if i := strings.IndexByte(source, ' '); i >= 0 {
+		// Drop the source version, as in "glibc (2.35-0ubuntu3)".
+		source = source[:i]
+	}
+	if source == "" {
+		return pkgName
+	}
+	return source
+}
+
+func parentDir(path string) string {
+	dir := filepath.Dir(strings.TrimRight(path, "/"))
+	if dir == "/" {
+		return dir
+	}
+	return dir + "/"
+}
+
+func unixPerm(mode fs.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return perm
+}
+
+func fileDigest(target fsutil.Root, path string) (string, error) {
+	file, err := target.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
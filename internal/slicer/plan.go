@@ -0,0 +1,125 @@
+package slicer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/canonical/chisel/internal/archive"
+	"github.com/canonical/chisel/internal/cache"
+	"github.com/canonical/chisel/internal/setup"
+)
+
+type PlanOptions struct {
+	Selection *setup.Selection
+	Archives  map[string]archive.Archive
+	// Packages holds the packages chosen with SelectPackages.
+	Packages map[string]*SelectedPackage
+	// Cache, if set, is checked for the packages already downloaded.
+	Cache *cache.Cache
+}
+
+// Plan describes what a cut of the selection would do, without doing it.
+type Plan struct {
+	Slices   []string       `json:"slices"`
+	Packages []*PlanPackage `json:"packages"`
+	Paths    []*PlanPath    `json:"paths"`
+}
+
+// PlanPackage describes a package which would be used by a cut. Cached
+// reports whether the package is available without downloading it.
+type PlanPackage struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Arch     string `json:"arch"`
+	Archive  string `json:"archive"`
+	Filename string `json:"filename"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size,omitempty"`
+	Cached   bool   `json:"cached"`
+}
+
+// PlanPath describes a path declared by the selected slices, with the
+// kind of its definition. Glob paths are listed as declared, since their
+// matches are only known once the package is extracted.
+type PlanPath struct {
+	Path   string   `json:"path"`
+	Kind   string   `json:"kind"`
+	Slices []string `json:"slices"`
+}
+
+// NewPlan returns the plan for cutting the selection, with the slices in
+// the order they would be processed, and the packages and paths sorted by
+// name.
+func NewPlan(options *PlanOptions) (*Plan, error) {
+	plan := &Plan{
+		Slices:   []string{},
+		Packages: []*PlanPackage{},
+		Paths:    []*PlanPath{},
+	}
+	paths := make(map[string]*PlanPath)
+	for _, slice := range options.Selection.Slices {
+		plan.Slices = append(plan.Slices, slice.String())
+
+		selected := options.Packages[slice.Package]
+		if selected == nil {
+			return nil, fmt.Errorf("internal error: package %q was not selected", slice.Package)
+		}
+		pkgArchive := options.Archives[selected.Archive]
+		if pkgArchive == nil {
+			return nil, fmt.Errorf("archive %q not defined", selected.Archive)
+		}
+		arch := pkgArchive.Options().Arch
+		for targetPath, pathInfo := range slice.Contents {
+			if len(pathInfo.Arch) > 0 && !contains(pathInfo.Arch, arch) {
+				continue
+			}
+			path := paths[targetPath]
+			if path == nil {
+				path = &PlanPath{Path: targetPath, Kind: string(pathInfo.Kind)}
+				paths[targetPath] = path
+				plan.Paths = append(plan.Paths, path)
+			}
+			path.Slices = append(path.Slices, slice.String())
+		}
+	}
+
+	for _, selected := range options.Packages {
+		info := selected.Info
+		pkgArchive := options.Archives[selected.Archive]
+		size := info.Size
+		if size == 0 {
+			// Locked packages do not record their size.
+			for _, other := range pkgArchive.Versions(info.Name) {
+				if other.SHA256 == info.SHA256 {
+					size = other.Size
+					break
+				}
+			}
+		}
+		cached := pkgArchive.Options().PackagesDir != ""
+		if !cached && options.Cache != nil {
+			cached = options.Cache.Has(info.SHA256)
+		}
+		plan.Packages = append(plan.Packages, &PlanPackage{
+			Name:     info.Name,
+			Version:  info.Version,
+			Arch:     info.Arch,
+			Archive:  selected.Archive,
+			Filename: info.Filename,
+			SHA256:   info.SHA256,
+			Size:     size,
+			Cached:   cached,
+		})
+	}
+
+	sort.Slice(plan.Packages, func(i, j int) bool {
+		return plan.Packages[i].Name < plan.Packages[j].Name
+	})
+	sort.Slice(plan.Paths, func(i, j int) bool {
+		return plan.Paths[i].Path < plan.Paths[j].Path
+	})
+	for _, path := range plan.Paths {
+		sort.Strings(path.Slices)
+	}
+	return plan, nil
+}
@@ -0,0 +1,90 @@
+package slicer_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/archive"
+	"github.com/canonical/chisel/internal/cache"
+	"github.com/canonical/chisel/internal/setup"
+	"github.com/canonical/chisel/internal/slicer"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+func (s *S) TestNewPlan(c *C) {
+	releaseDir := c.MkDir()
+	release := map[string]string{
+		"chisel.yaml": defaultChiselYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/hello:
+						/foo/file: {text: data1}
+						/bar/file: {text: data1, arch: i386}
+				myslice2:
+					essential:
+						- base-files_myslice1
+					contents:
+						/foo/file:  {text: data1}
+						/foo/link:  {symlink: file}
+						/usr/bin/*:
+		`,
+	}
+	for path, data := range release {
+		fpath := filepath.Join(releaseDir, path)
+		err := os.MkdirAll(filepath.Dir(fpath), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(fpath, testutil.Reindent(data), 0644)
+		c.Assert(err, IsNil)
+	}
+	r, err := setup.ReadRelease(releaseDir)
+	c.Assert(err, IsNil)
+	selection, err := setup.Select(r, []setup.SliceKey{{Package: "base-files", Slice: "myslice2"}})
+	c.Assert(err, IsNil)
+	archives := map[string]archive.Archive{
+		"ubuntu": &testArchive{arch: "amd64", pkgs: defaultPkgs["ubuntu"]},
+	}
+	packages, err := slicer.SelectPackages(&slicer.SelectOptions{
+		Selection: selection,
+		Archives:  archives,
+	})
+	c.Assert(err, IsNil)
+
+	options := &slicer.PlanOptions{
+		Selection: selection,
+		Archives:  archives,
+		Packages:  packages,
+		Cache:     &cache.Cache{Dir: c.MkDir()},
+	}
+	plan, err := slicer.NewPlan(options)
+	c.Assert(err, IsNil)
+	c.Assert(plan, DeepEquals, &slicer.Plan{
+		Slices: []string{"base-files_myslice1", "base-files_myslice2"},
+		Packages: []*slicer.PlanPackage{{
+			Name:     "base-files",
+			Version:  "1.0",
+			Arch:     "amd64",
+			Archive:  "ubuntu",
+			Filename: "base-files_1.0.deb",
+			SHA256:   baseFilesSHA256,
+			Size:     int64(len(testutil.PackageData["base-files"])),
+		}},
+		Paths: []*slicer.PlanPath{
+			{Path: "/foo/file", Kind: "text", Slices: []string{"base-files_myslice1", "base-files_myslice2"}},
+			{Path: "/foo/link", Kind: "symlink", Slices: []string{"base-files_myslice2"}},
+			{Path: "/usr/bin/*", Kind: "glob", Slices: []string{"base-files_myslice2"}},
+			{Path: "/usr/bin/hello", Kind: "copy", Slices: []string{"base-files_myslice1"}},
+		},
+	})
+
+	err = options.Cache.Write(baseFilesSHA256, testutil.PackageData["base-files"])
+	c.Assert(err, IsNil)
+	plan, err = slicer.NewPlan(options)
+	c.Assert(err, IsNil)
+	c.Assert(plan.Packages[0].Cached, Equals, true)
+}
@@ -7,12 +7,15 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/canonical/chisel/internal/archive"
 	"github.com/canonical/chisel/internal/deb"
 	"github.com/canonical/chisel/internal/fsutil"
+	"github.com/canonical/chisel/internal/jobs"
 	"github.com/canonical/chisel/internal/scripts"
 	"github.com/canonical/chisel/internal/setup"
 	"github.com/canonical/chisel/internal/strdist"
@@ -22,11 +25,52 @@ type RunOptions struct {
 	Selection *setup.Selection
 	Archives  map[string]archive.Archive
 	TargetDir string
+
+	// Target, if set, receives the content instead of the target
+	// directory, such as a fsutil.Tree holding it in memory. Mutation
+	// scripts work on actual files, so these require the target
+	// directory to be used instead.
+	Target fsutil.Root
+
+	// Packages optionally holds the packages previously chosen with
+	// SelectPackages. Otherwise they are chosen when running.
+	Packages map[string]*SelectedPackage
+
+	// DpkgDB selects the format of the dpkg database recording the
+	// packages that contributed slices, if one is to be written.
+	DpkgDB DpkgDB
+
+	// Timestamp, if set, is the modification time of all the written
+	// content, once done. Content extracted from packages keeps the
+	// time defined in them when older, unless mutated.
+	Timestamp time.Time
+
+	// Jobs is the maximum number of packages fetched concurrently, or
+	// one if unset. Packages are still extracted in the selection order.
+	Jobs int
 }
 
-func Run(options *RunOptions) error {
+// DpkgDB is the format of a dpkg database describing the installed packages.
+type DpkgDB string
+
+const (
+	// DpkgDBNone means no dpkg database is written.
+	DpkgDBNone DpkgDB = ""
+	// DpkgDBStatus writes all packages into /var/lib/dpkg/status.
+	DpkgDBStatus DpkgDB = "status"
+	// DpkgDBStatusDir writes each package into /var/lib/dpkg/status.d/<pkg>,
+	// as done in distroless images.
+	DpkgDBStatusDir DpkgDB = "status.d"
+)
+
+func Run(options *RunOptions) (*Manifest, error) {
+
+	switch options.DpkgDB {
+	case DpkgDBNone, DpkgDBStatus, DpkgDBStatusDir:
+	default:
+		return nil, fmt.Errorf("invalid dpkg database format: %q", options.DpkgDB)
+	}
 
-	archives := make(map[string]archive.Archive)
 	extract := make(map[string]map[string][]deb.ExtractInfo)
 	pathInfos := make(map[string]setup.PathInfo)
 
@@ -35,30 +79,50 @@ func Run(options *RunOptions) error {
 		syscall.Umask(oldUmask)
 	}()
 
-	release := options.Selection.Release
 	targetDir := filepath.Clean(options.TargetDir)
 	targetDirAbs := targetDir
 	if !filepath.IsAbs(targetDirAbs) {
 		dir, err := os.Getwd()
 		if err != nil {
-			return fmt.Errorf("cannot obtain current directory: %w", err)
+			return nil, fmt.Errorf("cannot obtain current directory: %w", err)
 		}
 		targetDirAbs = filepath.Join(dir, targetDir)
 	}
+	target := options.Target
+	if target == nil {
+		target = fsutil.Dir(targetDir)
+	} else {
+		for _, slice := range options.Selection.Slices {
+			if slice.Scripts.Mutate != "" {
+				return nil, fmt.Errorf("slice %s: cannot run mutation scripts without a target directory", slice)
+			}
+		}
+	}
+
+	packages := options.Packages
+	if packages == nil {
+		var err error
+		packages, err = SelectPackages(&SelectOptions{
+			Selection: options.Selection,
+			Archives:  options.Archives,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	archives := make(map[string]archive.Archive)
+	for _, slice := range options.Selection.Slices {
+		selected := packages[slice.Package]
+		if selected == nil {
+			return nil, fmt.Errorf("internal error: package %q was not selected", slice.Package)
+		}
+		archives[slice.Package] = options.Archives[selected.Archive]
+	}
 
 	// Build information to process the selection.
 	for _, slice := range options.Selection.Slices {
 		extractPackage := extract[slice.Package]
 		if extractPackage == nil {
-			archiveName := release.Packages[slice.Package].Archive
-			archive := options.Archives[archiveName]
-			if archive == nil {
-				return fmt.Errorf("archive %q not defined", archiveName)
-			}
-			if !archive.Exists(slice.Package) {
-				return fmt.Errorf("slice package %q missing from archive", slice.Package)
-			}
-			archives[slice.Package] = archive
 			extractPackage = make(map[string][]deb.ExtractInfo)
 			extract[slice.Package] = extractPackage
 		}
@@ -78,8 +142,15 @@ func Run(options *RunOptions) error {
 				if sourcePath == "" {
 					sourcePath = targetPath
 				}
+				xattrs, err := pathXattrs(&pathInfo)
+				if err != nil {
+					return nil, err
+				}
 				extractPackage[sourcePath] = append(extractPackage[sourcePath], deb.ExtractInfo{
-					Path: targetPath,
+					Path:   targetPath,
+					UID:    pathInfo.UID,
+					GID:    pathInfo.GID,
+					Xattrs: xattrs,
 				})
 				if sourcePath == copyrightPath && targetPath == copyrightPath {
 					hasCopyright = true
@@ -104,37 +175,69 @@ func Run(options *RunOptions) error {
 	}
 
 	// Fetch all packages, using the selection order.
-	packages := make(map[string]io.ReadCloser)
+	var pkgNames []string
+	readers := make(map[string]io.ReadCloser)
 	for _, slice := range options.Selection.Slices {
-		if packages[slice.Package] != nil {
-			continue
+		if _, ok := readers[slice.Package]; !ok {
+			readers[slice.Package] = nil
+			pkgNames = append(pkgNames, slice.Package)
 		}
-		reader, err := archives[slice.Package].Fetch(slice.Package)
-		if err != nil {
-			return err
+	}
+	fetched, err := fetchPackages(options.Jobs, pkgNames, func(pkgName string) (io.ReadCloser, error) {
+		return archives[pkgName].FetchPackage(packages[pkgName].Info)
+	})
+	for _, reader := range fetched {
+		if reader != nil {
+			defer reader.Close()
 		}
-		defer reader.Close()
-		packages[slice.Package] = reader
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, pkgName := range pkgNames {
+		readers[pkgName] = fetched[i]
 	}
 
 	globbedPaths := make(map[string][]string)
+	controls := make(map[string]string)
+	manifest := newManifestBuilder(target, options.Selection, packages, controls)
 
 	// Extract all packages, also using the selection order.
 	for _, slice := range options.Selection.Slices {
-		reader := packages[slice.Package]
+		reader := readers[slice.Package]
 		if reader == nil {
 			continue
 		}
-		err := deb.Extract(reader, &deb.ExtractOptions{
+		extractOptions := &deb.ExtractOptions{
 			Package:   slice.Package,
 			Extract:   extract[slice.Package],
 			TargetDir: targetDir,
+			Target:    options.Target,
 			Globbed:   globbedPaths,
-		})
+		}
+		pkgName := slice.Package
+		extractOptions.Created = func(path string, header *tar.Header) {
+			created := &createdPath{
+				pkgName: pkgName,
+				uid:     header.Uid,
+				gid:     header.Gid,
+				xattrs:  deb.Xattrs(header),
+				mtime:   header.ModTime,
+			}
+			if header.Typeflag == tar.TypeChar || header.Typeflag == tar.TypeBlock {
+				created.device = header
+			}
+			manifest.addCreated(path, created)
+		}
+		extractOptions.Control = func(data string) error {
+			controls[pkgName] = data
+			return nil
+		}
+		err := deb.Extract(reader, extractOptions)
 		reader.Close()
-		packages[slice.Package] = nil
+		readers[slice.Package] = nil
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -150,7 +253,18 @@ func Run(options *RunOptions) error {
 				continue
 			}
 			done[targetPath] = true
-			targetPath = filepath.Join(targetDir, targetPath)
+			var uid, gid int
+			if pathInfo.UID != nil {
+				uid = *pathInfo.UID
+			}
+			if pathInfo.GID != nil {
+				gid = *pathInfo.GID
+			}
+			xattrs, err := pathXattrs(&pathInfo)
+			if err != nil {
+				return nil, err
+			}
+			manifest.addCreated(targetPath, &createdPath{uid: uid, gid: gid, xattrs: xattrs})
 			targetMode := pathInfo.Mode
 			if targetMode == 0 {
 				if pathInfo.Kind == setup.DirPath {
@@ -174,27 +288,41 @@ func Run(options *RunOptions) error {
 				tarHeader.Typeflag = tar.TypeSymlink
 				linkTarget = pathInfo.Info
 			default:
-				return fmt.Errorf("internal error: cannot extract path of kind %q", pathInfo.Kind)
+				return nil, fmt.Errorf("internal error: cannot extract path of kind %q", pathInfo.Kind)
 			}
 
-			err := fsutil.Create(&fsutil.CreateOptions{
-				Path: targetPath,
-				Mode: tarHeader.FileInfo().Mode(),
-				Data: fileContent,
-				Link: linkTarget,
+			err = target.Create(&fsutil.CreateOptions{
+				Path:   targetPath,
+				Mode:   tarHeader.FileInfo().Mode(),
+				Data:   fileContent,
+				Link:   linkTarget,
+				UID:    uid,
+				GID:    gid,
+				Xattrs: xattrs,
 			})
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
 
+	if options.DpkgDB != DpkgDBNone {
+		dpkgPaths, err := writeDpkgDB(target, options.DpkgDB, options.Selection, controls)
+		if err != nil {
+			return nil, fmt.Errorf("cannot write dpkg database: %w", err)
+		}
+		for _, path := range dpkgPaths {
+			manifest.addCreated(path, &createdPath{})
+		}
+	}
+
 	// Run mutation scripts. Order is fundamental here as
 	// dependencies must run before dependents.
 	checkWrite := func(path string) error {
 		if !pathInfos[path].Mutable {
 			return fmt.Errorf("cannot write file which is not mutable: %s", path)
 		}
+		manifest.addMutated(path)
 		return nil
 	}
 	checkRead := func(path string) error {
@@ -223,10 +351,31 @@ func Run(options *RunOptions) error {
 		}
 		err := scripts.Run(&opts)
 		if err != nil {
-			return fmt.Errorf("slice %s: %w", slice, err)
+			return nil, fmt.Errorf("slice %s: %w", slice, err)
 		}
 	}
 
+	err = manifest.setMutatedXattrs()
+	if err != nil {
+		return nil, fmt.Errorf("cannot set extended attributes: %w", err)
+	}
+
+	err = manifest.scan()
+	if err != nil {
+		return nil, fmt.Errorf("cannot inspect written content: %w", err)
+	}
+
+	// Paths in a target directory are removed as seen by the scripts.
+	removePath := func(path string) error {
+		if options.Target != nil {
+			return target.Remove(path)
+		}
+		realPath, err := content.RealPath(path, scripts.CheckRead)
+		if err != nil {
+			return err
+		}
+		return os.Remove(realPath)
+	}
 	var untilDirs []string
 	for targetPath, pathInfo := range pathInfos {
 		if pathInfo.Until == setup.UntilMutate {
@@ -237,31 +386,257 @@ func Run(options *RunOptions) error {
 				targetPaths = []string{targetPath}
 			}
 			for _, targetPath := range targetPaths {
-				realPath, err := content.RealPath(targetPath, scripts.CheckRead)
-				if err == nil {
-					if strings.HasSuffix(targetPath, "/") {
-						untilDirs = append(untilDirs, realPath)
-					} else {
-						err = os.Remove(realPath)
-					}
+				if strings.HasSuffix(targetPath, "/") {
+					untilDirs = append(untilDirs, targetPath)
+					continue
 				}
-				if err != nil {
-					return fmt.Errorf("cannot perform 'until' removal: %w", err)
+				err := removePath(targetPath)
+				// Mutable paths may have been removed by scripts.
+				if err != nil && !os.IsNotExist(err) {
+					return nil, fmt.Errorf("cannot perform 'until' removal: %w", err)
 				}
+				manifest.addRemoved(targetPath)
 			}
 		}
 	}
-	for _, realPath := range untilDirs {
-		err := os.Remove(realPath)
+	for _, targetPath := range untilDirs {
+		err := removePath(targetPath)
 		// The non-empty directory error is caught by IsExist as well.
 		if err != nil && !os.IsExist(err) {
-			return fmt.Errorf("cannot perform 'until' removal: %#v", err)
+			return nil, fmt.Errorf("cannot perform 'until' removal: %#v", err)
+		}
+		if err == nil {
+			manifest.addRemoved(targetPath)
+		}
+	}
+
+	if !options.Timestamp.IsZero() {
+		err := manifest.setModTimes(options.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("cannot set modification times: %w", err)
+		}
+	}
+
+	return manifest.build(), nil
+}
+
+// writeDpkgDB writes the status entries of the packages in the selection
+// into the dpkg database of the target, in the given format, and returns
+// the paths written.
+func writeDpkgDB(target fsutil.Root, format DpkgDB, selection *setup.Selection, controls map[string]string) ([]string, error) {
+	var pkgNames []string
+	for _, slice := range selection.Slices {
+		if !contains(pkgNames, slice.Package) {
+			pkgNames = append(pkgNames, slice.Package)
+		}
+	}
+	sort.Strings(pkgNames)
+
+	var written []string
+	var status bytes.Buffer
+	for _, pkgName := range pkgNames {
+		entry := deb.StatusEntry(controls[pkgName])
+		if format == DpkgDBStatus {
+			if status.Len() > 0 {
+				status.WriteByte('\n')
+			}
+			status.WriteString(entry)
+			continue
+		}
+		path := "/var/lib/dpkg/status.d/" + pkgName
+		err := target.Create(&fsutil.CreateOptions{
+			Path: path,
+			Mode: 0644,
+			Data: bytes.NewBufferString(entry),
+		})
+		if err != nil {
+			return nil, err
+		}
+		written = append(written, path)
+	}
+	if format == DpkgDBStatus {
+		path := "/var/lib/dpkg/status"
+		err := target.Create(&fsutil.CreateOptions{
+			Path: path,
+			Mode: 0644,
+			Data: &status,
+		})
+		if err != nil {
+			return nil, err
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+// fetchPackages calls fetch for each of the packages, with up to maxJobs of
+// them fetched concurrently, and returns the readers obtained in the same
+// order. On failure, the error for the first package listed that failed is
+// returned, along with any readers obtained, which must still be closed.
+func fetchPackages(maxJobs int, pkgNames []string, fetch func(pkgName string) (io.ReadCloser, error)) ([]io.ReadCloser, error) {
+	readers := make([]io.ReadCloser, len(pkgNames))
+	err := jobs.Run(maxJobs, len(pkgNames), func(i int) error {
+		var err error
+		readers[i], err = fetch(pkgNames[i])
+		return err
+	})
+	return readers, err
+}
+
+// SelectedPackage holds the details of the package chosen to provide
+// the slices of a given package name.
+type SelectedPackage struct {
+	Archive string
+	Info    *archive.PackageInfo
+}
+
+type SelectOptions struct {
+	Selection *setup.Selection
+	Archives  map[string]archive.Archive
+
+	// Lock optionally holds the exact packages to select.
+	Lock *setup.Lock
+}
+
+// SelectPackages chooses the archive and version of each package in the
+// selection. Packages pinned to an archive are only looked up there, while
+// other packages come from the archive with the highest priority providing
+// a version that satisfies the package constraint, if any. Ties are decided
+// in favour of the default archive and then of the most recent version.
+// When a lock is provided, the packages it records are selected instead,
+// after ensuring they agree with the release.
+func SelectPackages(options *SelectOptions) (map[string]*SelectedPackage, error) {
+	release := options.Selection.Release
+
+	var candidates []*setup.Archive
+	for _, archiveInfo := range release.Archives {
+		if archiveInfo.Priority >= 0 {
+			candidates = append(candidates, archiveInfo)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+
+	packages := make(map[string]*SelectedPackage)
+	for _, slice := range options.Selection.Slices {
+		if packages[slice.Package] != nil {
+			continue
+		}
+		pkg := release.Packages[slice.Package]
+		if options.Lock != nil {
+			selected, err := selectLocked(options, pkg)
+			if err != nil {
+				return nil, err
+			}
+			packages[pkg.Name] = selected
+			continue
+		}
+		pkgCandidates := candidates
+		if pkg.Archive != "" {
+			pkgCandidates = []*setup.Archive{release.Archives[pkg.Archive]}
+		}
+		var selected *setup.Archive
+		var selectedInfo *archive.PackageInfo
+		for _, archiveInfo := range pkgCandidates {
+			pkgArchive := options.Archives[archiveInfo.Name]
+			if pkgArchive == nil {
+				return nil, fmt.Errorf("archive %q not defined", archiveInfo.Name)
+			}
+			info := findVersion(pkgArchive, pkg)
+			if info == nil {
+				continue
+			}
+			if selected != nil {
+				var prefer bool
+				switch {
+				case archiveInfo.Priority != selected.Priority:
+					prefer = archiveInfo.Priority > selected.Priority
+				case selected.Name == release.DefaultArchive:
+					prefer = false
+				case archiveInfo.Name == release.DefaultArchive:
+					prefer = true
+				default:
+					prefer = deb.CompareVersions(info.Version, selectedInfo.Version) > 0
+				}
+				if !prefer {
+					continue
+				}
+			}
+			selected = archiveInfo
+			selectedInfo = info
+		}
+		if selected == nil {
+			var constraint string
+			if pkg.Version != nil {
+				constraint = fmt.Sprintf(" with version %s", pkg.Version)
+			}
+			if pkg.Archive != "" {
+				return nil, fmt.Errorf("slice package %q%s missing from archive %q", pkg.Name, constraint, pkg.Archive)
+			}
+			return nil, fmt.Errorf("slice package %q%s missing from archive", pkg.Name, constraint)
+		}
+		packages[pkg.Name] = &SelectedPackage{
+			Archive: selected.Name,
+			Info:    selectedInfo,
 		}
 	}
+	return packages, nil
+}
 
+// findVersion returns the most recent version of the package in the archive
+// which satisfies the package constraint, or nil if there is none.
+func findVersion(pkgArchive archive.Archive, pkg *setup.Package) *archive.PackageInfo {
+	for _, info := range pkgArchive.Versions(pkg.Name) {
+		if pkg.Version == nil || pkg.Version.Match(info.Version) {
+			return info
+		}
+	}
 	return nil
 }
 
+func selectLocked(options *SelectOptions, pkg *setup.Package) (*SelectedPackage, error) {
+	locked := options.Lock.Packages[pkg.Name]
+	if locked == nil {
+		return nil, fmt.Errorf("package %q missing from %s", pkg.Name, setup.LockFileName)
+	}
+	if pkg.Archive != "" && locked.Archive != pkg.Archive {
+		return nil, fmt.Errorf("package %q locked to archive %q but pinned to %q", pkg.Name, locked.Archive, pkg.Archive)
+	}
+	lockedArchive := options.Archives[locked.Archive]
+	if lockedArchive == nil {
+		return nil, fmt.Errorf("archive %q not defined", locked.Archive)
+	}
+	if arch := lockedArchive.Options().Arch; locked.Arch != "all" && locked.Arch != arch {
+		return nil, fmt.Errorf("package %q locked for architecture %s, not %s", pkg.Name, locked.Arch, arch)
+	}
+	if pkg.Version != nil && !pkg.Version.Match(locked.Version) {
+		return nil, fmt.Errorf("package %q locked to version %s, which does not satisfy %s", pkg.Name, locked.Version, pkg.Version)
+	}
+	return &SelectedPackage{
+		Archive: locked.Archive,
+		Info: &archive.PackageInfo{
+			Name:     locked.Name,
+			Version:  locked.Version,
+			Arch:     locked.Arch,
+			Filename: locked.Filename,
+			SHA256:   locked.SHA256,
+		},
+	}, nil
+}
+
+// pathXattrs returns the extended attributes defined for the path.
+func pathXattrs(pathInfo *setup.PathInfo) (map[string]string, error) {
+	if pathInfo.Caps == "" {
+		return nil, nil
+	}
+	caps, err := fsutil.EncodeCapabilities(pathInfo.Caps)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{fsutil.CapabilityXattr: caps}, nil
+}
+
 func contains(l []string, s string) bool {
 	for _, si := range l {
 		if si == s {
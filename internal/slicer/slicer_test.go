@@ -2,15 +2,19 @@ package slicer_test
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	. "gopkg.in/check.v1"
 
 	"github.com/canonical/chisel/internal/archive"
+	"github.com/canonical/chisel/internal/fsutil"
 	"github.com/canonical/chisel/internal/setup"
 	"github.com/canonical/chisel/internal/slicer"
 	"github.com/canonical/chisel/internal/testutil"
@@ -20,6 +24,8 @@ type slicerTest struct {
 	summary string
 	arch    string
 	release map[string]string
+	pkgs    map[string]map[string]testPackage
+	lock    *setup.Lock
 	slices  []setup.SliceKey
 	hackopt func(c *C, opts *slicer.RunOptions)
 	result  map[string]string
@@ -38,7 +44,7 @@ var copyrightEntries = map[string]string{
 
 var slicerTests = []slicerTest{{
 	summary: "Basic slicing",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -66,7 +72,7 @@ var slicerTests = []slicerTest{{
 	},
 }, {
 	summary: "Glob extraction",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -83,7 +89,7 @@ var slicerTests = []slicerTest{{
 	},
 }, {
 	summary: "Create new file under extracted directory",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -100,7 +106,7 @@ var slicerTests = []slicerTest{{
 	},
 }, {
 	summary: "Create new nested file under extracted directory",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -118,7 +124,7 @@ var slicerTests = []slicerTest{{
 	},
 }, {
 	summary: "Create new directory under extracted directory",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -136,7 +142,7 @@ var slicerTests = []slicerTest{{
 }, {
 	summary: "Conditional architecture",
 	arch:    "amd64",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -162,7 +168,7 @@ var slicerTests = []slicerTest{{
 	},
 }, {
 	summary: "Script: write a file",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -178,9 +184,27 @@ var slicerTests = []slicerTest{{
 		"/tmp/":      "dir 01777",
 		"/tmp/file1": "file 0644 d98cf53e",
 	},
+}, {
+	summary: "Script: cannot write into a target without a directory",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/tmp/file1: {text: data1, mutable: true}
+					mutate: |
+						content.write("/tmp/file1", "data2")
+		`,
+	},
+	hackopt: func(c *C, opts *slicer.RunOptions) {
+		opts.Target = fsutil.NewTree()
+	},
+	error: `slice base-files_myslice: cannot run mutation scripts without a target directory`,
 }, {
 	summary: "Script: read a file",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -202,7 +226,7 @@ var slicerTests = []slicerTest{{
 	},
 }, {
 	summary: "Script: use 'until' to remove file after mutate",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -223,7 +247,7 @@ var slicerTests = []slicerTest{{
 	},
 }, {
 	summary: "Script: use 'until' to remove wildcard after mutate",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -240,7 +264,7 @@ var slicerTests = []slicerTest{{
 	},
 }, {
 	summary: "Script: 'until' does not remove non-empty directories",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -258,7 +282,7 @@ var slicerTests = []slicerTest{{
 	},
 }, {
 	summary: "Script: cannot write non-mutable files",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -271,9 +295,47 @@ var slicerTests = []slicerTest{{
 		`,
 	},
 	error: `slice base-files_myslice: cannot write file which is not mutable: /tmp/file1`,
+}, {
+	summary: "Script: remove and change the mode of mutable files",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/tmp/file1: {text: data1, mutable: true}
+						/tmp/file2: {text: data2, mutable: true, until: mutate}
+						/tmp/file3: {text: data3, mutable: true}
+					mutate: |
+						if content.exists("/tmp/file2") and content.stat("/tmp/file1").mode == 0o644:
+							content.remove("/tmp/file3")
+							content.remove("/tmp/file2")
+						content.chmod("/tmp/file1", 0o600)
+		`,
+	},
+	result: map[string]string{
+		"/tmp/":      "dir 01777",
+		"/tmp/file1": "file 0600 5b41362b",
+	},
+}, {
+	summary: "Script: cannot remove non-mutable files",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/tmp/file1: {text: data1}
+					mutate: |
+						content.remove("/tmp/file1")
+		`,
+	},
+	error: `slice base-files_myslice: cannot write file which is not mutable: /tmp/file1`,
 }, {
 	summary: "Script: cannot read unlisted content",
-	slices:  []setup.SliceKey{{"base-files", "myslice2"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice2"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -289,7 +351,7 @@ var slicerTests = []slicerTest{{
 	error: `slice base-files_myslice2: cannot read file which is not selected: /tmp/file1`,
 }, {
 	summary: "Script: can read globbed content",
-	slices:  []setup.SliceKey{{"base-files", "myslice1"}, {"base-files", "myslice2"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice1"}, {Package: "base-files", Slice: "myslice2"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -304,7 +366,7 @@ var slicerTests = []slicerTest{{
 	},
 }, {
 	summary: "Relative content root directory must not error",
-	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
 	release: map[string]string{
 		"slices/mydir/base-files.yaml": `
 			package: base-files
@@ -322,19 +384,626 @@ var slicerTests = []slicerTest{{
 		opts.TargetDir, err = filepath.Rel(dir, opts.TargetDir)
 		c.Assert(err, IsNil)
 	},
+}, {
+	summary: "Packages may be fetched concurrently",
+	slices: []setup.SliceKey{
+		{Package: "base-files", Slice: "myslice"},
+		{Package: "mypkg1", Slice: "myslice"},
+		{Package: "mypkg2", Slice: "myslice"},
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu": {
+			"base-files": {version: "1.0", data: testutil.PackageData["base-files"]},
+			"mypkg1":     {version: "1.0", data: makeTestDeb("mypkg1", testutil.Dir(0755, "./etc/"), testutil.Reg(0644, "./etc/mypkg1.conf", "data1"))},
+			"mypkg2":     {version: "1.0", data: makeTestDeb("mypkg2", testutil.Dir(0755, "./etc/"), testutil.Reg(0644, "./etc/mypkg2.conf", "data2"))},
+		},
+	},
+	release: map[string]string{
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice:
+					contents:
+						/etc/mypkg1.conf:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice:
+					contents:
+						/etc/mypkg2.conf:
+		`,
+	},
+	hackopt: func(c *C, opts *slicer.RunOptions) {
+		opts.Jobs = 2
+	},
+	result: map[string]string{
+		"/etc/":            "dir 0755",
+		"/etc/mypkg1.conf": "file 0644 5b41362b",
+		"/etc/mypkg2.conf": "file 0644 d98cf53e",
+		"/usr/bin/":        "dir 0755",
+		"/usr/bin/hello":   "file 0775 eaf29575",
+	},
+}, {
+	summary: "Package comes from the archive with the highest priority",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+				updates:
+					version: 22.04
+					components: [main]
+					priority: 10
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu":  {"base-files": {version: "2.0", data: []byte("broken")}},
+		"updates": {"base-files": {version: "1.0", data: testutil.PackageData["base-files"]}},
+	},
+	result: map[string]string{
+		"/usr/":          "dir 0755",
+		"/usr/bin/":      "dir 0755",
+		"/usr/bin/hello": "file 0775 eaf29575",
+	},
+}, {
+	summary: "Default archive wins among archives with the same priority",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+				other:
+					version: 22.04
+					components: [main]
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu": {"base-files": {version: "1.0", data: testutil.PackageData["base-files"]}},
+		"other":  {"base-files": {version: "2.0", data: []byte("broken")}},
+	},
+	result: map[string]string{
+		"/usr/":          "dir 0755",
+		"/usr/bin/":      "dir 0755",
+		"/usr/bin/hello": "file 0775 eaf29575",
+	},
+}, {
+	summary: "Most recent version wins among archives with the same priority",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				one:
+					version: 22.04
+					components: [main]
+					public-keys: [test-key]
+				two:
+					version: 22.04
+					components: [main]
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"one": {"base-files": {version: "1.0", data: []byte("broken")}},
+		"two": {"base-files": {version: "2.0", data: testutil.PackageData["base-files"]}},
+	},
+	result: map[string]string{
+		"/usr/":          "dir 0755",
+		"/usr/bin/":      "dir 0755",
+		"/usr/bin/hello": "file 0775 eaf29575",
+	},
+}, {
+	summary: "Package pinned to an archive comes from that archive",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+					priority: 10
+					public-keys: [test-key]
+				private:
+					version: 22.04
+					components: [main]
+					priority: -1
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			archive: private
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu":  {"base-files": {version: "2.0", data: []byte("broken")}},
+		"private": {"base-files": {version: "1.0", data: testutil.PackageData["base-files"]}},
+	},
+	result: map[string]string{
+		"/usr/":          "dir 0755",
+		"/usr/bin/":      "dir 0755",
+		"/usr/bin/hello": "file 0775 eaf29575",
+	},
+}, {
+	summary: "Archives with negative priority are only used when pinned",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+				private:
+					version: 22.04
+					components: [main]
+					priority: -1
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu":  {},
+		"private": {"base-files": {version: "1.0", data: testutil.PackageData["base-files"]}},
+	},
+	error: `slice package "base-files" missing from archive`,
+}, {
+	summary: "Package pinned to an archive must be found there",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+				private:
+					version: 22.04
+					components: [main]
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			archive: private
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu":  {"base-files": {version: "1.0", data: testutil.PackageData["base-files"]}},
+		"private": {},
+	},
+	error: `slice package "base-files" missing from archive "private"`,
+}, {
+	summary: "Package version constraint selects an older version",
+	arch:    "amd64",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+				updates:
+					version: 22.04
+					components: [main]
+					priority: 10
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			version: "<< 2.0"
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu":  {"base-files": {version: "1.0", data: testutil.PackageData["base-files"]}},
+		"updates": {"base-files": {version: "2.0", data: []byte("broken")}},
+	},
+	result: map[string]string{
+		"/usr/":          "dir 0755",
+		"/usr/bin/":      "dir 0755",
+		"/usr/bin/hello": "file 0775 eaf29575",
+	},
+}, {
+	summary: "Package version constraint must be satisfied",
+	arch:    "amd64",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+				updates:
+					version: 22.04
+					components: [main]
+					priority: 10
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			version: ">= 3.0"
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu":  {"base-files": {version: "1.0", data: testutil.PackageData["base-files"]}},
+		"updates": {"base-files": {version: "2.0", data: []byte("broken")}},
+	},
+	error: `slice package "base-files" with version >= 3.0 missing from archive`,
+}, {
+	summary: "Locked packages are selected over more recent ones",
+	arch:    "amd64",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+				updates:
+					version: 22.04
+					components: [main]
+					priority: 10
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu":  {"base-files": {version: "1.0", data: testutil.PackageData["base-files"]}},
+		"updates": {"base-files": {version: "2.0", data: []byte("broken")}},
+	},
+	lock: &setup.Lock{Packages: map[string]*setup.LockedPackage{
+		"base-files": {
+			Name:     "base-files",
+			Version:  "1.0",
+			Arch:     "all",
+			Archive:  "ubuntu",
+			Filename: "base-files_1.0.deb",
+			SHA256:   baseFilesSHA256,
+		},
+	}},
+	result: map[string]string{
+		"/usr/":          "dir 0755",
+		"/usr/bin/":      "dir 0755",
+		"/usr/bin/hello": "file 0775 eaf29575",
+	},
+}, {
+	summary: "Locked packages must satisfy the version constraint",
+	arch:    "amd64",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+				updates:
+					version: 22.04
+					components: [main]
+					priority: 10
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			version: ">= 2.0"
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu":  {"base-files": {version: "1.0", data: testutil.PackageData["base-files"]}},
+		"updates": {"base-files": {version: "2.0", data: []byte("broken")}},
+	},
+	lock: &setup.Lock{Packages: map[string]*setup.LockedPackage{
+		"base-files": {
+			Name:     "base-files",
+			Version:  "1.0",
+			Arch:     "all",
+			Archive:  "ubuntu",
+			Filename: "base-files_1.0.deb",
+			SHA256:   baseFilesSHA256,
+		},
+	}},
+	error: `package "base-files" locked to version 1.0, which does not satisfy >= 2.0`,
+}, {
+	summary: "Locked packages must agree with the pinned archive",
+	arch:    "amd64",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+				updates:
+					version: 22.04
+					components: [main]
+					priority: 10
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			archive: updates
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu":  {"base-files": {version: "1.0", data: testutil.PackageData["base-files"]}},
+		"updates": {"base-files": {version: "2.0", data: []byte("broken")}},
+	},
+	lock: &setup.Lock{Packages: map[string]*setup.LockedPackage{
+		"base-files": {
+			Name:     "base-files",
+			Version:  "1.0",
+			Arch:     "all",
+			Archive:  "ubuntu",
+			Filename: "base-files_1.0.deb",
+			SHA256:   baseFilesSHA256,
+		},
+	}},
+	error: `package "base-files" locked to archive "ubuntu" but pinned to "updates"`,
+}, {
+	summary: "Locked packages must match the architecture",
+	arch:    "amd64",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+				updates:
+					version: 22.04
+					components: [main]
+					priority: 10
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu":  {"base-files": {version: "1.0", data: testutil.PackageData["base-files"]}},
+		"updates": {"base-files": {version: "2.0", data: []byte("broken")}},
+	},
+	lock: &setup.Lock{Packages: map[string]*setup.LockedPackage{
+		"base-files": {
+			Name:     "base-files",
+			Version:  "1.0",
+			Arch:     "arm64",
+			Archive:  "ubuntu",
+			Filename: "base-files_1.0.deb",
+			SHA256:   baseFilesSHA256,
+		},
+	}},
+	error: `package "base-files" locked for architecture arm64, not amd64`,
+}, {
+	summary: "Selected packages must be in the lock",
+	arch:    "amd64",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+					public-keys: [test-key]
+				updates:
+					version: 22.04
+					components: [main]
+					priority: 10
+					public-keys: [test-key]
+		` + testPublicKeysYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	pkgs: map[string]map[string]testPackage{
+		"ubuntu":  {"base-files": {version: "1.0", data: testutil.PackageData["base-files"]}},
+		"updates": {"base-files": {version: "2.0", data: []byte("broken")}},
+	},
+	lock:  &setup.Lock{},
+	error: `package "base-files" missing from chisel.lock`,
+}, {
+	summary: "Write dpkg status file",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	hackopt: func(c *C, opts *slicer.RunOptions) {
+		opts.DpkgDB = slicer.DpkgDBStatus
+	},
+	result: map[string]string{
+		"/usr/":                "dir 0755",
+		"/usr/bin/":            "dir 0755",
+		"/usr/bin/hello":       "file 0775 eaf29575",
+		"/var/":                "dir 0755",
+		"/var/lib/":            "dir 0755",
+		"/var/lib/dpkg/":       "dir 0755",
+		"/var/lib/dpkg/status": "file 0644 bae4d0cf",
+	},
+}, {
+	summary: "Write dpkg status.d directory",
+	slices:  []setup.SliceKey{{Package: "base-files", Slice: "myslice"}},
+	release: map[string]string{
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+		`,
+	},
+	hackopt: func(c *C, opts *slicer.RunOptions) {
+		opts.DpkgDB = slicer.DpkgDBStatusDir
+	},
+	result: map[string]string{
+		"/usr/":                             "dir 0755",
+		"/usr/bin/":                         "dir 0755",
+		"/usr/bin/hello":                    "file 0775 eaf29575",
+		"/var/":                             "dir 0755",
+		"/var/lib/":                         "dir 0755",
+		"/var/lib/dpkg/":                    "dir 0755",
+		"/var/lib/dpkg/status.d/":           "dir 0755",
+		"/var/lib/dpkg/status.d/base-files": "file 0644 bae4d0cf",
+	},
 }}
 
-const defaultChiselYaml = `
+var testKey = testutil.PGPKeys["key1"]
+
+var defaultChiselYaml = `
 	format: chisel-v1
 	archives:
 		ubuntu:
 			version: 22.04
 			components: [main, universe]
-`
+			public-keys: [test-key]
+	public-keys:
+		test-key:
+			id: ` + testKey.ID + `
+			armor: |` + "\n" + testutil.PrefixEachLine(testKey.PubKeyArmor, "\t\t\t\t")
+
+var testPublicKeysYaml = `
+			public-keys:
+				test-key:
+					id: ` + testKey.ID + `
+					armor: |` + "\n" + testutil.PrefixEachLine(testKey.PubKeyArmor, "\t\t\t\t\t\t")
+
+var defaultPkgs = map[string]map[string]testPackage{
+	"ubuntu": {
+		"base-files": {version: "1.0", data: testutil.PackageData["base-files"]},
+	},
+}
+
+var baseFilesSHA256 = fmt.Sprintf("%x", sha256.Sum256(testutil.PackageData["base-files"]))
+
+func makeTestDeb(name string, entries ...testutil.TarEntry) []byte {
+	data, err := testutil.MakeDeb("Package: "+name+"\nVersion: 1.0\nArchitecture: amd64\n", entries)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+type testPackage struct {
+	version string
+	data    []byte
+}
 
 type testArchive struct {
 	arch string
-	pkgs map[string][]byte
+	pkgs map[string]testPackage
 }
 
 func (a *testArchive) Options() *archive.Options {
@@ -342,8 +1011,8 @@ func (a *testArchive) Options() *archive.Options {
 }
 
 func (a *testArchive) Fetch(pkg string) (io.ReadCloser, error) {
-	if data, ok := a.pkgs[pkg]; ok {
-		return ioutil.NopCloser(bytes.NewBuffer(data)), nil
+	if testPkg, ok := a.pkgs[pkg]; ok {
+		return ioutil.NopCloser(bytes.NewBuffer(testPkg.data)), nil
 	}
 	return nil, fmt.Errorf("attempted to open %q package", pkg)
 }
@@ -353,12 +1022,42 @@ func (a *testArchive) Exists(pkg string) bool {
 	return ok
 }
 
+func (a *testArchive) Info(pkg string) (*archive.PackageInfo, error) {
+	testPkg, ok := a.pkgs[pkg]
+	if !ok {
+		return nil, fmt.Errorf("cannot find package %q in archive", pkg)
+	}
+	return &archive.PackageInfo{
+		Name:     pkg,
+		Version:  testPkg.version,
+		Arch:     a.arch,
+		Filename: pkg + "_" + testPkg.version + ".deb",
+		SHA256:   fmt.Sprintf("%x", sha256.Sum256(testPkg.data)),
+		Size:     int64(len(testPkg.data)),
+	}, nil
+}
+
+func (a *testArchive) Versions(pkg string) []*archive.PackageInfo {
+	info, err := a.Info(pkg)
+	if err != nil {
+		return nil
+	}
+	return []*archive.PackageInfo{info}
+}
+
+func (a *testArchive) FetchPackage(info *archive.PackageInfo) (io.ReadCloser, error) {
+	if testPkg, ok := a.pkgs[info.Name]; ok && testPkg.version == info.Version {
+		return ioutil.NopCloser(bytes.NewBuffer(testPkg.data)), nil
+	}
+	return nil, fmt.Errorf("attempted to open %q package version %s", info.Name, info.Version)
+}
+
 func (s *S) TestRun(c *C) {
 	for _, test := range slicerTests {
 		c.Logf("Summary: %s", test.summary)
 
 		if _, ok := test.release["chisel.yaml"]; !ok {
-			test.release["chisel.yaml"] = string(defaultChiselYaml)
+			test.release["chisel.yaml"] = defaultChiselYaml
 		}
 
 		releaseDir := c.MkDir()
@@ -376,13 +1075,16 @@ func (s *S) TestRun(c *C) {
 		selection, err := setup.Select(release, test.slices)
 		c.Assert(err, IsNil)
 
-		archives := map[string]archive.Archive{
-			"ubuntu": &testArchive{
+		pkgs := test.pkgs
+		if pkgs == nil {
+			pkgs = defaultPkgs
+		}
+		archives := make(map[string]archive.Archive)
+		for name, archivePkgs := range pkgs {
+			archives[name] = &testArchive{
 				arch: test.arch,
-				pkgs: map[string][]byte{
-					"base-files": testutil.PackageData["base-files"],
-				},
-			},
+				pkgs: archivePkgs,
+			}
 		}
 
 		targetDir := c.MkDir()
@@ -394,7 +1096,16 @@ func (s *S) TestRun(c *C) {
 		if test.hackopt != nil {
 			test.hackopt(c, &options)
 		}
-		err = slicer.Run(&options)
+		if test.lock != nil {
+			options.Packages, err = slicer.SelectPackages(&slicer.SelectOptions{
+				Selection: selection,
+				Archives:  archives,
+				Lock:      test.lock,
+			})
+		}
+		if err == nil {
+			_, err = slicer.Run(&options)
+		}
 		if test.error == "" {
 			c.Assert(err, IsNil)
 		} else {
@@ -412,5 +1123,278 @@ func (s *S) TestRun(c *C) {
 			}
 			c.Assert(testutil.TreeDump(targetDir), DeepEquals, result)
 		}
+
+		// The same content is created in memory when no mutation scripts
+		// require an actual directory.
+		if test.hackopt != nil || hasMutations(selection) {
+			continue
+		}
+		tree := fsutil.NewTree()
+		options.TargetDir = c.MkDir()
+		options.Target = tree
+		_, err = slicer.Run(&options)
+		c.Assert(err, IsNil)
+		if test.result != nil {
+			c.Assert(testutil.MemTreeDump(tree), DeepEquals, testutil.TreeDump(targetDir))
+		}
+	}
+}
+
+func hasMutations(selection *setup.Selection) bool {
+	for _, slice := range selection.Slices {
+		if slice.Scripts.Mutate != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *S) TestRunManifest(c *C) {
+	releaseDir := c.MkDir()
+	release := map[string]string{
+		"chisel.yaml": defaultChiselYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello: {user: 0}
+						/tmp/file1: {text: data1, until: mutate}
+						/foo/file2: {text: data2, mutable: true, user: 100, group: 100, caps: cap_net_raw=ep}
+						/foo/link:  {symlink: file2}
+					mutate: |
+						data = content.read("/tmp/file1")
+						content.write("/foo/file2", data)
+		`,
+	}
+	for path, data := range release {
+		fpath := filepath.Join(releaseDir, path)
+		err := os.MkdirAll(filepath.Dir(fpath), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(fpath, testutil.Reindent(data), 0644)
+		c.Assert(err, IsNil)
+	}
+
+	r, err := setup.ReadRelease(releaseDir)
+	c.Assert(err, IsNil)
+	selection, err := setup.Select(r, []setup.SliceKey{{Package: "base-files", Slice: "myslice"}})
+	c.Assert(err, IsNil)
+
+	targetDir := c.MkDir()
+	manifest, err := slicer.Run(&slicer.RunOptions{
+		Selection: selection,
+		Archives: map[string]archive.Archive{
+			"ubuntu": &testArchive{arch: "amd64", pkgs: defaultPkgs["ubuntu"]},
+		},
+		TargetDir: targetDir,
+	})
+	c.Assert(err, IsNil)
+
+	slices := []string{"base-files_myslice"}
+	c.Assert(manifest.Packages, DeepEquals, []*slicer.ManifestPackage{{
+		Name:    "base-files",
+		Version: "1.0",
+		Arch:    "amd64",
+		Source:  "base-files",
+		Archive: "ubuntu",
+		SHA256:  baseFilesSHA256,
+		Slices:  slices,
+	}})
+	data1SHA256 := fmt.Sprintf("%x", sha256.Sum256([]byte("data1")))
+	netRawCaps := []byte("\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	c.Assert(manifest.Paths, DeepEquals, []*slicer.ManifestPath{
+		{Path: "/foo/", Kind: "dir", Mode: "0755", Slices: slices},
+		{Path: "/foo/file2", Kind: "file", Mode: "0644", Size: 5, SHA256: data1SHA256, UID: 100, GID: 100, Xattrs: slicer.Xattrs{"security.capability": netRawCaps}, Slices: slices, Mutated: true},
+		{Path: "/foo/link", Kind: "symlink", Mode: "0777", Link: "file2", Slices: slices},
+		{Path: "/tmp/", Kind: "dir", Mode: "01777", UID: 1000, GID: 1000, Slices: slices, Package: "base-files", Version: "1.0"},
+		{Path: "/tmp/file1", Kind: "file", Mode: "0644", Size: 5, SHA256: data1SHA256, Slices: slices, Removed: true},
+		{Path: "/usr/", Kind: "dir", Mode: "0755", UID: 1000, GID: 1000, Slices: slices, Package: "base-files", Version: "1.0"},
+		{Path: "/usr/bin/", Kind: "dir", Mode: "0755", UID: 1000, GID: 1000, Slices: slices, Package: "base-files", Version: "1.0"},
+		{Path: "/usr/bin/hello", Kind: "file", Mode: "0775", Size: 29, SHA256: "eaf2957543077e93015b0b2e06ebe320ed568ef853245c7ebedf33c4e45cf40d", UID: 0, GID: 1000, Slices: slices, Package: "base-files", Version: "1.0"},
+		{Path: "/usr/share/", Kind: "dir", Mode: "0755", UID: 1000, GID: 1000, Slices: slices, Package: "base-files", Version: "1.0"},
+		{Path: "/usr/share/doc/", Kind: "dir", Mode: "0755", UID: 1000, GID: 1000, Slices: slices, Package: "base-files", Version: "1.0"},
+		{Path: "/usr/share/doc/base-files/", Kind: "dir", Mode: "0755", UID: 1000, GID: 1000, Slices: slices, Package: "base-files", Version: "1.0"},
+		{Path: "/usr/share/doc/base-files/copyright", Kind: "file", Mode: "0644", Size: 1228, SHA256: "cdb5461d8515002d0fe3babb764eec3877458b20f4e4bb16219f62ea953afeea", UID: 1000, GID: 1000, Slices: slices, Package: "base-files", Version: "1.0"},
+	})
+
+	if os.Geteuid() == 0 {
+		// Capabilities dropped by the mutation are set again.
+		value := make([]byte, 64)
+		n, err := syscall.Getxattr(filepath.Join(targetDir, "foo/file2"), fsutil.CapabilityXattr, value)
+		c.Assert(err, IsNil)
+		c.Assert(value[:n], DeepEquals, netRawCaps)
+	}
+}
+
+func (s *S) TestRunManifestDevice(c *C) {
+	releaseDir := c.MkDir()
+	release := map[string]string{
+		"chisel.yaml": defaultChiselYaml,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/dev/null:
+		`,
+	}
+	for path, data := range release {
+		fpath := filepath.Join(releaseDir, path)
+		err := os.MkdirAll(filepath.Dir(fpath), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(fpath, testutil.Reindent(data), 0644)
+		c.Assert(err, IsNil)
+	}
+
+	r, err := setup.ReadRelease(releaseDir)
+	c.Assert(err, IsNil)
+	selection, err := setup.Select(r, []setup.SliceKey{{Package: "mypkg", Slice: "myslice"}})
+	c.Assert(err, IsNil)
+
+	pkgs := map[string]testPackage{
+		"mypkg": {version: "1.0", data: makeTestDeb("mypkg", testutil.Dir(0755, "./dev/"), testutil.Chr(0666, "./dev/null", 1, 3))},
+	}
+	manifest, err := slicer.Run(&slicer.RunOptions{
+		Selection: selection,
+		Archives: map[string]archive.Archive{
+			"ubuntu": &testArchive{arch: "amd64", pkgs: pkgs},
+		},
+		TargetDir: c.MkDir(),
+	})
+	c.Assert(err, IsNil)
+
+	// The device is listed as defined in the package whether or not
+	// it could be created.
+	slices := []string{"mypkg_myslice"}
+	c.Assert(manifest.Paths, DeepEquals, []*slicer.ManifestPath{
+		{Path: "/dev/", Kind: "dir", Mode: "0755", Slices: slices, Package: "mypkg", Version: "1.0"},
+		{Path: "/dev/null", Kind: "chardev", Mode: "0666", Major: 1, Minor: 3, Slices: slices, Package: "mypkg", Version: "1.0"},
+	})
+}
+
+func (s *S) TestRunExistingRoot(c *C) {
+	releaseDir := c.MkDir()
+	release := map[string]string{
+		"chisel.yaml": defaultChiselYaml,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+						/usr/bin/hallo:
+						/usr/bin/link:
+						/usr/bin/fifo:
+						/etc/conf: {text: data1}
+						/etc/link: {symlink: conf}
+		`,
+	}
+	for path, data := range release {
+		fpath := filepath.Join(releaseDir, path)
+		err := os.MkdirAll(filepath.Dir(fpath), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(fpath, testutil.Reindent(data), 0644)
+		c.Assert(err, IsNil)
+	}
+
+	r, err := setup.ReadRelease(releaseDir)
+	c.Assert(err, IsNil)
+	selection, err := setup.Select(r, []setup.SliceKey{{Package: "mypkg", Slice: "myslice"}})
+	c.Assert(err, IsNil)
+
+	pkgs := map[string]testPackage{
+		"mypkg": {version: "1.0", data: makeTestDeb("mypkg",
+			testutil.Dir(0755, "./usr/"),
+			testutil.Dir(0755, "./usr/bin/"),
+			testutil.Reg(0755, "./usr/bin/hello", "hello"),
+			testutil.Hln(0755, "./usr/bin/hallo", "./usr/bin/hello"),
+			testutil.Lnk(0777, "./usr/bin/link", "hello"),
+			testutil.Fifo(0644, "./usr/bin/fifo"),
+		)},
+	}
+
+	// Cutting again into the same root replaces the existing entries.
+	targetDir := c.MkDir()
+	for i := 0; i < 2; i++ {
+		_, err = slicer.Run(&slicer.RunOptions{
+			Selection: selection,
+			Archives: map[string]archive.Archive{
+				"ubuntu": &testArchive{arch: "amd64", pkgs: pkgs},
+			},
+			TargetDir: targetDir,
+		})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(testutil.TreeDump(targetDir), DeepEquals, map[string]string{
+		"/etc/":          "dir 0755",
+		"/etc/conf":      "file 0644 5b41362b",
+		"/etc/link":      "symlink conf",
+		"/usr/":          "dir 0755",
+		"/usr/bin/":      "dir 0755",
+		"/usr/bin/fifo":  "fifo 0644",
+		"/usr/bin/hallo": "file 0755 2cf24dba",
+		"/usr/bin/hello": "file 0755 2cf24dba",
+		"/usr/bin/link":  "symlink hello",
+	})
+}
+
+func (s *S) TestRunTimestamp(c *C) {
+	releaseDir := c.MkDir()
+	release := map[string]string{
+		"chisel.yaml": defaultChiselYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+						/usr/bin/hallo: {copy: /usr/bin/hello, mutable: true}
+						/foo/file:      {text: data1}
+						/foo/link:      {symlink: file}
+						/foo/dir/:      {make: true}
+					mutate: |
+						content.write("/usr/bin/hallo", "data2")
+		`,
+	}
+	for path, data := range release {
+		fpath := filepath.Join(releaseDir, path)
+		err := os.MkdirAll(filepath.Dir(fpath), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(fpath, testutil.Reindent(data), 0644)
+		c.Assert(err, IsNil)
+	}
+
+	r, err := setup.ReadRelease(releaseDir)
+	c.Assert(err, IsNil)
+	selection, err := setup.Select(r, []setup.SliceKey{{Package: "base-files", Slice: "myslice"}})
+	c.Assert(err, IsNil)
+
+	for _, timestamp := range []time.Time{time.Unix(1000, 0), time.Unix(4000000000, 0)} {
+		c.Logf("Timestamp: %s", timestamp)
+		targetDir := c.MkDir()
+		manifest, err := slicer.Run(&slicer.RunOptions{
+			Selection: selection,
+			Archives: map[string]archive.Archive{
+				"ubuntu": &testArchive{arch: "amd64", pkgs: defaultPkgs["ubuntu"]},
+			},
+			TargetDir: targetDir,
+			Timestamp: timestamp,
+		})
+		c.Assert(err, IsNil)
+
+		for _, mpath := range manifest.Paths {
+			finfo, err := os.Lstat(filepath.Join(targetDir, mpath.Path))
+			c.Assert(err, IsNil)
+			comment := Commentf("%s", mpath.Path)
+			if mpath.Package != "" && !mpath.Mutated {
+				// Extracted content keeps the package time if older.
+				c.Assert(finfo.ModTime().After(timestamp), Equals, false, comment)
+				if timestamp.Unix() > 1000 {
+					c.Assert(finfo.ModTime().Equal(timestamp), Equals, false, comment)
+				}
+			} else {
+				c.Assert(finfo.ModTime().Equal(timestamp), Equals, true, comment)
+			}
+		}
 	}
 }
@@ -0,0 +1,70 @@
+package slicer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// StatePath is the location of the state file within a root directory.
+const StatePath = "/var/lib/chisel/state.json"
+
+// State records the content cut into a root directory, so that slices may
+// later be added to it or removed from it.
+type State struct {
+	// Release identifies the release the slices were cut from, either by
+	// the path of its directory or by its label and version.
+	Release string `json:"release,omitempty"`
+	// Slices holds the slices selected for the cut, not including the
+	// ones selected only as their dependencies.
+	Slices []string `json:"slices"`
+	Arch   string   `json:"arch"`
+	DpkgDB DpkgDB   `json:"dpkg-db,omitempty"`
+	// Snapshot is the timestamp of the archive snapshot given for the
+	// cut, if any, which is used again when updating it.
+	Snapshot string `json:"snapshot,omitempty"`
+	Manifest
+}
+
+// ReadState returns the state recorded in the root directory, or nil if
+// no state was recorded there.
+func ReadState(rootDir string) (*State, error) {
+	data, err := ioutil.ReadFile(filepath.Join(rootDir, StatePath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read state: %w", err)
+	}
+	var state State
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse state: %w", err)
+	}
+	return &state, nil
+}
+
+// WriteState records the state in the root directory.
+func WriteState(rootDir string, state *State) error {
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return fmt.Errorf("cannot encode state: %w", err)
+	}
+
+	// Write it in full before replacing any previous state.
+	filePath := filepath.Join(rootDir, StatePath)
+	tmpPath := filePath + ".tmp"
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(tmpPath, append(data, '\n'), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package slicer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/canonical/chisel/internal/fsutil"
+)
+
+// Update cuts the selection into a target directory holding the content of
+// a previous cut, as recorded in state. The selection is cut in full into
+// a staging directory, so that mutation scripts observe all the selected
+// content, and then the paths which changed are moved into the target
+// directory and the ones no longer selected are removed from it.
+func Update(options *RunOptions, state *State) (*Manifest, error) {
+	stagingDir, err := os.MkdirTemp(options.TargetDir, ".chisel-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	stagingOptions := *options
+	stagingOptions.TargetDir = stagingDir
+	manifest, err := Run(&stagingOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	oldUmask := syscall.Umask(0)
+	defer func() {
+		syscall.Umask(oldUmask)
+	}()
+
+	err = syncContent(stagingDir, options.TargetDir, state.Paths, manifest.Paths, options.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot update content: %w", err)
+	}
+	return manifest, nil
+}
+
+// syncContent makes the paths previously written into targetDir match
+// the ones written into stagingDir. Both lists of paths must be sorted.
+func syncContent(stagingDir, targetDir string, previous, current []*ManifestPath, timestamp time.Time) error {
+	oldPaths := make(map[string]*ManifestPath)
+	for _, mpath := range previous {
+		if !mpath.Removed {
+			oldPaths[mpath.Path] = mpath
+		}
+	}
+	newPaths := make(map[string]*ManifestPath)
+	for _, mpath := range current {
+		if !mpath.Removed {
+			newPaths[mpath.Path] = mpath
+		}
+	}
+
+	// Remove the paths no longer written, or written with a different
+	// kind, in reverse order so that directories are emptied first.
+	for i := len(previous) - 1; i >= 0; i-- {
+		oldPath := previous[i]
+		if oldPath.Removed {
+			continue
+		}
+		if newPath := newPaths[oldPath.Path]; newPath != nil && newPath.Kind == oldPath.Kind {
+			continue
+		}
+		err := os.Remove(filepath.Join(targetDir, oldPath.Path))
+		// Directories with other content are kept, and the non-empty
+		// directory error is caught by IsExist as well.
+		if oldPath.Kind == "dir" && os.IsExist(err) {
+			if newPath := newPaths[strings.TrimSuffix(oldPath.Path, "/")]; newPath != nil {
+				return fmt.Errorf("cannot replace non-empty directory %s with a %s", oldPath.Path, newPath.Kind)
+			}
+			continue
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Directories are moved with all their content, so these are created
+	// instead, and their times only restored once done. Other paths are
+	// moved when changed, along with all the hard links to the same file,
+	// so that these are not split between the previous and new content.
+	dirTimes := make(map[string]time.Time)
+	var files []*ManifestPath
+	fileIDs := make(map[string]fileID)
+	changed := make(map[fileID]bool)
+	for _, newPath := range current {
+		if newPath.Removed {
+			continue
+		}
+		stagingPath := filepath.Join(stagingDir, newPath.Path)
+		targetPath := filepath.Join(targetDir, newPath.Path)
+		finfo, err := os.Lstat(stagingPath)
+		if os.IsNotExist(err) && (newPath.Kind == "chardev" || newPath.Kind == "blockdev") {
+			// Devices are not created without root privileges.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if newPath.Kind == "dir" {
+			dirTimes[targetPath] = finfo.ModTime()
+			err = fsutil.Create(&fsutil.CreateOptions{
+				Path:   targetPath,
+				Mode:   finfo.Mode(),
+				UID:    newPath.UID,
+				GID:    newPath.GID,
+				Xattrs: manifestXattrs(newPath),
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		stat := finfo.Sys().(*syscall.Stat_t)
+		id := fileID{uint64(stat.Dev), uint64(stat.Ino)}
+		files = append(files, newPath)
+		fileIDs[newPath.Path] = id
+		if oldPath := oldPaths[newPath.Path]; oldPath != nil && sameContent(oldPath, newPath) {
+			if _, err := os.Lstat(targetPath); err == nil {
+				continue
+			}
+		}
+		changed[id] = true
+	}
+	for _, newPath := range files {
+		if !changed[fileIDs[newPath.Path]] {
+			continue
+		}
+		stagingPath := filepath.Join(stagingDir, newPath.Path)
+		targetPath := filepath.Join(targetDir, newPath.Path)
+		err := os.Remove(targetPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = os.Rename(stagingPath, targetPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if timestamp.IsZero() {
+		return nil
+	}
+	for path, mtime := range dirTimes {
+		err := fsutil.SetModTime(path, mtime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileID identifies a file which may be reached through multiple hard links.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// sameContent returns whether both paths were written with the same
+// content and properties, regardless of the slices selecting them.
+func sameContent(a, b *ManifestPath) bool {
+	if a.Kind != b.Kind || a.Mode != b.Mode || a.Size != b.Size ||
+		a.SHA256 != b.SHA256 || a.Link != b.Link || a.Major != b.Major || a.Minor != b.Minor ||
+		a.UID != b.UID || a.GID != b.GID || len(a.Xattrs) != len(b.Xattrs) {
+		return false
+	}
+	for name, value := range a.Xattrs {
+		if other, ok := b.Xattrs[name]; !ok || !bytes.Equal(value, other) {
+			return false
+		}
+	}
+	return true
+}
+
+func manifestXattrs(mpath *ManifestPath) map[string]string {
+	if len(mpath.Xattrs) == 0 {
+		return nil
+	}
+	xattrs := make(map[string]string, len(mpath.Xattrs))
+	for name, value := range mpath.Xattrs {
+		xattrs[name] = string(value)
+	}
+	return xattrs
+}
@@ -0,0 +1,233 @@
+package slicer_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/archive"
+	"github.com/canonical/chisel/internal/setup"
+	"github.com/canonical/chisel/internal/slicer"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+func (s *S) TestUpdate(c *C) {
+	releaseDir := c.MkDir()
+	release := map[string]string{
+		"chisel.yaml": defaultChiselYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/hello:
+						/foo/file1: {text: data1}
+						/foo/dir/:  {make: true}
+						/bar/file:  {text: data1}
+				myslice2:
+					contents:
+						/foo/file2: {text: data2}
+						/bar/file:  {text: data1}
+		`,
+	}
+	for path, data := range release {
+		fpath := filepath.Join(releaseDir, path)
+		err := os.MkdirAll(filepath.Dir(fpath), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(fpath, testutil.Reindent(data), 0644)
+		c.Assert(err, IsNil)
+	}
+	r, err := setup.ReadRelease(releaseDir)
+	c.Assert(err, IsNil)
+	archives := map[string]archive.Archive{
+		"ubuntu": &testArchive{arch: "amd64", pkgs: defaultPkgs["ubuntu"]},
+	}
+
+	targetDir := c.MkDir()
+	selection, err := setup.Select(r, []setup.SliceKey{{Package: "base-files", Slice: "myslice1"}})
+	c.Assert(err, IsNil)
+	manifest, err := slicer.Run(&slicer.RunOptions{
+		Selection: selection,
+		Archives:  archives,
+		TargetDir: targetDir,
+	})
+	c.Assert(err, IsNil)
+	err = slicer.WriteState(targetDir, &slicer.State{
+		Release:  "ubuntu-22.04",
+		Slices:   []string{"base-files_myslice1"},
+		Arch:     "amd64",
+		Snapshot: "20240101T000000Z",
+		Manifest: *manifest,
+	})
+	c.Assert(err, IsNil)
+
+	// Content written by others is left alone.
+	err = ioutil.WriteFile(filepath.Join(targetDir, "foo/other"), []byte("other"), 0644)
+	c.Assert(err, IsNil)
+	unchanged, err := os.Stat(filepath.Join(targetDir, "bar/file"))
+	c.Assert(err, IsNil)
+
+	state, err := slicer.ReadState(targetDir)
+	c.Assert(err, IsNil)
+	c.Assert(state.Release, Equals, "ubuntu-22.04")
+	c.Assert(state.Slices, DeepEquals, []string{"base-files_myslice1"})
+	c.Assert(state.Arch, Equals, "amd64")
+	c.Assert(state.Snapshot, Equals, "20240101T000000Z")
+	c.Assert(state.Paths, DeepEquals, manifest.Paths)
+
+	selection, err = setup.Select(r, []setup.SliceKey{{Package: "base-files", Slice: "myslice2"}})
+	c.Assert(err, IsNil)
+	manifest, err = slicer.Update(&slicer.RunOptions{
+		Selection: selection,
+		Archives:  archives,
+		TargetDir: targetDir,
+	}, state)
+	c.Assert(err, IsNil)
+
+	// The state is written by the caller, and not updated here.
+	dump := testutil.TreeDump(targetDir)
+	c.Assert(dump["/var/lib/chisel/state.json"], Matches, "file 0644 .*")
+	delete(dump, "/var/lib/chisel/state.json")
+	c.Assert(dump, DeepEquals, map[string]string{
+		"/bar/":                               "dir 0755",
+		"/bar/file":                           "file 0644 5b41362b",
+		"/foo/":                               "dir 0755",
+		"/foo/file2":                          "file 0644 d98cf53e",
+		"/foo/other":                          "file 0644 d9298a10",
+		"/usr/":                               "dir 0755",
+		"/usr/share/":                         "dir 0755",
+		"/usr/share/doc/":                     "dir 0755",
+		"/usr/share/doc/base-files/":          "dir 0755",
+		"/usr/share/doc/base-files/copyright": "file 0644 cdb5461d",
+		"/var/":                               "dir 0755",
+		"/var/lib/":                           "dir 0755",
+		"/var/lib/chisel/":                    "dir 0755",
+	})
+	finfo, err := os.Stat(filepath.Join(targetDir, "bar/file"))
+	c.Assert(err, IsNil)
+	c.Assert(os.SameFile(finfo, unchanged), Equals, true)
+
+	var paths []string
+	for _, mpath := range manifest.Paths {
+		paths = append(paths, mpath.Path)
+	}
+	c.Assert(paths, DeepEquals, []string{
+		"/bar/",
+		"/bar/file",
+		"/foo/",
+		"/foo/file2",
+		"/usr/",
+		"/usr/share/",
+		"/usr/share/doc/",
+		"/usr/share/doc/base-files/",
+		"/usr/share/doc/base-files/copyright",
+	})
+}
+
+func (s *S) TestReadStateMissing(c *C) {
+	state, err := slicer.ReadState(c.MkDir())
+	c.Assert(err, IsNil)
+	c.Assert(state, IsNil)
+}
+
+// cutAndUpdate cuts the first slices into a new target directory, and
+// then updates it with the second ones, returning the target directory
+// and the error of the update.
+func cutAndUpdate(c *C, release map[string]string, pkgs map[string]testPackage, first, second []setup.SliceKey, prepare func(targetDir string)) (string, error) {
+	releaseDir := c.MkDir()
+	for path, data := range release {
+		fpath := filepath.Join(releaseDir, path)
+		err := os.MkdirAll(filepath.Dir(fpath), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(fpath, testutil.Reindent(data), 0644)
+		c.Assert(err, IsNil)
+	}
+	r, err := setup.ReadRelease(releaseDir)
+	c.Assert(err, IsNil)
+	archives := map[string]archive.Archive{
+		"ubuntu": &testArchive{arch: "amd64", pkgs: pkgs},
+	}
+
+	targetDir := c.MkDir()
+	selection, err := setup.Select(r, first)
+	c.Assert(err, IsNil)
+	manifest, err := slicer.Run(&slicer.RunOptions{
+		Selection: selection,
+		Archives:  archives,
+		TargetDir: targetDir,
+	})
+	c.Assert(err, IsNil)
+	if prepare != nil {
+		prepare(targetDir)
+	}
+
+	selection, err = setup.Select(r, second)
+	c.Assert(err, IsNil)
+	_, err = slicer.Update(&slicer.RunOptions{
+		Selection: selection,
+		Archives:  archives,
+		TargetDir: targetDir,
+	}, &slicer.State{Manifest: *manifest})
+	return targetDir, err
+}
+
+func (s *S) TestUpdateHardLinks(c *C) {
+	release := map[string]string{
+		"chisel.yaml": defaultChiselYaml,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/bin/foo:
+				myslice2:
+					contents:
+						/bin/foo:
+						/bin/bar:
+		`,
+	}
+	pkgs := map[string]testPackage{
+		"mypkg": {version: "1.0", data: makeTestDeb("mypkg",
+			testutil.Dir(0755, "./bin/"),
+			testutil.Reg(0755, "./bin/foo", "data1"),
+			testutil.Hln(0755, "./bin/bar", "./bin/foo"),
+		)},
+	}
+	first := []setup.SliceKey{{Package: "mypkg", Slice: "myslice1"}}
+	second := []setup.SliceKey{{Package: "mypkg", Slice: "myslice2"}}
+	targetDir, err := cutAndUpdate(c, release, pkgs, first, second, nil)
+	c.Assert(err, IsNil)
+
+	// The unchanged path is moved along with its new hard link.
+	foo, err := os.Lstat(filepath.Join(targetDir, "bin/foo"))
+	c.Assert(err, IsNil)
+	bar, err := os.Lstat(filepath.Join(targetDir, "bin/bar"))
+	c.Assert(err, IsNil)
+	c.Assert(os.SameFile(foo, bar), Equals, true)
+}
+
+func (s *S) TestUpdateKindConflict(c *C) {
+	release := map[string]string{
+		"chisel.yaml": defaultChiselYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice1:
+					contents:
+						/foo/bar/: {make: true}
+				myslice2:
+					contents:
+						/foo/bar: {text: data1}
+		`,
+	}
+	first := []setup.SliceKey{{Package: "base-files", Slice: "myslice1"}}
+	second := []setup.SliceKey{{Package: "base-files", Slice: "myslice2"}}
+	_, err := cutAndUpdate(c, release, defaultPkgs["ubuntu"], first, second, func(targetDir string) {
+		// Content written by others is left alone.
+		err := ioutil.WriteFile(filepath.Join(targetDir, "foo/bar/other"), []byte("other"), 0644)
+		c.Assert(err, IsNil)
+	})
+	c.Assert(err, ErrorMatches, `cannot update content: cannot replace non-empty directory /foo/bar/ with a file`)
+}
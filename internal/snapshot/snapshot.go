@@ -0,0 +1,20 @@
+// Package snapshot handles the timestamps identifying archive snapshots.
+package snapshot
+
+import (
+	"fmt"
+	"time"
+)
+
+// Layout is the layout of the timestamps identifying snapshots, as used
+// by the snapshot services of Ubuntu and Debian.
+const Layout = "20060102T150405Z"
+
+// Parse parses the timestamp of a snapshot.
+func Parse(snapshot string) (time.Time, error) {
+	t, err := time.Parse(Layout, snapshot)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid snapshot timestamp: %q", snapshot)
+	}
+	return t, nil
+}
@@ -0,0 +1,40 @@
+package snapshot_test
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/snapshot"
+)
+
+var parseTests = []struct {
+	snapshot string
+	result   time.Time
+	error    string
+}{{
+	snapshot: "20240101T000000Z",
+	result:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+}, {
+	snapshot: "20231231T235959Z",
+	result:   time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC),
+}, {
+	snapshot: "2024-01-01",
+	error:    `invalid snapshot timestamp: "2024-01-01"`,
+}, {
+	snapshot: "20240101T000000",
+	error:    `invalid snapshot timestamp: "20240101T000000"`,
+}}
+
+func (s *S) TestParse(c *C) {
+	for _, test := range parseTests {
+		c.Logf("Snapshot: %s", test.snapshot)
+		result, err := snapshot.Parse(test.snapshot)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(result.Equal(test.result), Equals, true)
+	}
+}
@@ -1,7 +1,13 @@
 package testutil
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"encoding/base64"
+	"time"
+
+	"github.com/blakesmith/ar"
 )
 
 var PackageData = map[string][]byte{}
@@ -14,6 +20,163 @@ func init() {
 	PackageData["base-files"] = baseFilesData
 }
 
+// TarEntry is an entry in the data tarball of a package made by MakeDeb.
+type TarEntry struct {
+	Header  tar.Header
+	Content []byte
+}
+
+// Reg returns the entry for a regular file with the given mode and content.
+func Reg(mode int64, path, content string) TarEntry {
+	return TarEntry{
+		Header: tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path,
+			Mode:     mode,
+			Size:     int64(len(content)),
+		},
+		Content: []byte(content),
+	}
+}
+
+// Dir returns the entry for a directory with the given mode.
+func Dir(mode int64, path string) TarEntry {
+	return TarEntry{
+		Header: tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     path,
+			Mode:     mode,
+		},
+	}
+}
+
+// Lnk returns the entry for a symbolic link to target.
+func Lnk(mode int64, path, target string) TarEntry {
+	return TarEntry{
+		Header: tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     path,
+			Mode:     mode,
+			Linkname: target,
+		},
+	}
+}
+
+// Hln returns the entry for a hard link to target.
+func Hln(mode int64, path, target string) TarEntry {
+	return TarEntry{
+		Header: tar.Header{
+			Typeflag: tar.TypeLink,
+			Name:     path,
+			Mode:     mode,
+			Linkname: target,
+		},
+	}
+}
+
+// Fifo returns the entry for a named pipe with the given mode.
+func Fifo(mode int64, path string) TarEntry {
+	return TarEntry{
+		Header: tar.Header{
+			Typeflag: tar.TypeFifo,
+			Name:     path,
+			Mode:     mode,
+		},
+	}
+}
+
+// Chr returns the entry for a character device with the given numbers.
+func Chr(mode int64, path string, major, minor int64) TarEntry {
+	return TarEntry{
+		Header: tar.Header{
+			Typeflag: tar.TypeChar,
+			Name:     path,
+			Mode:     mode,
+			Devmajor: major,
+			Devminor: minor,
+		},
+	}
+}
+
+// MakeDeb returns the data of a deb package with the given control file
+// content and data tarball entries.
+func MakeDeb(control string, entries []TarEntry) ([]byte, error) {
+	controlTar, err := makeTarGz([]TarEntry{Reg(0644, "./control", control)})
+	if err != nil {
+		return nil, err
+	}
+	dataTar, err := makeTarGz(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writer := ar.NewWriter(&buf)
+	err = writer.WriteGlobalHeader()
+	if err != nil {
+		return nil, err
+	}
+	members := []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlTar},
+		{"data.tar.gz", dataTar},
+	}
+	for _, member := range members {
+		err = writer.WriteHeader(&ar.Header{
+			Name:    member.name,
+			ModTime: time.Unix(0, 0),
+			Mode:    0644,
+			Size:    int64(len(member.data)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = writer.Write(member.data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// MustMakeDeb is like MakeDeb but panics on errors.
+func MustMakeDeb(control string, entries []TarEntry) []byte {
+	data, err := MakeDeb(control, entries)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func makeTarGz(entries []TarEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := entry.Header
+		err := tarWriter.WriteHeader(&header)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tarWriter.Write(entry.Content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := tarWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 var baseFilesBase64 = `
 ITxhcmNoPgpkZWJpYW4tYmluYXJ5ICAgMTY1ODc3NTg3OCAgMCAgICAgMCAgICAgMTAwNjQ0ICA0
 ICAgICAgICAgYAoyLjAKY29udHJvbC50YXIuenN0IDE2NTg3NzU4NzggIDAgICAgIDAgICAgIDEw
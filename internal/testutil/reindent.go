@@ -31,3 +31,14 @@ func Reindent(in string) []byte {
 	}
 	return buf.Bytes()
 }
+
+// PrefixEachLine indents each line of the provided string with the prefix.
+func PrefixEachLine(text string, prefix string) string {
+	var result strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		result.WriteString(prefix)
+		result.WriteString(line)
+		result.WriteByte('\n')
+	}
+	return result.String()
+}
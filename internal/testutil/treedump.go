@@ -7,6 +7,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/canonical/chisel/internal/fsutil"
 )
 
 func TreeDump(dir string) map[string]string {
@@ -23,37 +26,14 @@ func TreeDump(dir string) map[string]string {
 		if err != nil {
 			return fmt.Errorf("cannot get stat info for %q: %w", path, err)
 		}
-		fperm := finfo.Mode() & fs.ModePerm
-		ftype := finfo.Mode() & fs.ModeType
-		if finfo.Mode()&fs.ModeSticky != 0 {
-			fperm |= 01000
-		}
-		fpath := filepath.Join(dir, path)
-		switch ftype {
-		case fs.ModeDir:
-			result["/"+path+"/"] = fmt.Sprintf("dir %#o", fperm)
-		case fs.ModeSymlink:
-			lpath, err := os.Readlink(fpath)
-			if err != nil {
-				return err
-			}
-			result["/"+path] = fmt.Sprintf("symlink %s", lpath)
-		case 0: // Regular
-			data, err := ioutil.ReadFile(fpath)
-			if err != nil {
-				return fmt.Errorf("cannot read file: %w", err)
-			}
-			var entry string
-			if len(data) == 0 {
-				entry = fmt.Sprintf("file %#o empty", fperm)
-			} else {
-				sum := sha256.Sum256(data)
-				entry = fmt.Sprintf("file %#o %.4x", fperm, sum)
-			}
-			result["/"+path] = entry
-		default:
-			return fmt.Errorf("unknown file type %d: %s", ftype, fpath)
+		entry, err := dumpEntry(fsutil.Dir(dir), "/"+path, finfo)
+		if err != nil {
+			return err
+		}
+		if finfo.IsDir() {
+			path += "/"
 		}
+		result["/"+path] = entry
 		return nil
 	})
 	if err != nil {
@@ -61,3 +41,67 @@ func TreeDump(dir string) map[string]string {
 	}
 	return result
 }
+
+// MemTreeDump returns the entries of the tree in the format of TreeDump.
+func MemTreeDump(tree *fsutil.Tree) map[string]string {
+	result := make(map[string]string)
+	for _, path := range tree.Paths() {
+		if path == "/" {
+			continue
+		}
+		finfo, err := tree.Lstat(path)
+		if err == nil {
+			result[path], err = dumpEntry(tree, strings.TrimSuffix(path, "/"), finfo)
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	return result
+}
+
+func dumpEntry(root fsutil.Root, path string, finfo fs.FileInfo) (string, error) {
+	fperm := finfo.Mode() & fs.ModePerm
+	ftype := finfo.Mode() & fs.ModeType
+	if finfo.Mode()&fs.ModeSetuid != 0 {
+		fperm |= 04000
+	}
+	if finfo.Mode()&fs.ModeSetgid != 0 {
+		fperm |= 02000
+	}
+	if finfo.Mode()&fs.ModeSticky != 0 {
+		fperm |= 01000
+	}
+	switch ftype {
+	case fs.ModeDir:
+		return fmt.Sprintf("dir %#o", fperm), nil
+	case fs.ModeSymlink:
+		lpath, err := root.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("symlink %s", lpath), nil
+	case 0: // Regular
+		file, err := root.Open(path)
+		if err != nil {
+			return "", fmt.Errorf("cannot read file: %w", err)
+		}
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return "", fmt.Errorf("cannot read file: %w", err)
+		}
+		if len(data) == 0 {
+			return fmt.Sprintf("file %#o empty", fperm), nil
+		}
+		sum := sha256.Sum256(data)
+		return fmt.Sprintf("file %#o %.4x", fperm, sum), nil
+	case fs.ModeNamedPipe:
+		return fmt.Sprintf("fifo %#o", fperm), nil
+	case fs.ModeDevice:
+		return fmt.Sprintf("blockdev %#o", fperm), nil
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return fmt.Sprintf("chardev %#o", fperm), nil
+	}
+	return "", fmt.Errorf("unknown file type %d: %s", ftype, filepath.Join("/", path))
+}